@@ -1 +1,44 @@
 package connections
+
+import (
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"sync"
+	"testing"
+)
+
+func TestGetPostgresConnConcurrent(t *testing.T) {
+	// Nothing listens on port 1, so every connect fails straight away
+	t.Setenv("DB_HOST", "127.0.0.1")
+	t.Setenv("DB_PORT", "1")
+	t.Setenv("DOCKER_ENV", "")
+	log.SetOutput(io.Discard)
+	t.Cleanup(func() { log.SetOutput(os.Stderr) })
+
+	connector := &Connector{PostgresDB: make(map[string]*PostgresConn)}
+	var wg sync.WaitGroup
+	conns := make([]*PostgresConn, 20)
+	for i := range conns {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			name := fmt.Sprintf("conn%d", i%2)
+			if _, err := connector.GetPostgresConn(name); err == nil {
+				t.Errorf("connecting %s to a closed port succeeded", name)
+			}
+			conns[i] = connector.PostgresConns()[name]
+		}(i)
+	}
+	wg.Wait()
+
+	if len(connector.PostgresDB) != 2 {
+		t.Fatalf("got %d connections, want 2", len(connector.PostgresDB))
+	}
+	for i, conn := range conns {
+		if conn != connector.PostgresDB[conn.Name] || conn.Connected() {
+			t.Errorf("call %d got connection %s, which is not the one kept or is open", i, conn.Name)
+		}
+	}
+}
@@ -67,6 +67,11 @@ func getProdCred(c *util.Config) PostgresCred {
 
 	return prodCred
 }
+
+// upgradeScripts run on every start after the initial setup so existing
+// databases pick up new tables; they must be safe to run repeatedly.
+var upgradeScripts = []string{"etlRuns.sql", "etlChecks.sql", "etlDefinitions.sql"}
+
 func intialiseProdConn(conn *sql.DB) (bool, error) {
 	var exists bool
 	err := conn.QueryRow(`
@@ -79,42 +84,51 @@ func intialiseProdConn(conn *sql.DB) (bool, error) {
 		return false, fmt.Errorf("error checking workspace table: %v", err)
 	}
 
-	if !exists {
-		var workDir string
-		if os.Getenv("APP_ENV") == "prod" {
-			workDir = "/root/backend/initDB"
-		} else {
-			execPath, err := os.Executable()
-			if err != nil {
-				return false, fmt.Errorf("error getting executable path: %v", err)
-			}
-			workDir = filepath.Join(filepath.Dir(execPath), "backend//initDB")
-		}
+	workDir, err := getInitDBDir()
+	if err != nil {
+		return false, err
+	}
 
-		workspaceSQL, err := os.ReadFile(filepath.Join(workDir, "workspace.sql"))
-		if err != nil {
-			return false, fmt.Errorf("error reading workspace.sql: %v", err)
+	if !exists {
+		if err := execSQLFile(conn, workDir, "workspace.sql"); err != nil {
+			return false, err
 		}
-		_, err = conn.Exec(string(workspaceSQL))
-		if err != nil {
-			return false, fmt.Errorf("error executing workspace.sql: %v", err)
+		if err := execSQLFile(conn, workDir, "etlPipeline.sql"); err != nil {
+			return false, err
 		}
+		log.Println("Database initialized successfully")
+	} else {
+		log.Println("Database tables already exist, skipping initialization")
+	}
 
-		etlSQL, err := os.ReadFile(filepath.Join(workDir, "etlPipeline.sql"))
-		if err != nil {
-			return false, fmt.Errorf("error reading etlPipeline.sql: %v", err)
-		}
-		_, err = conn.Exec(string(etlSQL))
-		if err != nil {
-			return false, fmt.Errorf("error executing etlPipeline.sql: %v", err)
+	for _, script := range upgradeScripts {
+		if err := execSQLFile(conn, workDir, script); err != nil {
+			return false, err
 		}
+	}
+	return true, nil
+}
 
-		log.Println("Database initialized successfully")
-		return true, nil
+func getInitDBDir() (string, error) {
+	if os.Getenv("APP_ENV") == "prod" {
+		return "/root/backend/initDB", nil
 	}
+	execPath, err := os.Executable()
+	if err != nil {
+		return "", fmt.Errorf("error getting executable path: %v", err)
+	}
+	return filepath.Join(filepath.Dir(execPath), "backend//initDB"), nil
+}
 
-	log.Println("Database tables already exist, skipping initialization")
-	return true, nil
+func execSQLFile(conn *sql.DB, workDir string, name string) error {
+	script, err := os.ReadFile(filepath.Join(workDir, name))
+	if err != nil {
+		return fmt.Errorf("error reading %s: %v", name, err)
+	}
+	if _, err := conn.Exec(string(script)); err != nil {
+		return fmt.Errorf("error executing %s: %v", name, err)
+	}
+	return nil
 }
 
 func CloseConnector(config *util.Config) error {
@@ -2,6 +2,7 @@ package connections
 
 import (
 	"fmt"
+	"sync"
 	"time"
 )
 
@@ -109,6 +110,8 @@ type Connector struct {
 	PostgresDB  map[string]*PostgresConn
 	CSVfile     map[string]*CSVConn
 	Kafka       map[string]*KafkaConn
+	// mu guards the maps, which the simulator and ETL goroutines add to at once
+	mu sync.Mutex
 }
 
 type WorkspaceConnectors map[string]*Connector
@@ -129,6 +132,55 @@ func (w *WorkspaceConnectors) GetConnector(workspaceID int) *Connector {
 	return (*w)[fmt.Sprintf("%d", workspaceID)]
 }
 
+// GetPostgresConn returns the named Postgres connection for this workspace,
+// connecting it on first use.
+func (c *Connector) GetPostgresConn(name string) (*PostgresConn, error) {
+	c.mu.Lock()
+	conn, exists := c.PostgresDB[name]
+	if !exists || conn == nil {
+		conn = &PostgresConn{Name: name}
+		c.PostgresDB[name] = conn
+	}
+	c.mu.Unlock()
+
+	if err := conn.open(); err != nil {
+		return nil, err
+	}
+	return conn, nil
+}
+
+// PostgresConns returns a copy of the Postgres connections, safe to range over
+// while others are added.
+func (c *Connector) PostgresConns() map[string]*PostgresConn {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	conns := make(map[string]*PostgresConn, len(c.PostgresDB))
+	for name, conn := range c.PostgresDB {
+		conns[name] = conn
+	}
+	return conns
+}
+
+func (c *Connector) CSVConns() map[string]*CSVConn {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	conns := make(map[string]*CSVConn, len(c.CSVfile))
+	for name, conn := range c.CSVfile {
+		conns[name] = conn
+	}
+	return conns
+}
+
+func (c *Connector) KafkaConns() map[string]*KafkaConn {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	conns := make(map[string]*KafkaConn, len(c.Kafka))
+	for name, conn := range c.Kafka {
+		conns[name] = conn
+	}
+	return conns
+}
+
 func (w *WorkspaceConnectors) AddData(dataType string, table TableDefinition, data []interface{}) error {
 	connector := w.GetConnector(1)
 	if connector == nil {
@@ -139,6 +191,7 @@ func (w *WorkspaceConnectors) AddData(dataType string, table TableDefinition, da
 	switch dataType {
 	case "postgres":
 		connName := fmt.Sprintf("%s_%s", table.Schema, table.Name)
+		connector.mu.Lock()
 		conn, exists := connector.PostgresDB[connName]
 		if !exists {
 			for key, val := range connector.PostgresDB {
@@ -147,24 +200,29 @@ func (w *WorkspaceConnectors) AddData(dataType string, table TableDefinition, da
 			conn = &PostgresConn{Name: connName}
 			connector.PostgresDB[connName] = conn
 		}
+		connector.mu.Unlock()
 		err = conn.AddData(table, data)
 
 	case "kafka":
 		connName := fmt.Sprintf("%s_%s", table.Schema, table.Name)
+		connector.mu.Lock()
 		conn, exists := connector.Kafka[connName]
 		if !exists || conn == nil {
 			conn = &KafkaConn{Name: connName}
 			connector.Kafka[connName] = conn
 		}
+		connector.mu.Unlock()
 		err = conn.AddData(table, data)
 
 	case "csv":
 		connName := fmt.Sprintf("%s_%s", table.Schema, table.Name)
+		connector.mu.Lock()
 		conn, exists := connector.CSVfile[connName]
 		if !exists || conn == nil {
 			conn = &CSVConn{Name: connName}
 			connector.CSVfile[connName] = conn
 		}
+		connector.mu.Unlock()
 		err = conn.AddData(table, data)
 
 	default:
@@ -0,0 +1,32 @@
+CREATE TABLE IF NOT EXISTS prod.etl_step_checks(
+    check_id INTEGER GENERATED ALWAYS AS IDENTITY PRIMARY KEY,
+    step_id INTEGER REFERENCES prod.etl_steps(step_id) ON DELETE CASCADE,
+    name VARCHAR(255) NOT NULL,
+    check_type VARCHAR(50) NOT NULL,
+    column_name VARCHAR(255),
+    accepted_values TEXT[],
+    min_value DOUBLE PRECISION,
+    max_value DOUBLE PRECISION,
+    sql TEXT,
+    severity VARCHAR(20) NOT NULL DEFAULT 'fail',
+    created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+    updated_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP
+);
+
+CREATE TABLE IF NOT EXISTS prod.etl_check_results(
+    check_result_id INTEGER GENERATED ALWAYS AS IDENTITY PRIMARY KEY,
+    run_id INTEGER REFERENCES prod.etl_runs(run_id) ON DELETE CASCADE,
+    step_run_id INTEGER REFERENCES prod.etl_step_runs(step_run_id) ON DELETE CASCADE,
+    check_id INTEGER REFERENCES prod.etl_step_checks(check_id) ON DELETE SET NULL,
+    step_id INTEGER REFERENCES prod.etl_steps(step_id) ON DELETE SET NULL,
+    name VARCHAR(255) NOT NULL,
+    check_type VARCHAR(50) NOT NULL,
+    severity VARCHAR(20) NOT NULL,
+    status VARCHAR(20) NOT NULL,
+    failing_rows BIGINT NOT NULL DEFAULT 0,
+    message TEXT,
+    checked_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP
+);
+
+CREATE INDEX IF NOT EXISTS idx_etl_step_checks_step_id ON prod.etl_step_checks(step_id);
+CREATE INDEX IF NOT EXISTS idx_etl_check_results_run_id ON prod.etl_check_results(run_id);
@@ -0,0 +1,16 @@
+-- Pipeline definitions can be kept in dev and staging and promoted to prod, so both
+-- get copies of prod's definition tables. Only prod's are run by the ETL service.
+DO $$
+DECLARE
+    environment TEXT;
+    definition_table TEXT;
+BEGIN
+    FOREACH environment IN ARRAY ARRAY['dev', 'staging'] LOOP
+        EXECUTE format('CREATE SCHEMA IF NOT EXISTS %I', environment);
+        FOREACH definition_table IN ARRAY ARRAY['etl_pipeline', 'etl_steps', 'etl_step_metadata', 'etl_step_checks', 'data_sources', 'data_sources_conditions'] LOOP
+            IF to_regclass('prod.' || definition_table) IS NOT NULL THEN
+                EXECUTE format('CREATE TABLE IF NOT EXISTS %I.%I (LIKE prod.%I INCLUDING ALL)', environment, definition_table, definition_table);
+            END IF;
+        END LOOP;
+    END LOOP;
+END $$;
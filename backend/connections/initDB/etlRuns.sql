@@ -0,0 +1,37 @@
+CREATE TABLE IF NOT EXISTS prod.etl_runs(
+    run_id INTEGER GENERATED ALWAYS AS IDENTITY PRIMARY KEY,
+    pipeline_id INTEGER REFERENCES prod.etl_pipeline(pipeline_id) ON DELETE CASCADE,
+    triggered_by VARCHAR(50) NOT NULL,
+    status VARCHAR(20) NOT NULL,
+    started_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP,
+    finished_at TIMESTAMP,
+    duration_ms BIGINT NOT NULL DEFAULT 0,
+    rows_read BIGINT NOT NULL DEFAULT 0,
+    rows_written BIGINT NOT NULL DEFAULT 0,
+    error TEXT
+);
+
+CREATE TABLE IF NOT EXISTS prod.etl_step_runs(
+    step_run_id INTEGER GENERATED ALWAYS AS IDENTITY PRIMARY KEY,
+    run_id INTEGER REFERENCES prod.etl_runs(run_id) ON DELETE CASCADE,
+    step_id INTEGER REFERENCES prod.etl_steps(step_id) ON DELETE SET NULL,
+    step_name VARCHAR(255) NOT NULL,
+    layer etl_layers NOT NULL,
+    target_table VARCHAR(255),
+    status VARCHAR(20) NOT NULL,
+    started_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP,
+    finished_at TIMESTAMP,
+    duration_ms BIGINT NOT NULL DEFAULT 0,
+    rows_read BIGINT NOT NULL DEFAULT 0,
+    rows_written BIGINT NOT NULL DEFAULT 0,
+    error TEXT
+);
+
+CREATE INDEX IF NOT EXISTS idx_etl_runs_pipeline_id ON prod.etl_runs(pipeline_id);
+CREATE INDEX IF NOT EXISTS idx_etl_step_runs_run_id ON prod.etl_step_runs(run_id);
+CREATE INDEX IF NOT EXISTS idx_etl_step_runs_target_table ON prod.etl_step_runs(target_table);
+
+ALTER TABLE prod.etl_runs ADD COLUMN IF NOT EXISTS window_start TIMESTAMP;
+ALTER TABLE prod.etl_runs ADD COLUMN IF NOT EXISTS window_end TIMESTAMP;
+ALTER TABLE prod.etl_runs ADD COLUMN IF NOT EXISTS parent_run_id INTEGER REFERENCES prod.etl_runs(run_id) ON DELETE CASCADE;
+CREATE INDEX IF NOT EXISTS idx_etl_runs_parent_run_id ON prod.etl_runs(parent_run_id);
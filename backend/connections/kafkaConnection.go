@@ -238,6 +238,52 @@ func NewKafkaConn(name string) *KafkaConn {
 	}
 }
 
+// NewConsumerGroup joins groupID on the connection's broker, starting from the
+// oldest message the first time. Offsets are only committed when the caller
+// commits them, so a consumer resumes after the last batch it finished.
+func (k *KafkaConn) NewConsumerGroup(groupID string) (sarama.ConsumerGroup, error) {
+	config := sarama.NewConfig()
+	config.Consumer.Offsets.Initial = sarama.OffsetOldest
+	config.Consumer.Offsets.AutoCommit.Enable = false
+	config.Consumer.Return.Errors = true
+
+	group, err := sarama.NewConsumerGroup([]string{k.broker()}, groupID, config)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create Kafka consumer group %s: %w", groupID, err)
+	}
+	return group, nil
+}
+
+// CommittedMetadata returns the metadata groupID committed with its offset for
+// the partition, empty if it has not committed one.
+func (k *KafkaConn) CommittedMetadata(groupID string, topic string, partition int32) (string, error) {
+	admin, err := sarama.NewClusterAdmin([]string{k.broker()}, sarama.NewConfig())
+	if err != nil {
+		return "", fmt.Errorf("failed to create Kafka admin: %w", err)
+	}
+	defer admin.Close()
+
+	response, err := admin.ListConsumerGroupOffsets(groupID, map[string][]int32{topic: {partition}})
+	if err != nil {
+		return "", fmt.Errorf("failed to read offsets of consumer group %s: %w", groupID, err)
+	}
+	block := response.GetBlock(topic, partition)
+	if block == nil {
+		return "", nil
+	}
+	if block.Err != sarama.ErrNoError {
+		return "", fmt.Errorf("failed to read offset of %s/%d for consumer group %s: %w", topic, partition, groupID, block.Err)
+	}
+	return block.Metadata, nil
+}
+
+func (k *KafkaConn) broker() string {
+	if k.Credential != nil && k.Credential.Broker != "" {
+		return k.Credential.Broker
+	}
+	return fmt.Sprintf("%s:%s", k.Host, k.Port)
+}
+
 func getEnvWithDefault(key, defaultValue string) string {
 	if value := os.Getenv(key); value != "" {
 		return value
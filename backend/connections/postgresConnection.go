@@ -6,6 +6,7 @@ import (
 	"log"
 	"os"
 	"strings"
+	"sync"
 	"time"
 
 	_ "github.com/lib/pq"
@@ -14,6 +15,10 @@ import (
 type PostgresConn struct {
 	Conn *sql.DB
 	Name string
+	// migrated holds the tables whose columns have been checked against their definition
+	migrated sync.Map
+	// connecting makes concurrent first uses open a single pool
+	connecting sync.Mutex
 }
 
 type PostgresCred struct {
@@ -96,7 +101,52 @@ func (p *PostgresConn) InitialiseData(table TableDefinition) error {
 		if err != nil {
 			return fmt.Errorf("failed to create table: %v", err)
 		}
+		p.migrated.Store(table.Schema+"."+table.Name, true)
+		return nil
+	}
+	return p.migrateColumns(table)
+}
+
+// migrateColumns widens the columns an earlier version of a table created as
+// DATE to the TIMESTAMP it now declares, so the time of day is kept. Each table
+// is checked once per connection.
+func (p *PostgresConn) migrateColumns(table TableDefinition) error {
+	key := table.Schema + "." + table.Name
+	if _, done := p.migrated.Load(key); done {
+		return nil
+	}
+
+	rows, err := p.Conn.Query(`
+		SELECT column_name FROM information_schema.columns
+		WHERE table_schema = $1 AND table_name = $2 AND data_type = 'date'`, table.Schema, table.Name)
+	if err != nil {
+		return err
+	}
+	dates := make(map[string]bool)
+	for rows.Next() {
+		var name string
+		if err := rows.Scan(&name); err != nil {
+			rows.Close()
+			return err
+		}
+		dates[name] = true
 	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return err
+	}
+
+	for _, col := range table.Columns {
+		if col.Type != TypeTime || !dates[col.Name] {
+			continue
+		}
+		_, err := p.Conn.Exec(fmt.Sprintf("ALTER TABLE %s.%s ALTER COLUMN %s TYPE %s", table.Schema, table.Name, col.Name, col.Type))
+		if err != nil {
+			return fmt.Errorf("failed to migrate column %s of %s: %v", col.Name, key, err)
+		}
+		log.Printf("Migrated column %s of %s from DATE to %s\n", col.Name, key, col.Type)
+	}
+	p.migrated.Store(key, true)
 	return nil
 }
 
@@ -110,47 +160,8 @@ func getCreateTableQuery(table TableDefinition) string {
 }
 
 func (p *PostgresConn) AddData(table TableDefinition, data []interface{}) error {
-	var err error
-	if p.Conn == nil {
-
-		host := getEnv("DB_HOST", "localhost")
-		user := getEnv("DB_USER", "postgres")
-		password := getEnv("DB_PASSWORD", "Week7890")
-		dbName := getEnv("DB_NAME", "summervilledb")
-		port := getEnv("DB_PORT", "5432")
-		sslMode := getEnv("DB_SSLMODE", "disable")
-
-		// For Docker environment, use container name
-		if os.Getenv("DOCKER_ENV") == "true" {
-			host = "postgres" // Use the service name from docker-compose
-			log.Printf("Running in Docker environment, connecting to PostgreSQL at %s\n", host)
-		}
-
-		log.Printf("Attempting to connect to PostgreSQL at %s:%s\n", host, port)
-
-		p.Conn, err = InitPostgresDB(&PostgresCred{
-			User:     user,
-			Password: password,
-			DBName:   dbName,
-			Host:     host,
-			Port:     port,
-			SSLMode:  sslMode,
-		}, &ConnectionMetrics{
-			OpenConnections: 1,
-			IdleConnections: 1,
-			QueryCount:      0,
-			LastQueryTime:   0,
-		})
-
-		if err != nil {
-			return fmt.Errorf("error initializing database connection: %v", err)
-		}
-
-		if err := p.InitialiseData(table); err != nil {
-			return err
-		}
-
-		return p.insertData(table, data)
+	if err := p.open(); err != nil {
+		return err
 	}
 
 	if err := p.InitialiseData(table); err != nil {
@@ -159,6 +170,62 @@ func (p *PostgresConn) AddData(table TableDefinition, data []interface{}) error
 
 	return p.insertData(table, data)
 }
+
+// open connects on first use.
+func (p *PostgresConn) open() error {
+	p.connecting.Lock()
+	defer p.connecting.Unlock()
+	if p.Conn != nil {
+		return nil
+	}
+	return p.connect()
+}
+
+// Connected reports whether the connection has been opened.
+func (p *PostgresConn) Connected() bool {
+	p.connecting.Lock()
+	defer p.connecting.Unlock()
+	return p.Conn != nil
+}
+
+func (p *PostgresConn) connect() error {
+	var err error
+
+	host := getEnv("DB_HOST", "localhost")
+	user := getEnv("DB_USER", "postgres")
+	password := getEnv("DB_PASSWORD", "Week7890")
+	dbName := getEnv("DB_NAME", "summervilledb")
+	port := getEnv("DB_PORT", "5432")
+	sslMode := getEnv("DB_SSLMODE", "disable")
+
+	// For Docker environment, use container name
+	if os.Getenv("DOCKER_ENV") == "true" {
+		host = "postgres" // Use the service name from docker-compose
+		log.Printf("Running in Docker environment, connecting to PostgreSQL at %s\n", host)
+	}
+
+	log.Printf("Attempting to connect to PostgreSQL at %s:%s\n", host, port)
+
+	p.Conn, err = InitPostgresDB(&PostgresCred{
+		User:     user,
+		Password: password,
+		DBName:   dbName,
+		Host:     host,
+		Port:     port,
+		SSLMode:  sslMode,
+	}, &ConnectionMetrics{
+		OpenConnections: 1,
+		IdleConnections: 1,
+		QueryCount:      0,
+		LastQueryTime:   0,
+	})
+
+	if err != nil {
+		return fmt.Errorf("error initializing database connection: %v", err)
+	}
+	return nil
+}
+
 func (p *PostgresConn) insertData(table TableDefinition, data []interface{}) error {
 	if len(data) == 0 {
 		return nil
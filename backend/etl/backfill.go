@@ -0,0 +1,588 @@
+package etl
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"log"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+/*
+Backfills re-run a pipeline, or one step and the steps that read from it, over a
+[from, to) window. The window is cut into chunks which run in parallel up to a limit,
+each recorded as its own run under the backfill's run. A step is reprocessed chunk by chunk when it has a time
+column (the "time_column" metadata key, or its watermark_column): its query sees only
+the chunk's rows and the chunk's rows in its output are deleted first, so re-running a
+chunk replaces it. The remaining steps are rebuilt in full once every chunk has loaded.
+
+A query may place the window itself with {{from}} and {{to}}; otherwise it is wrapped
+in a filter on the time column.
+*/
+
+const (
+	MetaTimeColumn = "time_column"
+
+	fromPlaceholder = "{{from}}"
+	toPlaceholder   = "{{to}}"
+
+	defaultBackfillChunk       = 24 * time.Hour
+	defaultBackfillParallelism = 4
+	maxBackfillParallelism     = 16
+	maxBackfillChunks          = 10000
+
+	backfillTimeFormat = "2006-01-02 15:04:05.999999"
+)
+
+type BackfillOptions struct {
+	// StepID limits the backfill to the step and its descendants
+	StepID      *int
+	From        time.Time
+	To          time.Time
+	Chunk       time.Duration
+	Parallelism int
+}
+
+type BackfillChunk struct {
+	From        time.Time `json:"from"`
+	To          time.Time `json:"to"`
+	RunID       int       `json:"run_id"`
+	Status      RunStatus `json:"status"`
+	RowsRead    int64     `json:"rows_read"`
+	RowsWritten int64     `json:"rows_written"`
+	Error       string    `json:"error,omitempty"`
+}
+
+type Backfill struct {
+	RunID       int              `json:"run_id"`
+	PipelineID  int              `json:"pipeline_id"`
+	StepID      *int             `json:"step_id,omitempty"`
+	From        time.Time        `json:"from"`
+	To          time.Time        `json:"to"`
+	Chunk       string           `json:"chunk"`
+	Parallelism int              `json:"parallelism"`
+	Status      RunStatus        `json:"status"`
+	Windowed    []int            `json:"windowed_steps"`
+	Rebuilt     []int            `json:"rebuilt_steps"`
+	Chunks      []*BackfillChunk `json:"chunks"`
+	Rebuild     *BackfillChunk   `json:"rebuild,omitempty"`
+	DurationMs  int64            `json:"duration_ms"`
+
+	run      *Run
+	windowed []*Step
+	rebuilt  []*Step
+}
+
+// BackfillRequest is a backfill as given to the API or the backfill command.
+type BackfillRequest struct {
+	StepID      *int   `json:"step_id,omitempty"`
+	From        string `json:"from"`
+	To          string `json:"to"`
+	Chunk       string `json:"chunk"`
+	Parallelism int    `json:"parallelism"`
+}
+
+func (r BackfillRequest) Options() (BackfillOptions, error) {
+	opts := BackfillOptions{StepID: r.StepID, Parallelism: r.Parallelism}
+	var problems []string
+	var err error
+	if opts.From, err = ParseBackfillTime(r.From); err != nil {
+		problems = append(problems, "from: "+err.Error())
+	}
+	if opts.To, err = ParseBackfillTime(r.To); err != nil {
+		problems = append(problems, "to: "+err.Error())
+	}
+	if opts.Chunk, err = ParseBackfillChunk(r.Chunk); err != nil {
+		problems = append(problems, err.Error())
+	}
+	if len(problems) > 0 {
+		return opts, &ValidationError{Problems: problems}
+	}
+	return opts, nil
+}
+
+// TimeColumn is the column a backfill windows the step's output on.
+func (s *Step) TimeColumn() string {
+	if column := strings.TrimSpace(s.Metadata[MetaTimeColumn]); column != "" {
+		return column
+	}
+	return s.WatermarkColumn()
+}
+
+// ParseBackfillTime accepts RFC 3339, "2006-01-02 15:04:05" or a date.
+func ParseBackfillTime(value string) (time.Time, error) {
+	value = strings.TrimSpace(value)
+	for _, layout := range []string{time.RFC3339Nano, "2006-01-02 15:04:05", "2006-01-02T15:04:05", "2006-01-02"} {
+		if parsed, err := time.Parse(layout, value); err == nil {
+			return parsed, nil
+		}
+	}
+	return time.Time{}, fmt.Errorf("invalid time %q", value)
+}
+
+// ParseBackfillChunk accepts a Go duration ("6h") or a number of days ("7d").
+func ParseBackfillChunk(value string) (time.Duration, error) {
+	value = strings.TrimSpace(value)
+	if value == "" {
+		return defaultBackfillChunk, nil
+	}
+	if days, ok := strings.CutSuffix(value, "d"); ok {
+		n, err := strconv.Atoi(days)
+		if err != nil {
+			return 0, fmt.Errorf("invalid chunk %q", value)
+		}
+		return time.Duration(n) * 24 * time.Hour, nil
+	}
+	chunk, err := time.ParseDuration(value)
+	if err != nil {
+		return 0, fmt.Errorf("invalid chunk %q", value)
+	}
+	return chunk, nil
+}
+
+func (o *BackfillOptions) validate() error {
+	var problems []string
+	if o.Chunk == 0 {
+		o.Chunk = defaultBackfillChunk
+	}
+	if o.Parallelism == 0 {
+		o.Parallelism = defaultBackfillParallelism
+	}
+	if o.From.IsZero() || o.To.IsZero() {
+		problems = append(problems, "from and to are required")
+	} else if !o.From.Before(o.To) {
+		problems = append(problems, "from must be before to")
+	}
+	if o.Chunk < 0 {
+		problems = append(problems, "chunk must be positive")
+	} else if o.From.Before(o.To) && o.To.Sub(o.From)/o.Chunk >= maxBackfillChunks {
+		problems = append(problems, fmt.Sprintf("window would need more than %d chunks", maxBackfillChunks))
+	}
+	if o.Parallelism < 1 || o.Parallelism > maxBackfillParallelism {
+		problems = append(problems, fmt.Sprintf("parallelism must be between 1 and %d", maxBackfillParallelism))
+	}
+	if len(problems) > 0 {
+		return &ValidationError{Problems: problems}
+	}
+	return nil
+}
+
+func (o *BackfillOptions) chunks() []*BackfillChunk {
+	var chunks []*BackfillChunk
+	for from := o.From; from.Before(o.To); from = from.Add(o.Chunk) {
+		to := from.Add(o.Chunk)
+		if to.After(o.To) {
+			to = o.To
+		}
+		chunks = append(chunks, &BackfillChunk{From: from, To: to, Status: StatusSkipped})
+	}
+	return chunks
+}
+
+// backfillSteps splits the steps being backfilled into those reprocessed per
+// chunk and those rebuilt afterwards. A rebuilt step cannot feed a windowed
+// one, since the windowed step would read it before it was rebuilt.
+func backfillSteps(p *Pipeline, stepID *int) ([]*Step, []*Step, error) {
+	selected := make(map[int]bool)
+	for _, step := range p.Steps {
+		if stepID == nil || step.ID == *stepID || (step.ChildStepID != nil && selected[*step.ChildStepID]) {
+			selected[step.ID] = true
+		}
+	}
+	if stepID != nil && !selected[*stepID] {
+		return nil, nil, ErrNotFound
+	}
+
+	var windowed, rebuilt []*Step
+	var problems []string
+	rebuiltIDs := make(map[int]bool)
+	for _, step := range p.Steps {
+		stepType, ok := LookupStepType(step.Type())
+		if !selected[step.ID] || (ok && stepType.Continuous) {
+			continue
+		}
+		// Only SQL steps can be given a window; Go transforms are rebuilt in full
+		column := step.TimeColumn()
+		if column == "" || step.Type() != StepTypeSQL {
+			rebuilt = append(rebuilt, step)
+			rebuiltIDs[step.ID] = true
+			continue
+		}
+		if !identifierPattern.MatchString(column) {
+			problems = append(problems, fmt.Sprintf("step %d has invalid %s %q", step.ID, MetaTimeColumn, column))
+		}
+		if step.ChildStepID != nil && rebuiltIDs[*step.ChildStepID] {
+			problems = append(problems, fmt.Sprintf("step %d has a %s but reads from step %d which has none",
+				step.ID, MetaTimeColumn, *step.ChildStepID))
+		}
+		windowed = append(windowed, step)
+	}
+	if len(problems) > 0 {
+		return nil, nil, &ValidationError{Problems: problems}
+	}
+	return windowed, rebuilt, nil
+}
+
+func windowQuery(step *Step, from time.Time, to time.Time) string {
+	query := strings.TrimSpace(strings.TrimRight(strings.TrimSpace(step.Query), ";"))
+	// The window decides which rows are read, not the watermark
+	query = strings.ReplaceAll(query, watermarkPlaceholder, quoteLiteral(defaultWatermark))
+	return applyWindow(query, step.TimeColumn(), from, to)
+}
+
+// applyWindow limits a query to [from, to), through its {{from}} and {{to}}
+// placeholders if it has them and otherwise on column.
+func applyWindow(query string, column string, from time.Time, to time.Time) string {
+	fromLiteral := quoteLiteral(from.Format(backfillTimeFormat))
+	toLiteral := quoteLiteral(to.Format(backfillTimeFormat))
+	if strings.Contains(query, fromPlaceholder) || strings.Contains(query, toPlaceholder) {
+		query = strings.ReplaceAll(query, fromPlaceholder, fromLiteral)
+		return strings.ReplaceAll(query, toPlaceholder, toLiteral)
+	}
+	return fmt.Sprintf("SELECT * FROM (%s) AS chunk WHERE %s >= %s AND %s < %s",
+		query, quoteIdentifier(column), fromLiteral, quoteIdentifier(column), toLiteral)
+}
+
+// Backfill runs a backfill to the end. It holds the pipeline for its whole
+// duration so scheduled runs cannot interleave with its chunks.
+func (e *Executor) Backfill(ctx context.Context, p *Pipeline, opts BackfillOptions) (*Backfill, error) {
+	backfill, err := e.startBackfill(p, opts)
+	if err != nil {
+		return nil, err
+	}
+	defer e.release(p.ID)
+	if err := e.runBackfill(ctx, p, opts, backfill); err != nil {
+		return nil, err
+	}
+	return backfill, nil
+}
+
+// StartBackfill runs a backfill in the background under the executor's context
+// and returns its run as it started, whose chunks are recorded as runs with it
+// as their parent. The run's progress is read back from the history.
+func (e *Executor) StartBackfill(p *Pipeline, opts BackfillOptions) (*Run, error) {
+	backfill, err := e.startBackfill(p, opts)
+	if err != nil {
+		return nil, err
+	}
+	if backfill.run.ID == 0 {
+		e.release(p.ID)
+		return nil, fmt.Errorf("backfill of pipeline %d could not be recorded", p.ID)
+	}
+	// The backfill updates its run as it goes, so callers get a copy
+	started := *backfill.run
+	go func() {
+		defer e.release(p.ID)
+		if err := e.runBackfill(e.ctx, p, opts, backfill); err != nil {
+			log.Printf("Backfill of pipeline %d (%s) failed: %v", p.ID, p.Name, err)
+		}
+	}()
+	return &started, nil
+}
+
+// startBackfill holds the pipeline and records the backfill's run.
+func (e *Executor) startBackfill(p *Pipeline, opts BackfillOptions) (*Backfill, error) {
+	if err := opts.validate(); err != nil {
+		return nil, err
+	}
+	windowed, rebuilt, err := backfillSteps(p, opts.StepID)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := e.workspaceDB(p.WorkspaceID); err != nil {
+		return nil, err
+	}
+
+	if !e.acquire(p.ID) {
+		return nil, ErrPipelineRunning
+	}
+
+	backfill := &Backfill{
+		PipelineID:  p.ID,
+		StepID:      opts.StepID,
+		From:        opts.From,
+		To:          opts.To,
+		Chunk:       opts.Chunk.String(),
+		Parallelism: opts.Parallelism,
+		Status:      StatusRunning,
+		Windowed:    []int{},
+		Rebuilt:     []int{},
+		Chunks:      opts.chunks(),
+		windowed:    windowed,
+		rebuilt:     rebuilt,
+	}
+	for _, step := range windowed {
+		backfill.Windowed = append(backfill.Windowed, step.ID)
+	}
+	for _, step := range rebuilt {
+		backfill.Rebuilt = append(backfill.Rebuilt, step.ID)
+	}
+	backfill.run, err = e.history.StartBackfillRun(p.ID, nil, opts.From, opts.To)
+	if err != nil {
+		log.Printf("Error recording backfill of pipeline %d: %v", p.ID, err)
+	}
+	backfill.RunID = backfill.run.ID
+	return backfill, nil
+}
+
+// runBackfill runs the chunks and then the rebuilt steps, and records the
+// outcome on the backfill's run.
+func (e *Executor) runBackfill(ctx context.Context, p *Pipeline, opts BackfillOptions, backfill *Backfill) (err error) {
+	startTime := time.Now()
+	defer func() {
+		backfill.DurationMs = time.Since(startTime).Milliseconds()
+		if err != nil {
+			backfill.Status = StatusFailed
+		}
+		if historyErr := e.history.FinishRun(backfill.run, backfill.failure(err)); historyErr != nil {
+			log.Printf("Error recording backfill of pipeline %d: %v", p.ID, historyErr)
+		}
+	}()
+	db, err := e.workspaceDB(p.WorkspaceID)
+	if err != nil {
+		return err
+	}
+	backfill.Status = StatusSuccess
+	windowed, rebuilt := backfill.windowed, backfill.rebuilt
+
+	log.Printf("Backfilling pipeline %d (%s) from %s to %s in %d chunks", p.ID, p.Name,
+		opts.From.Format(backfillTimeFormat), opts.To.Format(backfillTimeFormat), len(backfill.Chunks))
+
+	if len(windowed) > 0 {
+		// Chunks running side by side must not race to create the same tables
+		for _, step := range windowed {
+			if err := prepareWindowedStep(ctx, db, step, opts.From, opts.To); err != nil {
+				return fmt.Errorf("step %d (%s): %v", step.ID, step.Name, err)
+			}
+		}
+
+		queue := make(chan *BackfillChunk)
+		var wg sync.WaitGroup
+		for i := 0; i < opts.Parallelism; i++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				for chunk := range queue {
+					e.runChunk(ctx, db, p, backfill.run, windowed, chunk)
+				}
+			}()
+		}
+		for _, chunk := range backfill.Chunks {
+			if ctx.Err() != nil {
+				break
+			}
+			queue <- chunk
+		}
+		close(queue)
+		wg.Wait()
+
+		for _, chunk := range backfill.Chunks {
+			if chunk.Status != StatusSuccess {
+				backfill.Status = StatusFailed
+			}
+			backfill.run.RowsRead += chunk.RowsRead
+			backfill.run.RowsWritten += chunk.RowsWritten
+		}
+		if backfill.Status == StatusSuccess {
+			if err := e.advanceWatermarks(ctx, db, windowed); err != nil {
+				log.Printf("Error advancing watermarks after backfill of pipeline %d: %v", p.ID, err)
+			}
+		}
+	}
+
+	// Rebuilt steps read what the chunks wrote, so they wait for every chunk
+	if len(rebuilt) > 0 && backfill.Status == StatusSuccess {
+		backfill.Rebuild = &BackfillChunk{From: opts.From, To: opts.To}
+		run, err := e.history.StartBackfillRun(p.ID, backfill.run, opts.From, opts.To)
+		if err != nil {
+			log.Printf("Error recording backfill of pipeline %d: %v", p.ID, err)
+		}
+		err = e.runSteps(ctx, &Pipeline{ID: p.ID, Name: p.Name, WorkspaceID: p.WorkspaceID, Steps: rebuilt}, run, RunOptions{TriggeredBy: TriggerBackfill})
+		if historyErr := e.history.FinishRun(run, err); historyErr != nil {
+			log.Printf("Error recording backfill of pipeline %d: %v", p.ID, historyErr)
+		}
+		backfill.Rebuild.RunID = run.ID
+		backfill.Rebuild.Status = run.Status
+		backfill.Rebuild.RowsRead = run.RowsRead
+		backfill.Rebuild.RowsWritten = run.RowsWritten
+		backfill.Rebuild.Error = run.Error
+		backfill.run.RowsRead += run.RowsRead
+		backfill.run.RowsWritten += run.RowsWritten
+		if err != nil {
+			backfill.Status = StatusFailed
+		}
+	}
+
+	log.Printf("Backfill of pipeline %d (%s) finished: %s", p.ID, p.Name, backfill.Status)
+	return nil
+}
+
+// failure is the error the backfill's run is recorded with: err, or which of
+// its chunks and rebuild failed.
+func (b *Backfill) failure(err error) error {
+	if err != nil || b.Status != StatusFailed {
+		return err
+	}
+	failed := 0
+	for _, chunk := range b.Chunks {
+		if chunk.Status != StatusSuccess {
+			failed++
+		}
+	}
+	if failed > 0 {
+		return fmt.Errorf("%d of %d chunks did not succeed", failed, len(b.Chunks))
+	}
+	return fmt.Errorf("rebuilding steps failed: %s", b.Rebuild.Error)
+}
+
+// prepareWindowedStep creates the step's output table, empty, if it does not
+// exist yet.
+func prepareWindowedStep(ctx context.Context, db *sql.DB, step *Step, from time.Time, to time.Time) error {
+	if !step.Layer.Valid() {
+		return fmt.Errorf("unknown layer %q", step.Layer)
+	}
+	if strings.TrimSpace(step.Query) == "" {
+		return fmt.Errorf("step has no query")
+	}
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if _, err := tx.ExecContext(ctx, fmt.Sprintf("CREATE SCHEMA IF NOT EXISTS %s", step.Layer.Schema())); err != nil {
+		return fmt.Errorf("error creating schema %s: %v", step.Layer.Schema(), err)
+	}
+	if _, err := tx.ExecContext(ctx, "SET LOCAL search_path TO "+searchPath()); err != nil {
+		return fmt.Errorf("error setting search_path: %v", err)
+	}
+	_, err = tx.ExecContext(ctx, fmt.Sprintf("CREATE TABLE IF NOT EXISTS %s AS %s WITH NO DATA",
+		step.QualifiedTableName(), windowQuery(step, from, to)))
+	if err != nil {
+		return fmt.Errorf("error creating %s: %v", step.QualifiedTableName(), err)
+	}
+	return tx.Commit()
+}
+
+func (e *Executor) runChunk(ctx context.Context, db *sql.DB, p *Pipeline, parent *Run, steps []*Step, chunk *BackfillChunk) {
+	run, err := e.history.StartBackfillRun(p.ID, parent, chunk.From, chunk.To)
+	if err != nil {
+		log.Printf("Error recording backfill of pipeline %d: %v", p.ID, err)
+	}
+
+	var runErr error
+	for _, step := range steps {
+		stepRun, historyErr := e.history.StartStep(run, step)
+		if historyErr != nil {
+			log.Printf("Error recording step %d: %v", step.ID, historyErr)
+		}
+
+		status := StatusSuccess
+		var stepErr error
+		switch {
+		case runErr != nil:
+			status = StatusSkipped
+		case ctx.Err() != nil:
+			status = StatusSkipped
+			runErr = ctx.Err()
+		default:
+			var loaded Loaded
+			loaded, stepRun.Checks, stepErr = runWindow(ctx, db, step, chunk.From, chunk.To)
+			stepRun.RowsRead = loaded.Read
+			stepRun.RowsWritten = loaded.Written
+			if stepErr != nil {
+				stepRun.RowsWritten = 0
+				status = StatusFailed
+				runErr = fmt.Errorf("step %d (%s) failed: %w", step.ID, step.Name, stepErr)
+			}
+		}
+
+		if historyErr := e.history.FinishStep(stepRun, status, stepErr); historyErr != nil {
+			log.Printf("Error recording step %d: %v", step.ID, historyErr)
+		}
+	}
+
+	if historyErr := e.history.FinishRun(run, runErr); historyErr != nil {
+		log.Printf("Error recording backfill of pipeline %d: %v", p.ID, historyErr)
+	}
+	chunk.RunID = run.ID
+	chunk.Status = run.Status
+	chunk.RowsWritten = run.RowsWritten
+	chunk.RowsRead = run.RowsRead
+	chunk.Error = run.Error
+	if runErr != nil {
+		log.Printf("Backfill chunk %s to %s of pipeline %d failed: %v", chunk.From.Format(backfillTimeFormat),
+			chunk.To.Format(backfillTimeFormat), p.ID, runErr)
+	}
+}
+
+// runWindow replaces the step's output rows within [from, to) in one transaction.
+func runWindow(ctx context.Context, db *sql.DB, step *Step, from time.Time, to time.Time) (Loaded, []*CheckResult, error) {
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return Loaded{}, nil, err
+	}
+	defer tx.Rollback()
+
+	if _, err := tx.ExecContext(ctx, "SET LOCAL search_path TO "+searchPath()); err != nil {
+		return Loaded{}, nil, fmt.Errorf("error setting search_path: %v", err)
+	}
+
+	column := quoteIdentifier(step.TimeColumn())
+	_, err = tx.ExecContext(ctx, fmt.Sprintf("DELETE FROM %s WHERE %s >= $1 AND %s < $2",
+		step.QualifiedTableName(), column, column), from, to)
+	if err != nil {
+		return Loaded{}, nil, fmt.Errorf("error clearing window of %s: %v", step.QualifiedTableName(), err)
+	}
+
+	result, err := tx.ExecContext(ctx, fmt.Sprintf("INSERT INTO %s %s", step.QualifiedTableName(), windowQuery(step, from, to)))
+	if err != nil {
+		return Loaded{}, nil, fmt.Errorf("error executing query: %v", err)
+	}
+	loaded := Loaded{}
+	loaded.Written, _ = result.RowsAffected()
+	if loaded.Read, err = countInput(ctx, tx, step, Load{From: &from, To: &to}, loaded.Written); err != nil {
+		return Loaded{}, nil, err
+	}
+
+	var checks []*CheckResult
+	if len(step.Checks) > 0 {
+		if checks, err = runChecks(ctx, tx, step, step.QualifiedTableName()); err != nil {
+			return loaded, checks, err
+		}
+	}
+
+	if err := tx.Commit(); err != nil {
+		return Loaded{}, checks, err
+	}
+	return loaded, checks, nil
+}
+
+// advanceWatermarks moves incremental steps past what the backfill wrote so
+// their next run does not load those rows again.
+func (e *Executor) advanceWatermarks(ctx context.Context, db *sql.DB, steps []*Step) error {
+	for _, step := range steps {
+		if step.WatermarkColumn() == "" {
+			continue
+		}
+		tx, err := db.BeginTx(ctx, nil)
+		if err != nil {
+			return err
+		}
+		if err := ensureWatermarkTable(ctx, tx); err != nil {
+			tx.Rollback()
+			return err
+		}
+		if _, err := advanceWatermark(ctx, tx, step); err != nil {
+			tx.Rollback()
+			return err
+		}
+		if err := tx.Commit(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
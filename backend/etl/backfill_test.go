@@ -0,0 +1,181 @@
+package etl
+
+import (
+	"errors"
+	"strings"
+	"testing"
+	"time"
+)
+
+func day(d int) time.Time {
+	return time.Date(2025, 1, d, 0, 0, 0, 0, time.UTC)
+}
+
+func TestBackfillChunks(t *testing.T) {
+	tests := []struct {
+		name  string
+		from  time.Time
+		to    time.Time
+		chunk time.Duration
+		want  [][2]time.Time
+	}{
+		{
+			name:  "whole chunks",
+			from:  day(1),
+			to:    day(3),
+			chunk: 24 * time.Hour,
+			want:  [][2]time.Time{{day(1), day(2)}, {day(2), day(3)}},
+		},
+		{
+			name:  "last chunk is cut at to",
+			from:  day(1),
+			to:    day(2).Add(6 * time.Hour),
+			chunk: 24 * time.Hour,
+			want:  [][2]time.Time{{day(1), day(2)}, {day(2), day(2).Add(6 * time.Hour)}},
+		},
+		{
+			name:  "chunk longer than the window",
+			from:  day(1),
+			to:    day(1).Add(time.Hour),
+			chunk: 7 * 24 * time.Hour,
+			want:  [][2]time.Time{{day(1), day(1).Add(time.Hour)}},
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			opts := BackfillOptions{From: test.from, To: test.to, Chunk: test.chunk}
+			chunks := opts.chunks()
+			if len(chunks) != len(test.want) {
+				t.Fatalf("got %d chunks, want %d", len(chunks), len(test.want))
+			}
+			for i, chunk := range chunks {
+				if !chunk.From.Equal(test.want[i][0]) || !chunk.To.Equal(test.want[i][1]) {
+					t.Errorf("chunk %d is [%s, %s), want [%s, %s)", i, chunk.From, chunk.To, test.want[i][0], test.want[i][1])
+				}
+				if chunk.Status != StatusSkipped {
+					t.Errorf("chunk %d starts %s, want %s until it runs", i, chunk.Status, StatusSkipped)
+				}
+			}
+		})
+	}
+}
+
+func TestParseBackfillChunk(t *testing.T) {
+	tests := []struct {
+		value   string
+		want    time.Duration
+		wantErr bool
+	}{
+		{value: "", want: defaultBackfillChunk},
+		{value: "6h", want: 6 * time.Hour},
+		{value: "7d", want: 7 * 24 * time.Hour},
+		{value: "xd", wantErr: true},
+		{value: "soon", wantErr: true},
+	}
+	for _, test := range tests {
+		got, err := ParseBackfillChunk(test.value)
+		if (err != nil) != test.wantErr {
+			t.Errorf("ParseBackfillChunk(%q) error = %v, want error %v", test.value, err, test.wantErr)
+			continue
+		}
+		if got != test.want {
+			t.Errorf("ParseBackfillChunk(%q) = %s, want %s", test.value, got, test.want)
+		}
+	}
+}
+
+func TestBackfillOptionsValidate(t *testing.T) {
+	tests := []struct {
+		name    string
+		opts    BackfillOptions
+		problem string
+	}{
+		{name: "defaults", opts: BackfillOptions{From: day(1), To: day(2)}},
+		{name: "missing window", opts: BackfillOptions{}, problem: "from and to are required"},
+		{name: "reversed window", opts: BackfillOptions{From: day(2), To: day(1)}, problem: "from must be before to"},
+		{name: "too many chunks", opts: BackfillOptions{From: day(1), To: day(31), Chunk: time.Minute}, problem: "more than"},
+		{name: "parallelism", opts: BackfillOptions{From: day(1), To: day(2), Parallelism: maxBackfillParallelism + 1}, problem: "parallelism"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			err := test.opts.validate()
+			if test.problem == "" {
+				if err != nil {
+					t.Fatalf("validate: %v", err)
+				}
+				if test.opts.Chunk != defaultBackfillChunk || test.opts.Parallelism != defaultBackfillParallelism {
+					t.Errorf("got chunk %s and parallelism %d, want the defaults", test.opts.Chunk, test.opts.Parallelism)
+				}
+				return
+			}
+			if err == nil || !strings.Contains(err.Error(), test.problem) {
+				t.Errorf("got error %v, want one mentioning %q", err, test.problem)
+			}
+		})
+	}
+}
+
+func TestBackfillSteps(t *testing.T) {
+	timed := map[string]string{MetaTimeColumn: "timestamp"}
+	p := &Pipeline{Steps: []*Step{
+		{ID: 1, Metadata: timed},
+		{ID: 2, ChildStepID: child(1), Metadata: map[string]string{}},
+		{ID: 3, Metadata: map[string]string{MetaWatermarkColumn: "updated_at"}},
+		{ID: 4, Metadata: map[string]string{"type": StepTypeStream, "topic": "events"}},
+	}}
+
+	windowed, rebuilt, err := backfillSteps(p, nil)
+	if err != nil {
+		t.Fatalf("backfillSteps: %v", err)
+	}
+	if got := stepIDs(windowed); !equalInts(got, []int{1, 3}) {
+		t.Errorf("got windowed steps %v, want [1 3]", got)
+	}
+	if got := stepIDs(rebuilt); !equalInts(got, []int{2}) {
+		t.Errorf("got rebuilt steps %v, want [2]", got)
+	}
+
+	one := 1
+	windowed, rebuilt, err = backfillSteps(p, &one)
+	if err != nil {
+		t.Fatalf("backfillSteps from step 1: %v", err)
+	}
+	if got := append(stepIDs(windowed), stepIDs(rebuilt)...); !equalInts(got, []int{1, 2}) {
+		t.Errorf("got steps %v from step 1, want it and its descendant [1 2]", got)
+	}
+
+	missing := 9
+	if _, _, err := backfillSteps(p, &missing); !errors.Is(err, ErrNotFound) {
+		t.Errorf("got error %v for an unknown step, want ErrNotFound", err)
+	}
+
+	p.Steps = append(p.Steps, &Step{ID: 5, ChildStepID: child(2), Metadata: timed})
+	if _, _, err := backfillSteps(p, nil); err == nil {
+		t.Error("expected an error for a windowed step reading a rebuilt one")
+	}
+}
+
+func TestApplyWindow(t *testing.T) {
+	got := applyWindow("SELECT * FROM events", "timestamp", day(1), day(2))
+	want := `SELECT * FROM (SELECT * FROM events) AS chunk WHERE "timestamp" >= '2025-01-01 00:00:00' AND "timestamp" < '2025-01-02 00:00:00'`
+	if got != want {
+		t.Errorf("got %s\nwant %s", got, want)
+	}
+
+	got = applyWindow("SELECT * FROM events WHERE t >= {{from}} AND t < {{to}}", "timestamp", day(1), day(2))
+	want = "SELECT * FROM events WHERE t >= '2025-01-01 00:00:00' AND t < '2025-01-02 00:00:00'"
+	if got != want {
+		t.Errorf("got %s\nwant %s", got, want)
+	}
+}
+
+func TestBackfillFailure(t *testing.T) {
+	backfill := &Backfill{Status: StatusSuccess, Chunks: []*BackfillChunk{{Status: StatusSuccess}, {Status: StatusSkipped}}}
+	if err := backfill.failure(nil); err != nil {
+		t.Errorf("got %v for a successful backfill, want nil", err)
+	}
+	backfill.Status = StatusFailed
+	if err := backfill.failure(nil); err == nil || !strings.Contains(err.Error(), "1 of 2 chunks") {
+		t.Errorf("got %v, want the count of chunks that did not succeed", err)
+	}
+}
@@ -0,0 +1,301 @@
+package etl
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"log"
+	"strings"
+	"time"
+
+	"github.com/lib/pq"
+)
+
+/*
+Data-quality checks attached to steps in prod.etl_step_checks. They are evaluated against
+a step's output inside the transaction that wrote it, so a failing check with severity
+"fail" rolls the output back and stops the run before bad rows reach later layers.
+*/
+
+type CheckType string
+
+const (
+	CheckNotNull        CheckType = "not_null"
+	CheckUnique         CheckType = "unique"
+	CheckAcceptedValues CheckType = "accepted_values"
+	CheckRange          CheckType = "range"
+	CheckRowCount       CheckType = "row_count"
+	CheckCustomSQL      CheckType = "custom_sql"
+)
+
+type Severity string
+
+const (
+	SeverityFail Severity = "fail"
+	SeverityWarn Severity = "warn"
+)
+
+const (
+	CheckPassed = "passed"
+	CheckFailed = "failed"
+	CheckWarned = "warned"
+	CheckError  = "error"
+)
+
+// tablePlaceholder is replaced by the step's output table in custom SQL checks.
+const tablePlaceholder = "{{table}}"
+
+type Check struct {
+	ID     int       `json:"check_id"`
+	StepID int       `json:"step_id"`
+	Name   string    `json:"name"`
+	Type   CheckType `json:"check_type"`
+	// Column is a single column, or a comma separated list for unique
+	Column   string   `json:"column,omitempty"`
+	Values   []string `json:"values,omitempty"`
+	Min      *float64 `json:"min,omitempty"`
+	Max      *float64 `json:"max,omitempty"`
+	SQL      string   `json:"sql,omitempty"`
+	Severity Severity `json:"severity"`
+}
+
+type CheckResult struct {
+	ID          int       `json:"check_result_id"`
+	CheckID     int       `json:"check_id"`
+	StepID      int       `json:"step_id"`
+	Name        string    `json:"name"`
+	Type        CheckType `json:"check_type"`
+	Severity    Severity  `json:"severity"`
+	Status      string    `json:"status"`
+	FailingRows int64     `json:"failing_rows"`
+	Message     string    `json:"message,omitempty"`
+	CheckedAt   time.Time `json:"checked_at"`
+}
+
+func loadChecks(db *sql.DB, schema string, where string, args ...interface{}) ([]*Check, error) {
+	rows, err := db.Query(`
+		SELECT check_id, step_id, name, check_type, COALESCE(column_name, ''), accepted_values,
+			min_value, max_value, COALESCE(sql, ''), severity
+		FROM `+schema+`.etl_step_checks `+where+`
+		ORDER BY check_id`, args...)
+	if err != nil {
+		return nil, fmt.Errorf("error loading step checks: %v", err)
+	}
+	defer rows.Close()
+
+	checks := []*Check{}
+	for rows.Next() {
+		check := &Check{}
+		var checkType, severity string
+		var min, max sql.NullFloat64
+		if err := rows.Scan(&check.ID, &check.StepID, &check.Name, &checkType, &check.Column,
+			pq.Array(&check.Values), &min, &max, &check.SQL, &severity); err != nil {
+			return nil, fmt.Errorf("error scanning step check: %v", err)
+		}
+		check.Type = CheckType(checkType)
+		check.Severity = Severity(severity)
+		if min.Valid {
+			check.Min = &min.Float64
+		}
+		if max.Valid {
+			check.Max = &max.Float64
+		}
+		checks = append(checks, check)
+	}
+	return checks, rows.Err()
+}
+
+func (c *Check) columns() []string {
+	var columns []string
+	for _, column := range strings.Split(c.Column, ",") {
+		if column = strings.TrimSpace(column); column != "" {
+			columns = append(columns, column)
+		}
+	}
+	return columns
+}
+
+// Validate fills in defaults and lists what is wrong with the check.
+func (c *Check) Validate() []string {
+	var problems []string
+	if c.Severity == "" {
+		c.Severity = SeverityFail
+	}
+	if c.Name == "" {
+		c.Name = string(c.Type)
+		if c.Column != "" {
+			c.Name += " " + c.Column
+		}
+	}
+	if c.Severity != SeverityFail && c.Severity != SeverityWarn {
+		problems = append(problems, fmt.Sprintf("check %q has unknown severity %q", c.Name, c.Severity))
+	}
+
+	needsColumn := false
+	switch c.Type {
+	case CheckNotNull, CheckUnique:
+		needsColumn = true
+	case CheckAcceptedValues:
+		needsColumn = true
+		if len(c.Values) == 0 {
+			problems = append(problems, fmt.Sprintf("check %q has no accepted values", c.Name))
+		}
+	case CheckRange:
+		needsColumn = true
+		if c.Min == nil && c.Max == nil {
+			problems = append(problems, fmt.Sprintf("check %q needs a min or max", c.Name))
+		}
+	case CheckRowCount:
+		if c.Min == nil && c.Max == nil {
+			problems = append(problems, fmt.Sprintf("check %q needs a min or max", c.Name))
+		}
+	case CheckCustomSQL:
+		if strings.TrimSpace(c.SQL) == "" {
+			problems = append(problems, fmt.Sprintf("check %q has no sql", c.Name))
+		}
+	default:
+		problems = append(problems, fmt.Sprintf("check %q has unknown type %q", c.Name, c.Type))
+	}
+
+	if needsColumn {
+		columns := c.columns()
+		if len(columns) == 0 {
+			problems = append(problems, fmt.Sprintf("check %q needs a column", c.Name))
+		}
+		if len(columns) > 1 && c.Type != CheckUnique {
+			problems = append(problems, fmt.Sprintf("check %q takes a single column", c.Name))
+		}
+		for _, column := range columns {
+			if !identifierPattern.MatchString(column) {
+				problems = append(problems, fmt.Sprintf("check %q has invalid column %q", c.Name, column))
+			}
+		}
+	}
+	if c.Min != nil && c.Max != nil && *c.Min > *c.Max {
+		problems = append(problems, fmt.Sprintf("check %q has min above max", c.Name))
+	}
+	return problems
+}
+
+// query returns SQL counting the rows that break the check, or for row_count
+// the rows in the table.
+func (c *Check) query(table string) string {
+	columns := c.columns()
+	quoted := make([]string, len(columns))
+	for i, column := range columns {
+		quoted[i] = quoteIdentifier(column)
+	}
+
+	switch c.Type {
+	case CheckNotNull:
+		return fmt.Sprintf("SELECT COUNT(*) FROM %s WHERE %s IS NULL", table, quoted[0])
+	case CheckUnique:
+		return fmt.Sprintf(`SELECT COALESCE(SUM(duplicates - 1), 0) FROM (
+			SELECT COUNT(*) AS duplicates FROM %s GROUP BY %s HAVING COUNT(*) > 1
+		) AS duplicated`, table, strings.Join(quoted, ", "))
+	case CheckAcceptedValues:
+		values := make([]string, len(c.Values))
+		for i, value := range c.Values {
+			values[i] = quoteLiteral(value)
+		}
+		return fmt.Sprintf("SELECT COUNT(*) FROM %s WHERE %s IS NOT NULL AND %s::text NOT IN (%s)",
+			table, quoted[0], quoted[0], strings.Join(values, ", "))
+	case CheckRange:
+		var conditions []string
+		if c.Min != nil {
+			conditions = append(conditions, fmt.Sprintf("%s < %v", quoted[0], *c.Min))
+		}
+		if c.Max != nil {
+			conditions = append(conditions, fmt.Sprintf("%s > %v", quoted[0], *c.Max))
+		}
+		return fmt.Sprintf("SELECT COUNT(*) FROM %s WHERE %s", table, strings.Join(conditions, " OR "))
+	case CheckRowCount:
+		return fmt.Sprintf("SELECT COUNT(*) FROM %s", table)
+	case CheckCustomSQL:
+		query := strings.TrimRight(strings.TrimSpace(c.SQL), ";")
+		return fmt.Sprintf("SELECT COUNT(*) FROM (%s) AS failing", strings.ReplaceAll(query, tablePlaceholder, table))
+	}
+	return ""
+}
+
+func (c *Check) describe(count int64) string {
+	switch c.Type {
+	case CheckRowCount:
+		var bounds []string
+		if c.Min != nil {
+			bounds = append(bounds, fmt.Sprintf("at least %v", *c.Min))
+		}
+		if c.Max != nil {
+			bounds = append(bounds, fmt.Sprintf("at most %v", *c.Max))
+		}
+		return fmt.Sprintf("%d rows, expected %s", count, strings.Join(bounds, " and "))
+	case CheckUnique:
+		return fmt.Sprintf("%d duplicate rows on %s", count, c.Column)
+	case CheckCustomSQL:
+		return fmt.Sprintf("%d rows returned", count)
+	}
+	return fmt.Sprintf("%d rows fail %s on %s", count, c.Type, c.Column)
+}
+
+// runChecks evaluates the step's checks against its output in table within tx. A
+// savepoint around each check keeps a broken check from aborting the transaction.
+func runChecks(ctx context.Context, tx *sql.Tx, step *Step, table string) ([]*CheckResult, error) {
+	var results []*CheckResult
+	var failed []string
+
+	for _, check := range step.Checks {
+		result := &CheckResult{
+			CheckID:   check.ID,
+			StepID:    step.ID,
+			Name:      check.Name,
+			Type:      check.Type,
+			Severity:  check.Severity,
+			Status:    CheckPassed,
+			CheckedAt: time.Now(),
+		}
+		results = append(results, result)
+
+		if _, err := tx.ExecContext(ctx, "SAVEPOINT etl_check"); err != nil {
+			return results, err
+		}
+		var count int64
+		err := tx.QueryRowContext(ctx, check.query(table)).Scan(&count)
+		if err != nil {
+			if _, rollbackErr := tx.ExecContext(ctx, "ROLLBACK TO SAVEPOINT etl_check"); rollbackErr != nil {
+				return results, rollbackErr
+			}
+			result.Status = CheckError
+			result.Message = err.Error()
+		} else {
+			if _, err := tx.ExecContext(ctx, "RELEASE SAVEPOINT etl_check"); err != nil {
+				return results, err
+			}
+			broken := count > 0
+			if check.Type == CheckRowCount {
+				broken = (check.Min != nil && float64(count) < *check.Min) || (check.Max != nil && float64(count) > *check.Max)
+			}
+			result.FailingRows = count
+			if broken {
+				result.Status = CheckFailed
+				result.Message = check.describe(count)
+			}
+		}
+
+		if result.Status == CheckPassed {
+			continue
+		}
+		if check.Severity == SeverityWarn {
+			if result.Status == CheckFailed {
+				result.Status = CheckWarned
+			}
+			log.Printf("Check %q on step %d warned: %s", check.Name, step.ID, result.Message)
+			continue
+		}
+		failed = append(failed, fmt.Sprintf("%s: %s", check.Name, result.Message))
+	}
+
+	if len(failed) > 0 {
+		return results, fmt.Errorf("data quality checks failed: %s", strings.Join(failed, "; "))
+	}
+	return results, nil
+}
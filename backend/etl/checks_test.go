@@ -0,0 +1,112 @@
+package etl
+
+import (
+	"strings"
+	"testing"
+)
+
+func bound(value float64) *float64 {
+	return &value
+}
+
+func TestCheckValidate(t *testing.T) {
+	tests := []struct {
+		name     string
+		check    Check
+		problems []string
+	}{
+		{name: "not null", check: Check{Type: CheckNotNull, Column: "id"}},
+		{name: "unique on several columns", check: Check{Type: CheckUnique, Column: "machine_id, timestamp"}},
+		{name: "accepted values", check: Check{Type: CheckAcceptedValues, Column: "status", Values: []string{"ok", "failed"}}},
+		{name: "row count", check: Check{Type: CheckRowCount, Min: bound(1)}},
+		{name: "custom sql", check: Check{Type: CheckCustomSQL, SQL: "SELECT * FROM {{table}} WHERE value < 0", Severity: SeverityWarn}},
+		{name: "missing column", check: Check{Type: CheckNotNull}, problems: []string{"needs a column"}},
+		{name: "several columns", check: Check{Type: CheckNotNull, Column: "a,b"}, problems: []string{"takes a single column"}},
+		{name: "invalid column", check: Check{Type: CheckRange, Column: "a b", Max: bound(1)}, problems: []string{`invalid column "a b"`}},
+		{name: "no accepted values", check: Check{Type: CheckAcceptedValues, Column: "status"}, problems: []string{"no accepted values"}},
+		{name: "range without bounds", check: Check{Type: CheckRange, Column: "value"}, problems: []string{"needs a min or max"}},
+		{name: "min above max", check: Check{Type: CheckRange, Column: "value", Min: bound(2), Max: bound(1)}, problems: []string{"min above max"}},
+		{name: "no sql", check: Check{Type: CheckCustomSQL}, problems: []string{"has no sql"}},
+		{name: "unknown type", check: Check{Type: "fresh"}, problems: []string{`unknown type "fresh"`}},
+		{name: "unknown severity", check: Check{Type: CheckRowCount, Max: bound(5), Severity: "info"}, problems: []string{`unknown severity "info"`}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			problems := test.check.Validate()
+			if len(problems) != len(test.problems) {
+				t.Fatalf("got problems %v, want %v", problems, test.problems)
+			}
+			for i, problem := range test.problems {
+				if !strings.Contains(problems[i], problem) {
+					t.Errorf("got problem %q, want one containing %q", problems[i], problem)
+				}
+			}
+		})
+	}
+}
+
+func TestCheckValidateDefaults(t *testing.T) {
+	check := &Check{Type: CheckNotNull, Column: "id"}
+	check.Validate()
+	if check.Name != "not_null id" || check.Severity != SeverityFail {
+		t.Errorf("got name %q and severity %q, want \"not_null id\" and fail", check.Name, check.Severity)
+	}
+}
+
+func TestCheckQuery(t *testing.T) {
+	tests := []struct {
+		check Check
+		want  []string
+	}{
+		{
+			check: Check{Type: CheckNotNull, Column: "id"},
+			want:  []string{`SELECT COUNT(*) FROM out WHERE "id" IS NULL`},
+		},
+		{
+			check: Check{Type: CheckUnique, Column: "machine_id, timestamp"},
+			want:  []string{`GROUP BY "machine_id", "timestamp" HAVING COUNT(*) > 1`},
+		},
+		{
+			check: Check{Type: CheckAcceptedValues, Column: "status", Values: []string{"ok", "it's"}},
+			want:  []string{`"status"::text NOT IN ('ok', 'it''s')`},
+		},
+		{
+			check: Check{Type: CheckRange, Column: "value", Min: bound(0), Max: bound(1.5)},
+			want:  []string{`WHERE "value" < 0 OR "value" > 1.5`},
+		},
+		{
+			check: Check{Type: CheckRowCount, Min: bound(1)},
+			want:  []string{"SELECT COUNT(*) FROM out"},
+		},
+		{
+			check: Check{Type: CheckCustomSQL, SQL: "SELECT * FROM {{table}} WHERE value < 0;"},
+			want:  []string{"SELECT COUNT(*) FROM (SELECT * FROM out WHERE value < 0) AS failing"},
+		},
+	}
+	for _, test := range tests {
+		query := test.check.query("out")
+		for _, want := range test.want {
+			if !strings.Contains(query, want) {
+				t.Errorf("%s query %q does not contain %q", test.check.Type, query, want)
+			}
+		}
+	}
+}
+
+func TestCheckDescribe(t *testing.T) {
+	tests := []struct {
+		check Check
+		count int64
+		want  string
+	}{
+		{check: Check{Type: CheckRowCount, Min: bound(10), Max: bound(20)}, count: 3, want: "3 rows, expected at least 10 and at most 20"},
+		{check: Check{Type: CheckUnique, Column: "id"}, count: 2, want: "2 duplicate rows on id"},
+		{check: Check{Type: CheckCustomSQL}, count: 1, want: "1 rows returned"},
+		{check: Check{Type: CheckNotNull, Column: "id"}, count: 4, want: "4 rows fail not_null on id"},
+	}
+	for _, test := range tests {
+		if got := test.check.describe(test.count); got != test.want {
+			t.Errorf("got %q, want %q", got, test.want)
+		}
+	}
+}
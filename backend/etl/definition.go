@@ -0,0 +1,931 @@
+package etl
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"reflect"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/lib/pq"
+	"gopkg.in/yaml.v3"
+)
+
+/*
+Pipeline definitions as files that can be reviewed in git and promoted between the dev,
+staging and prod schemas. A definition holds a pipeline, its steps with their metadata and
+checks, and the data sources that feed it with their refresh conditions. Everything is
+matched by name rather than id, since ids differ between schemas, so steps refer to each
+other in queries and "input" metadata as {{step:Name}} instead of step_<id>. Importing
+makes a schema match the file, changing only what differs, so importing the same file
+again changes nothing.
+*/
+
+const DefinitionVersion = 1
+
+const (
+	DevSchema     = "dev"
+	StagingSchema = "staging"
+	ProdSchema    = "prod"
+)
+
+// DefinitionSchemas are the schemas holding pipeline definitions. Only prod's are run.
+var DefinitionSchemas = []string{DevSchema, StagingSchema, ProdSchema}
+
+var (
+	stepIDPattern   = regexp.MustCompile(`\bstep_(\d+)\b`)
+	stepNamePattern = regexp.MustCompile(`\{\{step:([^}]+)\}\}`)
+)
+
+type Definition struct {
+	Version     int                     `json:"version" yaml:"version"`
+	Name        string                  `json:"name" yaml:"name"`
+	Description string                  `json:"description,omitempty" yaml:"description,omitempty"`
+	WorkspaceID int                     `json:"workspace_id,omitempty" yaml:"workspace_id,omitempty"`
+	Steps       []*StepDefinition       `json:"steps" yaml:"steps"`
+	DataSources []*DataSourceDefinition `json:"data_sources,omitempty" yaml:"data_sources,omitempty"`
+}
+
+type StepDefinition struct {
+	Name        string             `json:"name" yaml:"name"`
+	Description string             `json:"description,omitempty" yaml:"description,omitempty"`
+	Layer       Layer              `json:"layer" yaml:"layer"`
+	Order       int                `json:"order" yaml:"order"`
+	ReadsFrom   string             `json:"reads_from,omitempty" yaml:"reads_from,omitempty"`
+	Query       string             `json:"query" yaml:"query"`
+	Metadata    map[string]string  `json:"metadata,omitempty" yaml:"metadata,omitempty"`
+	Checks      []*CheckDefinition `json:"checks,omitempty" yaml:"checks,omitempty"`
+}
+
+type CheckDefinition struct {
+	Name     string    `json:"name" yaml:"name"`
+	Type     CheckType `json:"type" yaml:"type"`
+	Column   string    `json:"column,omitempty" yaml:"column,omitempty"`
+	Values   []string  `json:"values,omitempty" yaml:"values,omitempty"`
+	Min      *float64  `json:"min,omitempty" yaml:"min,omitempty"`
+	Max      *float64  `json:"max,omitempty" yaml:"max,omitempty"`
+	SQL      string    `json:"sql,omitempty" yaml:"sql,omitempty"`
+	Severity Severity  `json:"severity" yaml:"severity"`
+}
+
+type DataSourceDefinition struct {
+	Name        string                 `json:"name" yaml:"name"`
+	Description string                 `json:"description,omitempty" yaml:"description,omitempty"`
+	Layer       Layer                  `json:"layer" yaml:"layer"`
+	FeedsStep   string                 `json:"feeds_step,omitempty" yaml:"feeds_step,omitempty"`
+	Schema      map[string]interface{} `json:"schema,omitempty" yaml:"schema,omitempty"`
+	Conditions  []*ConditionDefinition `json:"conditions,omitempty" yaml:"conditions,omitempty"`
+}
+
+type ConditionDefinition struct {
+	RefreshInterval int  `json:"refresh_interval" yaml:"refresh_interval"`
+	AppendOnly      bool `json:"append_only" yaml:"append_only"`
+}
+
+const (
+	ChangeCreate = "create"
+	ChangeUpdate = "update"
+	ChangeDelete = "delete"
+)
+
+type DefinitionChange struct {
+	Action string `json:"action"`
+	// Kind is pipeline, step, check, data_source or condition
+	Kind   string   `json:"kind"`
+	Name   string   `json:"name"`
+	Fields []string `json:"fields,omitempty"`
+}
+
+type ImportResult struct {
+	Schema     string              `json:"schema"`
+	PipelineID int                 `json:"pipeline_id,omitempty"`
+	Name       string              `json:"name"`
+	DryRun     bool                `json:"dry_run"`
+	Changes    []*DefinitionChange `json:"changes"`
+	// DroppedOutputs are the output tables of prod steps the import deletes or
+	// whose output it changes, which are dropped with their watermarks
+	DroppedOutputs []string `json:"dropped_outputs,omitempty"`
+
+	stale       []*Step
+	workspaceID int
+}
+
+func checkSchema(schema string) error {
+	for _, known := range DefinitionSchemas {
+		if schema == known {
+			return nil
+		}
+	}
+	return &ValidationError{Problems: []string{fmt.Sprintf("schema must be one of %s", strings.Join(DefinitionSchemas, ", "))}}
+}
+
+// ParseDefinition reads a definition from YAML or JSON.
+func ParseDefinition(data []byte) (*Definition, error) {
+	def := &Definition{}
+	if err := yaml.Unmarshal(data, def); err != nil {
+		return nil, &ValidationError{Problems: []string{fmt.Sprintf("could not read definition: %v", err)}}
+	}
+	return def, nil
+}
+
+// Marshal writes the definition as yaml or json.
+func (d *Definition) Marshal(format string) ([]byte, error) {
+	switch format {
+	case "", "yaml", "yml":
+		return yaml.Marshal(d)
+	case "json":
+		return json.MarshalIndent(d, "", "  ")
+	}
+	return nil, &ValidationError{Problems: []string{fmt.Sprintf("unknown format %q, expected yaml or json", format)}}
+}
+
+// Validate fills in defaults, as CreateStep and Check.Validate do, so a file
+// compares equal to what importing it stores. Steps are numbered by their
+// position in the file.
+func (d *Definition) Validate() error {
+	var problems []string
+	switch d.Version {
+	case DefinitionVersion:
+	case 0:
+		problems = append(problems, "definition has no version")
+	default:
+		problems = append(problems, fmt.Sprintf("definition version %d is not supported, expected %d", d.Version, DefinitionVersion))
+	}
+	if strings.TrimSpace(d.Name) == "" {
+		problems = append(problems, "pipeline has no name")
+	}
+	if d.WorkspaceID == 0 {
+		d.WorkspaceID = 1
+	}
+
+	positions := make(map[string]int, len(d.Steps))
+	for i, step := range d.Steps {
+		if _, seen := positions[step.Name]; seen {
+			problems = append(problems, fmt.Sprintf("step name %q is used more than once", step.Name))
+		}
+		positions[step.Name] = i + 1
+	}
+
+	steps := make([]*Step, len(d.Steps))
+	for i, step := range d.Steps {
+		if step.Order == 0 {
+			step.Order = i + 1
+		}
+		if step.Metadata == nil {
+			step.Metadata = make(map[string]string)
+		}
+		if _, ok := step.Metadata["type"]; !ok {
+			step.Metadata["type"] = StepTypeSQL
+		}
+		steps[i] = &Step{ID: i + 1, Name: step.Name, Layer: step.Layer, Order: step.Order, Query: step.Query,
+			Metadata: resolveMetadata(step.Metadata, positions)}
+		if step.ReadsFrom != "" {
+			position, ok := positions[step.ReadsFrom]
+			if !ok {
+				problems = append(problems, fmt.Sprintf("step %q reads from unknown step %q", step.Name, step.ReadsFrom))
+			} else {
+				steps[i].ChildStepID = &position
+			}
+		}
+		for _, match := range stepNamePattern.FindAllStringSubmatch(step.Query, -1) {
+			if _, ok := positions[match[1]]; !ok {
+				problems = append(problems, fmt.Sprintf("step %q queries unknown step %q", step.Name, match[1]))
+			}
+		}
+		for _, match := range stepNamePattern.FindAllStringSubmatch(step.Metadata[MetaInput], -1) {
+			if _, ok := positions[match[1]]; !ok {
+				problems = append(problems, fmt.Sprintf("step %q has %s of unknown step %q", step.Name, MetaInput, match[1]))
+			}
+		}
+
+		names := make(map[string]bool)
+		for _, checkDef := range step.Checks {
+			check := checkDef.check()
+			for _, problem := range check.Validate() {
+				problems = append(problems, fmt.Sprintf("step %q: %s", step.Name, problem))
+			}
+			checkDef.Name, checkDef.Severity = check.Name, check.Severity
+			if names[checkDef.Name] {
+				problems = append(problems, fmt.Sprintf("step %q has more than one check named %q", step.Name, checkDef.Name))
+			}
+			names[checkDef.Name] = true
+		}
+	}
+	if err := ValidateSteps(steps); err != nil {
+		var invalid *ValidationError
+		if errors.As(err, &invalid) {
+			problems = append(problems, invalid.Problems...)
+		}
+	}
+
+	sources := make(map[string]bool)
+	for _, source := range d.DataSources {
+		if strings.TrimSpace(source.Name) == "" {
+			problems = append(problems, "data source has no name")
+		}
+		if sources[source.Name] {
+			problems = append(problems, fmt.Sprintf("data source name %q is used more than once", source.Name))
+		}
+		sources[source.Name] = true
+		if source.Layer == "" {
+			source.Layer = LayerRaw
+		}
+		if !source.Layer.Valid() {
+			problems = append(problems, fmt.Sprintf("data source %q has unknown layer %q", source.Name, source.Layer))
+		}
+		if _, ok := positions[source.FeedsStep]; source.FeedsStep != "" && !ok {
+			problems = append(problems, fmt.Sprintf("data source %q feeds unknown step %q", source.Name, source.FeedsStep))
+		}
+		for _, condition := range source.Conditions {
+			if condition.RefreshInterval <= 0 {
+				problems = append(problems, fmt.Sprintf("data source %q has a refresh_interval that is not positive", source.Name))
+			}
+		}
+		// Stored as JSONB, so compare it as JSON would read it back
+		if source.Schema != nil {
+			normalised, err := normaliseJSON(source.Schema)
+			if err != nil {
+				problems = append(problems, fmt.Sprintf("data source %q has a schema that is not JSON: %v", source.Name, err))
+			}
+			source.Schema = normalised
+		}
+	}
+
+	if len(problems) > 0 {
+		return &ValidationError{Problems: problems}
+	}
+	return nil
+}
+
+func normaliseJSON(value map[string]interface{}) (map[string]interface{}, error) {
+	data, err := json.Marshal(value)
+	if err != nil {
+		return nil, err
+	}
+	var normalised map[string]interface{}
+	err = json.Unmarshal(data, &normalised)
+	return normalised, err
+}
+
+func (c *CheckDefinition) check() *Check {
+	return &Check{Name: c.Name, Type: c.Type, Column: c.Column, Values: c.Values, Min: c.Min, Max: c.Max, SQL: c.SQL, Severity: c.Severity}
+}
+
+// portableQuery swaps references to the pipeline's own step tables for their names.
+func portableQuery(query string, names map[int]string) string {
+	return stepIDPattern.ReplaceAllStringFunc(query, func(table string) string {
+		id, _ := strconv.Atoi(strings.TrimPrefix(table, "step_"))
+		if name, ok := names[id]; ok {
+			return "{{step:" + name + "}}"
+		}
+		return table
+	})
+}
+
+func resolveQuery(query string, ids map[string]int) string {
+	return stepNamePattern.ReplaceAllStringFunc(query, func(reference string) string {
+		return fmt.Sprintf("step_%d", ids[stepNamePattern.FindStringSubmatch(reference)[1]])
+	})
+}
+
+// portableMetadata swaps the step tables named in metadata, the input of a Go
+// transform, for their names like portableQuery.
+func portableMetadata(metadata map[string]string, names map[int]string) map[string]string {
+	if _, ok := metadata[MetaInput]; !ok {
+		return metadata
+	}
+	portable := make(map[string]string, len(metadata))
+	for key, value := range metadata {
+		portable[key] = value
+	}
+	portable[MetaInput] = portableQuery(metadata[MetaInput], names)
+	return portable
+}
+
+func resolveMetadata(metadata map[string]string, ids map[string]int) map[string]string {
+	if _, ok := metadata[MetaInput]; !ok {
+		return metadata
+	}
+	resolved := make(map[string]string, len(metadata))
+	for key, value := range metadata {
+		resolved[key] = value
+	}
+	resolved[MetaInput] = resolveQuery(metadata[MetaInput], ids)
+	return resolved
+}
+
+// definitionIDs maps the names in a definition to the rows they are stored as.
+type definitionIDs struct {
+	pipeline    int
+	steps       map[string]int
+	checks      map[string]map[string]int
+	dataSources map[string]int
+	conditions  map[string][]int
+}
+
+func (s *Store) loadDefinition(schema string, pipelineID int) (*Definition, *definitionIDs, error) {
+	p, err := loadPipeline(s.db, schema, pipelineID)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, nil, ErrNotFound
+	}
+	if err != nil {
+		return nil, nil, err
+	}
+
+	ids := &definitionIDs{
+		pipeline:    p.ID,
+		steps:       make(map[string]int),
+		checks:      make(map[string]map[string]int),
+		dataSources: make(map[string]int),
+		conditions:  make(map[string][]int),
+	}
+	names := make(map[int]string, len(p.Steps))
+	for _, step := range p.Steps {
+		names[step.ID] = step.Name
+		ids.steps[step.Name] = step.ID
+	}
+
+	def := &Definition{
+		Version:     DefinitionVersion,
+		Name:        p.Name,
+		Description: p.Description,
+		WorkspaceID: p.WorkspaceID,
+		Steps:       []*StepDefinition{},
+	}
+	for _, step := range p.Steps {
+		stepDef := &StepDefinition{
+			Name:        step.Name,
+			Description: step.Description,
+			Layer:       step.Layer,
+			Order:       step.Order,
+			Query:       portableQuery(step.Query, names),
+			Metadata:    portableMetadata(step.Metadata, names),
+		}
+		if step.ChildStepID != nil {
+			stepDef.ReadsFrom = names[*step.ChildStepID]
+		}
+		ids.checks[step.Name] = make(map[string]int)
+		for _, check := range step.Checks {
+			stepDef.Checks = append(stepDef.Checks, &CheckDefinition{
+				Name: check.Name, Type: check.Type, Column: check.Column, Values: check.Values,
+				Min: check.Min, Max: check.Max, SQL: check.SQL, Severity: check.Severity,
+			})
+			ids.checks[step.Name][check.Name] = check.ID
+		}
+		def.Steps = append(def.Steps, stepDef)
+	}
+
+	rows, err := s.db.Query(`
+		SELECT data_source_id, name, COALESCE(description, ''), layer, step_child_id, schema
+		FROM `+schema+`.data_sources
+		WHERE pipeline_id = $1
+		ORDER BY data_source_id`, p.ID)
+	if err != nil {
+		return nil, nil, fmt.Errorf("error loading data sources: %v", err)
+	}
+	defer rows.Close()
+
+	byID := make(map[int]*DataSourceDefinition)
+	for rows.Next() {
+		source := &DataSourceDefinition{}
+		var id int
+		var layer string
+		var stepID sql.NullInt64
+		var sourceSchema []byte
+		if err := rows.Scan(&id, &source.Name, &source.Description, &layer, &stepID, &sourceSchema); err != nil {
+			return nil, nil, fmt.Errorf("error scanning data source: %v", err)
+		}
+		source.Layer = Layer(layer)
+		if stepID.Valid {
+			source.FeedsStep = names[int(stepID.Int64)]
+		}
+		if len(sourceSchema) > 0 {
+			if err := json.Unmarshal(sourceSchema, &source.Schema); err != nil {
+				return nil, nil, fmt.Errorf("error reading schema of data source %q: %v", source.Name, err)
+			}
+		}
+		def.DataSources = append(def.DataSources, source)
+		ids.dataSources[source.Name] = id
+		byID[id] = source
+	}
+	if err := rows.Err(); err != nil {
+		return nil, nil, err
+	}
+
+	conditionRows, err := s.db.Query(`
+		SELECT c.data_source_condition_id, c.data_source_id, c.refresh_interval, c.append_only
+		FROM `+schema+`.data_sources_conditions c
+		JOIN `+schema+`.data_sources d ON d.data_source_id = c.data_source_id
+		WHERE d.pipeline_id = $1
+		ORDER BY c.data_source_condition_id`, p.ID)
+	if err != nil {
+		return nil, nil, fmt.Errorf("error loading data source conditions: %v", err)
+	}
+	defer conditionRows.Close()
+
+	for conditionRows.Next() {
+		condition := &ConditionDefinition{}
+		var id, sourceID int
+		if err := conditionRows.Scan(&id, &sourceID, &condition.RefreshInterval, &condition.AppendOnly); err != nil {
+			return nil, nil, fmt.Errorf("error scanning data source condition: %v", err)
+		}
+		if source, ok := byID[sourceID]; ok {
+			source.Conditions = append(source.Conditions, condition)
+			ids.conditions[source.Name] = append(ids.conditions[source.Name], id)
+		}
+	}
+	return def, ids, conditionRows.Err()
+}
+
+// ExportPipeline returns the definition of a pipeline in schema.
+func (s *Store) ExportPipeline(schema string, pipelineID int) (*Definition, error) {
+	if err := checkSchema(schema); err != nil {
+		return nil, err
+	}
+	def, _, err := s.loadDefinition(schema, pipelineID)
+	return def, err
+}
+
+// findPipeline returns the id of the pipeline called name in schema, or 0.
+func (s *Store) findPipeline(schema string, name string) (int, error) {
+	rows, err := s.db.Query(`SELECT pipeline_id FROM `+schema+`.etl_pipeline WHERE name = $1`, name)
+	if err != nil {
+		return 0, fmt.Errorf("error finding pipeline %q: %v", name, err)
+	}
+	defer rows.Close()
+
+	var ids []int
+	for rows.Next() {
+		var id int
+		if err := rows.Scan(&id); err != nil {
+			return 0, err
+		}
+		ids = append(ids, id)
+	}
+	if len(ids) > 1 {
+		return 0, &ValidationError{Problems: []string{fmt.Sprintf("%d pipelines in %s are called %q", len(ids), schema, name)}}
+	}
+	if len(ids) == 0 {
+		return 0, rows.Err()
+	}
+	return ids[0], rows.Err()
+}
+
+// ImportPipeline makes the pipeline of the same name in schema match def,
+// creating it if needed. With dryRun the changes are listed but not made.
+func (s *Store) ImportPipeline(schema string, def *Definition, dryRun bool) (*ImportResult, error) {
+	if err := checkSchema(schema); err != nil {
+		return nil, err
+	}
+	if err := def.Validate(); err != nil {
+		return nil, err
+	}
+
+	current := &Definition{}
+	ids := &definitionIDs{
+		steps:       make(map[string]int),
+		checks:      make(map[string]map[string]int),
+		dataSources: make(map[string]int),
+		conditions:  make(map[string][]int),
+	}
+	pipelineID, err := s.findPipeline(schema, def.Name)
+	if err != nil {
+		return nil, err
+	}
+	if pipelineID != 0 {
+		if current, ids, err = s.loadDefinition(schema, pipelineID); err != nil {
+			return nil, err
+		}
+	}
+
+	plan := newImportPlan(schema, ids)
+	plan.diff(current, def, pipelineID == 0)
+
+	result := &ImportResult{Schema: schema, PipelineID: pipelineID, Name: def.Name, DryRun: dryRun, Changes: plan.changes,
+		stale: plan.stale, workspaceID: current.WorkspaceID}
+	for _, step := range plan.stale {
+		result.DroppedOutputs = append(result.DroppedOutputs, step.QualifiedTableName())
+	}
+	if dryRun || len(plan.changes) == 0 {
+		return result, nil
+	}
+
+	tx, err := s.db.Begin()
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+	for _, phase := range plan.phases {
+		for _, op := range phase {
+			if err := op(tx); err != nil {
+				return nil, err
+			}
+		}
+	}
+	if err := tx.Commit(); err != nil {
+		return nil, err
+	}
+	result.PipelineID = ids.pipeline
+	return result, nil
+}
+
+// PromotePipeline copies a pipeline's definition from one schema to another.
+func (s *Store) PromotePipeline(from string, to string, pipelineID int, dryRun bool) (*ImportResult, error) {
+	if from == to {
+		return nil, &ValidationError{Problems: []string{"cannot promote a pipeline to the schema it is in"}}
+	}
+	def, err := s.ExportPipeline(from, pipelineID)
+	if err != nil {
+		return nil, err
+	}
+	return s.ImportPipeline(to, def, dryRun)
+}
+
+// Changes are applied in phases so that, for example, every step exists
+// before steps are linked to the steps they read from.
+const (
+	phasePipeline = iota
+	phaseRemove
+	phaseSteps
+	phaseLinks
+	phaseDetails
+	phaseDataSources
+	phaseConditions
+	phaseCount
+)
+
+type importPlan struct {
+	schema  string
+	ids     *definitionIDs
+	changes []*DefinitionChange
+	phases  [phaseCount][]func(tx *sql.Tx) error
+	// stale are the steps, as they were, whose output tables no longer fit
+	stale []*Step
+}
+
+func newImportPlan(schema string, ids *definitionIDs) *importPlan {
+	return &importPlan{schema: schema, ids: ids, changes: []*DefinitionChange{}}
+}
+
+func (p *importPlan) add(phase int, change *DefinitionChange, op func(tx *sql.Tx) error) {
+	if change != nil {
+		p.changes = append(p.changes, change)
+	}
+	p.phases[phase] = append(p.phases[phase], op)
+}
+
+// compare lists the fields that differ, showing the values of short ones.
+func compare(fields []string, name string, from interface{}, to interface{}) []string {
+	if reflect.DeepEqual(from, to) {
+		return fields
+	}
+	switch from.(type) {
+	case string, Layer, int, bool:
+		if len(fmt.Sprint(from)) <= 40 && len(fmt.Sprint(to)) <= 40 {
+			return append(fields, fmt.Sprintf("%s: %v → %v", name, from, to))
+		}
+	}
+	return append(fields, name)
+}
+
+// outdate marks the output of step, as it was, to be dropped. Only prod's
+// pipelines run, and the tables of other schemas' steps could be prod's.
+func (p *importPlan) outdate(step *StepDefinition, id int) {
+	if p.schema != ProdSchema || id == 0 {
+		return
+	}
+	p.stale = append(p.stale, &Step{ID: id, Name: step.Name, Layer: step.Layer, Query: step.Query, Metadata: step.Metadata})
+}
+
+func emptyIfNil(metadata map[string]string) map[string]string {
+	if metadata == nil {
+		return map[string]string{}
+	}
+	return metadata
+}
+
+func (p *importPlan) diff(current *Definition, def *Definition, create bool) {
+	t := func(table string) string { return p.schema + "." + table }
+	ids := p.ids
+
+	var fields []string
+	fields = compare(fields, "description", current.Description, def.Description)
+	fields = compare(fields, "workspace_id", current.WorkspaceID, def.WorkspaceID)
+	switch {
+	case create:
+		p.add(phasePipeline, &DefinitionChange{Action: ChangeCreate, Kind: "pipeline", Name: def.Name}, func(tx *sql.Tx) error {
+			return tx.QueryRow(`INSERT INTO `+t("etl_pipeline")+` (name, description, workspace_id) VALUES ($1, $2, $3) RETURNING pipeline_id`,
+				def.Name, def.Description, def.WorkspaceID).Scan(&ids.pipeline)
+		})
+	case len(fields) > 0:
+		p.add(phasePipeline, &DefinitionChange{Action: ChangeUpdate, Kind: "pipeline", Name: def.Name, Fields: fields}, func(tx *sql.Tx) error {
+			_, err := tx.Exec(`UPDATE `+t("etl_pipeline")+` SET description = $1, workspace_id = $2, updated_at = CURRENT_TIMESTAMP WHERE pipeline_id = $3`,
+				def.Description, def.WorkspaceID, ids.pipeline)
+			return err
+		})
+	}
+
+	currentSteps := make(map[string]*StepDefinition)
+	for _, step := range current.Steps {
+		currentSteps[step.Name] = step
+	}
+	wanted := make(map[string]bool)
+	for _, step := range def.Steps {
+		wanted[step.Name] = true
+	}
+	for _, step := range current.Steps {
+		if wanted[step.Name] {
+			continue
+		}
+		id := ids.steps[step.Name]
+		p.outdate(step, id)
+		p.add(phaseRemove, &DefinitionChange{Action: ChangeDelete, Kind: "step", Name: step.Name}, func(tx *sql.Tx) error {
+			// Only prod's tables carry foreign keys, so clear references by hand
+			for _, statement := range []string{
+				`DELETE FROM ` + t("etl_step_metadata") + ` WHERE step_id = $1`,
+				`DELETE FROM ` + t("etl_step_checks") + ` WHERE step_id = $1`,
+				`UPDATE ` + t("etl_steps") + ` SET child_step_id = NULL WHERE child_step_id = $1`,
+				`UPDATE ` + t("data_sources") + ` SET step_child_id = NULL WHERE step_child_id = $1`,
+				`DELETE FROM ` + t("etl_steps") + ` WHERE step_id = $1`,
+			} {
+				if _, err := tx.Exec(statement, id); err != nil {
+					return fmt.Errorf("error deleting step %q: %v", step.Name, err)
+				}
+			}
+			return nil
+		})
+	}
+
+	for _, step := range def.Steps {
+		step := step
+		existing, found := currentSteps[step.Name]
+		if !found {
+			existing = &StepDefinition{}
+		}
+		var fields []string
+		fields = compare(fields, "description", existing.Description, step.Description)
+		fields = compare(fields, "layer", existing.Layer, step.Layer)
+		fields = compare(fields, "order", existing.Order, step.Order)
+		fields = compare(fields, "reads_from", existing.ReadsFrom, step.ReadsFrom)
+		fields = compare(fields, "query", existing.Query, step.Query)
+		metadataChanged := !reflect.DeepEqual(emptyIfNil(existing.Metadata), emptyIfNil(step.Metadata))
+		if metadataChanged {
+			fields = append(fields, "metadata")
+		}
+
+		link := func(tx *sql.Tx) error {
+			var child interface{}
+			if step.ReadsFrom != "" {
+				child = ids.steps[step.ReadsFrom]
+			}
+			_, err := tx.Exec(`UPDATE `+t("etl_steps")+` SET query = $1, child_step_id = $2 WHERE step_id = $3`,
+				resolveQuery(step.Query, ids.steps), child, ids.steps[step.Name])
+			return err
+		}
+		writeMetadata := func(tx *sql.Tx) error {
+			if _, err := tx.Exec(`DELETE FROM `+t("etl_step_metadata")+` WHERE step_id = $1`, ids.steps[step.Name]); err != nil {
+				return err
+			}
+			for key, value := range resolveMetadata(step.Metadata, ids.steps) {
+				if _, err := tx.Exec(`INSERT INTO `+t("etl_step_metadata")+` (step_id, key, value) VALUES ($1, $2, $3)`,
+					ids.steps[step.Name], key, value); err != nil {
+					return fmt.Errorf("error writing metadata %q for step %q: %v", key, step.Name, err)
+				}
+			}
+			return nil
+		}
+
+		switch {
+		case !found:
+			p.add(phaseSteps, &DefinitionChange{Action: ChangeCreate, Kind: "step", Name: step.Name}, func(tx *sql.Tx) error {
+				var id int
+				err := tx.QueryRow(`
+					INSERT INTO `+t("etl_steps")+` (pipeline_id, name, description, query, layer, step_order)
+					VALUES ($1, $2, $3, $4, $5, $6)
+					RETURNING step_id`, ids.pipeline, step.Name, step.Description, step.Query, step.Layer, step.Order).Scan(&id)
+				if err != nil {
+					return fmt.Errorf("error creating step %q: %v", step.Name, err)
+				}
+				ids.steps[step.Name] = id
+				return nil
+			})
+			p.add(phaseLinks, nil, link)
+			p.add(phaseDetails, nil, writeMetadata)
+		case len(fields) > 0:
+			p.add(phaseSteps, &DefinitionChange{Action: ChangeUpdate, Kind: "step", Name: step.Name, Fields: fields}, func(tx *sql.Tx) error {
+				_, err := tx.Exec(`
+					UPDATE `+t("etl_steps")+`
+					SET description = $1, layer = $2, step_order = $3, updated_at = CURRENT_TIMESTAMP
+					WHERE step_id = $4`, step.Description, step.Layer, step.Order, ids.steps[step.Name])
+				if err != nil {
+					return fmt.Errorf("error updating step %q: %v", step.Name, err)
+				}
+				return nil
+			})
+			p.add(phaseLinks, nil, link)
+			if metadataChanged {
+				p.add(phaseDetails, nil, writeMetadata)
+			}
+			changed := &Step{Layer: step.Layer, Query: step.Query, Metadata: step.Metadata}
+			if changed.OutputChanged(&Step{Layer: existing.Layer, Query: existing.Query, Metadata: existing.Metadata}) {
+				p.outdate(existing, ids.steps[step.Name])
+			}
+		}
+
+		p.diffChecks(step, existing)
+	}
+
+	p.diffDataSources(current, def)
+}
+
+func (p *importPlan) diffChecks(step *StepDefinition, existing *StepDefinition) {
+	t := p.schema + ".etl_step_checks"
+	ids := p.ids
+
+	currentChecks := make(map[string]*CheckDefinition)
+	for _, check := range existing.Checks {
+		currentChecks[check.Name] = check
+	}
+	wanted := make(map[string]bool)
+	for _, check := range step.Checks {
+		wanted[check.Name] = true
+	}
+	for _, check := range existing.Checks {
+		if wanted[check.Name] {
+			continue
+		}
+		id := ids.checks[step.Name][check.Name]
+		p.add(phaseRemove, &DefinitionChange{Action: ChangeDelete, Kind: "check", Name: step.Name + ": " + check.Name}, func(tx *sql.Tx) error {
+			_, err := tx.Exec(`DELETE FROM `+t+` WHERE check_id = $1`, id)
+			return err
+		})
+	}
+
+	for _, check := range step.Checks {
+		check := check
+		name := step.Name + ": " + check.Name
+		old, found := currentChecks[check.Name]
+		if !found {
+			p.add(phaseDetails, &DefinitionChange{Action: ChangeCreate, Kind: "check", Name: name}, func(tx *sql.Tx) error {
+				_, err := tx.Exec(`
+					INSERT INTO `+t+` (step_id, name, check_type, column_name, accepted_values, min_value, max_value, sql, severity)
+					VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9)`,
+					ids.steps[step.Name], check.Name, check.Type, nullString(check.Column), pq.Array(check.Values),
+					nullFloat(check.Min), nullFloat(check.Max), nullString(check.SQL), check.Severity)
+				if err != nil {
+					return fmt.Errorf("error creating check %q: %v", name, err)
+				}
+				return nil
+			})
+			continue
+		}
+
+		var fields []string
+		fields = compare(fields, "type", string(old.Type), string(check.Type))
+		fields = compare(fields, "column", old.Column, check.Column)
+		fields = compare(fields, "values", fmt.Sprint(old.Values), fmt.Sprint(check.Values))
+		fields = compare(fields, "min", old.Min, check.Min)
+		fields = compare(fields, "max", old.Max, check.Max)
+		fields = compare(fields, "sql", old.SQL, check.SQL)
+		fields = compare(fields, "severity", string(old.Severity), string(check.Severity))
+		if len(fields) == 0 {
+			continue
+		}
+		id := ids.checks[step.Name][check.Name]
+		p.add(phaseDetails, &DefinitionChange{Action: ChangeUpdate, Kind: "check", Name: name, Fields: fields}, func(tx *sql.Tx) error {
+			_, err := tx.Exec(`
+				UPDATE `+t+`
+				SET check_type = $1, column_name = $2, accepted_values = $3, min_value = $4, max_value = $5,
+					sql = $6, severity = $7, updated_at = CURRENT_TIMESTAMP
+				WHERE check_id = $8`,
+				check.Type, nullString(check.Column), pq.Array(check.Values), nullFloat(check.Min),
+				nullFloat(check.Max), nullString(check.SQL), check.Severity, id)
+			if err != nil {
+				return fmt.Errorf("error updating check %q: %v", name, err)
+			}
+			return nil
+		})
+	}
+}
+
+func (p *importPlan) diffDataSources(current *Definition, def *Definition) {
+	t := func(table string) string { return p.schema + "." + table }
+	ids := p.ids
+
+	currentSources := make(map[string]*DataSourceDefinition)
+	for _, source := range current.DataSources {
+		currentSources[source.Name] = source
+	}
+	wanted := make(map[string]bool)
+	for _, source := range def.DataSources {
+		wanted[source.Name] = true
+	}
+	for _, source := range current.DataSources {
+		if wanted[source.Name] {
+			continue
+		}
+		id := ids.dataSources[source.Name]
+		p.add(phaseRemove, &DefinitionChange{Action: ChangeDelete, Kind: "data_source", Name: source.Name}, func(tx *sql.Tx) error {
+			if _, err := tx.Exec(`DELETE FROM `+t("data_sources_conditions")+` WHERE data_source_id = $1`, id); err != nil {
+				return err
+			}
+			_, err := tx.Exec(`DELETE FROM `+t("data_sources")+` WHERE data_source_id = $1`, id)
+			return err
+		})
+	}
+
+	for _, source := range def.DataSources {
+		source := source
+		schemaJSON := func() interface{} {
+			if source.Schema == nil {
+				return nil
+			}
+			data, _ := json.Marshal(source.Schema)
+			return string(data)
+		}
+		feeds := func() interface{} {
+			if source.FeedsStep == "" {
+				return nil
+			}
+			return ids.steps[source.FeedsStep]
+		}
+
+		existing, found := currentSources[source.Name]
+		if !found {
+			existing = &DataSourceDefinition{}
+			p.add(phaseDataSources, &DefinitionChange{Action: ChangeCreate, Kind: "data_source", Name: source.Name}, func(tx *sql.Tx) error {
+				var id int
+				err := tx.QueryRow(`
+					INSERT INTO `+t("data_sources")+` (pipeline_id, step_child_id, name, description, layer, schema)
+					VALUES ($1, $2, $3, $4, $5, $6)
+					RETURNING data_source_id`,
+					ids.pipeline, feeds(), source.Name, source.Description, source.Layer, schemaJSON()).Scan(&id)
+				if err != nil {
+					return fmt.Errorf("error creating data source %q: %v", source.Name, err)
+				}
+				ids.dataSources[source.Name] = id
+				return nil
+			})
+		} else {
+			var fields []string
+			fields = compare(fields, "description", existing.Description, source.Description)
+			fields = compare(fields, "layer", existing.Layer, source.Layer)
+			fields = compare(fields, "feeds_step", existing.FeedsStep, source.FeedsStep)
+			fields = compare(fields, "schema", existing.Schema, source.Schema)
+			if len(fields) > 0 {
+				change := &DefinitionChange{Action: ChangeUpdate, Kind: "data_source", Name: source.Name, Fields: fields}
+				p.add(phaseDataSources, change, func(tx *sql.Tx) error {
+					_, err := tx.Exec(`
+						UPDATE `+t("data_sources")+`
+						SET step_child_id = $1, description = $2, layer = $3, schema = $4, updated_at = CURRENT_TIMESTAMP
+						WHERE data_source_id = $5`,
+						feeds(), source.Description, source.Layer, schemaJSON(), ids.dataSources[source.Name])
+					if err != nil {
+						return fmt.Errorf("error updating data source %q: %v", source.Name, err)
+					}
+					return nil
+				})
+			}
+		}
+
+		// Conditions have no name, so they are matched by position
+		for i := 0; i < len(source.Conditions) || i < len(existing.Conditions); i++ {
+			name := fmt.Sprintf("%s #%d", source.Name, i+1)
+			switch {
+			case i >= len(source.Conditions):
+				id := ids.conditions[source.Name][i]
+				p.add(phaseRemove, &DefinitionChange{Action: ChangeDelete, Kind: "condition", Name: name}, func(tx *sql.Tx) error {
+					_, err := tx.Exec(`DELETE FROM `+t("data_sources_conditions")+` WHERE data_source_condition_id = $1`, id)
+					return err
+				})
+			case i >= len(existing.Conditions):
+				condition := source.Conditions[i]
+				p.add(phaseConditions, &DefinitionChange{Action: ChangeCreate, Kind: "condition", Name: name}, func(tx *sql.Tx) error {
+					_, err := tx.Exec(`
+						INSERT INTO `+t("data_sources_conditions")+` (data_source_id, refresh_interval, append_only)
+						VALUES ($1, $2, $3)`, ids.dataSources[source.Name], condition.RefreshInterval, condition.AppendOnly)
+					return err
+				})
+			default:
+				condition, old := source.Conditions[i], existing.Conditions[i]
+				var fields []string
+				fields = compare(fields, "refresh_interval", old.RefreshInterval, condition.RefreshInterval)
+				fields = compare(fields, "append_only", old.AppendOnly, condition.AppendOnly)
+				if len(fields) == 0 {
+					continue
+				}
+				id := ids.conditions[source.Name][i]
+				p.add(phaseConditions, &DefinitionChange{Action: ChangeUpdate, Kind: "condition", Name: name, Fields: fields}, func(tx *sql.Tx) error {
+					_, err := tx.Exec(`
+						UPDATE `+t("data_sources_conditions")+`
+						SET refresh_interval = $1, append_only = $2, updated_at = CURRENT_TIMESTAMP
+						WHERE data_source_condition_id = $3`, condition.RefreshInterval, condition.AppendOnly, id)
+					return err
+				})
+			}
+		}
+	}
+}
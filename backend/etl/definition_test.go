@@ -0,0 +1,264 @@
+package etl
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestPortableQuery(t *testing.T) {
+	names := map[int]string{3: "clean", 12: "daily totals"}
+	tests := []struct {
+		query string
+		want  string
+	}{
+		{query: "SELECT * FROM step_3", want: "SELECT * FROM {{step:clean}}"},
+		{query: "SELECT * FROM etl_staging.step_12 JOIN step_3 USING (id)", want: "SELECT * FROM etl_staging.{{step:daily totals}} JOIN {{step:clean}} USING (id)"},
+		{query: "SELECT * FROM step_4", want: "SELECT * FROM step_4"},
+		{query: "SELECT step_30, my_step_3 FROM raw", want: "SELECT step_30, my_step_3 FROM raw"},
+	}
+	ids := map[string]int{"clean": 3, "daily totals": 12}
+	for _, test := range tests {
+		got := portableQuery(test.query, names)
+		if got != test.want {
+			t.Errorf("portableQuery(%q) = %q, want %q", test.query, got, test.want)
+		}
+		if back := resolveQuery(got, ids); back != test.query {
+			t.Errorf("resolveQuery(%q) = %q, want %q back", got, back, test.query)
+		}
+	}
+}
+
+func TestPortableMetadata(t *testing.T) {
+	names := map[int]string{7: "readings"}
+	metadata := map[string]string{"type": StepTypeDedupe, MetaInput: "step_7", "keys": "step_7_id"}
+
+	portable := portableMetadata(metadata, names)
+	if portable[MetaInput] != "{{step:readings}}" {
+		t.Errorf("got input %q, want {{step:readings}}", portable[MetaInput])
+	}
+	if portable["keys"] != "step_7_id" || portable["type"] != StepTypeDedupe {
+		t.Errorf("other metadata changed: %v", portable)
+	}
+	if metadata[MetaInput] != "step_7" {
+		t.Errorf("the step's own metadata changed to %q", metadata[MetaInput])
+	}
+
+	resolved := resolveMetadata(portable, map[string]int{"readings": 41})
+	if resolved[MetaInput] != "step_41" {
+		t.Errorf("got resolved input %q, want step_41", resolved[MetaInput])
+	}
+
+	plain := map[string]string{"type": StepTypeSQL}
+	if got := portableMetadata(plain, names); len(got) != 1 || got["type"] != StepTypeSQL {
+		t.Errorf("metadata without an input changed to %v", got)
+	}
+}
+
+func TestDefinitionValidate(t *testing.T) {
+	tests := []struct {
+		name     string
+		yaml     string
+		problems []string
+	}{
+		{
+			name: "steps refer to each other by name",
+			yaml: `
+version: 1
+name: readings
+steps:
+  - name: raw
+    layer: raw
+    query: SELECT * FROM sensor_data
+  - name: clean
+    layer: staging
+    reads_from: raw
+    query: SELECT * FROM {{step:raw}} WHERE value IS NOT NULL
+  - name: unique
+    layer: staging
+    metadata:
+      type: dedupe
+      input: "{{step:clean}}"
+`,
+		},
+		{
+			name: "unknown steps",
+			yaml: `
+version: 1
+name: readings
+steps:
+  - name: clean
+    layer: staging
+    reads_from: raw
+    query: SELECT * FROM {{step:raw}}
+  - name: unique
+    layer: staging
+    metadata:
+      type: dedupe
+      input: "{{step:gone}}"
+`,
+			problems: []string{
+				`step "clean" reads from unknown step "raw"`,
+				`step "clean" queries unknown step "raw"`,
+				`step "unique" has input of unknown step "gone"`,
+			},
+		},
+		{
+			name: "version, names and layers",
+			yaml: `
+name: ""
+steps:
+  - name: a
+    layer: bronze
+  - name: a
+    layer: raw
+`,
+			problems: []string{
+				"definition has no version",
+				"pipeline has no name",
+				`step name "a" is used more than once`,
+				`unknown layer "bronze"`,
+			},
+		},
+		{
+			name: "a step cannot read from a later layer",
+			yaml: `
+version: 1
+name: layers
+steps:
+  - name: final
+    layer: final
+  - name: raw
+    layer: raw
+    reads_from: final
+`,
+			problems: []string{"cannot read from step 1 in the later final layer"},
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			def, err := ParseDefinition([]byte(test.yaml))
+			if err != nil {
+				t.Fatalf("ParseDefinition: %v", err)
+			}
+			err = def.Validate()
+			if len(test.problems) == 0 {
+				if err != nil {
+					t.Fatalf("Validate: %v", err)
+				}
+				return
+			}
+			if err == nil {
+				t.Fatalf("expected problems %v", test.problems)
+			}
+			for _, problem := range test.problems {
+				if !strings.Contains(err.Error(), problem) {
+					t.Errorf("got %v, want a problem containing %q", err, problem)
+				}
+			}
+		})
+	}
+}
+
+func TestDefinitionValidateDefaults(t *testing.T) {
+	def, err := ParseDefinition([]byte(`
+version: 1
+name: defaults
+steps:
+  - name: raw
+    layer: raw
+    query: SELECT 1
+    checks:
+      - type: not_null
+        column: id
+data_sources:
+  - name: sensors
+`))
+	if err != nil {
+		t.Fatalf("ParseDefinition: %v", err)
+	}
+	if err := def.Validate(); err != nil {
+		t.Fatalf("Validate: %v", err)
+	}
+	step := def.Steps[0]
+	if step.Order != 1 || step.Metadata["type"] != StepTypeSQL {
+		t.Errorf("got order %d and type %q, want 1 and sql", step.Order, step.Metadata["type"])
+	}
+	if check := step.Checks[0]; check.Name != "not_null id" || check.Severity != SeverityFail {
+		t.Errorf("got check %q with severity %q, want \"not_null id\" failing", check.Name, check.Severity)
+	}
+	if def.WorkspaceID != 1 || def.DataSources[0].Layer != LayerRaw {
+		t.Errorf("got workspace %d and data source layer %q, want 1 and raw", def.WorkspaceID, def.DataSources[0].Layer)
+	}
+}
+
+func TestDefinitionRoundTrip(t *testing.T) {
+	def := &Definition{
+		Version: DefinitionVersion,
+		Name:    "round trip",
+		Steps: []*StepDefinition{
+			{Name: "raw", Layer: LayerRaw, Order: 1, Query: "SELECT * FROM sensor_data", Metadata: map[string]string{"type": StepTypeSQL}},
+			{Name: "clean", Layer: LayerStaging, Order: 2, ReadsFrom: "raw", Query: "SELECT * FROM {{step:raw}}",
+				Metadata: map[string]string{"type": StepTypeSQL, MetaWatermarkColumn: "timestamp"}},
+		},
+	}
+	for _, format := range []string{"yaml", "json"} {
+		data, err := def.Marshal(format)
+		if err != nil {
+			t.Fatalf("Marshal(%s): %v", format, err)
+		}
+		parsed, err := ParseDefinition(data)
+		if err != nil {
+			t.Fatalf("ParseDefinition(%s): %v", format, err)
+		}
+		if len(parsed.Steps) != 2 || parsed.Steps[1].Query != def.Steps[1].Query ||
+			parsed.Steps[1].ReadsFrom != "raw" || parsed.Steps[1].Metadata[MetaWatermarkColumn] != "timestamp" {
+			t.Errorf("%s round trip changed the steps: %+v", format, parsed.Steps[1])
+		}
+	}
+	if _, err := def.Marshal("xml"); err == nil {
+		t.Error("expected an error for an unknown format")
+	}
+}
+
+func TestImportPlanDroppedOutputs(t *testing.T) {
+	current := &Definition{Name: "sales", Steps: []*StepDefinition{
+		{Name: "orders", Layer: LayerRaw, Query: "SELECT * FROM raw_orders"},
+		{Name: "clean", Layer: LayerStaging, Query: "SELECT id, amount FROM {{step:orders}}"},
+		{Name: "totals", Layer: LayerFinal, Query: "SELECT sum(amount) FROM {{step:clean}}", Metadata: map[string]string{MetaWatermarkColumn: "id"}},
+		{Name: "moved", Layer: LayerStaging, Query: "SELECT * FROM {{step:orders}}"},
+		{Name: "old", Layer: LayerFinal, Query: "SELECT 1"},
+	}}
+	def := &Definition{Name: "sales", Steps: []*StepDefinition{
+		{Name: "orders", Layer: LayerRaw, Query: "SELECT * FROM raw_orders", Description: "only described"},
+		{Name: "clean", Layer: LayerStaging, Query: "SELECT id, amount, placed_at FROM {{step:orders}}"},
+		{Name: "totals", Layer: LayerFinal, Query: "SELECT sum(amount) FROM {{step:clean}}"},
+		{Name: "moved", Layer: LayerTransformed, Query: "SELECT * FROM {{step:orders}}"},
+		{Name: "new", Layer: LayerFinal, Query: "SELECT 2"},
+	}}
+	ids := func() *definitionIDs {
+		return &definitionIDs{
+			pipeline:    1,
+			steps:       map[string]int{"orders": 1, "clean": 2, "totals": 3, "moved": 4, "old": 5},
+			checks:      make(map[string]map[string]int),
+			dataSources: make(map[string]int),
+			conditions:  make(map[string][]int),
+		}
+	}
+
+	plan := newImportPlan(ProdSchema, ids())
+	plan.diff(current, def, false)
+	var got []string
+	for _, step := range plan.stale {
+		got = append(got, step.QualifiedTableName())
+	}
+	want := []string{"etl_final.step_5", "etl_staging.step_2", "etl_final.step_3", "etl_staging.step_4"}
+	if strings.Join(got, ",") != strings.Join(want, ",") {
+		t.Errorf("got dropped outputs %v, want %v", got, want)
+	}
+
+	plan = newImportPlan(DevSchema, ids())
+	plan.diff(current, def, false)
+	if len(plan.stale) != 0 {
+		t.Errorf("importing into %s dropped %d outputs, want none as only prod runs", DevSchema, len(plan.stale))
+	}
+}
@@ -0,0 +1,266 @@
+package etl
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"foo/backend/connections"
+	"log"
+	"strings"
+	"sync"
+)
+
+/*
+Runs the steps of a pipeline against the workspace's Postgres connection, materialising
+each step's query into a table in the schema of its layer
+*/
+
+const workspaceConnName = "etl"
+
+var ErrPipelineRunning = errors.New("pipeline is already running")
+
+type Executor struct {
+	// ctx bounds the work the executor runs in the background, such as backfills
+	ctx        context.Context
+	connectors connections.WorkspaceConnectors
+	history    *History
+	mutex      sync.Mutex
+	running    map[int]bool
+}
+
+type RunOptions struct {
+	// TriggeredBy is recorded with the run, e.g. TriggerSchedule
+	TriggeredBy string
+
+	// AppendSteps are steps whose new rows are appended to their existing output
+	// instead of truncating and reloading it
+	AppendSteps map[int]bool
+}
+
+func NewExecutor(ctx context.Context, connectors connections.WorkspaceConnectors, history *History) *Executor {
+	return &Executor{
+		ctx:        ctx,
+		connectors: connectors,
+		history:    history,
+		running:    make(map[int]bool),
+	}
+}
+
+func (e *Executor) acquire(pipelineID int) bool {
+	e.mutex.Lock()
+	defer e.mutex.Unlock()
+	if e.running[pipelineID] {
+		return false
+	}
+	e.running[pipelineID] = true
+	return true
+}
+
+func (e *Executor) release(pipelineID int) {
+	e.mutex.Lock()
+	defer e.mutex.Unlock()
+	delete(e.running, pipelineID)
+}
+
+func (e *Executor) workspaceDB(workspaceID int) (*sql.DB, error) {
+	connector := e.connectors.GetConnector(workspaceID)
+	if connector == nil {
+		return nil, fmt.Errorf("no connector found for workspace ID %d", workspaceID)
+	}
+	conn, err := connector.GetPostgresConn(workspaceConnName)
+	if err != nil {
+		return nil, fmt.Errorf("error connecting to workspace %d: %v", workspaceID, err)
+	}
+	return conn.Conn, nil
+}
+
+func (e *Executor) History() *History {
+	return e.history
+}
+
+func (e *Executor) RunPipeline(ctx context.Context, p *Pipeline, opts RunOptions) (*Run, error) {
+	if !e.acquire(p.ID) {
+		return nil, ErrPipelineRunning
+	}
+	defer e.release(p.ID)
+
+	if opts.TriggeredBy == "" {
+		opts.TriggeredBy = TriggerManual
+	}
+	run, err := e.history.StartRun(p.ID, opts.TriggeredBy)
+	if err != nil {
+		log.Printf("Error recording run of pipeline %d: %v", p.ID, err)
+	}
+
+	log.Printf("Running pipeline %d (%s) with %d steps", p.ID, p.Name, len(p.Steps))
+	err = e.runSteps(ctx, p, run, opts)
+
+	if historyErr := e.history.FinishRun(run, err); historyErr != nil {
+		log.Printf("Error recording run of pipeline %d: %v", p.ID, historyErr)
+	}
+	if err != nil {
+		return run, err
+	}
+	log.Printf("Pipeline %d (%s) finished in %dms", p.ID, p.Name, run.DurationMs)
+	return run, nil
+}
+
+func (e *Executor) runSteps(ctx context.Context, p *Pipeline, run *Run, opts RunOptions) error {
+	db, err := e.workspaceDB(p.WorkspaceID)
+	if err != nil {
+		return err
+	}
+
+	var runErr error
+	for _, step := range p.Steps {
+		// Stream steps run continuously under the StreamManager
+		if stepType, ok := LookupStepType(step.Type()); ok && stepType.Continuous {
+			continue
+		}
+		stepRun, historyErr := e.history.StartStep(run, step)
+		if historyErr != nil {
+			log.Printf("Error recording step %d: %v", step.ID, historyErr)
+		}
+
+		status := StatusSuccess
+		var stepErr error
+		switch {
+		case runErr != nil:
+			status = StatusSkipped
+		case ctx.Err() != nil:
+			status = StatusSkipped
+			runErr = ctx.Err()
+		default:
+			var loaded Loaded
+			loaded, stepRun.Checks, stepErr = e.runStep(ctx, db, step, opts.AppendSteps[step.ID])
+			stepRun.RowsRead = loaded.Read
+			stepRun.RowsWritten = loaded.Written
+			if stepErr != nil {
+				// The transaction was rolled back, so nothing was written
+				stepRun.RowsWritten = 0
+				status = StatusFailed
+				runErr = fmt.Errorf("step %d (%s) failed: %w", step.ID, step.Name, stepErr)
+			} else {
+				log.Printf("Step %d (%s) read %d rows and wrote %d rows to %s", step.ID, step.Name, loaded.Read, loaded.Written, step.QualifiedTableName())
+			}
+		}
+
+		if historyErr := e.history.FinishStep(stepRun, status, stepErr); historyErr != nil {
+			log.Printf("Error recording step %d: %v", step.ID, historyErr)
+		}
+	}
+	return runErr
+}
+
+func (e *Executor) runStep(ctx context.Context, db *sql.DB, step *Step, appendOnly bool) (Loaded, []*CheckResult, error) {
+	stepType, ok := LookupStepType(step.Type())
+	if !ok || stepType.Load == nil {
+		return Loaded{}, nil, fmt.Errorf("step type %q cannot be run", step.Type())
+	}
+	if !step.Layer.Valid() {
+		return Loaded{}, nil, fmt.Errorf("unknown layer %q", step.Layer)
+	}
+
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return Loaded{}, nil, err
+	}
+	defer tx.Rollback()
+
+	if _, err := tx.ExecContext(ctx, fmt.Sprintf("CREATE SCHEMA IF NOT EXISTS %s", step.Layer.Schema())); err != nil {
+		return Loaded{}, nil, fmt.Errorf("error creating schema %s: %v", step.Layer.Schema(), err)
+	}
+	if _, err := tx.ExecContext(ctx, "SET LOCAL search_path TO "+searchPath()); err != nil {
+		return Loaded{}, nil, fmt.Errorf("error setting search_path: %v", err)
+	}
+
+	var exists bool
+	err = tx.QueryRowContext(ctx, `
+		SELECT EXISTS (
+			SELECT FROM information_schema.tables
+			WHERE table_schema = $1 AND table_name = $2
+		)`, step.Layer.Schema(), step.TableName()).Scan(&exists)
+	if err != nil {
+		return Loaded{}, nil, fmt.Errorf("error checking %s: %v", step.QualifiedTableName(), err)
+	}
+
+	// A step without its output table is loaded in full whatever its watermark says
+	load := Load{Table: step.QualifiedTableName(), Exists: exists, Append: appendOnly, Incremental: step.WatermarkColumn() != ""}
+	if load.Incremental {
+		if err := ensureWatermarkTable(ctx, tx); err != nil {
+			return Loaded{}, nil, err
+		}
+		if exists {
+			if load.Watermark, load.Found, err = readWatermark(ctx, tx, step); err != nil {
+				return Loaded{}, nil, err
+			}
+		}
+	}
+
+	loaded, err := stepType.Load(ctx, tx, step, load)
+	if err != nil {
+		return Loaded{}, nil, err
+	}
+
+	// Checks see the output as it will be committed; a failing one rolls it back
+	var checks []*CheckResult
+	if len(step.Checks) > 0 {
+		if checks, err = runChecks(ctx, tx, step, step.QualifiedTableName()); err != nil {
+			return loaded, checks, err
+		}
+	}
+
+	if load.Incremental {
+		watermark, err := advanceWatermark(ctx, tx, step)
+		if err != nil {
+			return Loaded{}, checks, err
+		}
+		if watermark != "" {
+			log.Printf("Step %d (%s) watermark on %s is now %s", step.ID, step.Name, step.WatermarkColumn(), watermark)
+		}
+	}
+
+	if err := tx.Commit(); err != nil {
+		return Loaded{}, checks, err
+	}
+	return loaded, checks, nil
+}
+
+// DropOutput removes the table a step writes to, and its watermark, so the next
+// run recreates it in full after its query or layer has changed.
+func (e *Executor) DropOutput(workspaceID int, step *Step) error {
+	db, err := e.workspaceDB(workspaceID)
+	if err != nil {
+		return err
+	}
+	if _, err := db.Exec(fmt.Sprintf("DROP TABLE IF EXISTS %s", step.QualifiedTableName())); err != nil {
+		return err
+	}
+	return e.ResetWatermark(workspaceID, step.ID)
+}
+
+// DropImportedOutputs drops the outputs an import left stale, listed in its
+// DroppedOutputs.
+func (e *Executor) DropImportedOutputs(result *ImportResult) error {
+	if result.DryRun {
+		return nil
+	}
+	for _, step := range result.stale {
+		if err := e.DropOutput(result.workspaceID, step); err != nil {
+			return fmt.Errorf("error dropping output of step %q: %v", step.Name, err)
+		}
+	}
+	return nil
+}
+
+// searchPath lets step queries refer to earlier step tables without a schema,
+// latest layer first.
+func searchPath() string {
+	schemas := make([]string, 0, len(Layers)+1)
+	for i := len(Layers) - 1; i >= 0; i-- {
+		schemas = append(schemas, Layers[i].Schema())
+	}
+	schemas = append(schemas, "public")
+	return strings.Join(schemas, ", ")
+}
@@ -0,0 +1,389 @@
+package etl
+
+import (
+	"database/sql"
+	"fmt"
+	"strings"
+	"time"
+)
+
+/*
+Records every pipeline run and the steps within it in prod.etl_runs and prod.etl_step_runs
+*/
+
+type RunStatus string
+
+const (
+	StatusRunning RunStatus = "running"
+	StatusSuccess RunStatus = "success"
+	StatusFailed  RunStatus = "failed"
+	StatusSkipped RunStatus = "skipped"
+)
+
+const (
+	TriggerStartup  = "startup"
+	TriggerSchedule = "schedule"
+	TriggerManual   = "manual"
+	TriggerBackfill = "backfill"
+)
+
+type Run struct {
+	ID          int        `json:"run_id"`
+	PipelineID  int        `json:"pipeline_id"`
+	TriggeredBy string     `json:"triggered_by"`
+	Status      RunStatus  `json:"status"`
+	StartedAt   time.Time  `json:"started_at"`
+	FinishedAt  *time.Time `json:"finished_at,omitempty"`
+	DurationMs  int64      `json:"duration_ms"`
+	RowsRead    int64      `json:"rows_read"`
+	RowsWritten int64      `json:"rows_written"`
+	Error       string     `json:"error,omitempty"`
+	// WindowStart and WindowEnd bound the rows a backfill run reprocessed
+	WindowStart *time.Time `json:"window_start,omitempty"`
+	WindowEnd   *time.Time `json:"window_end,omitempty"`
+	// ParentRunID is the backfill a chunk's run belongs to, whose Runs are its chunks
+	ParentRunID *int       `json:"parent_run_id,omitempty"`
+	Steps       []*StepRun `json:"steps,omitempty"`
+	Runs        []*Run     `json:"runs,omitempty"`
+}
+
+type StepRun struct {
+	ID          int            `json:"step_run_id"`
+	RunID       int            `json:"run_id"`
+	StepID      int            `json:"step_id"`
+	StepName    string         `json:"step_name"`
+	Layer       Layer          `json:"layer"`
+	TargetTable string         `json:"target_table"`
+	Status      RunStatus      `json:"status"`
+	StartedAt   time.Time      `json:"started_at"`
+	FinishedAt  *time.Time     `json:"finished_at,omitempty"`
+	DurationMs  int64          `json:"duration_ms"`
+	RowsRead    int64          `json:"rows_read"`
+	RowsWritten int64          `json:"rows_written"`
+	Error       string         `json:"error,omitempty"`
+	Checks      []*CheckResult `json:"checks,omitempty"`
+}
+
+type RunFilter struct {
+	PipelineID  int
+	ParentRunID int
+	Status      RunStatus
+	// Table limits the runs to those that wrote the given step table
+	Table string
+	Limit int
+}
+
+type History struct {
+	db *sql.DB
+}
+
+func NewHistory(db *sql.DB) *History {
+	return &History{db: db}
+}
+
+func (h *History) StartRun(pipelineID int, triggeredBy string) (*Run, error) {
+	return h.startRun(&Run{PipelineID: pipelineID, TriggeredBy: triggeredBy})
+}
+
+// StartBackfillRun records a run that reprocesses the [from, to) window, as
+// part of parent unless it is the backfill's own run.
+func (h *History) StartBackfillRun(pipelineID int, parent *Run, from time.Time, to time.Time) (*Run, error) {
+	run := &Run{PipelineID: pipelineID, TriggeredBy: TriggerBackfill, WindowStart: &from, WindowEnd: &to}
+	if parent != nil && parent.ID != 0 {
+		run.ParentRunID = &parent.ID
+	}
+	return h.startRun(run)
+}
+
+func (h *History) startRun(run *Run) (*Run, error) {
+	run.Status = StatusRunning
+	run.StartedAt = time.Now()
+	if h == nil {
+		return run, nil
+	}
+	err := h.db.QueryRow(`
+		INSERT INTO prod.etl_runs (pipeline_id, triggered_by, status, started_at, window_start, window_end, parent_run_id)
+		VALUES ($1, $2, $3, $4, $5, $6, $7)
+		RETURNING run_id`, run.PipelineID, run.TriggeredBy, run.Status, run.StartedAt,
+		nullTime(run.WindowStart), nullTime(run.WindowEnd), nullInt(run.ParentRunID)).Scan(&run.ID)
+	if err != nil {
+		return run, fmt.Errorf("error recording run: %v", err)
+	}
+	return run, nil
+}
+
+func (h *History) FinishRun(run *Run, runErr error) error {
+	finishedAt := time.Now()
+	run.FinishedAt = &finishedAt
+	run.DurationMs = finishedAt.Sub(run.StartedAt).Milliseconds()
+	run.Status = StatusSuccess
+	if runErr != nil {
+		run.Status = StatusFailed
+		run.Error = runErr.Error()
+	}
+	for _, step := range run.Steps {
+		run.RowsRead += step.RowsRead
+		run.RowsWritten += step.RowsWritten
+	}
+
+	if h == nil || run.ID == 0 {
+		return nil
+	}
+	_, err := h.db.Exec(`
+		UPDATE prod.etl_runs
+		SET status = $1, finished_at = $2, duration_ms = $3, rows_read = $4, rows_written = $5, error = $6
+		WHERE run_id = $7`,
+		run.Status, finishedAt, run.DurationMs, run.RowsRead, run.RowsWritten, nullString(run.Error), run.ID)
+	if err != nil {
+		return fmt.Errorf("error updating run %d: %v", run.ID, err)
+	}
+	return nil
+}
+
+func (h *History) StartStep(run *Run, step *Step) (*StepRun, error) {
+	stepRun := &StepRun{
+		RunID:       run.ID,
+		StepID:      step.ID,
+		StepName:    step.Name,
+		Layer:       step.Layer,
+		TargetTable: step.QualifiedTableName(),
+		Status:      StatusRunning,
+		StartedAt:   time.Now(),
+	}
+	run.Steps = append(run.Steps, stepRun)
+
+	if h == nil || run.ID == 0 {
+		return stepRun, nil
+	}
+	err := h.db.QueryRow(`
+		INSERT INTO prod.etl_step_runs (run_id, step_id, step_name, layer, target_table, status, started_at)
+		VALUES ($1, $2, $3, $4, $5, $6, $7)
+		RETURNING step_run_id`,
+		stepRun.RunID, stepRun.StepID, stepRun.StepName, stepRun.Layer, stepRun.TargetTable,
+		stepRun.Status, stepRun.StartedAt).Scan(&stepRun.ID)
+	if err != nil {
+		return stepRun, fmt.Errorf("error recording step run: %v", err)
+	}
+	return stepRun, nil
+}
+
+func (h *History) FinishStep(stepRun *StepRun, status RunStatus, stepErr error) error {
+	finishedAt := time.Now()
+	stepRun.FinishedAt = &finishedAt
+	stepRun.DurationMs = finishedAt.Sub(stepRun.StartedAt).Milliseconds()
+	stepRun.Status = status
+	if stepErr != nil {
+		stepRun.Error = stepErr.Error()
+	}
+
+	if h == nil || stepRun.ID == 0 {
+		return nil
+	}
+	_, err := h.db.Exec(`
+		UPDATE prod.etl_step_runs
+		SET status = $1, finished_at = $2, duration_ms = $3, rows_read = $4, rows_written = $5, error = $6
+		WHERE step_run_id = $7`,
+		stepRun.Status, finishedAt, stepRun.DurationMs, stepRun.RowsRead, stepRun.RowsWritten,
+		nullString(stepRun.Error), stepRun.ID)
+	if err != nil {
+		return fmt.Errorf("error updating step run %d: %v", stepRun.ID, err)
+	}
+
+	for _, result := range stepRun.Checks {
+		err := h.db.QueryRow(`
+			INSERT INTO prod.etl_check_results (run_id, step_run_id, check_id, step_id, name, check_type, severity,
+				status, failing_rows, message, checked_at)
+			VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11)
+			RETURNING check_result_id`,
+			stepRun.RunID, stepRun.ID, nullInt(&result.CheckID), result.StepID, result.Name, result.Type, result.Severity,
+			result.Status, result.FailingRows, nullString(result.Message), result.CheckedAt).Scan(&result.ID)
+		if err != nil {
+			return fmt.Errorf("error recording check %q of step run %d: %v", result.Name, stepRun.ID, err)
+		}
+	}
+	return nil
+}
+
+func (h *History) ListRuns(filter RunFilter) ([]*Run, error) {
+	var conditions []string
+	var args []interface{}
+	if filter.PipelineID != 0 {
+		args = append(args, filter.PipelineID)
+		conditions = append(conditions, fmt.Sprintf("r.pipeline_id = $%d", len(args)))
+	}
+	if filter.ParentRunID != 0 {
+		args = append(args, filter.ParentRunID)
+		conditions = append(conditions, fmt.Sprintf("r.parent_run_id = $%d", len(args)))
+	}
+	if filter.Status != "" {
+		args = append(args, filter.Status)
+		conditions = append(conditions, fmt.Sprintf("r.status = $%d", len(args)))
+	}
+	if filter.Table != "" {
+		args = append(args, filter.Table)
+		conditions = append(conditions, fmt.Sprintf(
+			"EXISTS (SELECT 1 FROM prod.etl_step_runs s WHERE s.run_id = r.run_id AND s.status = 'success' AND s.target_table = $%d)",
+			len(args)))
+	}
+
+	where := ""
+	if len(conditions) > 0 {
+		where = "WHERE " + strings.Join(conditions, " AND ")
+	}
+	limit := filter.Limit
+	if limit <= 0 {
+		limit = 100
+	}
+	args = append(args, limit)
+
+	rows, err := h.db.Query(`
+		SELECT r.run_id, r.pipeline_id, r.triggered_by, r.status, r.started_at, r.finished_at,
+			r.duration_ms, r.rows_read, r.rows_written, COALESCE(r.error, ''), r.window_start, r.window_end,
+			r.parent_run_id
+		FROM prod.etl_runs r `+where+`
+		ORDER BY r.started_at DESC
+		LIMIT $`+fmt.Sprint(len(args)), args...)
+	if err != nil {
+		return nil, fmt.Errorf("error listing runs: %v", err)
+	}
+	defer rows.Close()
+
+	runs := []*Run{}
+	for rows.Next() {
+		run, err := scanRun(rows)
+		if err != nil {
+			return nil, err
+		}
+		runs = append(runs, run)
+	}
+	return runs, rows.Err()
+}
+
+func (h *History) GetRun(runID int) (*Run, error) {
+	row := h.db.QueryRow(`
+		SELECT run_id, pipeline_id, triggered_by, status, started_at, finished_at,
+			duration_ms, rows_read, rows_written, COALESCE(error, ''), window_start, window_end, parent_run_id
+		FROM prod.etl_runs
+		WHERE run_id = $1`, runID)
+	run, err := scanRun(row)
+	if err != nil {
+		return nil, err
+	}
+	if run.Runs, err = h.ListRuns(RunFilter{ParentRunID: runID, Limit: maxBackfillChunks + 1}); err != nil {
+		return nil, err
+	}
+	if len(run.Runs) == 0 {
+		run.Runs = nil
+	}
+
+	rows, err := h.db.Query(`
+		SELECT step_run_id, run_id, COALESCE(step_id, 0), step_name, layer, COALESCE(target_table, ''), status,
+			started_at, finished_at, duration_ms, rows_read, rows_written, COALESCE(error, '')
+		FROM prod.etl_step_runs
+		WHERE run_id = $1
+		ORDER BY step_run_id`, runID)
+	if err != nil {
+		return nil, fmt.Errorf("error loading step runs: %v", err)
+	}
+	defer rows.Close()
+
+	run.Steps = []*StepRun{}
+	for rows.Next() {
+		stepRun := &StepRun{}
+		var layer, status string
+		var finishedAt sql.NullTime
+		if err := rows.Scan(&stepRun.ID, &stepRun.RunID, &stepRun.StepID, &stepRun.StepName, &layer,
+			&stepRun.TargetTable, &status, &stepRun.StartedAt, &finishedAt, &stepRun.DurationMs,
+			&stepRun.RowsRead, &stepRun.RowsWritten, &stepRun.Error); err != nil {
+			return nil, fmt.Errorf("error scanning step run: %v", err)
+		}
+		stepRun.Layer = Layer(layer)
+		stepRun.Status = RunStatus(status)
+		if finishedAt.Valid {
+			stepRun.FinishedAt = &finishedAt.Time
+		}
+		run.Steps = append(run.Steps, stepRun)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	results, err := h.checkResults(runID)
+	if err != nil {
+		return nil, err
+	}
+	for _, stepRun := range run.Steps {
+		stepRun.Checks = results[stepRun.ID]
+	}
+	return run, nil
+}
+
+func (h *History) checkResults(runID int) (map[int][]*CheckResult, error) {
+	rows, err := h.db.Query(`
+		SELECT check_result_id, step_run_id, COALESCE(check_id, 0), COALESCE(step_id, 0), name, check_type,
+			severity, status, failing_rows, COALESCE(message, ''), checked_at
+		FROM prod.etl_check_results
+		WHERE run_id = $1
+		ORDER BY check_result_id`, runID)
+	if err != nil {
+		return nil, fmt.Errorf("error loading check results: %v", err)
+	}
+	defer rows.Close()
+
+	results := make(map[int][]*CheckResult)
+	for rows.Next() {
+		result := &CheckResult{}
+		var stepRunID int
+		var checkType, severity string
+		if err := rows.Scan(&result.ID, &stepRunID, &result.CheckID, &result.StepID, &result.Name, &checkType,
+			&severity, &result.Status, &result.FailingRows, &result.Message, &result.CheckedAt); err != nil {
+			return nil, fmt.Errorf("error scanning check result: %v", err)
+		}
+		result.Type = CheckType(checkType)
+		result.Severity = Severity(severity)
+		results[stepRunID] = append(results[stepRunID], result)
+	}
+	return results, rows.Err()
+}
+
+type rowScanner interface {
+	Scan(dest ...interface{}) error
+}
+
+func scanRun(row rowScanner) (*Run, error) {
+	run := &Run{}
+	var status string
+	var finishedAt, windowStart, windowEnd sql.NullTime
+	var parentRunID sql.NullInt64
+	if err := row.Scan(&run.ID, &run.PipelineID, &run.TriggeredBy, &status, &run.StartedAt, &finishedAt,
+		&run.DurationMs, &run.RowsRead, &run.RowsWritten, &run.Error, &windowStart, &windowEnd, &parentRunID); err != nil {
+		return nil, err
+	}
+	if parentRunID.Valid {
+		id := int(parentRunID.Int64)
+		run.ParentRunID = &id
+	}
+	run.Status = RunStatus(status)
+	if finishedAt.Valid {
+		run.FinishedAt = &finishedAt.Time
+	}
+	if windowStart.Valid && windowEnd.Valid {
+		run.WindowStart = &windowStart.Time
+		run.WindowEnd = &windowEnd.Time
+	}
+	return run, nil
+}
+
+func nullString(s string) interface{} {
+	if s == "" {
+		return nil
+	}
+	return s
+}
+
+func nullTime(t *time.Time) interface{} {
+	if t == nil {
+		return nil
+	}
+	return *t
+}
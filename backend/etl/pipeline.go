@@ -0,0 +1,363 @@
+package etl
+
+import (
+	"database/sql"
+	"fmt"
+	"log"
+	"sort"
+	"strings"
+
+	"github.com/lib/pq"
+)
+
+/*
+Pipelines and steps as stored in prod.etl_pipeline, prod.etl_steps and prod.etl_step_metadata
+*/
+
+type Layer string
+
+const (
+	LayerRaw         Layer = "raw"
+	LayerStaging     Layer = "staging"
+	LayerTransformed Layer = "transformed"
+	LayerFinal       Layer = "final"
+)
+
+var layerRanks = map[Layer]int{
+	LayerRaw:         0,
+	LayerStaging:     1,
+	LayerTransformed: 2,
+	LayerFinal:       3,
+}
+
+// Layers lists every etl_layers value in the order data moves through them.
+var Layers = []Layer{LayerRaw, LayerStaging, LayerTransformed, LayerFinal}
+
+func (l Layer) Valid() bool {
+	_, ok := layerRanks[l]
+	return ok
+}
+
+func (l Layer) Rank() int {
+	rank, ok := layerRanks[l]
+	if !ok {
+		return -1
+	}
+	return rank
+}
+
+// Schema is the Postgres schema that step outputs for this layer are written to.
+func (l Layer) Schema() string {
+	return "etl_" + string(l)
+}
+
+type Pipeline struct {
+	ID          int     `json:"pipeline_id"`
+	Name        string  `json:"name"`
+	Description string  `json:"description"`
+	WorkspaceID int     `json:"workspace_id"`
+	Steps       []*Step `json:"steps"`
+}
+
+type Step struct {
+	ID          int               `json:"step_id"`
+	PipelineID  int               `json:"pipeline_id"`
+	Name        string            `json:"name"`
+	Description string            `json:"description"`
+	Query       string            `json:"query"`
+	Layer       Layer             `json:"layer"`
+	Order       int               `json:"step_order"`
+	ChildStepID *int              `json:"child_step_id,omitempty"`
+	Metadata    map[string]string `json:"metadata"`
+	Checks      []*Check          `json:"checks,omitempty"`
+}
+
+const (
+	StepTypeSQL    = "sql"
+	StepTypeStream = "stream"
+)
+
+// Type is the "type" metadata of the step, which defaults to sql.
+func (s *Step) Type() string {
+	if stepType := strings.TrimSpace(s.Metadata["type"]); stepType != "" {
+		return stepType
+	}
+	return StepTypeSQL
+}
+
+// TableName is where the output of the step is materialised. Later steps refer
+// to it unqualified (e.g. "SELECT * FROM step_1").
+func (s *Step) TableName() string {
+	return fmt.Sprintf("step_%d", s.ID)
+}
+
+func (s *Step) QualifiedTableName() string {
+	return fmt.Sprintf("%s.%s", s.Layer.Schema(), s.TableName())
+}
+
+func (p *Pipeline) GetStep(stepID int) *Step {
+	for _, step := range p.Steps {
+		if step.ID == stepID {
+			return step
+		}
+	}
+	return nil
+}
+
+// LoadPipelines reads every pipeline, skipping those whose steps cannot be
+// ordered so one bad pipeline doesn't stop the rest from loading.
+func LoadPipelines(db *sql.DB) ([]*Pipeline, error) {
+	rows, err := db.Query(`
+		SELECT pipeline_id, name, COALESCE(description, ''), COALESCE(workspace_id, 1)
+		FROM prod.etl_pipeline
+		ORDER BY pipeline_id`)
+	if err != nil {
+		return nil, fmt.Errorf("error loading pipelines: %v", err)
+	}
+	defer rows.Close()
+
+	var pipelines []*Pipeline
+	byID := make(map[int]*Pipeline)
+	for rows.Next() {
+		p := &Pipeline{}
+		if err := rows.Scan(&p.ID, &p.Name, &p.Description, &p.WorkspaceID); err != nil {
+			return nil, fmt.Errorf("error scanning pipeline: %v", err)
+		}
+		pipelines = append(pipelines, p)
+		byID[p.ID] = p
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	steps, err := loadSteps(db, ProdSchema, "")
+	if err != nil {
+		return nil, err
+	}
+	for _, step := range steps {
+		if p, ok := byID[step.PipelineID]; ok {
+			p.Steps = append(p.Steps, step)
+		}
+	}
+
+	loaded := pipelines[:0]
+	for _, p := range pipelines {
+		ordered, err := OrderSteps(p.Steps)
+		if err != nil {
+			log.Printf("Skipping pipeline %d (%s): %v", p.ID, p.Name, err)
+			continue
+		}
+		p.Steps = ordered
+		loaded = append(loaded, p)
+	}
+	return loaded, nil
+}
+
+func LoadPipeline(db *sql.DB, pipelineID int) (*Pipeline, error) {
+	return loadPipeline(db, ProdSchema, pipelineID)
+}
+
+// loadPipeline reads a pipeline from the definition tables of schema, which
+// only the prod schema's are run from.
+func loadPipeline(db *sql.DB, schema string, pipelineID int) (*Pipeline, error) {
+	p := &Pipeline{}
+	err := db.QueryRow(`
+		SELECT pipeline_id, name, COALESCE(description, ''), COALESCE(workspace_id, 1)
+		FROM `+schema+`.etl_pipeline
+		WHERE pipeline_id = $1`, pipelineID).Scan(&p.ID, &p.Name, &p.Description, &p.WorkspaceID)
+	if err != nil {
+		return nil, err
+	}
+
+	steps, err := loadSteps(db, schema, "WHERE s.pipeline_id = $1", pipelineID)
+	if err != nil {
+		return nil, err
+	}
+	p.Steps, err = OrderSteps(steps)
+	if err != nil {
+		return nil, fmt.Errorf("pipeline %d (%s): %w", p.ID, p.Name, err)
+	}
+	return p, nil
+}
+
+func loadSteps(db *sql.DB, schema string, where string, args ...interface{}) ([]*Step, error) {
+	rows, err := db.Query(`
+		SELECT s.step_id, s.pipeline_id, s.name, COALESCE(s.description, ''), COALESCE(s.query, ''),
+			s.layer, s.step_order, s.child_step_id
+		FROM `+schema+`.etl_steps s `+where+`
+		ORDER BY s.pipeline_id, s.step_order, s.step_id`, args...)
+	if err != nil {
+		return nil, fmt.Errorf("error loading steps: %v", err)
+	}
+	defer rows.Close()
+
+	var steps []*Step
+	byID := make(map[int]*Step)
+	for rows.Next() {
+		step := &Step{Metadata: make(map[string]string)}
+		var layer string
+		var child sql.NullInt64
+		if err := rows.Scan(&step.ID, &step.PipelineID, &step.Name, &step.Description, &step.Query,
+			&layer, &step.Order, &child); err != nil {
+			return nil, fmt.Errorf("error scanning step: %v", err)
+		}
+		step.Layer = Layer(layer)
+		if child.Valid {
+			id := int(child.Int64)
+			step.ChildStepID = &id
+		}
+		steps = append(steps, step)
+		byID[step.ID] = step
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	if len(steps) == 0 {
+		return steps, nil
+	}
+
+	// Only the metadata and checks of the steps loaded are read
+	ids := make([]int64, 0, len(steps))
+	for _, step := range steps {
+		ids = append(ids, int64(step.ID))
+	}
+	metaRows, err := db.Query(`
+		SELECT step_id, key, COALESCE(value, '') FROM `+schema+`.etl_step_metadata
+		WHERE step_id = ANY($1)
+		ORDER BY step_metadata_id`, pq.Array(ids))
+	if err != nil {
+		return nil, fmt.Errorf("error loading step metadata: %v", err)
+	}
+	defer metaRows.Close()
+
+	for metaRows.Next() {
+		var stepID int
+		var key, value string
+		if err := metaRows.Scan(&stepID, &key, &value); err != nil {
+			return nil, fmt.Errorf("error scanning step metadata: %v", err)
+		}
+		if step, ok := byID[stepID]; ok {
+			step.Metadata[key] = value
+		}
+	}
+	if err := metaRows.Err(); err != nil {
+		return nil, err
+	}
+
+	checks, err := loadChecks(db, schema, "WHERE step_id = ANY($1)", pq.Array(ids))
+	if err != nil {
+		return nil, err
+	}
+	for _, check := range checks {
+		if step, ok := byID[check.StepID]; ok {
+			step.Checks = append(step.Checks, check)
+		}
+	}
+	return steps, nil
+}
+
+// OrderSteps returns the steps in execution order. A step runs after the step
+// named by its child_step_id (the step it reads from); otherwise step_order
+// decides, with step_id breaking ties.
+func OrderSteps(steps []*Step) ([]*Step, error) {
+	byID := make(map[int]*Step, len(steps))
+	for _, step := range steps {
+		byID[step.ID] = step
+	}
+
+	dependents := make(map[int][]*Step)
+	waiting := make(map[int]int)
+	var ready []*Step
+	for _, step := range steps {
+		if step.ChildStepID != nil {
+			if _, ok := byID[*step.ChildStepID]; ok {
+				dependents[*step.ChildStepID] = append(dependents[*step.ChildStepID], step)
+				waiting[step.ID]++
+				continue
+			}
+		}
+		ready = append(ready, step)
+	}
+
+	ordered := make([]*Step, 0, len(steps))
+	for len(ready) > 0 {
+		sort.Slice(ready, func(i, j int) bool {
+			if ready[i].Order != ready[j].Order {
+				return ready[i].Order < ready[j].Order
+			}
+			return ready[i].ID < ready[j].ID
+		})
+		next := ready[0]
+		ready = ready[1:]
+		ordered = append(ordered, next)
+
+		for _, dependent := range dependents[next.ID] {
+			waiting[dependent.ID]--
+			if waiting[dependent.ID] == 0 {
+				ready = append(ready, dependent)
+			}
+		}
+	}
+
+	if len(ordered) != len(steps) {
+		return nil, fmt.Errorf("child_step_id references form a cycle")
+	}
+	return ordered, nil
+}
+
+type ValidationError struct {
+	Problems []string
+}
+
+func (v *ValidationError) Error() string {
+	return "invalid pipeline: " + strings.Join(v.Problems, "; ")
+}
+
+// ValidateSteps checks that every step has a known layer, that child_step_id
+// points at a step of the same pipeline without forming a cycle, and that no
+// step writes to an earlier layer than the step it reads from.
+func ValidateSteps(steps []*Step) error {
+	var problems []string
+	byID := make(map[int]*Step, len(steps))
+	for _, step := range steps {
+		byID[step.ID] = step
+	}
+
+	for _, step := range steps {
+		if strings.TrimSpace(step.Name) == "" {
+			problems = append(problems, fmt.Sprintf("step %d has no name", step.ID))
+		}
+		if !step.Layer.Valid() {
+			problems = append(problems, fmt.Sprintf("step %d has unknown layer %q", step.ID, step.Layer))
+			continue
+		}
+		if column := step.WatermarkColumn(); column != "" && !identifierPattern.MatchString(column) {
+			problems = append(problems, fmt.Sprintf("step %d has invalid %s %q", step.ID, MetaWatermarkColumn, column))
+		}
+		if column := strings.TrimSpace(step.Metadata[MetaTimeColumn]); column != "" && !identifierPattern.MatchString(column) {
+			problems = append(problems, fmt.Sprintf("step %d has invalid %s %q", step.ID, MetaTimeColumn, column))
+		}
+		problems = append(problems, validateStepType(step)...)
+		if step.ChildStepID == nil {
+			continue
+		}
+		upstream, ok := byID[*step.ChildStepID]
+		if !ok {
+			problems = append(problems, fmt.Sprintf("step %d reads from step %d which is not in this pipeline", step.ID, *step.ChildStepID))
+			continue
+		}
+		if upstream.Layer.Valid() && step.Layer.Rank() < upstream.Layer.Rank() {
+			problems = append(problems, fmt.Sprintf("step %d (%s) cannot read from step %d in the later %s layer",
+				step.ID, step.Layer, upstream.ID, upstream.Layer))
+		}
+	}
+
+	if _, err := OrderSteps(steps); err != nil {
+		problems = append(problems, err.Error())
+	}
+
+	if len(problems) > 0 {
+		return &ValidationError{Problems: problems}
+	}
+	return nil
+}
@@ -0,0 +1,89 @@
+package etl
+
+import (
+	"testing"
+)
+
+func stepIDs(steps []*Step) []int {
+	ids := make([]int, 0, len(steps))
+	for _, step := range steps {
+		ids = append(ids, step.ID)
+	}
+	return ids
+}
+
+func child(id int) *int {
+	return &id
+}
+
+func TestOrderSteps(t *testing.T) {
+	tests := []struct {
+		name  string
+		steps []*Step
+		want  []int
+	}{
+		{
+			name:  "step order",
+			steps: []*Step{{ID: 1, Order: 3}, {ID: 2, Order: 1}, {ID: 3, Order: 2}},
+			want:  []int{2, 3, 1},
+		},
+		{
+			name:  "step id breaks ties",
+			steps: []*Step{{ID: 5, Order: 1}, {ID: 4, Order: 1}},
+			want:  []int{4, 5},
+		},
+		{
+			name:  "child step runs first",
+			steps: []*Step{{ID: 1, Order: 1, ChildStepID: child(2)}, {ID: 2, Order: 2}},
+			want:  []int{2, 1},
+		},
+		{
+			name: "chain",
+			steps: []*Step{
+				{ID: 1, Order: 1, ChildStepID: child(3)},
+				{ID: 2, Order: 1},
+				{ID: 3, Order: 1, ChildStepID: child(2)},
+			},
+			want: []int{2, 3, 1},
+		},
+		{
+			name:  "child in another pipeline is ignored",
+			steps: []*Step{{ID: 1, Order: 2, ChildStepID: child(99)}, {ID: 2, Order: 1}},
+			want:  []int{2, 1},
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			ordered, err := OrderSteps(test.steps)
+			if err != nil {
+				t.Fatalf("OrderSteps: %v", err)
+			}
+			if got := stepIDs(ordered); !equalInts(got, test.want) {
+				t.Errorf("got order %v, want %v", got, test.want)
+			}
+		})
+	}
+}
+
+func TestOrderStepsCycle(t *testing.T) {
+	steps := []*Step{
+		{ID: 1, ChildStepID: child(2)},
+		{ID: 2, ChildStepID: child(1)},
+		{ID: 3},
+	}
+	if _, err := OrderSteps(steps); err == nil {
+		t.Fatal("expected an error for a cycle")
+	}
+}
+
+func equalInts(a, b []int) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,303 @@
+package etl
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"regexp"
+	"strings"
+	"time"
+)
+
+/*
+Previews run a step, saved or still being edited, against a sample of what it reads inside
+a transaction that is always rolled back. The output goes to a temporary table rather than
+the step's layer, so a preview neither writes to nor locks the step's real table; its
+checks are run against the temporary table the same way a run would.
+
+The sample is taken of the step's inputs rather than its output: each table the step's
+query scans, as Postgres plans it, is copied to a temporary table of the same name holding
+at most the limit's rows within the time slice, and the query runs against the copies. The
+step then only reads the sample, and its checks see the whole output of that sample instead
+of an output cut short.
+*/
+
+const (
+	defaultPreviewLimit = 100
+	maxPreviewLimit     = 1000
+	previewTimeout      = 30 * time.Second
+	previewTable        = "pg_temp.etl_preview"
+)
+
+type PreviewOptions struct {
+	Limit int
+	From  *time.Time
+	To    *time.Time
+}
+
+// PreviewRequest is a preview as given to the API. Step is the edited step; when
+// previewing a saved step it may be left out to preview the step as saved.
+type PreviewRequest struct {
+	Step  *Step  `json:"step,omitempty"`
+	Limit int    `json:"limit"`
+	From  string `json:"from"`
+	To    string `json:"to"`
+}
+
+type PreviewColumn struct {
+	Name string `json:"name"`
+	Type string `json:"type"`
+}
+
+type Preview struct {
+	StepID     int             `json:"step_id"`
+	Columns    []PreviewColumn `json:"columns"`
+	Rows       [][]interface{} `json:"rows"`
+	RowCount   int64           `json:"row_count"`
+	Checks     []*CheckResult  `json:"checks"`
+	Passed     bool            `json:"passed"`
+	Message    string          `json:"message,omitempty"`
+	DurationMs int64           `json:"duration_ms"`
+}
+
+func (r PreviewRequest) Options() (PreviewOptions, error) {
+	opts := PreviewOptions{Limit: r.Limit}
+	var problems []string
+	if opts.Limit == 0 {
+		opts.Limit = defaultPreviewLimit
+	}
+	if opts.Limit < 0 || opts.Limit > maxPreviewLimit {
+		problems = append(problems, fmt.Sprintf("limit must be between 1 and %d", maxPreviewLimit))
+	}
+	if r.From != "" || r.To != "" {
+		from, err := ParseBackfillTime(r.From)
+		if err != nil {
+			problems = append(problems, "from: "+err.Error())
+		}
+		to, err := ParseBackfillTime(r.To)
+		if err != nil {
+			problems = append(problems, "to: "+err.Error())
+		}
+		if err == nil && !to.After(from) {
+			problems = append(problems, "to must be after from")
+		}
+		opts.From, opts.To = &from, &to
+	}
+	if len(problems) > 0 {
+		return opts, &ValidationError{Problems: problems}
+	}
+	return opts, nil
+}
+
+// validatePreview checks the step as it would be saved into the pipeline.
+func validatePreview(p *Pipeline, step *Step, opts PreviewOptions) error {
+	steps := []*Step{}
+	replaced := false
+	for _, existing := range p.Steps {
+		if existing.ID == step.ID {
+			existing, replaced = step, true
+		}
+		steps = append(steps, existing)
+	}
+	if !replaced {
+		steps = append(steps, step)
+	}
+
+	var problems []string
+	if err := ValidateSteps(steps); err != nil {
+		problems = append(problems, err.(*ValidationError).Problems...)
+	}
+	for _, check := range step.Checks {
+		problems = append(problems, check.Validate()...)
+	}
+	if stepType, ok := LookupStepType(step.Type()); ok && stepType.Load == nil {
+		problems = append(problems, fmt.Sprintf("%s steps cannot be previewed", step.Type()))
+	}
+	if opts.From != nil && step.TimeColumn() == "" &&
+		!(step.Type() == StepTypeSQL && strings.Contains(step.Query, fromPlaceholder)) {
+		problems = append(problems, fmt.Sprintf("a time slice needs the step to have a %s", MetaTimeColumn))
+	}
+	if len(problems) > 0 {
+		return &ValidationError{Problems: problems}
+	}
+	return nil
+}
+
+// Preview runs step against a sample of its input and returns the sample of its
+// output and how its checks fared. Nothing it does is committed.
+func (e *Executor) Preview(ctx context.Context, p *Pipeline, step *Step, opts PreviewOptions) (*Preview, error) {
+	if err := validatePreview(p, step, opts); err != nil {
+		return nil, err
+	}
+	stepType, _ := LookupStepType(step.Type())
+	db, err := e.workspaceDB(p.WorkspaceID)
+	if err != nil {
+		return nil, err
+	}
+
+	start := time.Now()
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	if _, err := tx.ExecContext(ctx, fmt.Sprintf("SET LOCAL statement_timeout = %d", previewTimeout.Milliseconds())); err != nil {
+		return nil, fmt.Errorf("error setting statement_timeout: %v", err)
+	}
+	if _, err := tx.ExecContext(ctx, "SET LOCAL search_path TO "+searchPath()); err != nil {
+		return nil, fmt.Errorf("error setting search_path: %v", err)
+	}
+
+	// Previewed as a first, full load, so an incremental step reads from its initial watermark
+	load := Load{
+		Table:       previewTable,
+		Incremental: step.WatermarkColumn() != "",
+		Limit:       opts.Limit,
+		From:        opts.From,
+		To:          opts.To,
+	}
+	preview := &Preview{StepID: step.ID, Columns: []PreviewColumn{}, Checks: []*CheckResult{}, Passed: true}
+	loaded, err := stepType.Load(ctx, tx, step, load)
+	if err != nil {
+		return nil, &ValidationError{Problems: []string{fmt.Sprintf("step %d: %v", step.ID, err)}}
+	}
+	preview.RowCount = loaded.Written
+
+	sample, err := readRows(ctx, tx, fmt.Sprintf("SELECT * FROM %s LIMIT %d", previewTable, opts.Limit))
+	if err != nil {
+		return nil, fmt.Errorf("error reading preview: %v", err)
+	}
+	for i, column := range sample.Columns {
+		preview.Columns = append(preview.Columns, PreviewColumn{Name: column, Type: sample.Types[i]})
+	}
+	preview.Rows = sample.Values
+
+	if len(step.Checks) > 0 {
+		checks, err := runChecks(ctx, tx, step, previewTable)
+		if checks != nil {
+			preview.Checks = checks
+		}
+		if err != nil {
+			preview.Passed = false
+			preview.Message = err.Error()
+		}
+	}
+
+	preview.DurationMs = time.Since(start).Milliseconds()
+	return preview, tx.Rollback()
+}
+
+// sampleInputs copies a sample of each table query scans to a temporary table
+// and returns query reading from the copies. A query with {{from}} and {{to}}
+// filters itself, so its inputs are only limited.
+func sampleInputs(ctx context.Context, tx *sql.Tx, query string, step *Step, load Load) (string, error) {
+	window := load
+	if load.From != nil && load.To != nil && (strings.Contains(query, fromPlaceholder) || strings.Contains(query, toPlaceholder)) {
+		query = applyWindow(query, "", *load.From, *load.To)
+		window.From, window.To = nil, nil
+	}
+	tables, err := scannedTables(ctx, tx, query)
+	if err != nil {
+		return "", err
+	}
+
+	// Temporary tables are found before any other unqualified table, and
+	// qualified references are pointed at them
+	names := make(map[string]int)
+	for _, table := range tables {
+		names[table.name]++
+	}
+	for _, table := range tables {
+		if names[table.name] > 1 {
+			continue
+		}
+		qualified := table.schema + "." + table.name
+		sample, err := sampleQuery(ctx, tx, qualified, "SELECT * FROM "+quoteTableName(qualified), step, window)
+		if err != nil {
+			return "", err
+		}
+		sampleTable := "pg_temp." + quoteIdentifier(table.name)
+		if _, err := tx.ExecContext(ctx, fmt.Sprintf("CREATE TEMP TABLE %s AS %s", sampleTable, sample)); err != nil {
+			return "", fmt.Errorf("error sampling %s: %v", qualified, err)
+		}
+		query = qualifiedReference(table.schema, table.name).ReplaceAllString(query, "${1}"+sampleTable)
+	}
+	return query, nil
+}
+
+// sampleQuery narrows query, reading table, to the window of load when table
+// has the step's time column, and to its limit.
+func sampleQuery(ctx context.Context, tx *sql.Tx, table string, query string, step *Step, load Load) (string, error) {
+	if load.From != nil && load.To != nil {
+		found, err := hasColumn(ctx, tx, table, step.TimeColumn())
+		if err != nil {
+			return "", err
+		}
+		if found {
+			query = applyWindow(query, step.TimeColumn(), *load.From, *load.To)
+		}
+	}
+	if load.Limit > 0 {
+		query = fmt.Sprintf("SELECT * FROM (%s) AS sample LIMIT %d", query, load.Limit)
+	}
+	return query, nil
+}
+
+type scannedTable struct {
+	schema string
+	name   string
+}
+
+// scannedTables lists the tables Postgres would scan to run query, in the
+// order its plan first reaches them.
+func scannedTables(ctx context.Context, tx *sql.Tx, query string) ([]scannedTable, error) {
+	var plan string
+	if err := tx.QueryRowContext(ctx, "EXPLAIN (VERBOSE, FORMAT JSON) "+query).Scan(&plan); err != nil {
+		return nil, fmt.Errorf("error planning query: %v", err)
+	}
+	var nodes []interface{}
+	if err := json.Unmarshal([]byte(plan), &nodes); err != nil {
+		return nil, fmt.Errorf("error reading query plan: %v", err)
+	}
+	return planTables(nodes, nil), nil
+}
+
+func planTables(node interface{}, tables []scannedTable) []scannedTable {
+	switch node := node.(type) {
+	case []interface{}:
+		for _, child := range node {
+			tables = planTables(child, tables)
+		}
+	case map[string]interface{}:
+		name, _ := node["Relation Name"].(string)
+		schema, _ := node["Schema"].(string)
+		if name != "" && schema != "" && !strings.HasPrefix(schema, "pg_temp") {
+			table := scannedTable{schema: schema, name: name}
+			found := false
+			for _, seen := range tables {
+				found = found || seen == table
+			}
+			if !found {
+				tables = append(tables, table)
+			}
+		}
+		if plan, ok := node["Plan"]; ok {
+			tables = planTables(plan, tables)
+		}
+		if plans, ok := node["Plans"]; ok {
+			tables = planTables(plans, tables)
+		}
+	}
+	return tables
+}
+
+// qualifiedReference matches schema.name in a query, quoted or not, along with
+// the character before it.
+func qualifiedReference(schema string, name string) *regexp.Regexp {
+	part := func(identifier string) string {
+		return `(?:"` + regexp.QuoteMeta(identifier) + `"|` + regexp.QuoteMeta(identifier) + `\b)`
+	}
+	return regexp.MustCompile(`(?i)(^|[^\w."])` + part(schema) + `\s*\.\s*` + part(name))
+}
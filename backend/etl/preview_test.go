@@ -0,0 +1,91 @@
+package etl
+
+import (
+	"encoding/json"
+	"testing"
+)
+
+func TestPlanTables(t *testing.T) {
+	plan := `[{"Plan": {"Node Type": "Hash Join", "Plans": [
+		{"Node Type": "Seq Scan", "Relation Name": "step_3", "Schema": "etl_staging", "Alias": "s"},
+		{"Node Type": "Hash", "Plans": [
+			{"Node Type": "Index Scan", "Relation Name": "machines", "Schema": "public", "Alias": "m"},
+			{"Node Type": "Seq Scan", "Relation Name": "step_3", "Schema": "etl_staging", "Alias": "again"},
+			{"Node Type": "Seq Scan", "Relation Name": "etl_preview", "Schema": "pg_temp_3"},
+			{"Node Type": "CTE Scan", "CTE Name": "recent"}
+		]}
+	]}}]`
+	var nodes []interface{}
+	if err := json.Unmarshal([]byte(plan), &nodes); err != nil {
+		t.Fatal(err)
+	}
+	got := planTables(nodes, nil)
+	want := []scannedTable{{schema: "etl_staging", name: "step_3"}, {schema: "public", name: "machines"}}
+	if len(got) != len(want) {
+		t.Fatalf("got tables %v, want %v", got, want)
+	}
+	for i := range want {
+		if got[i] != want[i] {
+			t.Errorf("table %d: got %v, want %v", i, got[i], want[i])
+		}
+	}
+}
+
+func TestQualifiedReference(t *testing.T) {
+	tests := []struct {
+		query string
+		want  string
+	}{
+		{query: "SELECT * FROM etl_staging.step_3", want: "SELECT * FROM pg_temp.step_3"},
+		{query: `SELECT * FROM "etl_staging"."step_3" s`, want: "SELECT * FROM pg_temp.step_3 s"},
+		{query: "SELECT * FROM ETL_STAGING . step_3", want: "SELECT * FROM pg_temp.step_3"},
+		{query: "SELECT * FROM step_3", want: "SELECT * FROM step_3"},
+		{query: "SELECT * FROM etl_staging.step_30", want: "SELECT * FROM etl_staging.step_30"},
+		{query: "SELECT * FROM other.etl_staging.step_3", want: "SELECT * FROM other.etl_staging.step_3"},
+		{query: "SELECT * FROM my_etl_staging.step_3", want: "SELECT * FROM my_etl_staging.step_3"},
+	}
+	reference := qualifiedReference("etl_staging", "step_3")
+	for _, test := range tests {
+		if got := reference.ReplaceAllString(test.query, "${1}pg_temp.step_3"); got != test.want {
+			t.Errorf("%q: got %q, want %q", test.query, got, test.want)
+		}
+	}
+}
+
+func TestPreviewRequestOptions(t *testing.T) {
+	tests := []struct {
+		name    string
+		request PreviewRequest
+		limit   int
+		window  bool
+		invalid bool
+	}{
+		{name: "default limit", request: PreviewRequest{}, limit: defaultPreviewLimit},
+		{name: "limit", request: PreviewRequest{Limit: 10}, limit: 10},
+		{name: "limit too large", request: PreviewRequest{Limit: maxPreviewLimit + 1}, invalid: true},
+		{name: "time slice", request: PreviewRequest{From: "2024-01-01", To: "2024-01-02"}, limit: defaultPreviewLimit, window: true},
+		{name: "time slice backwards", request: PreviewRequest{From: "2024-01-02", To: "2024-01-01"}, invalid: true},
+		{name: "time slice without an end", request: PreviewRequest{From: "2024-01-02"}, invalid: true},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			opts, err := test.request.Options()
+			if test.invalid {
+				if err == nil {
+					t.Fatal("expected an error")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("Options: %v", err)
+			}
+			if opts.Limit != test.limit || (opts.From != nil) != test.window {
+				t.Errorf("got limit %d and window %v, want %d and %v", opts.Limit, opts.From != nil, test.limit, test.window)
+			}
+			load := Load{Limit: opts.Limit, From: opts.From, To: opts.To}
+			if !load.sampled() {
+				t.Error("a preview load should only read a sample")
+			}
+		})
+	}
+}
@@ -1 +1,281 @@
 package etl
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"log"
+	"sort"
+	"sync"
+	"time"
+)
+
+/*
+Re-runs the pipeline that owns each data source at the refresh_interval stored in
+prod.data_sources_conditions. The conditions are reloaded periodically so interval
+changes are picked up without a restart. Data sources of the same pipeline that are due
+together share one run, and a pipeline held by a manual run or backfill is tried again
+shortly rather than waiting a whole interval.
+*/
+
+const (
+	schedulerTick   = time.Second
+	schedulerReload = 30 * time.Second
+	schedulerRetry  = 10 * time.Second
+)
+
+type Schedule struct {
+	DataSourceID    int       `json:"data_source_id"`
+	DataSourceName  string    `json:"data_source_name"`
+	PipelineID      int       `json:"pipeline_id"`
+	StepID          *int      `json:"step_id,omitempty"`
+	RefreshInterval int       `json:"refresh_interval"`
+	AppendOnly      bool      `json:"append_only"`
+	LastRun         time.Time `json:"last_run"`
+	NextRun         time.Time `json:"next_run"`
+	LastError       string    `json:"last_error,omitempty"`
+	Running         bool      `json:"running"`
+}
+
+func (s *Schedule) interval() time.Duration {
+	return time.Duration(s.RefreshInterval) * time.Second
+}
+
+type Scheduler struct {
+	db        *sql.DB
+	executor  *Executor
+	mutex     sync.RWMutex
+	schedules map[int]*Schedule
+	wg        sync.WaitGroup
+}
+
+func NewScheduler(db *sql.DB, executor *Executor) *Scheduler {
+	return &Scheduler{
+		db:        db,
+		executor:  executor,
+		schedules: make(map[int]*Schedule),
+	}
+}
+
+// Reload reads prod.data_sources_conditions, adding new schedules, dropping
+// removed ones and rescheduling any whose interval has changed.
+func (s *Scheduler) Reload() error {
+	rows, err := s.db.Query(`
+		SELECT c.data_source_id, d.name, d.pipeline_id, d.step_child_id, c.refresh_interval, c.append_only
+		FROM prod.data_sources_conditions c
+		JOIN prod.data_sources d ON d.data_source_id = c.data_source_id
+		WHERE d.pipeline_id IS NOT NULL`)
+	if err != nil {
+		return fmt.Errorf("error loading data source conditions: %v", err)
+	}
+	defer rows.Close()
+
+	loaded := make(map[int]*Schedule)
+	for rows.Next() {
+		schedule := &Schedule{}
+		var stepID sql.NullInt64
+		if err := rows.Scan(&schedule.DataSourceID, &schedule.DataSourceName, &schedule.PipelineID,
+			&stepID, &schedule.RefreshInterval, &schedule.AppendOnly); err != nil {
+			return fmt.Errorf("error scanning data source condition: %v", err)
+		}
+		if stepID.Valid {
+			id := int(stepID.Int64)
+			schedule.StepID = &id
+		}
+		if schedule.RefreshInterval <= 0 {
+			log.Printf("Skipping data source %d (%s): refresh_interval must be positive", schedule.DataSourceID, schedule.DataSourceName)
+			continue
+		}
+		loaded[schedule.DataSourceID] = schedule
+	}
+	if err := rows.Err(); err != nil {
+		return err
+	}
+	s.update(loaded, time.Now())
+	return nil
+}
+
+// update makes the schedules those loaded: new ones are due now, and those
+// whose interval changed are due an interval after their last run.
+func (s *Scheduler) update(loaded map[int]*Schedule, now time.Time) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	for id, schedule := range loaded {
+		existing, ok := s.schedules[id]
+		if !ok {
+			schedule.NextRun = now
+			s.schedules[id] = schedule
+			continue
+		}
+
+		if existing.RefreshInterval != schedule.RefreshInterval {
+			existing.RefreshInterval = schedule.RefreshInterval
+			if existing.LastRun.IsZero() {
+				existing.NextRun = now
+			} else {
+				existing.NextRun = existing.LastRun.Add(existing.interval())
+			}
+		}
+		existing.DataSourceName = schedule.DataSourceName
+		existing.PipelineID = schedule.PipelineID
+		existing.StepID = schedule.StepID
+		existing.AppendOnly = schedule.AppendOnly
+	}
+	for id := range s.schedules {
+		if _, ok := loaded[id]; !ok {
+			delete(s.schedules, id)
+		}
+	}
+}
+
+func (s *Scheduler) Run(ctx context.Context) {
+	ticker := time.NewTicker(schedulerTick)
+	defer ticker.Stop()
+	lastReload := time.Now()
+
+	for {
+		select {
+		case <-ctx.Done():
+			s.wg.Wait()
+			return
+		case now := <-ticker.C:
+			if now.Sub(lastReload) >= schedulerReload {
+				if err := s.Reload(); err != nil {
+					log.Printf("Error reloading refresh schedules: %v", err)
+				}
+				lastReload = now
+			}
+			s.runDue(ctx, now)
+		}
+	}
+}
+
+// due returns the schedules due at now by pipeline, marking them running. A
+// pipeline still being refreshed for another of its data sources waits.
+func (s *Scheduler) due(now time.Time) map[int][]*Schedule {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	busy := make(map[int]bool)
+	for _, schedule := range s.schedules {
+		if schedule.Running {
+			busy[schedule.PipelineID] = true
+		}
+	}
+	due := make(map[int][]*Schedule)
+	for _, schedule := range s.schedules {
+		if busy[schedule.PipelineID] || now.Before(schedule.NextRun) {
+			continue
+		}
+		schedule.Running = true
+		due[schedule.PipelineID] = append(due[schedule.PipelineID], schedule)
+	}
+	return due
+}
+
+func (s *Scheduler) runDue(ctx context.Context, now time.Time) {
+	for pipelineID, schedules := range s.due(now) {
+		s.wg.Add(1)
+		go s.refresh(ctx, pipelineID, schedules)
+	}
+}
+
+// refresh runs the pipeline once for every data source of it that is due.
+func (s *Scheduler) refresh(ctx context.Context, pipelineID int, schedules []*Schedule) {
+	defer s.wg.Done()
+
+	s.mutex.RLock()
+	feeds := make([]Schedule, len(schedules))
+	for i, schedule := range schedules {
+		feeds[i] = *schedule
+	}
+	s.mutex.RUnlock()
+
+	startTime := time.Now()
+	err := s.refreshPipeline(ctx, pipelineID, feeds)
+	if err != nil && !errors.Is(err, ErrPipelineRunning) {
+		log.Printf("Error refreshing pipeline %d: %v", pipelineID, err)
+	}
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	for _, schedule := range schedules {
+		schedule.Running = false
+		if errors.Is(err, ErrPipelineRunning) {
+			// A manual run or backfill holds the pipeline, so this was not a refresh
+			schedule.NextRun = startTime.Add(schedulerRetry)
+			continue
+		}
+		schedule.LastRun = startTime
+		schedule.NextRun = startTime.Add(schedule.interval())
+		schedule.LastError = ""
+		if err != nil {
+			schedule.LastError = err.Error()
+		}
+	}
+}
+
+// refreshPipeline reloads the pipeline definition so step edits take effect
+// on the next refresh.
+func (s *Scheduler) refreshPipeline(ctx context.Context, pipelineID int, schedules []Schedule) error {
+	pipeline, err := LoadPipeline(s.db, pipelineID)
+	if err != nil {
+		return fmt.Errorf("error loading pipeline %d: %v", pipelineID, err)
+	}
+	opts := RunOptions{TriggeredBy: TriggerSchedule, AppendSteps: appendSteps(pipeline, schedules)}
+	_, err = s.executor.RunPipeline(ctx, pipeline, opts)
+	return err
+}
+
+// appendSteps are the steps that keep their existing rows. For an append_only
+// data source that is the step it feeds, or the raw layer when it feeds none;
+// the layers after it are rebuilt from it. A step without a watermark column
+// would insert its whole result again, so it is rebuilt instead.
+func appendSteps(pipeline *Pipeline, schedules []Schedule) map[int]bool {
+	steps := make(map[int]bool)
+	for _, schedule := range schedules {
+		if !schedule.AppendOnly {
+			continue
+		}
+		for _, step := range pipeline.Steps {
+			if schedule.StepID != nil && step.ID != *schedule.StepID || schedule.StepID == nil && step.Layer != LayerRaw {
+				continue
+			}
+			if step.WatermarkColumn() == "" {
+				log.Printf("Data source %d (%s) is append_only, but step %d (%s) has no watermark column, so it is rebuilt",
+					schedule.DataSourceID, schedule.DataSourceName, step.ID, step.Name)
+				continue
+			}
+			steps[step.ID] = true
+		}
+	}
+	return steps
+}
+
+// HasPipeline reports whether any data source refreshes the pipeline.
+func (s *Scheduler) HasPipeline(pipelineID int) bool {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+	for _, schedule := range s.schedules {
+		if schedule.PipelineID == pipelineID {
+			return true
+		}
+	}
+	return false
+}
+
+func (s *Scheduler) Schedules() []Schedule {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+
+	schedules := make([]Schedule, 0, len(s.schedules))
+	for _, schedule := range s.schedules {
+		schedules = append(schedules, *schedule)
+	}
+	sort.Slice(schedules, func(i, j int) bool {
+		return schedules[i].DataSourceID < schedules[j].DataSourceID
+	})
+	return schedules
+}
@@ -0,0 +1,148 @@
+package etl
+
+import (
+	"reflect"
+	"sort"
+	"testing"
+	"time"
+)
+
+func TestSchedulerSchedules(t *testing.T) {
+	scheduler := NewScheduler(nil, nil)
+	scheduler.schedules[3] = &Schedule{DataSourceID: 3, PipelineID: 2, RefreshInterval: 60}
+	scheduler.schedules[1] = &Schedule{DataSourceID: 1, PipelineID: 1, RefreshInterval: 5}
+	scheduler.schedules[2] = &Schedule{DataSourceID: 2, PipelineID: 2, RefreshInterval: 30}
+
+	schedules := scheduler.Schedules()
+	for i, want := range []int{1, 2, 3} {
+		if schedules[i].DataSourceID != want {
+			t.Errorf("schedule %d is data source %d, want %d", i, schedules[i].DataSourceID, want)
+		}
+	}
+	schedules[0].Running = true
+	if scheduler.schedules[1].Running {
+		t.Error("Schedules returned the scheduler's own schedule rather than a copy")
+	}
+
+	for _, test := range []struct {
+		pipelineID int
+		want       bool
+	}{{1, true}, {2, true}, {4, false}} {
+		if got := scheduler.HasPipeline(test.pipelineID); got != test.want {
+			t.Errorf("HasPipeline(%d) = %v, want %v", test.pipelineID, got, test.want)
+		}
+	}
+	if got := scheduler.schedules[2].interval().Seconds(); got != 30 {
+		t.Errorf("got interval %vs, want 30s", got)
+	}
+}
+
+func TestSchedulerUpdate(t *testing.T) {
+	now := time.Date(2025, 1, 1, 12, 0, 0, 0, time.UTC)
+	lastRun := now.Add(-time.Minute)
+	scheduler := NewScheduler(nil, nil)
+	scheduler.schedules[1] = &Schedule{DataSourceID: 1, PipelineID: 1, RefreshInterval: 300, LastRun: lastRun, NextRun: lastRun.Add(5 * time.Minute)}
+	scheduler.schedules[2] = &Schedule{DataSourceID: 2, PipelineID: 1, RefreshInterval: 60, NextRun: now.Add(time.Hour)}
+	scheduler.schedules[3] = &Schedule{DataSourceID: 3, PipelineID: 2, RefreshInterval: 60, LastRun: lastRun, NextRun: now}
+	scheduler.schedules[4] = &Schedule{DataSourceID: 4, PipelineID: 2, RefreshInterval: 60}
+
+	scheduler.update(map[int]*Schedule{
+		1: {DataSourceID: 1, PipelineID: 1, RefreshInterval: 120},
+		2: {DataSourceID: 2, PipelineID: 1, RefreshInterval: 30},
+		3: {DataSourceID: 3, PipelineID: 2, RefreshInterval: 60, AppendOnly: true},
+		5: {DataSourceID: 5, PipelineID: 3, RefreshInterval: 10},
+	}, now)
+
+	tests := []struct {
+		id      int
+		nextRun time.Time
+	}{
+		{id: 1, nextRun: lastRun.Add(2 * time.Minute)},
+		{id: 2, nextRun: now},
+		{id: 3, nextRun: now},
+		{id: 5, nextRun: now},
+	}
+	for _, test := range tests {
+		schedule, ok := scheduler.schedules[test.id]
+		if !ok {
+			t.Errorf("data source %d lost its schedule", test.id)
+			continue
+		}
+		if !schedule.NextRun.Equal(test.nextRun) {
+			t.Errorf("data source %d next runs at %s, want %s", test.id, schedule.NextRun, test.nextRun)
+		}
+	}
+	if scheduler.schedules[1].RefreshInterval != 120 || !scheduler.schedules[1].LastRun.Equal(lastRun) {
+		t.Errorf("got interval %ds and last run %s, want 120s and the last run kept", scheduler.schedules[1].RefreshInterval, scheduler.schedules[1].LastRun)
+	}
+	if !scheduler.schedules[3].AppendOnly {
+		t.Error("a change to append_only was not picked up")
+	}
+	if _, ok := scheduler.schedules[4]; ok {
+		t.Error("a removed condition is still scheduled")
+	}
+}
+
+func TestSchedulerDue(t *testing.T) {
+	now := time.Date(2025, 1, 1, 12, 0, 0, 0, time.UTC)
+	scheduler := NewScheduler(nil, nil)
+	scheduler.schedules[1] = &Schedule{DataSourceID: 1, PipelineID: 1, NextRun: now}
+	scheduler.schedules[2] = &Schedule{DataSourceID: 2, PipelineID: 1, NextRun: now.Add(-time.Minute)}
+	scheduler.schedules[3] = &Schedule{DataSourceID: 3, PipelineID: 1, NextRun: now.Add(time.Minute)}
+	scheduler.schedules[4] = &Schedule{DataSourceID: 4, PipelineID: 2, NextRun: now, Running: true}
+	scheduler.schedules[5] = &Schedule{DataSourceID: 5, PipelineID: 2, NextRun: now}
+
+	due := scheduler.due(now)
+	if len(due) != 1 || len(due[1]) != 2 {
+		t.Fatalf("got %d pipelines due, want pipeline 1 once for its two due data sources", len(due))
+	}
+	var ids []int
+	for _, schedule := range due[1] {
+		ids = append(ids, schedule.DataSourceID)
+		if !schedule.Running {
+			t.Errorf("data source %d is due but not marked running", schedule.DataSourceID)
+		}
+	}
+	sort.Ints(ids)
+	if !reflect.DeepEqual(ids, []int{1, 2}) {
+		t.Errorf("got data sources %v due, want [1 2]", ids)
+	}
+	if scheduler.schedules[5].Running {
+		t.Error("a data source started while its pipeline was refreshing for another")
+	}
+	if len(scheduler.due(now)) != 0 {
+		t.Error("pipeline 1 was due again while it was refreshing")
+	}
+}
+
+func TestAppendSteps(t *testing.T) {
+	watermark := map[string]string{MetaWatermarkColumn: "id"}
+	pipeline := &Pipeline{Steps: []*Step{
+		{ID: 1, Name: "readings", Layer: LayerRaw, Metadata: watermark},
+		{ID: 2, Name: "events", Layer: LayerRaw},
+		{ID: 3, Name: "clean", Layer: LayerStaging, Metadata: watermark},
+		{ID: 4, Name: "totals", Layer: LayerFinal},
+	}}
+	stepID := func(id int) *int { return &id }
+	tests := []struct {
+		name      string
+		schedules []Schedule
+		want      []int
+	}{
+		{name: "not append only", schedules: []Schedule{{}, {StepID: stepID(3)}}},
+		{name: "raw layer", schedules: []Schedule{{AppendOnly: true}}, want: []int{1}},
+		{name: "step fed", schedules: []Schedule{{AppendOnly: true, StepID: stepID(3)}}, want: []int{3}},
+		{name: "step fed without a watermark", schedules: []Schedule{{AppendOnly: true, StepID: stepID(4)}}},
+		{name: "several data sources", schedules: []Schedule{{AppendOnly: true}, {AppendOnly: true, StepID: stepID(3)}, {StepID: stepID(2)}}, want: []int{1, 3}},
+	}
+	for _, test := range tests {
+		var got []int
+		for id := range appendSteps(pipeline, test.schedules) {
+			got = append(got, id)
+		}
+		sort.Ints(got)
+		if !reflect.DeepEqual(got, test.want) {
+			t.Errorf("%s: got append steps %v, want %v", test.name, got, test.want)
+		}
+	}
+}
@@ -0,0 +1,225 @@
+package etl
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"reflect"
+	"sort"
+	"strings"
+	"time"
+)
+
+/*
+Step types, chosen by a step's "type" metadata. A type validates the rest of the step's
+metadata and loads the step's output table inside the transaction the executor opens for
+it, so checks, watermarks and run history work the same for every type. Besides sql and
+stream, the Go transforms in transforms.go register themselves.
+*/
+
+type StepType struct {
+	Name string
+	// Continuous types are not run as part of a pipeline run, e.g. streams which
+	// the StreamManager keeps running
+	Continuous bool
+	// Validate lists what is wrong with the step's metadata
+	Validate func(step *Step) []string
+	// Load writes the step's output and returns how many rows it read and wrote
+	Load func(ctx context.Context, tx *sql.Tx, step *Step, load Load) (Loaded, error)
+}
+
+// Loaded counts the rows a step read from its input and wrote to its output.
+type Loaded struct {
+	Read    int64
+	Written int64
+}
+
+// Load describes the output table a step type is loading into.
+type Load struct {
+	// Table is where the output goes, the step's own table except in previews
+	Table string
+	// Exists is false when the output table has to be created
+	Exists bool
+	// Append keeps the existing rows instead of replacing them
+	Append bool
+	// Incremental steps only read rows past Watermark, if Found
+	Incremental bool
+	Watermark   string
+	Found       bool
+	// Previews only read a sample of each input: at most Limit rows, within
+	// [From, To) of the step's time column when the input has it
+	Limit int
+	From  *time.Time
+	To    *time.Time
+}
+
+// appends is whether the load keeps the existing rows: an incremental load
+// past a stored watermark only reads the new rows, so it appends them too.
+func (l Load) appends() bool {
+	return l.Append || (l.Incremental && l.Found)
+}
+
+// sampled is whether the load only reads a sample of the step's inputs.
+func (l Load) sampled() bool {
+	return l.Limit > 0 || (l.From != nil && l.To != nil)
+}
+
+var stepTypes = make(map[string]*StepType)
+
+// RegisterStepType makes a step type available to steps by name.
+func RegisterStepType(stepType *StepType) {
+	stepTypes[stepType.Name] = stepType
+}
+
+func LookupStepType(name string) (*StepType, bool) {
+	stepType, ok := stepTypes[name]
+	return stepType, ok
+}
+
+func StepTypeNames() []string {
+	names := make([]string, 0, len(stepTypes))
+	for name := range stepTypes {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+func init() {
+	RegisterStepType(&StepType{Name: StepTypeSQL, Validate: validateSQLStep, Load: loadSQL})
+	RegisterStepType(&StepType{Name: StepTypeStream, Continuous: true, Validate: validateStreamStep})
+}
+
+func validateStepType(step *Step) []string {
+	stepType, ok := LookupStepType(step.Type())
+	if !ok {
+		return []string{fmt.Sprintf("step %d has unknown type %q, expected one of %s",
+			step.ID, step.Type(), strings.Join(StepTypeNames(), ", "))}
+	}
+	if stepType.Validate == nil {
+		return nil
+	}
+	var problems []string
+	for _, problem := range stepType.Validate(step) {
+		problems = append(problems, fmt.Sprintf("step %d: %s", step.ID, problem))
+	}
+	return problems
+}
+
+func validateSQLStep(step *Step) []string {
+	return nil
+}
+
+func validateStreamStep(step *Step) []string {
+	_, err := ParseStreamConfig(step)
+	var invalid *ValidationError
+	if errors.As(err, &invalid) {
+		return invalid.Problems
+	}
+	return nil
+}
+
+func loadSQL(ctx context.Context, tx *sql.Tx, step *Step, load Load) (Loaded, error) {
+	query := strings.TrimSpace(strings.TrimRight(strings.TrimSpace(step.Query), ";"))
+	if query == "" {
+		return Loaded{}, fmt.Errorf("step has no query")
+	}
+	if load.Incremental {
+		query = applyWatermark(query, step, load.Watermark, load.Found)
+	}
+	if load.sampled() {
+		var err error
+		if query, err = sampleInputs(ctx, tx, query, step, load); err != nil {
+			return Loaded{}, err
+		}
+	}
+
+	var statement string
+	switch {
+	case !load.Exists:
+		statement = fmt.Sprintf("CREATE TABLE %s AS %s", load.Table, query)
+	case load.appends():
+		statement = fmt.Sprintf("INSERT INTO %s %s", load.Table, query)
+	default:
+		if _, err := tx.ExecContext(ctx, fmt.Sprintf("TRUNCATE TABLE %s", load.Table)); err != nil {
+			return Loaded{}, fmt.Errorf("error truncating %s: %v", load.Table, err)
+		}
+		statement = fmt.Sprintf("INSERT INTO %s %s", load.Table, query)
+	}
+
+	result, err := tx.ExecContext(ctx, statement)
+	if err != nil {
+		return Loaded{}, fmt.Errorf("error executing query: %v", err)
+	}
+	loaded := Loaded{}
+	loaded.Written, _ = result.RowsAffected()
+	if loaded.Read, err = countInput(ctx, tx, step, load, loaded.Written); err != nil {
+		return Loaded{}, err
+	}
+	return loaded, nil
+}
+
+// countInput counts the rows of the step's input table, narrowed to its
+// watermark and window like the step's own read when the input has those
+// columns. A query without an input table reads what it selects, which is what
+// it wrote.
+func countInput(ctx context.Context, tx *sql.Tx, step *Step, load Load, written int64) (int64, error) {
+	input := step.InputTable()
+	if input == "" {
+		return written, nil
+	}
+	query := "SELECT * FROM " + quoteTableName(input)
+	if load.Incremental && load.Found {
+		found, err := hasColumn(ctx, tx, input, step.WatermarkColumn())
+		if err != nil {
+			return 0, err
+		}
+		if found {
+			query = applyWatermark(query, step, load.Watermark, true)
+		}
+	}
+	if load.From != nil && load.To != nil {
+		found, err := hasColumn(ctx, tx, input, step.TimeColumn())
+		if err != nil {
+			return 0, err
+		}
+		if found {
+			query = applyWindow(query, step.TimeColumn(), *load.From, *load.To)
+		}
+	}
+
+	var count int64
+	if err := tx.QueryRowContext(ctx, fmt.Sprintf("SELECT COUNT(*) FROM (%s) AS input", query)).Scan(&count); err != nil {
+		return 0, fmt.Errorf("error counting %s: %v", input, err)
+	}
+	return count, nil
+}
+
+// hasColumn reports whether table, resolved through the search_path, has column.
+func hasColumn(ctx context.Context, tx *sql.Tx, table string, column string) (bool, error) {
+	if column == "" {
+		return false, nil
+	}
+	var found bool
+	err := tx.QueryRowContext(ctx, `
+		SELECT EXISTS (
+			SELECT FROM pg_attribute
+			WHERE attrelid = to_regclass($1) AND attname = $2 AND attnum > 0 AND NOT attisdropped
+		)`, quoteTableName(table), column).Scan(&found)
+	if err != nil {
+		return false, fmt.Errorf("error reading the columns of %s: %v", table, err)
+	}
+	return found, nil
+}
+
+// OutputChanged reports whether the step's output table may no longer have the
+// columns an earlier version of the step created it with.
+func (s *Step) OutputChanged(previous *Step) bool {
+	if previous.Query != s.Query || previous.Layer != s.Layer || previous.Type() != s.Type() ||
+		previous.WatermarkColumn() != s.WatermarkColumn() {
+		return true
+	}
+	// Go transforms are configured entirely through metadata
+	return s.Type() != StepTypeSQL && !reflect.DeepEqual(previous.Metadata, s.Metadata)
+}
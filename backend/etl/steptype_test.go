@@ -0,0 +1,26 @@
+package etl
+
+import (
+	"testing"
+)
+
+func TestLoadAppends(t *testing.T) {
+	tests := []struct {
+		name string
+		load Load
+		want bool
+	}{
+		{name: "full load", load: Load{}, want: false},
+		{name: "append only", load: Load{Append: true}, want: true},
+		{name: "first incremental load", load: Load{Incremental: true}, want: false},
+		{name: "incremental past a watermark", load: Load{Incremental: true, Found: true}, want: true},
+		{name: "append only incremental", load: Load{Append: true, Incremental: true}, want: true},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if got := test.load.appends(); got != test.want {
+				t.Errorf("appends() = %v, want %v", got, test.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,370 @@
+package etl
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+
+	"github.com/lib/pq"
+)
+
+/*
+Creates, updates and deletes pipelines, steps, step metadata and step checks. Step changes are
+validated against the rest of the pipeline before anything is written.
+*/
+
+var ErrNotFound = errors.New("not found")
+
+type Store struct {
+	db *sql.DB
+}
+
+func NewStore(db *sql.DB) *Store {
+	return &Store{db: db}
+}
+
+func (s *Store) GetPipeline(pipelineID int) (*Pipeline, error) {
+	p, err := LoadPipeline(s.db, pipelineID)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, ErrNotFound
+	}
+	return p, err
+}
+
+func (s *Store) ListPipelines() ([]*Pipeline, error) {
+	return LoadPipelines(s.db)
+}
+
+func (s *Store) CreatePipeline(p *Pipeline) error {
+	if p.Name == "" {
+		return &ValidationError{Problems: []string{"pipeline has no name"}}
+	}
+	if p.WorkspaceID == 0 {
+		p.WorkspaceID = 1
+	}
+	err := s.db.QueryRow(`
+		INSERT INTO prod.etl_pipeline (name, description, workspace_id)
+		VALUES ($1, $2, $3)
+		RETURNING pipeline_id`, p.Name, p.Description, p.WorkspaceID).Scan(&p.ID)
+	if err != nil {
+		return fmt.Errorf("error creating pipeline: %v", err)
+	}
+	p.Steps = []*Step{}
+	return nil
+}
+
+func (s *Store) UpdatePipeline(p *Pipeline) error {
+	if p.Name == "" {
+		return &ValidationError{Problems: []string{"pipeline has no name"}}
+	}
+	if p.WorkspaceID == 0 {
+		p.WorkspaceID = 1
+	}
+	result, err := s.db.Exec(`
+		UPDATE prod.etl_pipeline
+		SET name = $1, description = $2, workspace_id = $3, updated_at = CURRENT_TIMESTAMP
+		WHERE pipeline_id = $4`, p.Name, p.Description, p.WorkspaceID, p.ID)
+	if err != nil {
+		return fmt.Errorf("error updating pipeline %d: %v", p.ID, err)
+	}
+	return requireAffected(result)
+}
+
+func (s *Store) DeletePipeline(pipelineID int) error {
+	result, err := s.db.Exec(`DELETE FROM prod.etl_pipeline WHERE pipeline_id = $1`, pipelineID)
+	if err != nil {
+		return fmt.Errorf("error deleting pipeline %d: %v", pipelineID, err)
+	}
+	return requireAffected(result)
+}
+
+func (s *Store) CreateStep(step *Step) error {
+	p, err := s.GetPipeline(step.PipelineID)
+	if err != nil {
+		return err
+	}
+	if step.Order == 0 {
+		step.Order = len(p.Steps) + 1
+	}
+	if step.Metadata == nil {
+		step.Metadata = make(map[string]string)
+	}
+	if _, ok := step.Metadata["type"]; !ok {
+		step.Metadata["type"] = StepTypeSQL
+	}
+	if err := ValidateSteps(append(p.Steps, step)); err != nil {
+		return err
+	}
+	var problems []string
+	for _, check := range step.Checks {
+		problems = append(problems, check.Validate()...)
+	}
+	if len(problems) > 0 {
+		return &ValidationError{Problems: problems}
+	}
+
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	err = tx.QueryRow(`
+		INSERT INTO prod.etl_steps (pipeline_id, name, description, query, layer, step_order, child_step_id)
+		VALUES ($1, $2, $3, $4, $5, $6, $7)
+		RETURNING step_id`,
+		step.PipelineID, step.Name, step.Description, step.Query, step.Layer, step.Order, nullInt(step.ChildStepID)).Scan(&step.ID)
+	if err != nil {
+		return fmt.Errorf("error creating step: %v", err)
+	}
+	if err := writeStepMetadata(tx, step); err != nil {
+		return err
+	}
+	for _, check := range step.Checks {
+		check.StepID = step.ID
+		if err := insertCheck(tx, check); err != nil {
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+// UpdateStep replaces the step, including its metadata, and returns the
+// previous version so callers can tell what changed.
+func (s *Store) UpdateStep(step *Step) (*Step, error) {
+	p, err := s.GetPipeline(step.PipelineID)
+	if err != nil {
+		return nil, err
+	}
+	previous := p.GetStep(step.ID)
+	if previous == nil {
+		return nil, ErrNotFound
+	}
+
+	steps := make([]*Step, 0, len(p.Steps))
+	for _, existing := range p.Steps {
+		if existing.ID == step.ID {
+			steps = append(steps, step)
+		} else {
+			steps = append(steps, existing)
+		}
+	}
+	if step.Metadata == nil {
+		step.Metadata = previous.Metadata
+	}
+	if err := ValidateSteps(steps); err != nil {
+		return nil, err
+	}
+
+	tx, err := s.db.Begin()
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	_, err = tx.Exec(`
+		UPDATE prod.etl_steps
+		SET name = $1, description = $2, query = $3, layer = $4, step_order = $5, child_step_id = $6,
+			updated_at = CURRENT_TIMESTAMP
+		WHERE step_id = $7`,
+		step.Name, step.Description, step.Query, step.Layer, step.Order, nullInt(step.ChildStepID), step.ID)
+	if err != nil {
+		return nil, fmt.Errorf("error updating step %d: %v", step.ID, err)
+	}
+	if _, err := tx.Exec(`DELETE FROM prod.etl_step_metadata WHERE step_id = $1`, step.ID); err != nil {
+		return nil, fmt.Errorf("error clearing metadata for step %d: %v", step.ID, err)
+	}
+	if err := writeStepMetadata(tx, step); err != nil {
+		return nil, err
+	}
+	return previous, tx.Commit()
+}
+
+func (s *Store) DeleteStep(pipelineID int, stepID int) (*Step, error) {
+	p, err := s.GetPipeline(pipelineID)
+	if err != nil {
+		return nil, err
+	}
+	step := p.GetStep(stepID)
+	if step == nil {
+		return nil, ErrNotFound
+	}
+	if _, err := s.db.Exec(`DELETE FROM prod.etl_steps WHERE step_id = $1`, stepID); err != nil {
+		return nil, fmt.Errorf("error deleting step %d: %v", stepID, err)
+	}
+	return step, nil
+}
+
+// ReorderSteps sets step_order from the position of each step in stepIDs,
+// which must list every step of the pipeline with each step after the one it
+// reads from.
+func (s *Store) ReorderSteps(pipelineID int, stepIDs []int) error {
+	p, err := s.GetPipeline(pipelineID)
+	if err != nil {
+		return err
+	}
+
+	var problems []string
+	position := make(map[int]int, len(stepIDs))
+	for i, id := range stepIDs {
+		if p.GetStep(id) == nil {
+			problems = append(problems, fmt.Sprintf("step %d is not in pipeline %d", id, pipelineID))
+		}
+		if _, seen := position[id]; seen {
+			problems = append(problems, fmt.Sprintf("step %d is listed more than once", id))
+		}
+		position[id] = i
+	}
+	for _, step := range p.Steps {
+		pos, ok := position[step.ID]
+		if !ok {
+			problems = append(problems, fmt.Sprintf("step %d is missing from the new order", step.ID))
+			continue
+		}
+		if step.ChildStepID != nil {
+			if upstream, ok := position[*step.ChildStepID]; ok && upstream > pos {
+				problems = append(problems, fmt.Sprintf("step %d must come after step %d which it reads from", step.ID, *step.ChildStepID))
+			}
+		}
+	}
+	if len(problems) > 0 {
+		return &ValidationError{Problems: problems}
+	}
+
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	for i, id := range stepIDs {
+		if _, err := tx.Exec(`
+			UPDATE prod.etl_steps SET step_order = $1, updated_at = CURRENT_TIMESTAMP
+			WHERE step_id = $2`, i+1, id); err != nil {
+			return fmt.Errorf("error reordering step %d: %v", id, err)
+		}
+	}
+	return tx.Commit()
+}
+
+func writeStepMetadata(tx *sql.Tx, step *Step) error {
+	for key, value := range step.Metadata {
+		if _, err := tx.Exec(`
+			INSERT INTO prod.etl_step_metadata (step_id, key, value)
+			VALUES ($1, $2, $3)`, step.ID, key, value); err != nil {
+			return fmt.Errorf("error writing metadata %q for step %d: %v", key, step.ID, err)
+		}
+	}
+	return nil
+}
+
+func requireAffected(result sql.Result) error {
+	affected, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if affected == 0 {
+		return ErrNotFound
+	}
+	return nil
+}
+
+func nullInt(value *int) interface{} {
+	if value == nil {
+		return nil
+	}
+	return *value
+}
+
+func (s *Store) getStep(pipelineID int, stepID int) (*Step, error) {
+	p, err := s.GetPipeline(pipelineID)
+	if err != nil {
+		return nil, err
+	}
+	step := p.GetStep(stepID)
+	if step == nil {
+		return nil, ErrNotFound
+	}
+	return step, nil
+}
+
+func (s *Store) ListChecks(pipelineID int, stepID int) ([]*Check, error) {
+	step, err := s.getStep(pipelineID, stepID)
+	if err != nil {
+		return nil, err
+	}
+	if step.Checks == nil {
+		return []*Check{}, nil
+	}
+	return step.Checks, nil
+}
+
+func (s *Store) CreateCheck(pipelineID int, check *Check) error {
+	if _, err := s.getStep(pipelineID, check.StepID); err != nil {
+		return err
+	}
+	if problems := check.Validate(); len(problems) > 0 {
+		return &ValidationError{Problems: problems}
+	}
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if err := insertCheck(tx, check); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+func insertCheck(tx *sql.Tx, check *Check) error {
+	err := tx.QueryRow(`
+		INSERT INTO prod.etl_step_checks (step_id, name, check_type, column_name, accepted_values, min_value, max_value, sql, severity)
+		VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9)
+		RETURNING check_id`,
+		check.StepID, check.Name, check.Type, nullString(check.Column), pq.Array(check.Values),
+		nullFloat(check.Min), nullFloat(check.Max), nullString(check.SQL), check.Severity).Scan(&check.ID)
+	if err != nil {
+		return fmt.Errorf("error creating check %q: %v", check.Name, err)
+	}
+	return nil
+}
+
+func (s *Store) UpdateCheck(pipelineID int, check *Check) error {
+	if _, err := s.getStep(pipelineID, check.StepID); err != nil {
+		return err
+	}
+	if problems := check.Validate(); len(problems) > 0 {
+		return &ValidationError{Problems: problems}
+	}
+	result, err := s.db.Exec(`
+		UPDATE prod.etl_step_checks
+		SET name = $1, check_type = $2, column_name = $3, accepted_values = $4, min_value = $5, max_value = $6,
+			sql = $7, severity = $8, updated_at = CURRENT_TIMESTAMP
+		WHERE check_id = $9 AND step_id = $10`,
+		check.Name, check.Type, nullString(check.Column), pq.Array(check.Values), nullFloat(check.Min),
+		nullFloat(check.Max), nullString(check.SQL), check.Severity, check.ID, check.StepID)
+	if err != nil {
+		return fmt.Errorf("error updating check %d: %v", check.ID, err)
+	}
+	return requireAffected(result)
+}
+
+func (s *Store) DeleteCheck(pipelineID int, stepID int, checkID int) error {
+	if _, err := s.getStep(pipelineID, stepID); err != nil {
+		return err
+	}
+	result, err := s.db.Exec(`DELETE FROM prod.etl_step_checks WHERE check_id = $1 AND step_id = $2`, checkID, stepID)
+	if err != nil {
+		return fmt.Errorf("error deleting check %d: %v", checkID, err)
+	}
+	return requireAffected(result)
+}
+
+func nullFloat(value *float64) interface{} {
+	if value == nil {
+		return nil
+	}
+	return *value
+}
@@ -0,0 +1,471 @@
+package etl
+
+import (
+	"fmt"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+/*
+Streaming steps. A step with "type" metadata "stream" consumes a Kafka topic instead of
+running a query, configured through its metadata:
+
+	topic       topic to consume (required)
+	filter      conditions a message must meet, e.g. "operation_type = Cutting AND duration_seconds > 2"
+	fields      comma separated fields to keep
+	window      tumbling window length in seconds; with it messages are aggregated
+	group_by    comma separated fields to aggregate by within a window
+	aggregates  e.g. "count, avg(duration_seconds), max(duration_seconds)"
+	time_field  field holding the event time, "timestamp" by default
+	lateness    seconds a window stays open for late messages, 5 by default
+	sink        "postgres" (the step's table) or "csv", postgres by default
+	group_id    consumer group, "etl-step-<step_id>" by default
+*/
+
+const (
+	SinkPostgres = "postgres"
+	SinkCSV      = "csv"
+
+	defaultTimeField = "timestamp"
+	defaultLateness  = 5 * time.Second
+)
+
+type StreamConfig struct {
+	Topic      string
+	Filter     []Condition
+	Fields     []string
+	Window     time.Duration
+	GroupBy    []string
+	Aggregates []Aggregate
+	TimeField  string
+	Lateness   time.Duration
+	Sink       string
+	GroupID    string
+}
+
+type Condition struct {
+	Field    string
+	Operator string
+	Value    string
+}
+
+type Aggregate struct {
+	Function string
+	Field    string
+}
+
+// Column is the name the aggregate is written under, e.g. avg_duration_seconds.
+func (a Aggregate) Column() string {
+	if a.Field == "" {
+		return a.Function
+	}
+	return a.Function + "_" + a.Field
+}
+
+var (
+	conditionPattern = regexp.MustCompile(`^([A-Za-z_][A-Za-z0-9_]*)\s*(>=|<=|!=|=|>|<)\s*(.+)$`)
+	aggregatePattern = regexp.MustCompile(`(?i)^(count|sum|avg|min|max)\s*(?:\(\s*([A-Za-z_][A-Za-z0-9_]*|\*)?\s*\))?$`)
+	andPattern       = regexp.MustCompile(`(?i)\s+and\s+`)
+)
+
+func ParseStreamConfig(step *Step) (*StreamConfig, error) {
+	meta := step.Metadata
+	config := &StreamConfig{
+		Topic:     strings.TrimSpace(meta["topic"]),
+		TimeField: strings.TrimSpace(meta["time_field"]),
+		Lateness:  defaultLateness,
+		Sink:      strings.ToLower(strings.TrimSpace(meta["sink"])),
+		GroupID:   strings.TrimSpace(meta["group_id"]),
+	}
+	var problems []string
+
+	if config.Topic == "" {
+		problems = append(problems, "stream step has no topic")
+	}
+	if config.TimeField == "" {
+		config.TimeField = defaultTimeField
+	}
+	if config.Sink == "" {
+		config.Sink = SinkPostgres
+	}
+	if config.Sink != SinkPostgres && config.Sink != SinkCSV {
+		problems = append(problems, fmt.Sprintf("unknown sink %q", config.Sink))
+	}
+	if config.GroupID == "" {
+		config.GroupID = fmt.Sprintf("etl-step-%d", step.ID)
+	}
+
+	if filter := strings.TrimSpace(meta["filter"]); filter != "" {
+		for _, part := range andPattern.Split(filter, -1) {
+			match := conditionPattern.FindStringSubmatch(strings.TrimSpace(part))
+			if match == nil {
+				problems = append(problems, fmt.Sprintf("invalid filter condition %q", part))
+				continue
+			}
+			config.Filter = append(config.Filter, Condition{
+				Field:    match[1],
+				Operator: match[2],
+				Value:    strings.Trim(strings.TrimSpace(match[3]), `'"`),
+			})
+		}
+	}
+
+	var err error
+	if config.Fields, err = splitFields(meta["fields"]); err != nil {
+		problems = append(problems, err.Error())
+	}
+	if config.GroupBy, err = splitFields(meta["group_by"]); err != nil {
+		problems = append(problems, err.Error())
+	}
+
+	for _, part := range strings.Split(meta["aggregates"], ",") {
+		part = strings.TrimSpace(part)
+		if part == "" {
+			continue
+		}
+		match := aggregatePattern.FindStringSubmatch(part)
+		if match == nil {
+			problems = append(problems, fmt.Sprintf("invalid aggregate %q", part))
+			continue
+		}
+		aggregate := Aggregate{Function: strings.ToLower(match[1]), Field: match[2]}
+		if aggregate.Field == "*" {
+			aggregate.Field = ""
+		}
+		if aggregate.Function != "count" && aggregate.Field == "" {
+			problems = append(problems, fmt.Sprintf("aggregate %q needs a field", part))
+			continue
+		}
+		config.Aggregates = append(config.Aggregates, aggregate)
+	}
+
+	if value := strings.TrimSpace(meta["window"]); value != "" {
+		seconds, err := strconv.Atoi(value)
+		if err != nil || seconds <= 0 {
+			problems = append(problems, fmt.Sprintf("window must be a positive number of seconds, got %q", value))
+		}
+		config.Window = time.Duration(seconds) * time.Second
+	}
+	if value := strings.TrimSpace(meta["lateness"]); value != "" {
+		seconds, err := strconv.Atoi(value)
+		if err != nil || seconds < 0 {
+			problems = append(problems, fmt.Sprintf("lateness must be a number of seconds, got %q", value))
+		}
+		config.Lateness = time.Duration(seconds) * time.Second
+	}
+
+	if config.Window > 0 {
+		if len(config.Fields) > 0 {
+			problems = append(problems, "fields cannot be used with window; use group_by and aggregates")
+		}
+		if len(config.Aggregates) == 0 {
+			config.Aggregates = []Aggregate{{Function: "count"}}
+		}
+	} else if len(config.Aggregates) > 0 || len(config.GroupBy) > 0 {
+		problems = append(problems, "aggregates and group_by need a window")
+	}
+
+	if len(problems) > 0 {
+		return nil, &ValidationError{Problems: problems}
+	}
+	return config, nil
+}
+
+func splitFields(value string) ([]string, error) {
+	var fields []string
+	for _, field := range strings.Split(value, ",") {
+		field = strings.TrimSpace(field)
+		if field == "" {
+			continue
+		}
+		if !identifierPattern.MatchString(field) {
+			return nil, fmt.Errorf("invalid field name %q", field)
+		}
+		fields = append(fields, field)
+	}
+	return fields, nil
+}
+
+func (c *Condition) Match(record map[string]interface{}) bool {
+	value, ok := record[c.Field]
+	if !ok || value == nil {
+		return false
+	}
+
+	var cmp int
+	if number, isNumber := value.(float64); isNumber {
+		expected, err := strconv.ParseFloat(c.Value, 64)
+		if err != nil {
+			return false
+		}
+		switch {
+		case number < expected:
+			cmp = -1
+		case number > expected:
+			cmp = 1
+		}
+	} else {
+		cmp = strings.Compare(fmt.Sprint(value), c.Value)
+	}
+
+	switch c.Operator {
+	case "=":
+		return cmp == 0
+	case "!=":
+		return cmp != 0
+	case ">":
+		return cmp > 0
+	case ">=":
+		return cmp >= 0
+	case "<":
+		return cmp < 0
+	case "<=":
+		return cmp <= 0
+	}
+	return false
+}
+
+type window struct {
+	start       time.Time
+	firstOffset int64
+	groups      map[string]*windowGroup
+}
+
+type windowGroup struct {
+	keys   []interface{}
+	count  int64
+	sums   map[string]float64
+	counts map[string]int64
+	mins   map[string]float64
+	maxs   map[string]float64
+}
+
+// StreamProcessor applies a stream step's filter, projection and windowed
+// aggregation to the messages of one partition. It tracks offsets so a
+// message is only committed once the rows it contributes to have been emitted,
+// and the end of the windows emitted so messages replayed from an open
+// window's first offset are not counted again in windows already closed.
+type StreamProcessor struct {
+	config       *StreamConfig
+	pending      []map[string]interface{}
+	windows      map[int64]*window
+	closedBefore time.Time
+	eventTime    time.Time
+	nextOffset   int64
+
+	Filtered int64
+	Late     int64
+}
+
+func NewStreamProcessor(config *StreamConfig) *StreamProcessor {
+	return &StreamProcessor{
+		config:     config,
+		windows:    make(map[int64]*window),
+		nextOffset: -1,
+	}
+}
+
+func (p *StreamProcessor) Add(record map[string]interface{}, received time.Time, offset int64) {
+	p.nextOffset = offset + 1
+
+	for _, condition := range p.config.Filter {
+		if !condition.Match(record) {
+			p.Filtered++
+			return
+		}
+	}
+
+	if p.config.Window == 0 {
+		p.pending = append(p.pending, p.project(record))
+		return
+	}
+
+	eventTime := p.eventTimeOf(record, received)
+	start := eventTime.Truncate(p.config.Window)
+	if start.Before(p.closedBefore) {
+		p.Late++
+		return
+	}
+	if eventTime.After(p.eventTime) {
+		p.eventTime = eventTime
+	}
+
+	w, ok := p.windows[start.UnixNano()]
+	if !ok {
+		w = &window{start: start, firstOffset: offset, groups: make(map[string]*windowGroup)}
+		p.windows[start.UnixNano()] = w
+	}
+
+	keys := make([]interface{}, len(p.config.GroupBy))
+	for i, field := range p.config.GroupBy {
+		keys[i] = record[field]
+	}
+	groupKey := fmt.Sprint(keys...)
+	group, ok := w.groups[groupKey]
+	if !ok {
+		group = &windowGroup{
+			keys:   keys,
+			sums:   make(map[string]float64),
+			counts: make(map[string]int64),
+			mins:   make(map[string]float64),
+			maxs:   make(map[string]float64),
+		}
+		w.groups[groupKey] = group
+	}
+
+	group.count++
+	for _, aggregate := range p.config.Aggregates {
+		if aggregate.Field == "" {
+			continue
+		}
+		number, ok := toFloat(record[aggregate.Field])
+		if !ok {
+			continue
+		}
+		field := aggregate.Field
+		if group.counts[field] == 0 || number < group.mins[field] {
+			group.mins[field] = number
+		}
+		if group.counts[field] == 0 || number > group.maxs[field] {
+			group.maxs[field] = number
+		}
+		group.sums[field] += number
+		group.counts[field]++
+	}
+}
+
+// ClosedBefore is the end of the last window emitted; messages for earlier
+// windows are dropped.
+func (p *StreamProcessor) ClosedBefore() time.Time {
+	return p.closedBefore
+}
+
+// Resume picks up from a processor that had emitted every window ending by
+// closedBefore, as committed with the offset consumption resumes from.
+func (p *StreamProcessor) Resume(closedBefore time.Time) {
+	if closedBefore.After(p.closedBefore) {
+		p.closedBefore = closedBefore
+	}
+}
+
+// Skip moves past a message that could not be decoded.
+func (p *StreamProcessor) Skip(offset int64) {
+	p.nextOffset = offset + 1
+}
+
+func (p *StreamProcessor) project(record map[string]interface{}) map[string]interface{} {
+	if len(p.config.Fields) == 0 {
+		return record
+	}
+	row := make(map[string]interface{}, len(p.config.Fields))
+	for _, field := range p.config.Fields {
+		row[field] = record[field]
+	}
+	return row
+}
+
+func (p *StreamProcessor) eventTimeOf(record map[string]interface{}, received time.Time) time.Time {
+	if value, ok := record[p.config.TimeField].(string); ok {
+		if parsed, err := time.Parse(time.RFC3339Nano, value); err == nil {
+			return parsed
+		}
+	}
+	if received.IsZero() {
+		return time.Now()
+	}
+	return received
+}
+
+// Flush returns the rows ready to be written: every pending row, and the
+// windows that event time has moved past (all of them when force is set).
+// commitOffset is the offset consumption can resume from once those rows are
+// written, or -1 when nothing new can be committed.
+func (p *StreamProcessor) Flush(force bool) (rows []map[string]interface{}, commitOffset int64) {
+	rows = p.pending
+	p.pending = nil
+
+	var closing []*window
+	for key, w := range p.windows {
+		end := w.start.Add(p.config.Window)
+		if force || !p.eventTime.Before(end.Add(p.config.Lateness)) {
+			closing = append(closing, w)
+			delete(p.windows, key)
+			if end.After(p.closedBefore) {
+				p.closedBefore = end
+			}
+		}
+	}
+	sort.Slice(closing, func(i, j int) bool { return closing[i].start.Before(closing[j].start) })
+	for _, w := range closing {
+		rows = append(rows, p.windowRows(w)...)
+	}
+
+	commitOffset = p.nextOffset
+	for _, w := range p.windows {
+		if w.firstOffset < commitOffset {
+			commitOffset = w.firstOffset
+		}
+	}
+	return rows, commitOffset
+}
+
+func (p *StreamProcessor) windowRows(w *window) []map[string]interface{} {
+	keys := make([]string, 0, len(w.groups))
+	for key := range w.groups {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	rows := make([]map[string]interface{}, 0, len(keys))
+	for _, key := range keys {
+		group := w.groups[key]
+		row := map[string]interface{}{
+			"window_start": w.start,
+			"window_end":   w.start.Add(p.config.Window),
+		}
+		for i, field := range p.config.GroupBy {
+			row[field] = group.keys[i]
+		}
+		for _, aggregate := range p.config.Aggregates {
+			field := aggregate.Field
+			var value interface{}
+			switch {
+			case aggregate.Function == "count" && field == "":
+				value = group.count
+			case aggregate.Function == "count":
+				value = group.counts[field]
+			case group.counts[field] == 0:
+				value = nil
+			case aggregate.Function == "sum":
+				value = group.sums[field]
+			case aggregate.Function == "avg":
+				value = group.sums[field] / float64(group.counts[field])
+			case aggregate.Function == "min":
+				value = group.mins[field]
+			case aggregate.Function == "max":
+				value = group.maxs[field]
+			}
+			row[aggregate.Column()] = value
+		}
+		rows = append(rows, row)
+	}
+	return rows
+}
+
+func toFloat(value interface{}) (float64, bool) {
+	switch v := value.(type) {
+	case float64:
+		return v, true
+	case int:
+		return float64(v), true
+	case int64:
+		return float64(v), true
+	case string:
+		number, err := strconv.ParseFloat(v, 64)
+		return number, err == nil
+	}
+	return 0, false
+}
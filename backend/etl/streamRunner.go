@@ -0,0 +1,519 @@
+package etl
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"foo/backend/connections"
+	"log"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/IBM/sarama"
+)
+
+/*
+Runs every stream step as a Kafka consumer group member, writing what it emits to the
+step's Postgres table or a CSV file. Offsets are committed after each write, so a
+restarted stream resumes from the last rows it wrote. A windowed step resumes from the
+first message of its oldest open window, and commits the end of the windows it has
+written as the offset's metadata so their messages are not aggregated twice.
+*/
+
+const (
+	streamFlushInterval = time.Second
+	streamBatchSize     = 500
+	streamRetryDelay    = 10 * time.Second
+)
+
+type StreamStatus struct {
+	StepID      int        `json:"step_id"`
+	PipelineID  int        `json:"pipeline_id"`
+	Topic       string     `json:"topic"`
+	GroupID     string     `json:"group_id"`
+	Sink        string     `json:"sink"`
+	Target      string     `json:"target"`
+	Running     bool       `json:"running"`
+	Messages    int64      `json:"messages"`
+	Filtered    int64      `json:"filtered"`
+	Late        int64      `json:"late"`
+	RowsWritten int64      `json:"rows_written"`
+	LastCommit  *time.Time `json:"last_commit,omitempty"`
+	LastError   string     `json:"last_error,omitempty"`
+}
+
+type stream struct {
+	step        *Step
+	workspaceID int
+	config      *StreamConfig
+	key         string
+	cancel      context.CancelFunc
+	done        chan struct{}
+	executor    *Executor
+
+	mutex  sync.Mutex
+	status StreamStatus
+
+	// writeMutex serialises writes from the partitions of the topic
+	writeMutex sync.Mutex
+	columns    []string
+	types      map[string]string
+	csv        *connections.CSVConn
+}
+
+type StreamManager struct {
+	db       *sql.DB
+	executor *Executor
+	mutex    sync.Mutex
+	streams  map[int]*stream
+}
+
+func NewStreamManager(db *sql.DB, executor *Executor) *StreamManager {
+	return &StreamManager{
+		db:       db,
+		executor: executor,
+		streams:  make(map[int]*stream),
+	}
+}
+
+// Run keeps a consumer going for every stream step, picking up added, changed
+// and removed steps each time the pipelines are reloaded.
+func (m *StreamManager) Run(ctx context.Context) {
+	ticker := time.NewTicker(schedulerReload)
+	defer ticker.Stop()
+
+	for {
+		if err := m.Reload(ctx); err != nil {
+			log.Printf("Error reloading stream steps: %v", err)
+		}
+		select {
+		case <-ctx.Done():
+			m.stopAll()
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+func (m *StreamManager) Reload(ctx context.Context) error {
+	pipelines, err := LoadPipelines(m.db)
+	if err != nil {
+		return err
+	}
+
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	wanted := make(map[int]bool)
+	for _, pipeline := range pipelines {
+		for _, step := range pipeline.Steps {
+			if step.Type() != StepTypeStream {
+				continue
+			}
+			wanted[step.ID] = true
+			key := streamKey(pipeline, step)
+			if existing, ok := m.streams[step.ID]; ok {
+				if existing.key == key {
+					continue
+				}
+				existing.stop()
+				delete(m.streams, step.ID)
+			}
+
+			config, err := ParseStreamConfig(step)
+			if err != nil {
+				log.Printf("Not starting stream step %d: %v", step.ID, err)
+				continue
+			}
+			m.streams[step.ID] = m.start(ctx, pipeline, step, config, key)
+		}
+	}
+	for id, existing := range m.streams {
+		if !wanted[id] {
+			existing.stop()
+			delete(m.streams, id)
+		}
+	}
+	return nil
+}
+
+func (m *StreamManager) start(ctx context.Context, pipeline *Pipeline, step *Step, config *StreamConfig, key string) *stream {
+	streamCtx, cancel := context.WithCancel(ctx)
+	s := &stream{
+		step:        step,
+		workspaceID: pipeline.WorkspaceID,
+		config:      config,
+		key:         key,
+		cancel:      cancel,
+		done:        make(chan struct{}),
+		executor:    m.executor,
+		status: StreamStatus{
+			StepID:     step.ID,
+			PipelineID: pipeline.ID,
+			Topic:      config.Topic,
+			GroupID:    config.GroupID,
+			Sink:       config.Sink,
+			Target:     step.QualifiedTableName(),
+		},
+	}
+	if config.Sink == SinkCSV {
+		s.csv = connections.NewCSVConn(fmt.Sprintf("%s_%s", step.Layer.Schema(), step.TableName()))
+		s.status.Target = s.csv.FilePath
+	}
+
+	log.Printf("Starting stream step %d (%s) on topic %s", step.ID, step.Name, config.Topic)
+	go s.run(streamCtx)
+	return s
+}
+
+func (m *StreamManager) stopAll() {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	for id, existing := range m.streams {
+		existing.stop()
+		delete(m.streams, id)
+	}
+}
+
+func (m *StreamManager) Statuses() []StreamStatus {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	statuses := make([]StreamStatus, 0, len(m.streams))
+	for _, s := range m.streams {
+		s.mutex.Lock()
+		statuses = append(statuses, s.status)
+		s.mutex.Unlock()
+	}
+	sort.Slice(statuses, func(i, j int) bool { return statuses[i].StepID < statuses[j].StepID })
+	return statuses
+}
+
+// streamKey changes whenever anything the running consumer depends on does.
+func streamKey(pipeline *Pipeline, step *Step) string {
+	keys := make([]string, 0, len(step.Metadata))
+	for key, value := range step.Metadata {
+		keys = append(keys, key+"="+value)
+	}
+	sort.Strings(keys)
+	return fmt.Sprintf("%d|%s|%s", pipeline.WorkspaceID, step.Layer, strings.Join(keys, "|"))
+}
+
+func (s *stream) stop() {
+	s.cancel()
+	<-s.done
+	if s.csv != nil {
+		s.csv.CloseConnection()
+	}
+}
+
+func (s *stream) setError(err error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	message := ""
+	if err != nil {
+		message = err.Error()
+	}
+	if message != "" && message != s.status.LastError {
+		log.Printf("Stream step %d: %v", s.step.ID, err)
+	}
+	s.status.LastError = message
+}
+
+func (s *stream) setRunning(running bool) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.status.Running = running
+}
+
+func (s *stream) run(ctx context.Context) {
+	defer close(s.done)
+	defer s.setRunning(false)
+
+	for ctx.Err() == nil {
+		group, err := connections.NewKafkaConn(s.config.GroupID).NewConsumerGroup(s.config.GroupID)
+		if err != nil {
+			s.setError(err)
+			sleepContext(ctx, streamRetryDelay)
+			continue
+		}
+
+		go func() {
+			for err := range group.Errors() {
+				s.setError(err)
+			}
+		}()
+
+		s.setRunning(true)
+		for ctx.Err() == nil {
+			if err := group.Consume(ctx, []string{s.config.Topic}, s); err != nil {
+				if errors.Is(err, sarama.ErrClosedConsumerGroup) {
+					break
+				}
+				s.setError(err)
+				sleepContext(ctx, streamRetryDelay)
+			}
+		}
+		s.setRunning(false)
+		group.Close()
+	}
+}
+
+func sleepContext(ctx context.Context, d time.Duration) {
+	select {
+	case <-ctx.Done():
+	case <-time.After(d):
+	}
+}
+
+func (s *stream) Setup(sarama.ConsumerGroupSession) error {
+	return nil
+}
+
+func (s *stream) Cleanup(sarama.ConsumerGroupSession) error {
+	return nil
+}
+
+// ConsumeClaim processes one partition. Rows are written in batches, and an
+// offset is only committed once every row built from earlier messages has been
+// written; windows still open when the claim ends are rebuilt by whichever
+// consumer picks the partition up.
+func (s *stream) ConsumeClaim(session sarama.ConsumerGroupSession, claim sarama.ConsumerGroupClaim) error {
+	processor := NewStreamProcessor(s.config)
+	ticker := time.NewTicker(streamFlushInterval)
+	defer ticker.Stop()
+
+	committed, metadata := claim.InitialOffset(), ""
+	if s.config.Window > 0 {
+		var err error
+		metadata, err = connections.NewKafkaConn(s.config.GroupID).CommittedMetadata(s.config.GroupID, claim.Topic(), claim.Partition())
+		if err != nil {
+			s.setError(err)
+			return err
+		}
+		if closedBefore, err := time.Parse(time.RFC3339Nano, metadata); err == nil {
+			processor.Resume(closedBefore)
+		}
+	}
+
+	flush := func(force bool) error {
+		rows, offset := processor.Flush(force)
+		if err := s.write(session.Context(), rows); err != nil {
+			return err
+		}
+		if offset >= 0 {
+			closed := ""
+			if closedBefore := processor.ClosedBefore(); !closedBefore.IsZero() {
+				closed = closedBefore.Format(time.RFC3339Nano)
+			}
+			switch {
+			case offset > committed:
+				session.MarkOffset(claim.Topic(), claim.Partition(), offset, closed)
+				committed, metadata = offset, closed
+			case offset == committed && closed != metadata:
+				// MarkOffset ignores an offset that has not moved, even with new metadata
+				session.ResetOffset(claim.Topic(), claim.Partition(), offset, closed)
+				metadata = closed
+			}
+			session.Commit()
+		}
+
+		now := time.Now()
+		s.mutex.Lock()
+		s.status.Filtered += processor.Filtered
+		s.status.Late += processor.Late
+		s.status.RowsWritten += int64(len(rows))
+		if offset >= 0 {
+			s.status.LastCommit = &now
+		}
+		s.status.LastError = ""
+		s.mutex.Unlock()
+		processor.Filtered, processor.Late = 0, 0
+		return nil
+	}
+
+	received := 0
+	idle := 0
+	for {
+		select {
+		case <-session.Context().Done():
+			return nil
+
+		case message, ok := <-claim.Messages():
+			if !ok {
+				return nil
+			}
+			var record map[string]interface{}
+			if err := json.Unmarshal(message.Value, &record); err != nil {
+				s.setError(fmt.Errorf("skipping message at offset %d: %v", message.Offset, err))
+				record = nil
+			}
+			s.mutex.Lock()
+			s.status.Messages++
+			s.mutex.Unlock()
+
+			if record == nil {
+				processor.Skip(message.Offset)
+			} else {
+				processor.Add(record, message.Timestamp, message.Offset)
+			}
+			received++
+			idle = 0
+			if received >= streamBatchSize {
+				received = 0
+				if err := flush(false); err != nil {
+					s.setError(err)
+					return err
+				}
+			}
+
+		case <-ticker.C:
+			// A window whose topic has gone quiet is closed once nothing has
+			// arrived for a whole window length
+			idle++
+			force := s.config.Window > 0 && time.Duration(idle)*streamFlushInterval >= s.config.Window+s.config.Lateness
+			received = 0
+			if err := flush(force); err != nil {
+				s.setError(err)
+				return err
+			}
+		}
+	}
+}
+
+func (s *stream) write(ctx context.Context, rows []map[string]interface{}) error {
+	if len(rows) == 0 {
+		return nil
+	}
+	s.writeMutex.Lock()
+	defer s.writeMutex.Unlock()
+	if s.columns == nil {
+		s.columns, s.types = s.outputColumns(rows[0])
+	}
+
+	if s.config.Sink == SinkCSV {
+		return s.writeCSV(rows)
+	}
+	return s.writePostgres(ctx, rows)
+}
+
+// outputColumns fixes the columns of the sink: the window, group and aggregate
+// columns for windowed steps, otherwise the projected fields (or those of the
+// first row) typed from their first values.
+func (s *stream) outputColumns(first map[string]interface{}) ([]string, map[string]string) {
+	types := make(map[string]string)
+	var columns []string
+
+	if s.config.Window > 0 {
+		columns = []string{"window_start", "window_end"}
+		types["window_start"] = "TIMESTAMP"
+		types["window_end"] = "TIMESTAMP"
+		for _, field := range s.config.GroupBy {
+			columns = append(columns, field)
+			types[field] = columnType(first[field])
+		}
+		for _, aggregate := range s.config.Aggregates {
+			columns = append(columns, aggregate.Column())
+			if aggregate.Function == "count" {
+				types[aggregate.Column()] = "BIGINT"
+			} else {
+				types[aggregate.Column()] = "DOUBLE PRECISION"
+			}
+		}
+		return columns, types
+	}
+
+	columns = s.config.Fields
+	if len(columns) == 0 {
+		for field := range first {
+			if identifierPattern.MatchString(field) {
+				columns = append(columns, field)
+			}
+		}
+		sort.Strings(columns)
+	}
+	for _, field := range columns {
+		types[field] = columnType(first[field])
+		if field == s.config.TimeField {
+			if _, ok := first[field].(string); ok {
+				types[field] = "TIMESTAMP"
+			}
+		}
+	}
+	return columns, types
+}
+
+func columnType(value interface{}) string {
+	switch value.(type) {
+	case float64:
+		return "DOUBLE PRECISION"
+	case bool:
+		return "BOOLEAN"
+	case time.Time:
+		return "TIMESTAMP"
+	}
+	return "TEXT"
+}
+
+func (s *stream) writePostgres(ctx context.Context, rows []map[string]interface{}) error {
+	db, err := s.executor.workspaceDB(s.workspaceID)
+	if err != nil {
+		return err
+	}
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	definitions := make([]string, len(s.columns))
+	quoted := make([]string, len(s.columns))
+	placeholders := make([]string, len(s.columns))
+	for i, column := range s.columns {
+		quoted[i] = quoteIdentifier(column)
+		definitions[i] = quoted[i] + " " + s.types[column]
+		placeholders[i] = fmt.Sprintf("$%d", i+1)
+	}
+
+	if _, err := tx.ExecContext(ctx, fmt.Sprintf("CREATE SCHEMA IF NOT EXISTS %s", s.step.Layer.Schema())); err != nil {
+		return fmt.Errorf("error creating schema %s: %v", s.step.Layer.Schema(), err)
+	}
+	if _, err := tx.ExecContext(ctx, fmt.Sprintf("CREATE TABLE IF NOT EXISTS %s (%s)",
+		s.step.QualifiedTableName(), strings.Join(definitions, ", "))); err != nil {
+		return fmt.Errorf("error creating %s: %v", s.step.QualifiedTableName(), err)
+	}
+
+	statement, err := tx.PrepareContext(ctx, fmt.Sprintf("INSERT INTO %s (%s) VALUES (%s)",
+		s.step.QualifiedTableName(), strings.Join(quoted, ", "), strings.Join(placeholders, ", ")))
+	if err != nil {
+		return fmt.Errorf("error preparing insert into %s: %v", s.step.QualifiedTableName(), err)
+	}
+	defer statement.Close()
+
+	for _, row := range rows {
+		values := make([]interface{}, len(s.columns))
+		for i, column := range s.columns {
+			values[i] = row[column]
+		}
+		if _, err := statement.ExecContext(ctx, values...); err != nil {
+			return fmt.Errorf("error writing to %s: %v", s.step.QualifiedTableName(), err)
+		}
+	}
+	return tx.Commit()
+}
+
+func (s *stream) writeCSV(rows []map[string]interface{}) error {
+	table := connections.TableDefinition{Name: s.step.TableName(), Schema: s.step.Layer.Schema()}
+	for _, column := range s.columns {
+		table.Columns = append(table.Columns, connections.ColumnDefinition{Name: column, Type: connections.TypeText})
+	}
+	data := make([]interface{}, len(rows))
+	for i, row := range rows {
+		data[i] = row
+	}
+	return s.csv.AddData(table, data)
+}
@@ -0,0 +1,162 @@
+package etl
+
+import (
+	"testing"
+	"time"
+)
+
+var streamEpoch = time.Date(2025, 1, 1, 0, 0, 0, 0, time.UTC)
+
+type streamMessage struct {
+	offset  int64
+	seconds int
+}
+
+func (m streamMessage) record() map[string]interface{} {
+	return map[string]interface{}{
+		"timestamp": streamEpoch.Add(time.Duration(m.seconds) * time.Second).Format(time.RFC3339Nano),
+		"duration":  float64(m.seconds),
+	}
+}
+
+func windowedConfig() *StreamConfig {
+	return &StreamConfig{
+		Window:     10 * time.Second,
+		Lateness:   0,
+		TimeField:  defaultTimeField,
+		Aggregates: []Aggregate{{Function: "count"}, {Function: "max", Field: "duration"}},
+	}
+}
+
+func windowStarts(rows []map[string]interface{}) []int {
+	starts := make([]int, 0, len(rows))
+	for _, row := range rows {
+		starts = append(starts, int(row["window_start"].(time.Time).Sub(streamEpoch).Seconds()))
+	}
+	return starts
+}
+
+func TestStreamProcessorFlush(t *testing.T) {
+	tests := []struct {
+		name       string
+		config     *StreamConfig
+		messages   []streamMessage
+		force      bool
+		wantStarts []int
+		wantCounts []int64
+		wantOffset int64
+	}{
+		{
+			name:       "open window holds its first offset",
+			config:     windowedConfig(),
+			messages:   []streamMessage{{0, 1}, {1, 4}, {2, 12}},
+			wantStarts: []int{0},
+			wantCounts: []int64{2},
+			wantOffset: 2,
+		},
+		{
+			name:       "late message stays in the oldest open window",
+			config:     windowedConfig(),
+			messages:   []streamMessage{{0, 11}, {1, 3}, {2, 15}},
+			wantStarts: []int{0},
+			wantCounts: []int64{1},
+			wantOffset: 0,
+		},
+		{
+			name:       "force closes every window",
+			config:     windowedConfig(),
+			messages:   []streamMessage{{0, 1}, {1, 12}},
+			force:      true,
+			wantStarts: []int{0, 10},
+			wantCounts: []int64{1, 1},
+			wantOffset: 2,
+		},
+		{
+			name:       "nothing closes before event time passes the window",
+			config:     windowedConfig(),
+			messages:   []streamMessage{{5, 1}, {6, 8}},
+			wantStarts: []int{},
+			wantOffset: 5,
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			processor := NewStreamProcessor(test.config)
+			for _, message := range test.messages {
+				processor.Add(message.record(), time.Time{}, message.offset)
+			}
+			rows, offset := processor.Flush(test.force)
+			if got := windowStarts(rows); !equalInts(got, test.wantStarts) {
+				t.Fatalf("got windows starting at %v, want %v", got, test.wantStarts)
+			}
+			for i, row := range rows {
+				if row["count"] != test.wantCounts[i] {
+					t.Errorf("window %d: got count %v, want %d", i, row["count"], test.wantCounts[i])
+				}
+			}
+			if offset != test.wantOffset {
+				t.Errorf("got commit offset %d, want %d", offset, test.wantOffset)
+			}
+		})
+	}
+}
+
+func TestStreamProcessorFlushWithoutWindow(t *testing.T) {
+	processor := NewStreamProcessor(&StreamConfig{
+		TimeField: defaultTimeField,
+		Fields:    []string{"duration"},
+		Filter:    []Condition{{Field: "duration", Operator: ">", Value: "2"}},
+	})
+	for _, message := range []streamMessage{{0, 1}, {1, 3}, {2, 5}} {
+		processor.Add(message.record(), time.Time{}, message.offset)
+	}
+	rows, offset := processor.Flush(false)
+	if len(rows) != 2 || offset != 3 || processor.Filtered != 1 {
+		t.Fatalf("got %d rows, offset %d and %d filtered, want 2 rows, offset 3 and 1 filtered", len(rows), offset, processor.Filtered)
+	}
+	if len(rows[0]) != 1 || rows[0]["duration"] != 3.0 {
+		t.Errorf("got row %v, want only duration 3", rows[0])
+	}
+	if rows, offset := processor.Flush(false); len(rows) != 0 || offset != 3 {
+		t.Errorf("second flush got %d rows and offset %d, want none and 3", len(rows), offset)
+	}
+}
+
+// A processor resuming from the committed offset, the first of the oldest open
+// window, replays messages of windows closed since, which must not be emitted
+// again as partial windows.
+func TestStreamProcessorResume(t *testing.T) {
+	messages := []streamMessage{{0, 15}, {1, 3}, {2, 4}, {3, 18}}
+
+	first := NewStreamProcessor(windowedConfig())
+	for _, message := range messages {
+		first.Add(message.record(), time.Time{}, message.offset)
+	}
+	rows, offset := first.Flush(false)
+	if got := windowStarts(rows); !equalInts(got, []int{0}) {
+		t.Fatalf("got windows starting at %v, want [0]", got)
+	}
+	if offset != 0 {
+		t.Fatalf("got commit offset %d, want 0", offset)
+	}
+
+	messages = append(messages, streamMessage{4, 21})
+	replayed := NewStreamProcessor(windowedConfig())
+	replayed.Resume(first.ClosedBefore())
+	for _, message := range messages[offset:] {
+		replayed.Add(message.record(), time.Time{}, message.offset)
+	}
+	rows, offset = replayed.Flush(true)
+	if got := windowStarts(rows); !equalInts(got, []int{10, 20}) {
+		t.Fatalf("after resuming got windows starting at %v, want [10 20]", got)
+	}
+	if rows[0]["count"] != int64(2) {
+		t.Errorf("got count %v for the window at 10s, want 2", rows[0]["count"])
+	}
+	if replayed.Late != 2 {
+		t.Errorf("got %d messages dropped, want the 2 of the closed window", replayed.Late)
+	}
+	if offset != 5 {
+		t.Errorf("got commit offset %d, want 5", offset)
+	}
+}
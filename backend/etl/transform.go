@@ -0,0 +1,220 @@
+package etl
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"regexp"
+	"strings"
+	"time"
+)
+
+/*
+Go transforms are step types that read every row of their input, the output of the step
+named by child_step_id (or the table in the "input" metadata key), transform them in Go
+and write the result to the step's own table. Incremental transforms only read input rows
+past their watermark.
+*/
+
+const MetaInput = "input"
+
+// insertBatchRows keeps each INSERT well under Postgres' 65535 parameter limit.
+const insertBatchRows = 500
+
+var tableNamePattern = regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9_]*(\.[A-Za-z_][A-Za-z0-9_]*)?$`)
+
+// Rows is a table held in memory. Types are Postgres type names, used to create
+// the output table.
+type Rows struct {
+	Columns []string
+	Types   []string
+	Values  [][]interface{}
+}
+
+func (r *Rows) Index(column string) int {
+	for i, name := range r.Columns {
+		if name == column {
+			return i
+		}
+	}
+	return -1
+}
+
+// TransformFunc turns a step's input rows into its output rows.
+type TransformFunc func(step *Step, input *Rows) (*Rows, error)
+
+// RegisterTransform registers a Go transform as a step type.
+func RegisterTransform(name string, validate func(step *Step) []string, transform TransformFunc) {
+	RegisterStepType(&StepType{
+		Name: name,
+		Validate: func(step *Step) []string {
+			var problems []string
+			input := step.InputTable()
+			if input == "" {
+				problems = append(problems, fmt.Sprintf("%s steps need a child_step_id or %q metadata to read from", name, MetaInput))
+			} else if !tableNamePattern.MatchString(input) {
+				problems = append(problems, fmt.Sprintf("invalid %s %q", MetaInput, input))
+			}
+			if validate != nil {
+				problems = append(problems, validate(step)...)
+			}
+			return problems
+		},
+		Load: func(ctx context.Context, tx *sql.Tx, step *Step, load Load) (Loaded, error) {
+			return loadTransform(ctx, tx, step, load, transform)
+		},
+	})
+}
+
+// InputTable is the table a Go transform reads, unqualified for step tables so
+// the search_path finds them in whichever layer they are in.
+func (s *Step) InputTable() string {
+	if input := strings.TrimSpace(s.Metadata[MetaInput]); input != "" {
+		return input
+	}
+	if s.ChildStepID != nil {
+		return fmt.Sprintf("step_%d", *s.ChildStepID)
+	}
+	return ""
+}
+
+func quoteTableName(name string) string {
+	parts := strings.Split(name, ".")
+	for i, part := range parts {
+		parts[i] = quoteIdentifier(part)
+	}
+	return strings.Join(parts, ".")
+}
+
+func loadTransform(ctx context.Context, tx *sql.Tx, step *Step, load Load, transform TransformFunc) (Loaded, error) {
+	query := "SELECT * FROM " + quoteTableName(step.InputTable())
+	if load.Incremental {
+		query = applyWatermark(query, step, load.Watermark, load.Found)
+	}
+	if load.sampled() {
+		var err error
+		if query, err = sampleQuery(ctx, tx, step.InputTable(), query, step, load); err != nil {
+			return Loaded{}, err
+		}
+	}
+	input, err := readRows(ctx, tx, query)
+	if err != nil {
+		return Loaded{}, fmt.Errorf("error reading %s: %v", step.InputTable(), err)
+	}
+	output, err := transform(step, input)
+	if err != nil {
+		return Loaded{}, err
+	}
+	written, err := writeRows(ctx, tx, output, load)
+	if err != nil {
+		return Loaded{}, err
+	}
+	return Loaded{Read: int64(len(input.Values)), Written: written}, nil
+}
+
+func readRows(ctx context.Context, tx *sql.Tx, query string, args ...interface{}) (*Rows, error) {
+	rows, err := tx.QueryContext(ctx, query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	columnTypes, err := rows.ColumnTypes()
+	if err != nil {
+		return nil, err
+	}
+	result := &Rows{Values: [][]interface{}{}}
+	for _, columnType := range columnTypes {
+		result.Columns = append(result.Columns, columnType.Name())
+		typeName := strings.ToLower(columnType.DatabaseTypeName())
+		if typeName == "" {
+			typeName = "text"
+		}
+		result.Types = append(result.Types, typeName)
+	}
+
+	for rows.Next() {
+		values := make([]interface{}, len(columnTypes))
+		pointers := make([]interface{}, len(columnTypes))
+		for i := range values {
+			pointers[i] = &values[i]
+		}
+		if err := rows.Scan(pointers...); err != nil {
+			return nil, err
+		}
+		for i, value := range values {
+			// lib/pq returns text and numeric values as bytes
+			if bytes, ok := value.([]byte); ok {
+				values[i] = string(bytes)
+			}
+		}
+		result.Values = append(result.Values, values)
+	}
+	return result, rows.Err()
+}
+
+// writeRows creates the output table from the rows' columns if needed and
+// replaces (or appends to) its contents.
+func writeRows(ctx context.Context, tx *sql.Tx, rows *Rows, load Load) (int64, error) {
+	table := load.Table
+	quoted := make([]string, len(rows.Columns))
+	for i, column := range rows.Columns {
+		quoted[i] = quoteIdentifier(column)
+	}
+
+	switch {
+	case !load.Exists:
+		definitions := make([]string, len(rows.Columns))
+		for i := range rows.Columns {
+			definitions[i] = quoted[i] + " " + rows.Types[i]
+		}
+		if _, err := tx.ExecContext(ctx, fmt.Sprintf("CREATE TABLE %s (%s)", table, strings.Join(definitions, ", "))); err != nil {
+			return 0, fmt.Errorf("error creating %s: %v", table, err)
+		}
+	case !load.appends():
+		if _, err := tx.ExecContext(ctx, fmt.Sprintf("TRUNCATE TABLE %s", table)); err != nil {
+			return 0, fmt.Errorf("error truncating %s: %v", table, err)
+		}
+	}
+
+	var written int64
+	for start := 0; start < len(rows.Values); start += insertBatchRows {
+		end := start + insertBatchRows
+		if end > len(rows.Values) {
+			end = len(rows.Values)
+		}
+		var placeholders []string
+		var args []interface{}
+		for _, values := range rows.Values[start:end] {
+			row := make([]string, len(values))
+			for i, value := range values {
+				args = append(args, value)
+				row[i] = fmt.Sprintf("$%d", len(args))
+			}
+			placeholders = append(placeholders, "("+strings.Join(row, ", ")+")")
+		}
+		result, err := tx.ExecContext(ctx, fmt.Sprintf("INSERT INTO %s (%s) VALUES %s",
+			table, strings.Join(quoted, ", "), strings.Join(placeholders, ", ")), args...)
+		if err != nil {
+			return written, fmt.Errorf("error writing %s: %v", table, err)
+		}
+		affected, _ := result.RowsAffected()
+		written += affected
+	}
+	return written, nil
+}
+
+// postgresType is the column type for values a transform produces itself.
+func postgresType(value interface{}) string {
+	switch value.(type) {
+	case float32, float64:
+		return "double precision"
+	case int, int32, int64:
+		return "bigint"
+	case bool:
+		return "boolean"
+	case time.Time:
+		return "timestamp"
+	}
+	return "text"
+}
@@ -0,0 +1,652 @@
+package etl
+
+import (
+	"encoding/csv"
+	"fmt"
+	"math"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+/*
+Built-in Go transforms. Each reads the step's input table (see transform.go) and is
+configured with metadata alone:
+
+unit_conversion
+	conversions  comma separated, either "column:from:to" between units of the same kind
+	             (c, f, k / mm, cm, m, in, ft / g, kg, lb / s, min, h / bar, psi, kpa)
+	             or a calibration "column*scale+offset", e.g. "temperature*1.02-0.4"
+
+dedupe
+	keys      comma separated columns identifying a row, all columns by default
+	order_by  column to order duplicates by before keeping one
+	keep      "first" or "last", first by default
+
+pivot
+	index         comma separated columns to group by
+	pivot_column  column whose values become columns
+	value_column  column aggregated into them
+	aggregate     sum, avg, min, max, count or first, sum by default
+	prefix        put in front of each new column name
+
+csv_lookup
+	file        name of a CSV file with headers in the lookup directory, ".csv" optional
+	on          input column to join on
+	lookup_key  CSV column to match it against, the same name as "on" by default
+	columns     comma separated CSV columns to add, all but the key by default
+	join        "left" keeps unmatched rows, "inner" drops them, left by default
+
+Lookup files are only read from LookupDir, test_data unless ETL_LOOKUP_DIR is set, so a
+step cannot read any other file the server can.
+*/
+
+const (
+	StepTypeUnitConversion = "unit_conversion"
+	StepTypeDedupe         = "dedupe"
+	StepTypePivot          = "pivot"
+	StepTypeCSVLookup      = "csv_lookup"
+)
+
+func init() {
+	RegisterTransform(StepTypeUnitConversion, validateUnitConversion, unitConversion)
+	RegisterTransform(StepTypeDedupe, validateDedupe, dedupe)
+	RegisterTransform(StepTypePivot, validatePivot, pivot)
+	RegisterTransform(StepTypeCSVLookup, validateCSVLookup, csvLookup)
+}
+
+// metaColumns reads a comma separated list of column names from the step's metadata.
+func metaColumns(step *Step, key string, problems *[]string) []string {
+	columns, err := splitFields(step.Metadata[key])
+	if err != nil {
+		*problems = append(*problems, fmt.Sprintf("%s: %v", key, err))
+	}
+	return columns
+}
+
+func metaColumn(step *Step, key string, required bool, problems *[]string) string {
+	column := strings.TrimSpace(step.Metadata[key])
+	switch {
+	case column == "" && required:
+		*problems = append(*problems, fmt.Sprintf("%s is required", key))
+	case column != "" && !identifierPattern.MatchString(column):
+		*problems = append(*problems, fmt.Sprintf("invalid %s %q", key, column))
+	}
+	return column
+}
+
+func metaChoice(step *Step, key string, choices []string, problems *[]string) string {
+	value := strings.ToLower(strings.TrimSpace(step.Metadata[key]))
+	if value == "" {
+		return choices[0]
+	}
+	for _, choice := range choices {
+		if value == choice {
+			return value
+		}
+	}
+	*problems = append(*problems, fmt.Sprintf("%s must be one of %s", key, strings.Join(choices, ", ")))
+	return choices[0]
+}
+
+func columnIndexes(rows *Rows, columns []string) ([]int, error) {
+	indexes := make([]int, len(columns))
+	for i, column := range columns {
+		if indexes[i] = rows.Index(column); indexes[i] < 0 {
+			return nil, fmt.Errorf("input has no column %q", column)
+		}
+	}
+	return indexes, nil
+}
+
+func rowKey(values []interface{}, indexes []int) string {
+	parts := make([]string, len(indexes))
+	for i, index := range indexes {
+		if values[index] == nil {
+			parts[i] = "\x01"
+		} else {
+			parts[i] = fmt.Sprint(values[index])
+		}
+	}
+	return strings.Join(parts, "\x00")
+}
+
+// compareValues orders nulls first, then times and numbers by value and anything
+// else as text.
+func compareValues(a interface{}, b interface{}) int {
+	switch {
+	case a == nil && b == nil:
+		return 0
+	case a == nil:
+		return -1
+	case b == nil:
+		return 1
+	}
+	if at, ok := a.(time.Time); ok {
+		if bt, ok := b.(time.Time); ok {
+			return at.Compare(bt)
+		}
+	}
+	if af, ok := toFloat(a); ok {
+		if bf, ok := toFloat(b); ok {
+			switch {
+			case af < bf:
+				return -1
+			case af > bf:
+				return 1
+			}
+			return 0
+		}
+	}
+	return strings.Compare(fmt.Sprint(a), fmt.Sprint(b))
+}
+
+// Unit conversion
+
+type unit struct {
+	kind   string
+	factor float64
+	offset float64
+}
+
+// units convert to their kind's base unit as value*factor + offset
+var units = map[string]unit{
+	"k": {"temperature", 1, 0},
+	"c": {"temperature", 1, 273.15},
+	"f": {"temperature", 5.0 / 9, 273.15 - 32*5.0/9},
+
+	"m":  {"length", 1, 0},
+	"mm": {"length", 0.001, 0},
+	"cm": {"length", 0.01, 0},
+	"in": {"length", 0.0254, 0},
+	"ft": {"length", 0.3048, 0},
+
+	"kg": {"mass", 1, 0},
+	"g":  {"mass", 0.001, 0},
+	"lb": {"mass", 0.45359237, 0},
+
+	"s":   {"time", 1, 0},
+	"min": {"time", 60, 0},
+	"h":   {"time", 3600, 0},
+
+	"kpa": {"pressure", 1, 0},
+	"bar": {"pressure", 100, 0},
+	"psi": {"pressure", 6.894757, 0},
+}
+
+var calibrationPattern = regexp.MustCompile(`^([A-Za-z_][A-Za-z0-9_]*)\s*(?:\*\s*(-?[0-9]*\.?[0-9]+))?\s*(?:([+-])\s*([0-9]*\.?[0-9]+))?$`)
+
+type conversion struct {
+	column string
+	scale  float64
+	offset float64
+}
+
+func parseConversions(step *Step) ([]conversion, []string) {
+	var conversions []conversion
+	var problems []string
+	for _, entry := range strings.Split(step.Metadata["conversions"], ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+		if parts := strings.Split(entry, ":"); len(parts) > 1 {
+			if len(parts) != 3 || !identifierPattern.MatchString(strings.TrimSpace(parts[0])) {
+				problems = append(problems, fmt.Sprintf("invalid conversion %q, expected column:from:to", entry))
+				continue
+			}
+			from, fromOK := units[strings.ToLower(strings.TrimSpace(parts[1]))]
+			to, toOK := units[strings.ToLower(strings.TrimSpace(parts[2]))]
+			if !fromOK || !toOK || from.kind != to.kind {
+				problems = append(problems, fmt.Sprintf("cannot convert %s to %s in %q", parts[1], parts[2], entry))
+				continue
+			}
+			conversions = append(conversions, conversion{
+				column: strings.TrimSpace(parts[0]),
+				scale:  from.factor / to.factor,
+				offset: (from.offset - to.offset) / to.factor,
+			})
+			continue
+		}
+
+		match := calibrationPattern.FindStringSubmatch(entry)
+		if match == nil || (match[2] == "" && match[4] == "") {
+			problems = append(problems, fmt.Sprintf("invalid conversion %q, expected column*scale+offset", entry))
+			continue
+		}
+		c := conversion{column: match[1], scale: 1}
+		var err error
+		if match[2] != "" {
+			if c.scale, err = strconv.ParseFloat(match[2], 64); err != nil {
+				problems = append(problems, fmt.Sprintf("invalid scale in %q", entry))
+				continue
+			}
+		}
+		if match[4] != "" {
+			if c.offset, err = strconv.ParseFloat(match[4], 64); err != nil {
+				problems = append(problems, fmt.Sprintf("invalid offset in %q", entry))
+				continue
+			}
+			if match[3] == "-" {
+				c.offset = -c.offset
+			}
+		}
+		conversions = append(conversions, c)
+	}
+	if len(conversions) == 0 && len(problems) == 0 {
+		problems = append(problems, "conversions is required")
+	}
+	return conversions, problems
+}
+
+func validateUnitConversion(step *Step) []string {
+	_, problems := parseConversions(step)
+	return problems
+}
+
+// unitConversion rewrites the converted columns in place, as double precision.
+func unitConversion(step *Step, input *Rows) (*Rows, error) {
+	conversions, problems := parseConversions(step)
+	if len(problems) > 0 {
+		return nil, &ValidationError{Problems: problems}
+	}
+	for _, c := range conversions {
+		index := input.Index(c.column)
+		if index < 0 {
+			return nil, fmt.Errorf("input has no column %q", c.column)
+		}
+		input.Types[index] = postgresType(float64(0))
+		for _, values := range input.Values {
+			if values[index] == nil {
+				continue
+			}
+			number, ok := toFloat(values[index])
+			if !ok {
+				return nil, fmt.Errorf("cannot convert %v in column %q, it is not a number", values[index], c.column)
+			}
+			// rounded so 100 C comes out as 212 F rather than 211.99999999999991
+			values[index] = math.Round((number*c.scale+c.offset)*1e9) / 1e9
+		}
+	}
+	return input, nil
+}
+
+// Dedupe
+
+func validateDedupe(step *Step) []string {
+	var problems []string
+	metaColumns(step, "keys", &problems)
+	metaColumn(step, "order_by", false, &problems)
+	metaChoice(step, "keep", []string{"first", "last"}, &problems)
+	return problems
+}
+
+func dedupe(step *Step, input *Rows) (*Rows, error) {
+	var problems []string
+	keys := metaColumns(step, "keys", &problems)
+	orderBy := metaColumn(step, "order_by", false, &problems)
+	keep := metaChoice(step, "keep", []string{"first", "last"}, &problems)
+	if len(problems) > 0 {
+		return nil, &ValidationError{Problems: problems}
+	}
+	if len(keys) == 0 {
+		keys = input.Columns
+	}
+	indexes, err := columnIndexes(input, keys)
+	if err != nil {
+		return nil, err
+	}
+
+	values := input.Values
+	if orderBy != "" {
+		order := input.Index(orderBy)
+		if order < 0 {
+			return nil, fmt.Errorf("input has no column %q", orderBy)
+		}
+		values = append([][]interface{}{}, values...)
+		sort.SliceStable(values, func(i, j int) bool {
+			return compareValues(values[i][order], values[j][order]) < 0
+		})
+	}
+
+	kept := make(map[string]int)
+	output := &Rows{Columns: input.Columns, Types: input.Types, Values: [][]interface{}{}}
+	for _, row := range values {
+		key := rowKey(row, indexes)
+		if i, seen := kept[key]; seen {
+			if keep == "last" {
+				output.Values[i] = row
+			}
+			continue
+		}
+		kept[key] = len(output.Values)
+		output.Values = append(output.Values, row)
+	}
+	return output, nil
+}
+
+// Pivot
+
+type pivotConfig struct {
+	index     []string
+	column    string
+	value     string
+	aggregate string
+	prefix    string
+}
+
+func parsePivot(step *Step) (*pivotConfig, []string) {
+	var problems []string
+	config := &pivotConfig{
+		index:     metaColumns(step, "index", &problems),
+		column:    metaColumn(step, "pivot_column", true, &problems),
+		value:     metaColumn(step, "value_column", true, &problems),
+		aggregate: metaChoice(step, "aggregate", []string{"sum", "avg", "min", "max", "count", "first"}, &problems),
+		prefix:    strings.TrimSpace(step.Metadata["prefix"]),
+	}
+	if len(config.index) == 0 {
+		problems = append(problems, "index is required")
+	}
+	return config, problems
+}
+
+func validatePivot(step *Step) []string {
+	_, problems := parsePivot(step)
+	return problems
+}
+
+var nonIdentifierPattern = regexp.MustCompile(`[^a-z0-9_]+`)
+
+// pivotColumnName turns a pivoted value into a column name, e.g. "Line 2" into line_2.
+func pivotColumnName(prefix string, value interface{}) string {
+	name := prefix + "null"
+	if value != nil {
+		name = prefix + fmt.Sprint(value)
+	}
+	name = strings.Trim(nonIdentifierPattern.ReplaceAllString(strings.ToLower(name), "_"), "_")
+	if !identifierPattern.MatchString(name) {
+		name = "_" + name
+	}
+	return name
+}
+
+type pivotCell struct {
+	count int64
+	total float64
+	first interface{}
+	set   bool
+}
+
+func pivot(step *Step, input *Rows) (*Rows, error) {
+	config, problems := parsePivot(step)
+	if len(problems) > 0 {
+		return nil, &ValidationError{Problems: problems}
+	}
+	indexes, err := columnIndexes(input, config.index)
+	if err != nil {
+		return nil, err
+	}
+	pivotIndex, err := columnIndexes(input, []string{config.column, config.value})
+	if err != nil {
+		return nil, err
+	}
+
+	var groups []string
+	groupValues := make(map[string][]interface{})
+	cells := make(map[string]map[string]*pivotCell)
+	for _, row := range input.Values {
+		group := rowKey(row, indexes)
+		if _, ok := groupValues[group]; !ok {
+			values := make([]interface{}, len(indexes))
+			for i, index := range indexes {
+				values[i] = row[index]
+			}
+			groups = append(groups, group)
+			groupValues[group] = values
+			cells[group] = make(map[string]*pivotCell)
+		}
+
+		name := pivotColumnName(config.prefix, row[pivotIndex[0]])
+		cell, ok := cells[group][name]
+		if !ok {
+			cell = &pivotCell{}
+			cells[group][name] = cell
+		}
+		value := row[pivotIndex[1]]
+		if value == nil {
+			continue
+		}
+		if cell.count == 0 {
+			cell.first = value
+		}
+		cell.count++
+		if config.aggregate == "count" || config.aggregate == "first" {
+			continue
+		}
+		number, ok := toFloat(value)
+		if !ok {
+			return nil, fmt.Errorf("cannot %s %v in column %q, it is not a number", config.aggregate, value, config.value)
+		}
+		switch config.aggregate {
+		case "min":
+			if !cell.set || number < cell.total {
+				cell.total = number
+			}
+		case "max":
+			if !cell.set || number > cell.total {
+				cell.total = number
+			}
+		default:
+			cell.total += number
+		}
+		cell.set = true
+	}
+
+	// Pivoted columns are sorted so their order doesn't depend on the input's
+	names := make(map[string]bool)
+	for _, group := range cells {
+		for name := range group {
+			names[name] = true
+		}
+	}
+	var pivoted []string
+	for name := range names {
+		if contains(config.index, name) {
+			return nil, fmt.Errorf("pivoted column %q clashes with an index column, set a prefix", name)
+		}
+		pivoted = append(pivoted, name)
+	}
+	sort.Strings(pivoted)
+
+	valueType := "double precision"
+	switch config.aggregate {
+	case "count":
+		valueType = "bigint"
+	case "first":
+		valueType = input.Types[pivotIndex[1]]
+	}
+	output := &Rows{Values: [][]interface{}{}}
+	for i, column := range config.index {
+		output.Columns = append(output.Columns, column)
+		output.Types = append(output.Types, input.Types[indexes[i]])
+	}
+	for _, name := range pivoted {
+		output.Columns = append(output.Columns, name)
+		output.Types = append(output.Types, valueType)
+	}
+
+	for _, group := range groups {
+		row := append([]interface{}{}, groupValues[group]...)
+		for _, name := range pivoted {
+			cell := cells[group][name]
+			var value interface{}
+			switch {
+			case config.aggregate == "count":
+				value = int64(0)
+				if cell != nil {
+					value = cell.count
+				}
+			case cell == nil || cell.count == 0:
+			case config.aggregate == "first":
+				value = cell.first
+			case config.aggregate == "avg":
+				value = cell.total / float64(cell.count)
+			default:
+				value = cell.total
+			}
+			row = append(row, value)
+		}
+		output.Values = append(output.Values, row)
+	}
+	return output, nil
+}
+
+func contains(values []string, value string) bool {
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
+
+// CSV lookup
+
+// LookupDir is the directory csv_lookup steps read their files from.
+var LookupDir = lookupDir()
+
+func lookupDir() string {
+	if dir := os.Getenv("ETL_LOOKUP_DIR"); dir != "" {
+		return dir
+	}
+	return "test_data"
+}
+
+type lookupConfig struct {
+	file    string
+	on      string
+	key     string
+	columns []string
+	join    string
+}
+
+func parseLookup(step *Step) (*lookupConfig, []string) {
+	var problems []string
+	config := &lookupConfig{
+		file:    strings.TrimSpace(step.Metadata["file"]),
+		on:      metaColumn(step, "on", true, &problems),
+		key:     metaColumn(step, "lookup_key", false, &problems),
+		columns: metaColumns(step, "columns", &problems),
+		join:    metaChoice(step, "join", []string{"left", "inner"}, &problems),
+	}
+	switch name := config.file; {
+	case name == "":
+		problems = append(problems, "file is required")
+	case filepath.IsAbs(name) || strings.ContainsAny(name, `/\`) || name == "." || strings.Contains(name, ".."):
+		problems = append(problems, fmt.Sprintf("file %q must be the name of a file in the lookup directory", name))
+	default:
+		if !strings.HasSuffix(name, ".csv") {
+			name += ".csv"
+		}
+		config.file = filepath.Join(LookupDir, name)
+	}
+	if config.key == "" {
+		config.key = config.on
+	}
+	return config, problems
+}
+
+func validateCSVLookup(step *Step) []string {
+	_, problems := parseLookup(step)
+	return problems
+}
+
+func csvLookup(step *Step, input *Rows) (*Rows, error) {
+	config, problems := parseLookup(step)
+	if len(problems) > 0 {
+		return nil, &ValidationError{Problems: problems}
+	}
+	on := input.Index(config.on)
+	if on < 0 {
+		return nil, fmt.Errorf("input has no column %q", config.on)
+	}
+
+	file, err := os.Open(config.file)
+	if err != nil {
+		return nil, fmt.Errorf("error opening lookup file: %v", err)
+	}
+	defer file.Close()
+	records, err := csv.NewReader(file).ReadAll()
+	if err != nil {
+		return nil, fmt.Errorf("error reading %s: %v", config.file, err)
+	}
+	if len(records) == 0 {
+		return nil, fmt.Errorf("%s has no header row", config.file)
+	}
+
+	headers := records[0]
+	lookup := &Rows{Columns: headers}
+	key := lookup.Index(config.key)
+	if key < 0 {
+		return nil, fmt.Errorf("%s has no column %q", config.file, config.key)
+	}
+	columns := config.columns
+	if len(columns) == 0 {
+		for _, header := range headers {
+			if header != config.key {
+				columns = append(columns, header)
+			}
+		}
+	}
+	added, err := columnIndexes(lookup, columns)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %v", config.file, err)
+	}
+	for _, column := range columns {
+		if input.Index(column) >= 0 {
+			return nil, fmt.Errorf("lookup column %q is already in the input", column)
+		}
+	}
+
+	// The first row for a key wins
+	matches := make(map[string][]string)
+	for _, record := range records[1:] {
+		if key < len(record) {
+			if _, ok := matches[record[key]]; !ok {
+				matches[record[key]] = record
+			}
+		}
+	}
+
+	output := &Rows{
+		Columns: append(append([]string{}, input.Columns...), columns...),
+		Types:   append([]string{}, input.Types...),
+		Values:  [][]interface{}{},
+	}
+	for range columns {
+		output.Types = append(output.Types, "text")
+	}
+	for _, row := range input.Values {
+		var record []string
+		if row[on] != nil {
+			record = matches[fmt.Sprint(row[on])]
+		}
+		if record == nil && config.join == "inner" {
+			continue
+		}
+		joined := append([]interface{}{}, row...)
+		for _, index := range added {
+			var value interface{}
+			if record != nil && index < len(record) {
+				value = record[index]
+			}
+			joined = append(joined, value)
+		}
+		output.Values = append(output.Values, joined)
+	}
+	return output, nil
+}
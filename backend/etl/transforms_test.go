@@ -0,0 +1,105 @@
+package etl
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func lookupStep(metadata map[string]string) *Step {
+	metadata["type"] = StepTypeCSVLookup
+	return &Step{ID: 1, Name: "lookup", Layer: LayerStaging, Metadata: metadata}
+}
+
+func TestParseLookupFile(t *testing.T) {
+	dir := LookupDir
+	LookupDir = "lookups"
+	defer func() { LookupDir = dir }()
+
+	tests := []struct {
+		file    string
+		want    string
+		problem string
+	}{
+		{file: "machines", want: filepath.Join("lookups", "machines.csv")},
+		{file: "machines.csv", want: filepath.Join("lookups", "machines.csv")},
+		{file: "", problem: "file is required"},
+		{file: "/etc/passwd", problem: "lookup directory"},
+		{file: "../connections.json", problem: "lookup directory"},
+		{file: "sub/machines.csv", problem: "lookup directory"},
+		{file: `sub\machines.csv`, problem: "lookup directory"},
+		{file: "..", problem: "lookup directory"},
+	}
+	for _, test := range tests {
+		config, problems := parseLookup(lookupStep(map[string]string{"file": test.file, "on": "machine_id"}))
+		if test.problem == "" {
+			if len(problems) > 0 {
+				t.Errorf("file %q: unexpected problems %v", test.file, problems)
+			} else if config.file != test.want {
+				t.Errorf("file %q: got path %q, want %q", test.file, config.file, test.want)
+			}
+			continue
+		}
+		if len(problems) != 1 || !strings.Contains(problems[0], test.problem) {
+			t.Errorf("file %q: got problems %v, want one containing %q", test.file, problems, test.problem)
+		}
+	}
+}
+
+func TestCSVLookup(t *testing.T) {
+	dir := LookupDir
+	LookupDir = t.TempDir()
+	defer func() { LookupDir = dir }()
+	csv := "machine_id,line,site\nm1,cutting,north\nm2,welding,south\nm1,duplicate,ignored\n"
+	if err := os.WriteFile(filepath.Join(LookupDir, "machines.csv"), []byte(csv), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	input := &Rows{
+		Columns: []string{"id", "machine_id"},
+		Types:   []string{"int4", "text"},
+		Values:  [][]interface{}{{1, "m1"}, {2, "m3"}, {3, nil}, {4, "m2"}},
+	}
+
+	tests := []struct {
+		name    string
+		join    string
+		columns string
+		want    [][]interface{}
+	}{
+		{
+			name: "left join keeps unmatched rows",
+			want: [][]interface{}{{1, "m1", "cutting", "north"}, {2, "m3", nil, nil}, {3, nil, nil, nil}, {4, "m2", "welding", "south"}},
+		},
+		{
+			name:    "inner join with chosen columns",
+			join:    "inner",
+			columns: "site",
+			want:    [][]interface{}{{1, "m1", "north"}, {4, "m2", "south"}},
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			step := lookupStep(map[string]string{"file": "machines", "on": "machine_id", "join": test.join, "columns": test.columns})
+			output, err := csvLookup(step, input)
+			if err != nil {
+				t.Fatalf("csvLookup: %v", err)
+			}
+			if len(output.Values) != len(test.want) {
+				t.Fatalf("got %d rows, want %d", len(output.Values), len(test.want))
+			}
+			for i, row := range output.Values {
+				for j, value := range row {
+					if value != test.want[i][j] {
+						t.Errorf("row %d column %s: got %v, want %v", i, output.Columns[j], value, test.want[i][j])
+					}
+				}
+			}
+		})
+	}
+
+	step := lookupStep(map[string]string{"file": "../machines.csv", "on": "machine_id"})
+	if _, err := csvLookup(step, input); err == nil {
+		t.Error("expected a lookup outside the lookup directory to fail")
+	}
+}
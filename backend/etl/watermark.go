@@ -0,0 +1,179 @@
+package etl
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"regexp"
+	"strings"
+	"time"
+)
+
+/*
+Incremental loads. A step opts in by setting the "watermark_column" metadata key to a
+column of its output. The highest value written is stored per step in
+etl_state.watermarks, in the same transaction as the step's data, and substituted into
+the next run's query:
+
+  - a query containing {{watermark}} has it replaced by the stored value as a literal
+    (e.g. "WHERE timestamp > {{watermark}}"). Before the first run the step's
+    "watermark_initial" metadata is used, or '-infinity' which suits timestamp columns.
+  - any other query is wrapped so only rows above the stored value are returned.
+
+Rows read past a stored watermark are appended to the step's output. Without one, on the
+first run or after the watermark is reset, the output is replaced.
+*/
+
+const (
+	MetaWatermarkColumn  = "watermark_column"
+	MetaWatermarkInitial = "watermark_initial"
+
+	watermarkPlaceholder = "{{watermark}}"
+	defaultWatermark     = "-infinity"
+)
+
+var identifierPattern = regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9_]*$`)
+
+type Watermark struct {
+	StepID    int       `json:"step_id"`
+	Column    string    `json:"column"`
+	Value     string    `json:"value"`
+	UpdatedAt time.Time `json:"updated_at"`
+}
+
+func (s *Step) WatermarkColumn() string {
+	return strings.TrimSpace(s.Metadata[MetaWatermarkColumn])
+}
+
+func ensureWatermarkTable(ctx context.Context, tx *sql.Tx) error {
+	if _, err := tx.ExecContext(ctx, `CREATE SCHEMA IF NOT EXISTS etl_state`); err != nil {
+		return fmt.Errorf("error creating schema etl_state: %v", err)
+	}
+	_, err := tx.ExecContext(ctx, `
+		CREATE TABLE IF NOT EXISTS etl_state.watermarks (
+			step_id INTEGER PRIMARY KEY,
+			column_name VARCHAR(255) NOT NULL,
+			value TEXT NOT NULL,
+			updated_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP
+		)`)
+	if err != nil {
+		return fmt.Errorf("error creating etl_state.watermarks: %v", err)
+	}
+	return nil
+}
+
+// readWatermark returns the stored value for the step, ignoring it if the step
+// has since been pointed at a different column.
+func readWatermark(ctx context.Context, tx *sql.Tx, step *Step) (string, bool, error) {
+	var column, value string
+	err := tx.QueryRowContext(ctx, `SELECT column_name, value FROM etl_state.watermarks WHERE step_id = $1`, step.ID).Scan(&column, &value)
+	if err == sql.ErrNoRows {
+		return "", false, nil
+	}
+	if err != nil {
+		return "", false, fmt.Errorf("error reading watermark: %v", err)
+	}
+	if column != step.WatermarkColumn() {
+		return "", false, nil
+	}
+	return value, true, nil
+}
+
+// advanceWatermark stores the highest watermark column value now in the
+// step's output. An empty delta leaves the stored value untouched.
+func advanceWatermark(ctx context.Context, tx *sql.Tx, step *Step) (string, error) {
+	column := step.WatermarkColumn()
+	var value sql.NullString
+	err := tx.QueryRowContext(ctx, fmt.Sprintf(`SELECT MAX(%s)::text FROM %s`,
+		quoteIdentifier(column), step.QualifiedTableName())).Scan(&value)
+	if err != nil {
+		return "", fmt.Errorf("error reading new watermark: %v", err)
+	}
+	if !value.Valid {
+		return "", nil
+	}
+
+	_, err = tx.ExecContext(ctx, `
+		INSERT INTO etl_state.watermarks (step_id, column_name, value, updated_at)
+		VALUES ($1, $2, $3, CURRENT_TIMESTAMP)
+		ON CONFLICT (step_id) DO UPDATE
+		SET column_name = EXCLUDED.column_name, value = EXCLUDED.value, updated_at = EXCLUDED.updated_at`,
+		step.ID, column, value.String)
+	if err != nil {
+		return "", fmt.Errorf("error storing watermark: %v", err)
+	}
+	return value.String, nil
+}
+
+func applyWatermark(query string, step *Step, value string, found bool) string {
+	if strings.Contains(query, watermarkPlaceholder) {
+		if !found {
+			value = step.Metadata[MetaWatermarkInitial]
+			if value == "" {
+				value = defaultWatermark
+			}
+		}
+		return strings.ReplaceAll(query, watermarkPlaceholder, quoteLiteral(value))
+	}
+	if !found {
+		return query
+	}
+	return fmt.Sprintf("SELECT * FROM (%s) AS delta WHERE %s > %s",
+		query, quoteIdentifier(step.WatermarkColumn()), quoteLiteral(value))
+}
+
+func hasWatermarkTable(db *sql.DB) (bool, error) {
+	var exists bool
+	err := db.QueryRow(`SELECT to_regclass('etl_state.watermarks') IS NOT NULL`).Scan(&exists)
+	return exists, err
+}
+
+func (e *Executor) Watermarks(p *Pipeline) ([]Watermark, error) {
+	db, err := e.workspaceDB(p.WorkspaceID)
+	if err != nil {
+		return nil, err
+	}
+	exists, err := hasWatermarkTable(db)
+	if err != nil {
+		return nil, fmt.Errorf("error checking etl_state.watermarks: %v", err)
+	}
+
+	watermarks := []Watermark{}
+	for _, step := range p.Steps {
+		if step.WatermarkColumn() == "" {
+			continue
+		}
+		watermark := Watermark{StepID: step.ID, Column: step.WatermarkColumn()}
+		if exists {
+			err := db.QueryRow(`SELECT value, updated_at FROM etl_state.watermarks WHERE step_id = $1 AND column_name = $2`,
+				step.ID, watermark.Column).Scan(&watermark.Value, &watermark.UpdatedAt)
+			if err != nil && err != sql.ErrNoRows {
+				return nil, fmt.Errorf("error reading watermark for step %d: %v", step.ID, err)
+			}
+		}
+		watermarks = append(watermarks, watermark)
+	}
+	return watermarks, nil
+}
+
+// ResetWatermark forgets what the step has processed so its next run is a full load.
+func (e *Executor) ResetWatermark(workspaceID int, stepID int) error {
+	db, err := e.workspaceDB(workspaceID)
+	if err != nil {
+		return err
+	}
+	exists, err := hasWatermarkTable(db)
+	if err != nil || !exists {
+		return err
+	}
+	_, err = db.Exec(`DELETE FROM etl_state.watermarks WHERE step_id = $1`, stepID)
+	return err
+}
+
+func quoteIdentifier(name string) string {
+	return `"` + strings.ReplaceAll(name, `"`, `""`) + `"`
+}
+
+func quoteLiteral(value string) string {
+	return "'" + strings.ReplaceAll(value, "'", "''") + "'"
+}
@@ -0,0 +1,78 @@
+package etl
+
+import "testing"
+
+func TestApplyWatermark(t *testing.T) {
+	step := &Step{Metadata: map[string]string{MetaWatermarkColumn: "timestamp"}}
+	initial := &Step{Metadata: map[string]string{MetaWatermarkColumn: "id", MetaWatermarkInitial: "0"}}
+	tests := []struct {
+		name  string
+		query string
+		step  *Step
+		value string
+		found bool
+		want  string
+	}{
+		{
+			name:  "first load reads everything",
+			query: "SELECT * FROM sensor_data",
+			step:  step,
+			want:  "SELECT * FROM sensor_data",
+		},
+		{
+			name:  "later loads read past the watermark",
+			query: "SELECT * FROM sensor_data",
+			step:  step,
+			value: "2024-01-01 10:00:00",
+			found: true,
+			want:  `SELECT * FROM (SELECT * FROM sensor_data) AS delta WHERE "timestamp" > '2024-01-01 10:00:00'`,
+		},
+		{
+			name:  "placeholder before the first load",
+			query: "SELECT * FROM sensor_data WHERE timestamp > {{watermark}}",
+			step:  step,
+			want:  "SELECT * FROM sensor_data WHERE timestamp > '-infinity'",
+		},
+		{
+			name:  "placeholder with an initial value",
+			query: "SELECT * FROM orders WHERE id > {{watermark}}",
+			step:  initial,
+			want:  "SELECT * FROM orders WHERE id > '0'",
+		},
+		{
+			name:  "placeholder with a stored value",
+			query: "SELECT * FROM orders WHERE id > {{watermark}}",
+			step:  initial,
+			value: "it's 42",
+			found: true,
+			want:  "SELECT * FROM orders WHERE id > 'it''s 42'",
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if got := applyWatermark(test.query, test.step, test.value, test.found); got != test.want {
+				t.Errorf("got %q, want %q", got, test.want)
+			}
+		})
+	}
+}
+
+func TestValidateWatermarkColumn(t *testing.T) {
+	tests := []struct {
+		column string
+		valid  bool
+	}{
+		{column: "", valid: true},
+		{column: "timestamp", valid: true},
+		{column: "updated_at", valid: true},
+		{column: "updated at", valid: false},
+		{column: `id"; DROP TABLE x; --`, valid: false},
+	}
+	for _, test := range tests {
+		step := &Step{ID: 1, Name: "step", Layer: LayerRaw, Metadata: map[string]string{MetaWatermarkColumn: test.column}}
+		err := ValidateSteps([]*Step{step})
+		if (err == nil) != test.valid {
+			t.Errorf("column %q: got %v, want valid %v", test.column, err, test.valid)
+		}
+	}
+}
@@ -0,0 +1,358 @@
+package lineage
+
+import (
+	"fmt"
+	"foo/backend/connections"
+	"foo/backend/etl"
+	"sort"
+	"strings"
+)
+
+/*
+Builds the column-level lineage graph from the simulator's data source tables through
+every ETL step to the final layer. Nodes are tables, edges connect a source column to
+the output column computed from it; edges without columns mean a table is read only to
+join or filter.
+*/
+
+const (
+	KindDataSource = "data_source"
+	KindStep       = "step"
+	KindTopic      = "topic"
+	KindTable      = "table"
+)
+
+const (
+	DirectionUpstream   = "upstream"
+	DirectionDownstream = "downstream"
+	DirectionBoth       = "both"
+)
+
+type Node struct {
+	ID         string   `json:"id"`
+	Kind       string   `json:"kind"`
+	Name       string   `json:"name"`
+	Layer      string   `json:"layer,omitempty"`
+	PipelineID int      `json:"pipeline_id,omitempty"`
+	StepID     int      `json:"step_id,omitempty"`
+	Columns    []string `json:"columns"`
+}
+
+type Edge struct {
+	FromTable  string `json:"from_table"`
+	FromColumn string `json:"from_column,omitempty"`
+	ToTable    string `json:"to_table"`
+	ToColumn   string `json:"to_column,omitempty"`
+	Expression string `json:"expression,omitempty"`
+}
+
+type Graph struct {
+	Nodes    []*Node  `json:"nodes"`
+	Edges    []*Edge  `json:"edges"`
+	Problems []string `json:"problems,omitempty"`
+
+	byID map[string]*Node
+}
+
+func newGraph() *Graph {
+	return &Graph{Nodes: []*Node{}, Edges: []*Edge{}, byID: make(map[string]*Node)}
+}
+
+func (g *Graph) addNode(node *Node) *Node {
+	if existing, ok := g.byID[node.ID]; ok {
+		return existing
+	}
+	if node.Columns == nil {
+		node.Columns = []string{}
+	}
+	g.byID[node.ID] = node
+	g.Nodes = append(g.Nodes, node)
+	return node
+}
+
+func (g *Graph) Node(id string) *Node {
+	return g.byID[id]
+}
+
+// Build follows every step of the pipelines. Step outputs feed later steps, so
+// steps are parsed in layer order and then once more so a step can see the
+// columns of any step it reads from.
+func Build(pipelines []*etl.Pipeline, sources []connections.TableDefinition) *Graph {
+	sourceIDs := make(map[string]string)
+	sourceColumns := make(map[string][]string)
+	for _, source := range sources {
+		id := source.GetTableName()
+		sourceIDs[source.Name] = id
+		sourceColumns[id] = source.GetColumns()
+	}
+
+	var steps []*etl.Step
+	pipelineOf := make(map[int]*etl.Pipeline)
+	stepTables := make(map[string]string)
+	for _, pipeline := range pipelines {
+		for _, step := range pipeline.Steps {
+			steps = append(steps, step)
+			pipelineOf[step.ID] = pipeline
+			stepTables[step.TableName()] = step.QualifiedTableName()
+		}
+	}
+	sort.SliceStable(steps, func(i, j int) bool {
+		return steps[i].Layer.Rank() < steps[j].Layer.Rank()
+	})
+
+	outputs := make(map[string][]string)
+	columnsOf := func(id string) []string {
+		if columns, ok := outputs[id]; ok {
+			return columns
+		}
+		return sourceColumns[id]
+	}
+	resolve := func(parts []string) (string, []string) {
+		var id string
+		switch {
+		case len(parts) == 1 && stepTables[parts[0]] != "":
+			id = stepTables[parts[0]]
+		case len(parts) == 1 && sourceIDs[parts[0]] != "":
+			id = sourceIDs[parts[0]]
+		case len(parts) == 1:
+			id = "public." + parts[0]
+		default:
+			id = parts[len(parts)-2] + "." + parts[len(parts)-1]
+		}
+		return id, columnsOf(id)
+	}
+
+	var graph *Graph
+	for pass := 0; pass < 2; pass++ {
+		graph = newGraph()
+		for _, source := range sources {
+			graph.addNode(&Node{ID: source.GetTableName(), Kind: KindDataSource, Name: source.Name, Columns: source.GetColumns()})
+		}
+		for _, step := range steps {
+			node := graph.addNode(&Node{
+				ID:         step.QualifiedTableName(),
+				Kind:       KindStep,
+				Name:       step.Name,
+				Layer:      string(step.Layer),
+				PipelineID: pipelineOf[step.ID].ID,
+				StepID:     step.ID,
+			})
+			switch step.Type() {
+			case etl.StepTypeStream:
+				graph.addStream(step, node, sourceIDs, columnsOf)
+			case etl.StepTypeSQL:
+				graph.addQuery(step, node, resolve)
+			default:
+				graph.addTransform(step, node, resolve)
+			}
+			outputs[node.ID] = node.Columns
+		}
+	}
+	return graph
+}
+
+func (g *Graph) addQuery(step *etl.Step, node *Node, resolve Resolver) {
+	sql := strings.TrimSpace(step.Query)
+	if sql == "" {
+		return
+	}
+	query, err := Parse(strings.ReplaceAll(sql, "{{watermark}}", "NULL"), resolve)
+	if err != nil {
+		g.Problems = append(g.Problems, fmt.Sprintf("step %d (%s): could not parse its query: %v", step.ID, step.Name, err))
+		return
+	}
+	if len(query.Columns) == 0 {
+		g.Problems = append(g.Problems, fmt.Sprintf("step %d (%s): could not read the columns of its query", step.ID, step.Name))
+	}
+
+	fed := make(map[string]bool)
+	for _, column := range query.Columns {
+		node.Columns = append(node.Columns, column.Name)
+		for _, source := range column.Sources {
+			g.addNode(&Node{ID: source.Table, Kind: KindTable, Name: source.Table})
+			g.Edges = append(g.Edges, &Edge{
+				FromTable:  source.Table,
+				FromColumn: source.Column,
+				ToTable:    node.ID,
+				ToColumn:   column.Name,
+				Expression: column.Expression,
+			})
+			fed[source.Table] = true
+		}
+	}
+	for _, table := range query.Tables {
+		g.addNode(&Node{ID: table, Kind: KindTable, Name: table})
+		if !fed[table] {
+			g.Edges = append(g.Edges, &Edge{FromTable: table, ToTable: node.ID})
+		}
+	}
+}
+
+// addTransform links a Go transform to the table it reads. Which columns feed
+// which is up to the transform, so the edge is table-level.
+func (g *Graph) addTransform(step *etl.Step, node *Node, resolve Resolver) {
+	input := step.InputTable()
+	if input == "" {
+		g.Problems = append(g.Problems, fmt.Sprintf("step %d (%s) has no input table", step.ID, step.Name))
+		return
+	}
+	from, _ := resolve(strings.Split(strings.ToLower(input), "."))
+	g.addNode(&Node{ID: from, Kind: KindTable, Name: from})
+	g.Edges = append(g.Edges, &Edge{FromTable: from, ToTable: node.ID, Expression: step.Type()})
+}
+
+func (g *Graph) addStream(step *etl.Step, node *Node, sourceIDs map[string]string, columnsOf func(string) []string) {
+	config, err := etl.ParseStreamConfig(step)
+	if err != nil {
+		g.Problems = append(g.Problems, fmt.Sprintf("step %d (%s): %v", step.ID, step.Name, err))
+		return
+	}
+
+	from := sourceIDs[config.Topic]
+	if from == "" {
+		from = "kafka." + config.Topic
+		g.addNode(&Node{ID: from, Kind: KindTopic, Name: config.Topic})
+	}
+	link := func(fromColumn, toColumn, expression string) {
+		node.Columns = append(node.Columns, toColumn)
+		g.Edges = append(g.Edges, &Edge{FromTable: from, FromColumn: fromColumn, ToTable: node.ID, ToColumn: toColumn, Expression: expression})
+	}
+
+	if config.Window == 0 {
+		fields := config.Fields
+		if len(fields) == 0 {
+			fields = columnsOf(from)
+		}
+		if len(fields) == 0 {
+			link("*", "*", "*")
+		}
+		for _, field := range fields {
+			link(field, field, field)
+		}
+		return
+	}
+
+	window := fmt.Sprintf("%s window of %s", config.Window, config.TimeField)
+	link(config.TimeField, "window_start", window)
+	link(config.TimeField, "window_end", window)
+	for _, field := range config.GroupBy {
+		link(field, field, field)
+	}
+	for _, aggregate := range config.Aggregates {
+		if aggregate.Field == "" {
+			node.Columns = append(node.Columns, aggregate.Column())
+			g.Edges = append(g.Edges, &Edge{FromTable: from, ToTable: node.ID, ToColumn: aggregate.Column(), Expression: aggregate.Function + "(*)"})
+			continue
+		}
+		link(aggregate.Field, aggregate.Column(), fmt.Sprintf("%s(%s)", aggregate.Function, aggregate.Field))
+	}
+}
+
+// Find matches a table as a user would name it: qualified, or by table name
+// alone when only one table has it.
+func (g *Graph) Find(name string) (*Node, error) {
+	name = strings.ToLower(strings.TrimSpace(name))
+	if node, ok := g.byID[name]; ok {
+		return node, nil
+	}
+	var matches []*Node
+	for _, node := range g.Nodes {
+		if strings.HasSuffix(node.ID, "."+name) || strings.EqualFold(node.Name, name) {
+			matches = append(matches, node)
+		}
+	}
+	if len(matches) == 0 {
+		return nil, fmt.Errorf("table %q not found in lineage", name)
+	}
+	if len(matches) > 1 {
+		ids := make([]string, len(matches))
+		for i, node := range matches {
+			ids[i] = node.ID
+		}
+		return nil, fmt.Errorf("table %q is ambiguous: %s", name, strings.Join(ids, ", "))
+	}
+	return matches[0], nil
+}
+
+type columnKey struct {
+	table  string
+	column string
+}
+
+// Lineage is the part of the graph upstream and/or downstream of a table, or of
+// a single column when one is given.
+func (g *Graph) Lineage(table string, column string, direction string) (*Graph, error) {
+	start, err := g.Find(table)
+	if err != nil {
+		return nil, err
+	}
+	if direction == "" {
+		direction = DirectionBoth
+	}
+	if direction != DirectionUpstream && direction != DirectionDownstream && direction != DirectionBoth {
+		return nil, fmt.Errorf("direction must be %s, %s or %s", DirectionUpstream, DirectionDownstream, DirectionBoth)
+	}
+
+	edges := make(map[*Edge]bool)
+	if direction != DirectionDownstream {
+		g.walk(columnKey{start.ID, column}, true, edges)
+	}
+	if direction != DirectionUpstream {
+		g.walk(columnKey{start.ID, column}, false, edges)
+	}
+
+	sub := newGraph()
+	sub.addNode(start)
+	for _, edge := range g.Edges {
+		if !edges[edge] {
+			continue
+		}
+		sub.addNode(g.byID[edge.FromTable])
+		sub.addNode(g.byID[edge.ToTable])
+		sub.Edges = append(sub.Edges, edge)
+	}
+	return sub, nil
+}
+
+// walk follows edges away from start. An empty column follows every edge of
+// the table; a column follows the edges of that column, of "*" and of the
+// table as a whole.
+func (g *Graph) walk(start columnKey, upstream bool, found map[*Edge]bool) {
+	visited := map[columnKey]bool{start: true}
+	queue := []columnKey{start}
+	for len(queue) > 0 {
+		current := queue[0]
+		queue = queue[1:]
+
+		for _, edge := range g.Edges {
+			near, nearColumn, far, farColumn := edge.FromTable, edge.FromColumn, edge.ToTable, edge.ToColumn
+			if upstream {
+				near, nearColumn, far, farColumn = edge.ToTable, edge.ToColumn, edge.FromTable, edge.FromColumn
+			}
+			if near != current.table {
+				continue
+			}
+			next := columnKey{far, ""}
+			if current.column != "" {
+				if nearColumn != "" && nearColumn != current.column && nearColumn != "*" {
+					continue
+				}
+				if farColumn == "" {
+					// A table read only to join or filter is included but not followed
+					found[edge] = true
+					continue
+				}
+				next.column = farColumn
+				if farColumn == "*" {
+					next.column = current.column
+				}
+			}
+
+			found[edge] = true
+			if !visited[next] {
+				visited[next] = true
+				queue = append(queue, next)
+			}
+		}
+	}
+}
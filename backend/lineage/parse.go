@@ -0,0 +1,760 @@
+package lineage
+
+import (
+	"errors"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+/*
+A small, forgiving parser for the SELECT statements ETL steps run. It does not validate
+SQL; it only follows which tables are read and which source columns each output column
+is computed from, through CTEs, subqueries, joins, set operations and SELECT *.
+*/
+
+type ColumnRef struct {
+	Table  string `json:"table"`
+	Column string `json:"column"`
+}
+
+type OutputColumn struct {
+	Name       string      `json:"name"`
+	Sources    []ColumnRef `json:"sources"`
+	Expression string      `json:"expression"`
+}
+
+type Query struct {
+	Columns []*OutputColumn
+	// Tables are every table read, including those only used to join or filter
+	Tables []string
+	// From is the first table of the outermost FROM clause, followed through
+	// CTEs and subqueries to the table they read from
+	From string
+}
+
+// Resolver maps a table name as written in SQL (one to three parts) to its
+// qualified name and, if known, its columns.
+type Resolver func(parts []string) (string, []string)
+
+type tokenKind int
+
+const (
+	tokIdent tokenKind = iota
+	tokQuotedIdent
+	tokString
+	tokNumber
+	tokSymbol
+)
+
+type token struct {
+	kind tokenKind
+	text string
+}
+
+func (t token) is(keyword string) bool {
+	return t.kind == tokIdent && t.text == keyword
+}
+
+func tokenize(sql string) []token {
+	var tokens []token
+	runes := []rune(sql)
+	for i := 0; i < len(runes); {
+		r := runes[i]
+		switch {
+		case r == ' ' || r == '\t' || r == '\n' || r == '\r':
+			i++
+		case r == '-' && i+1 < len(runes) && runes[i+1] == '-':
+			for i < len(runes) && runes[i] != '\n' {
+				i++
+			}
+		case r == '/' && i+1 < len(runes) && runes[i+1] == '*':
+			i += 2
+			for i+1 < len(runes) && !(runes[i] == '*' && runes[i+1] == '/') {
+				i++
+			}
+			i += 2
+		case r == '\'' || r == '"':
+			quote := r
+			var text strings.Builder
+			i++
+			for i < len(runes) {
+				if runes[i] == quote {
+					if i+1 < len(runes) && runes[i+1] == quote {
+						text.WriteRune(quote)
+						i += 2
+						continue
+					}
+					break
+				}
+				text.WriteRune(runes[i])
+				i++
+			}
+			i++
+			kind := tokString
+			if quote == '"' {
+				kind = tokQuotedIdent
+			}
+			tokens = append(tokens, token{kind: kind, text: text.String()})
+		case isIdentStart(r):
+			start := i
+			for i < len(runes) && (isIdentStart(runes[i]) || (runes[i] >= '0' && runes[i] <= '9') || runes[i] == '$') {
+				i++
+			}
+			tokens = append(tokens, token{kind: tokIdent, text: strings.ToLower(string(runes[start:i]))})
+		case r >= '0' && r <= '9':
+			start := i
+			for i < len(runes) && ((runes[i] >= '0' && runes[i] <= '9') || runes[i] == '.' || runes[i] == 'e' || runes[i] == 'E') {
+				i++
+			}
+			tokens = append(tokens, token{kind: tokNumber, text: string(runes[start:i])})
+		default:
+			symbol := string(r)
+			if i+1 < len(runes) {
+				switch pair := string(runes[i : i+2]); pair {
+				case "::", "<=", ">=", "<>", "!=", "||":
+					symbol = pair
+				}
+			}
+			i += len([]rune(symbol))
+			tokens = append(tokens, token{kind: tokSymbol, text: symbol})
+		}
+	}
+	return tokens
+}
+
+func isIdentStart(r rune) bool {
+	return r == '_' || (r >= 'a' && r <= 'z') || (r >= 'A' && r <= 'Z')
+}
+
+// keywords are never treated as column names or aliases.
+var keywords = map[string]bool{
+	"select": true, "from": true, "where": true, "group": true, "having": true, "order": true, "by": true,
+	"limit": true, "offset": true, "fetch": true, "window": true, "union": true, "intersect": true,
+	"except": true, "all": true, "distinct": true, "on": true, "using": true, "join": true, "inner": true,
+	"left": true, "right": true, "full": true, "outer": true, "cross": true, "natural": true, "lateral": true,
+	"as": true, "and": true, "or": true, "not": true, "null": true, "is": true, "in": true, "true": true,
+	"false": true, "case": true, "when": true, "then": true, "else": true, "end": true, "between": true,
+	"like": true, "ilike": true, "similar": true, "escape": true, "exists": true, "any": true, "some": true,
+	"interval": true, "over": true, "partition": true, "filter": true, "asc": true, "desc": true,
+	"nulls": true, "first": true, "last": true, "rows": true, "range": true, "preceding": true,
+	"following": true, "unbounded": true, "current": true, "row": true, "with": true, "recursive": true,
+	"values": true, "into": true, "for": true, "at": true, "time": true, "zone": true, "array": true,
+	"current_date": true, "current_time": true, "current_timestamp": true, "localtime": true,
+	"localtimestamp": true, "current_user": true, "session_user": true, "default": true, "to": true,
+}
+
+// clauses end the select list or FROM clause of a SELECT.
+var clauses = map[string]bool{
+	"from": true, "where": true, "group": true, "having": true, "window": true, "order": true,
+	"limit": true, "offset": true, "fetch": true, "for": true, "into": true,
+	"union": true, "intersect": true, "except": true,
+}
+
+type relation struct {
+	alias   string
+	table   string
+	columns []*OutputColumn
+	known   bool
+}
+
+func (r *relation) column(name string) *OutputColumn {
+	for _, column := range r.columns {
+		if column.Name == name {
+			return column
+		}
+	}
+	return nil
+}
+
+// ErrUnbalanced is returned for a query with a parenthesis that is never closed.
+var ErrUnbalanced = errors.New("unbalanced parentheses")
+
+type parser struct {
+	resolve Resolver
+	ctes    map[string][]*OutputColumn
+	tables  map[string]bool
+	// from is the first table read from a FROM clause, and cteFrom each CTE's
+	from    string
+	cteFrom map[string]string
+	err     error
+}
+
+// Parse follows the lineage of a single SELECT statement.
+func Parse(sql string, resolve Resolver) (*Query, error) {
+	p := &parser{resolve: resolve, ctes: make(map[string][]*OutputColumn), tables: make(map[string]bool),
+		cteFrom: make(map[string]string)}
+	columns := p.query(tokenize(sql))
+	if p.err != nil {
+		return nil, p.err
+	}
+
+	query := &Query{Columns: columns, From: p.from}
+	for table := range p.tables {
+		query.Tables = append(query.Tables, table)
+	}
+	sort.Strings(query.Tables)
+	return query, nil
+}
+
+func (p *parser) query(tokens []token) []*OutputColumn {
+	tokens = trimSemicolons(tokens)
+	if len(tokens) > 0 && tokens[0].is("with") {
+		tokens = p.with(tokens[1:])
+	}
+
+	var result []*OutputColumn
+	for _, core := range splitTopLevel(tokens, func(t token) bool {
+		return t.is("union") || t.is("intersect") || t.is("except")
+	}) {
+		if len(core) > 0 && (core[0].is("all") || core[0].is("distinct")) {
+			core = core[1:]
+		}
+		columns := p.core(core)
+		if result == nil {
+			result = columns
+			continue
+		}
+		for i, column := range columns {
+			if i < len(result) {
+				result[i].Sources = mergeRefs(result[i].Sources, column.Sources)
+			}
+		}
+	}
+	return result
+}
+
+// with registers the CTEs of a WITH clause and returns the statement after it.
+func (p *parser) with(tokens []token) []token {
+	if len(tokens) > 0 && tokens[0].is("recursive") {
+		tokens = tokens[1:]
+	}
+	for len(tokens) > 0 {
+		name := tokens[0].text
+		tokens = tokens[1:]
+
+		var aliases []string
+		if len(tokens) > 0 && tokens[0].text == "(" {
+			end := p.matchParen(tokens, 0)
+			if end < 0 {
+				return nil
+			}
+			aliases = identList(tokens[1:end])
+			tokens = tokens[end+1:]
+		}
+		for len(tokens) > 0 && (tokens[0].is("as") || tokens[0].is("not") || tokens[0].is("materialized")) {
+			tokens = tokens[1:]
+		}
+		if len(tokens) == 0 || tokens[0].text != "(" {
+			return tokens
+		}
+		end := p.matchParen(tokens, 0)
+		if end < 0 {
+			return nil
+		}
+		outer := p.from
+		p.from = ""
+		p.ctes[name] = renameColumns(p.query(tokens[1:end]), aliases)
+		p.cteFrom[name], p.from = p.from, outer
+		tokens = tokens[end+1:]
+
+		if len(tokens) == 0 || tokens[0].text != "," {
+			return tokens
+		}
+		tokens = tokens[1:]
+	}
+	return tokens
+}
+
+func (p *parser) core(tokens []token) []*OutputColumn {
+	if len(tokens) > 0 && tokens[0].text == "(" && matchParen(tokens, 0) == len(tokens)-1 {
+		return p.query(tokens[1 : len(tokens)-1])
+	}
+	if len(tokens) > 0 && tokens[0].is("values") {
+		rows := splitTopLevel(tokens[1:], func(t token) bool { return t.text == "," })
+		if len(rows) == 0 || len(rows[0]) < 2 {
+			return nil
+		}
+		count := len(splitTopLevel(rows[0][1:len(rows[0])-1], func(t token) bool { return t.text == "," }))
+		columns := make([]*OutputColumn, count)
+		for i := range columns {
+			columns[i] = &OutputColumn{Name: "column" + strconv.Itoa(i+1)}
+		}
+		return columns
+	}
+	if len(tokens) == 0 || !tokens[0].is("select") {
+		return nil
+	}
+	tokens = tokens[1:]
+	if len(tokens) > 0 && tokens[0].is("all") {
+		tokens = tokens[1:]
+	}
+	if len(tokens) > 0 && tokens[0].is("distinct") {
+		tokens = tokens[1:]
+		if len(tokens) > 1 && tokens[0].is("on") && tokens[1].text == "(" {
+			end := p.matchParen(tokens, 1)
+			if end < 0 {
+				return nil
+			}
+			tokens = tokens[end+1:]
+		}
+	}
+
+	sections := splitClauses(tokens)
+	relations := p.relations(sections["from"])
+	for _, name := range []string{"where", "group", "having", "order"} {
+		p.expression(sections[name], relations)
+	}
+
+	var columns []*OutputColumn
+	for _, item := range splitTopLevel(sections["select"], func(t token) bool { return t.text == "," }) {
+		columns = append(columns, p.selectItem(item, relations)...)
+	}
+	return columns
+}
+
+// splitClauses cuts the body of a SELECT into its select list and clauses.
+func splitClauses(tokens []token) map[string][]token {
+	sections := make(map[string][]token)
+	current := "select"
+	depth := 0
+	start := 0
+	for i, t := range tokens {
+		switch t.text {
+		case "(":
+			depth++
+		case ")":
+			depth--
+		}
+		if depth != 0 || t.kind != tokIdent || !clauses[t.text] {
+			continue
+		}
+		sections[current] = append(sections[current], tokens[start:i]...)
+		current = t.text
+		start = i + 1
+		if (t.text == "group" || t.text == "order") && i+1 < len(tokens) && tokens[i+1].is("by") {
+			start++
+		}
+	}
+	sections[current] = append(sections[current], tokens[start:]...)
+	return sections
+}
+
+func (p *parser) relations(tokens []token) []*relation {
+	var relations []*relation
+	for i := 0; i < len(tokens); {
+		t := tokens[i]
+		switch {
+		case t.text == "," || t.is("join") || t.is("inner") || t.is("left") || t.is("right") ||
+			t.is("full") || t.is("outer") || t.is("cross") || t.is("natural") || t.is("lateral"):
+			i++
+			continue
+		case t.is("on"):
+			end := i + 1
+			for end < len(tokens) && !isJoinStart(tokens[end]) {
+				if tokens[end].text == "(" {
+					if end = p.matchParen(tokens, end); end < 0 {
+						return relations
+					}
+				}
+				end++
+			}
+			p.expression(tokens[i+1:end], relations)
+			i = end
+			continue
+		case t.is("using"):
+			if i+1 < len(tokens) && tokens[i+1].text == "(" {
+				end := p.matchParen(tokens, i+1)
+				if end < 0 {
+					return relations
+				}
+				i = end + 1
+			} else {
+				i++
+			}
+			continue
+		}
+
+		rel := &relation{}
+		switch {
+		case t.text == "(":
+			end := p.matchParen(tokens, i)
+			if end < 0 {
+				return relations
+			}
+			inner := tokens[i+1 : end]
+			if len(inner) > 0 && (inner[0].is("select") || inner[0].is("with") || inner[0].is("values")) {
+				rel.columns = p.query(inner)
+				rel.known = true
+				relations = append(relations, rel)
+			} else {
+				relations = append(relations, p.relations(inner)...)
+				rel = nil
+			}
+			i = end + 1
+		case t.kind == tokIdent || t.kind == tokQuotedIdent:
+			parts := []string{t.text}
+			i++
+			for i+1 < len(tokens) && tokens[i].text == "." {
+				parts = append(parts, tokens[i+1].text)
+				i += 2
+			}
+			if i < len(tokens) && tokens[i].text == "(" {
+				// A set-returning function such as generate_series
+				end := p.matchParen(tokens, i)
+				if end < 0 {
+					return relations
+				}
+				p.expression(tokens[i+1:end], relations)
+				rel.alias = parts[len(parts)-1]
+				i = end + 1
+			} else if columns, ok := p.ctes[parts[0]]; ok && len(parts) == 1 {
+				rel.alias = parts[0]
+				rel.columns = columns
+				rel.known = true
+				if p.from == "" {
+					p.from = p.cteFrom[parts[0]]
+				}
+			} else {
+				table, columns := p.resolve(parts)
+				p.tables[table] = true
+				if p.from == "" {
+					p.from = table
+				}
+				rel.alias = parts[len(parts)-1]
+				rel.table = table
+				rel.known = columns != nil
+				for _, column := range columns {
+					rel.columns = append(rel.columns, &OutputColumn{
+						Name:    column,
+						Sources: []ColumnRef{{Table: table, Column: column}},
+					})
+				}
+			}
+			relations = append(relations, rel)
+		default:
+			i++
+			continue
+		}
+
+		if rel == nil {
+			continue
+		}
+		if i < len(tokens) && tokens[i].is("as") {
+			i++
+		}
+		if i < len(tokens) && (tokens[i].kind == tokQuotedIdent || (tokens[i].kind == tokIdent && !keywords[tokens[i].text])) {
+			rel.alias = tokens[i].text
+			i++
+			if i < len(tokens) && tokens[i].text == "(" {
+				end := p.matchParen(tokens, i)
+				if end < 0 {
+					return relations
+				}
+				rel.columns = renameColumns(rel.columns, identList(tokens[i+1:end]))
+				i = end + 1
+			}
+		}
+	}
+	return relations
+}
+
+func isJoinStart(t token) bool {
+	return t.text == "," || t.is("join") || t.is("inner") || t.is("left") || t.is("right") ||
+		t.is("full") || t.is("cross") || t.is("natural")
+}
+
+func (p *parser) selectItem(tokens []token, relations []*relation) []*OutputColumn {
+	if len(tokens) == 0 {
+		return nil
+	}
+
+	// * and alias.*
+	if len(tokens) == 1 && tokens[0].text == "*" {
+		var columns []*OutputColumn
+		for _, rel := range relations {
+			columns = append(columns, expand(rel)...)
+		}
+		return columns
+	}
+	if len(tokens) == 3 && tokens[1].text == "." && tokens[2].text == "*" {
+		for _, rel := range relations {
+			if rel.alias == tokens[0].text {
+				return expand(rel)
+			}
+		}
+		return nil
+	}
+
+	expression := tokens
+	name := ""
+	last := len(tokens) - 1
+	switch {
+	case last >= 1 && tokens[last-1].is("as"):
+		name = tokens[last].text
+		expression = tokens[:last-1]
+	case last >= 1 && (tokens[last].kind == tokQuotedIdent || (tokens[last].kind == tokIdent && !keywords[tokens[last].text])) &&
+		tokens[last-1].text != "." && tokens[last-1].text != "::" &&
+		(tokens[last-1].kind != tokSymbol || tokens[last-1].text == ")") &&
+		(tokens[last-1].kind != tokIdent || !keywords[tokens[last-1].text] || tokens[last-1].text == "end"):
+		name = tokens[last].text
+		expression = tokens[:last]
+	}
+	if name == "" {
+		name = defaultName(expression)
+	}
+
+	return []*OutputColumn{{
+		Name:       name,
+		Sources:    p.expression(expression, relations),
+		Expression: render(expression),
+	}}
+}
+
+func expand(rel *relation) []*OutputColumn {
+	if rel.known {
+		columns := make([]*OutputColumn, len(rel.columns))
+		for i, column := range rel.columns {
+			columns[i] = &OutputColumn{Name: column.Name, Sources: column.Sources, Expression: column.Name}
+		}
+		return columns
+	}
+	if rel.table == "" {
+		return nil
+	}
+	return []*OutputColumn{{Name: "*", Sources: []ColumnRef{{Table: rel.table, Column: "*"}}, Expression: "*"}}
+}
+
+// defaultName is the name Postgres gives an unaliased select item.
+func defaultName(tokens []token) string {
+	if len(tokens) == 0 {
+		return "?column?"
+	}
+	if tokens[0].is("case") {
+		return "case"
+	}
+	if tokens[0].is("cast") && len(tokens) > 2 {
+		return nameOr(tokens[2].text)
+	}
+	last := ""
+	for i, t := range tokens {
+		if t.kind != tokIdent && t.kind != tokQuotedIdent {
+			if t.text == "." {
+				continue
+			}
+			if t.text == "(" && i > 0 && last != "" {
+				return last
+			}
+			return nameOr(last)
+		}
+		last = t.text
+	}
+	return nameOr(last)
+}
+
+func nameOr(name string) string {
+	if name == "" || keywords[name] {
+		return "?column?"
+	}
+	return name
+}
+
+// expression returns the columns the tokens read, following any subqueries.
+func (p *parser) expression(tokens []token, relations []*relation) []ColumnRef {
+	var refs []ColumnRef
+	for i := 0; i < len(tokens); i++ {
+		t := tokens[i]
+		switch {
+		case t.text == "(":
+			end := p.matchParen(tokens, i)
+			if end < 0 {
+				return refs
+			}
+			inner := tokens[i+1 : end]
+			if len(inner) > 0 && (inner[0].is("select") || inner[0].is("with")) {
+				sub := &parser{resolve: p.resolve, ctes: p.ctes, tables: p.tables, cteFrom: p.cteFrom}
+				for _, column := range sub.query(inner) {
+					refs = mergeRefs(refs, column.Sources)
+				}
+				if sub.err != nil {
+					p.err = sub.err
+					return refs
+				}
+				i = end
+			}
+		case t.text == "::":
+			// Skip the type name, including any (precision) and []
+			i++
+			for i+1 < len(tokens) && (tokens[i+1].kind == tokIdent && !keywords[tokens[i+1].text] || tokens[i+1].text == "[" || tokens[i+1].text == "]") {
+				i++
+			}
+			if i+1 < len(tokens) && tokens[i+1].text == "(" {
+				if i = p.matchParen(tokens, i+1); i < 0 {
+					return refs
+				}
+			}
+		case t.is("as"):
+			// CAST(x AS type)
+			for i+1 < len(tokens) && tokens[i+1].text != ")" {
+				i++
+			}
+		case t.is("extract") && i+2 < len(tokens) && tokens[i+1].text == "(":
+			i += 2
+		case t.kind == tokIdent && keywords[t.text]:
+		case t.kind == tokIdent || t.kind == tokQuotedIdent:
+			parts := []string{t.text}
+			for i+2 < len(tokens) && tokens[i+1].text == "." && (tokens[i+2].kind == tokIdent || tokens[i+2].kind == tokQuotedIdent) {
+				parts = append(parts, tokens[i+2].text)
+				i += 2
+			}
+			if i+1 < len(tokens) && tokens[i+1].text == "(" {
+				continue
+			}
+			refs = mergeRefs(refs, resolveColumn(parts, relations))
+		}
+	}
+	return refs
+}
+
+func resolveColumn(parts []string, relations []*relation) []ColumnRef {
+	name := parts[len(parts)-1]
+	candidates := relations
+	if len(parts) > 1 {
+		qualifier := parts[len(parts)-2]
+		candidates = nil
+		for _, rel := range relations {
+			if rel.alias == qualifier || strings.HasSuffix(rel.table, "."+qualifier) {
+				candidates = append(candidates, rel)
+			}
+		}
+	}
+
+	for _, rel := range candidates {
+		if column := rel.column(name); column != nil {
+			return column.Sources
+		}
+	}
+	// Fall back to a table whose columns are unknown
+	for _, rel := range candidates {
+		if !rel.known && rel.table != "" {
+			return []ColumnRef{{Table: rel.table, Column: name}}
+		}
+	}
+	return nil
+}
+
+// mergeRefs returns a new slice so columns never share their sources.
+func mergeRefs(refs []ColumnRef, more []ColumnRef) []ColumnRef {
+	refs = append([]ColumnRef(nil), refs...)
+	for _, ref := range more {
+		found := false
+		for _, existing := range refs {
+			if existing == ref {
+				found = true
+				break
+			}
+		}
+		if !found {
+			refs = append(refs, ref)
+		}
+	}
+	return refs
+}
+
+func renameColumns(columns []*OutputColumn, aliases []string) []*OutputColumn {
+	if len(aliases) == 0 {
+		return columns
+	}
+	renamed := make([]*OutputColumn, len(columns))
+	for i, column := range columns {
+		copied := *column
+		if i < len(aliases) {
+			copied.Name = aliases[i]
+		}
+		renamed[i] = &copied
+	}
+	return renamed
+}
+
+func identList(tokens []token) []string {
+	var names []string
+	for _, t := range tokens {
+		if t.kind == tokIdent || t.kind == tokQuotedIdent {
+			names = append(names, t.text)
+		}
+	}
+	return names
+}
+
+// matchParen returns the index of the parenthesis closing the one at open, or
+// -1 if it is never closed.
+func matchParen(tokens []token, open int) int {
+	depth := 0
+	for i := open; i < len(tokens); i++ {
+		switch tokens[i].text {
+		case "(":
+			depth++
+		case ")":
+			depth--
+			if depth == 0 {
+				return i
+			}
+		}
+	}
+	return -1
+}
+
+// matchParen records ErrUnbalanced when the parenthesis is never closed.
+func (p *parser) matchParen(tokens []token, open int) int {
+	end := matchParen(tokens, open)
+	if end < 0 && p.err == nil {
+		p.err = ErrUnbalanced
+	}
+	return end
+}
+
+func splitTopLevel(tokens []token, separator func(token) bool) [][]token {
+	var parts [][]token
+	depth := 0
+	start := 0
+	for i, t := range tokens {
+		switch t.text {
+		case "(":
+			depth++
+		case ")":
+			depth--
+		}
+		if depth == 0 && t.kind != tokString && t.kind != tokQuotedIdent && separator(t) {
+			parts = append(parts, tokens[start:i])
+			start = i + 1
+		}
+	}
+	return append(parts, tokens[start:])
+}
+
+func trimSemicolons(tokens []token) []token {
+	for len(tokens) > 0 && tokens[len(tokens)-1].text == ";" {
+		tokens = tokens[:len(tokens)-1]
+	}
+	return tokens
+}
+
+func render(tokens []token) string {
+	var b strings.Builder
+	for i, t := range tokens {
+		text := t.text
+		switch t.kind {
+		case tokString:
+			text = "'" + strings.ReplaceAll(text, "'", "''") + "'"
+		case tokQuotedIdent:
+			text = `"` + text + `"`
+		}
+		if i > 0 && !(t.text == "." || t.text == "," || t.text == ")" || t.text == "::" ||
+			tokens[i-1].text == "." || tokens[i-1].text == "(" || tokens[i-1].text == "::" ||
+			(t.text == "(" && tokens[i-1].kind == tokIdent)) {
+			b.WriteByte(' ')
+		}
+		b.WriteString(text)
+	}
+	return b.String()
+}
@@ -0,0 +1,249 @@
+package lineage
+
+import (
+	"strings"
+	"testing"
+)
+
+// testTables are the tables the resolver knows the columns of; any other
+// table resolves with unknown columns.
+var testTables = map[string][]string{
+	"public.orders":    {"order_id", "customer_id", "amount", "placed_at"},
+	"public.customers": {"customer_id", "name", "Region"},
+}
+
+func testResolver(parts []string) (string, []string) {
+	name := strings.Join(parts, ".")
+	if len(parts) == 1 {
+		name = "public." + name
+	}
+	return name, testTables[name]
+}
+
+func ref(table string, column string) ColumnRef {
+	return ColumnRef{Table: table, Column: column}
+}
+
+func TestParse(t *testing.T) {
+	tests := []struct {
+		name    string
+		sql     string
+		columns map[string][]ColumnRef
+		order   []string
+		tables  []string
+		from    string
+	}{
+		{
+			name: "join with aliases",
+			sql: `SELECT o.order_id, c.name AS customer
+				FROM orders o JOIN customers AS c ON c.customer_id = o.customer_id`,
+			columns: map[string][]ColumnRef{
+				"order_id": {ref("public.orders", "order_id")},
+				"customer": {ref("public.customers", "name")},
+			},
+			order:  []string{"order_id", "customer"},
+			tables: []string{"public.customers", "public.orders"},
+			from:   "public.orders",
+		},
+		{
+			name: "primary table is the first of the FROM clause, not the first alphabetically",
+			sql:  `SELECT amount FROM orders, audit.changes WHERE changes.id = orders.order_id`,
+			columns: map[string][]ColumnRef{
+				"amount": {ref("public.orders", "amount")},
+			},
+			tables: []string{"audit.changes", "public.orders"},
+			from:   "public.orders",
+		},
+		{
+			name: "expression over several columns",
+			sql:  `SELECT amount * 2 + o.order_id total FROM orders o`,
+			columns: map[string][]ColumnRef{
+				"total": {ref("public.orders", "amount"), ref("public.orders", "order_id")},
+			},
+			tables: []string{"public.orders"},
+			from:   "public.orders",
+		},
+		{
+			name: "cte",
+			sql: `WITH big AS (SELECT order_id, amount AS value FROM orders WHERE amount > 100)
+				SELECT b.value, c.name FROM customers c JOIN big b ON b.order_id = c.customer_id`,
+			columns: map[string][]ColumnRef{
+				"value": {ref("public.orders", "amount")},
+				"name":  {ref("public.customers", "name")},
+			},
+			tables: []string{"public.customers", "public.orders"},
+			from:   "public.customers",
+		},
+		{
+			name:    "primary table through a cte",
+			sql:     `WITH recent (id) AS (SELECT order_id FROM orders) SELECT id FROM recent`,
+			columns: map[string][]ColumnRef{"id": {ref("public.orders", "order_id")}},
+			tables:  []string{"public.orders"},
+			from:    "public.orders",
+		},
+		{
+			name: "subquery in FROM",
+			sql:  `SELECT s.spent FROM (SELECT customer_id, SUM(amount) AS spent FROM orders GROUP BY customer_id) s`,
+			columns: map[string][]ColumnRef{
+				"spent": {ref("public.orders", "amount")},
+			},
+			tables: []string{"public.orders"},
+			from:   "public.orders",
+		},
+		{
+			name: "subquery in WHERE is read but not primary",
+			sql:  `SELECT name FROM customers WHERE customer_id IN (SELECT customer_id FROM orders)`,
+			columns: map[string][]ColumnRef{
+				"name": {ref("public.customers", "name")},
+			},
+			tables: []string{"public.customers", "public.orders"},
+			from:   "public.customers",
+		},
+		{
+			name: "star expands known columns",
+			sql:  `SELECT * FROM customers`,
+			columns: map[string][]ColumnRef{
+				"customer_id": {ref("public.customers", "customer_id")},
+				"name":        {ref("public.customers", "name")},
+				"Region":      {ref("public.customers", "Region")},
+			},
+			order:  []string{"customer_id", "name", "Region"},
+			tables: []string{"public.customers"},
+			from:   "public.customers",
+		},
+		{
+			name: "alias star over an unknown table",
+			sql:  `SELECT e.* FROM orders o JOIN raw.events e ON e.order_id = o.order_id`,
+			columns: map[string][]ColumnRef{
+				"*": {ref("raw.events", "*")},
+			},
+			tables: []string{"public.orders", "raw.events"},
+			from:   "public.orders",
+		},
+		{
+			name: "quoted identifiers",
+			sql:  `SELECT c."Region" AS "Sales Region" FROM "customers" c`,
+			columns: map[string][]ColumnRef{
+				"Sales Region": {ref("public.customers", "Region")},
+			},
+			tables: []string{"public.customers"},
+			from:   "public.customers",
+		},
+		{
+			name: "union merges sources by position",
+			sql:  `SELECT order_id AS id FROM orders UNION ALL SELECT customer_id FROM customers`,
+			columns: map[string][]ColumnRef{
+				"id": {ref("public.orders", "order_id"), ref("public.customers", "customer_id")},
+			},
+			tables: []string{"public.customers", "public.orders"},
+			from:   "public.orders",
+		},
+		{
+			name: "casts and functions",
+			sql:  `SELECT CAST(placed_at AS date), date_trunc('day', placed_at)::date AS day FROM orders;`,
+			columns: map[string][]ColumnRef{
+				"placed_at": {ref("public.orders", "placed_at")},
+				"day":       {ref("public.orders", "placed_at")},
+			},
+			tables: []string{"public.orders"},
+			from:   "public.orders",
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			query, err := Parse(test.sql, testResolver)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if len(query.Columns) != len(test.columns) {
+				t.Fatalf("got %d columns (%v), want %d", len(query.Columns), columnNames(query), len(test.columns))
+			}
+			for i, name := range test.order {
+				if query.Columns[i].Name != name {
+					t.Errorf("column %d is %q, want %q", i, query.Columns[i].Name, name)
+				}
+			}
+			for _, column := range query.Columns {
+				want, ok := test.columns[column.Name]
+				if !ok {
+					t.Errorf("unexpected column %q", column.Name)
+					continue
+				}
+				if !equalRefs(column.Sources, want) {
+					t.Errorf("column %q has sources %v, want %v", column.Name, column.Sources, want)
+				}
+			}
+			if strings.Join(query.Tables, ",") != strings.Join(test.tables, ",") {
+				t.Errorf("got tables %v, want %v", query.Tables, test.tables)
+			}
+			if query.From != test.from {
+				t.Errorf("got primary table %q, want %q", query.From, test.from)
+			}
+		})
+	}
+}
+
+func TestParseUnbalanced(t *testing.T) {
+	for _, sql := range []string{
+		`SELECT * FROM (`,
+		`SELECT (`,
+		`SELECT count(`,
+		`WITH a AS (`,
+		`WITH a (x, y AS (SELECT 1, 2) SELECT * FROM a`,
+		`SELECT a FROM t WHERE x IN (`,
+		`SELECT DISTINCT ON (a a FROM t`,
+		`SELECT a FROM t JOIN u USING (id`,
+		`SELECT a FROM t JOIN u ON (t.id = u.id`,
+		`SELECT a FROM generate_series(1, 3`,
+		`SELECT a FROM t AS x (a, b`,
+		`SELECT a::numeric(10, 2 FROM t`,
+		`SELECT (SELECT max(b FROM u) FROM t`,
+		`SELECT $$(a$$ FROM t`,
+	} {
+		if query, err := Parse(sql, testResolver); err != ErrUnbalanced {
+			t.Errorf("Parse(%q) got %v and %v, want ErrUnbalanced", sql, query, err)
+		}
+	}
+}
+
+func TestTokenizeQuoting(t *testing.T) {
+	tokens := tokenize(`SELECT 'it''s', "a ""b""" -- comment
+		/* block */ FROM t`)
+	want := []token{
+		{kind: tokIdent, text: "select"},
+		{kind: tokString, text: "it's"},
+		{kind: tokSymbol, text: ","},
+		{kind: tokQuotedIdent, text: `a "b"`},
+		{kind: tokIdent, text: "from"},
+		{kind: tokIdent, text: "t"},
+	}
+	if len(tokens) != len(want) {
+		t.Fatalf("got %d tokens %v, want %v", len(tokens), tokens, want)
+	}
+	for i := range want {
+		if tokens[i] != want[i] {
+			t.Errorf("token %d is %v, want %v", i, tokens[i], want[i])
+		}
+	}
+}
+
+func columnNames(query *Query) []string {
+	names := make([]string, len(query.Columns))
+	for i, column := range query.Columns {
+		names[i] = column.Name
+	}
+	return names
+}
+
+func equalRefs(a, b []ColumnRef) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
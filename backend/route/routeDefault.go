@@ -4,6 +4,7 @@ import (
 	"encoding/json"
 	"fmt"
 	"foo/backend/connections"
+	"foo/backend/lineage"
 	"math/rand"
 	"net/http"
 	"net/url"
@@ -425,15 +426,37 @@ func extractWhereInfo(query string) map[string]string {
 	}
 }
 
-// Helper functions (implement these based on your needs)
+// parseQuery reads a query with table names kept as written.
+func parseQuery(query string) (*lineage.Query, error) {
+	return lineage.Parse(query, func(parts []string) (string, []string) {
+		return strings.Join(parts, "."), nil
+	})
+}
+
+// extractTableName returns the table the query selects from, rather than one
+// it only joins or filters on.
 func extractTableName(query string) string {
-	// Implement table name extraction logic
-	return ""
+	parsed, err := parseQuery(query)
+	if err != nil {
+		return ""
+	}
+	return parsed.From
 }
 
+// extractColumnName returns the first column the query's output is computed from, or *.
 func extractColumnName(query string) string {
-	// Implement column name extraction logic
-	return ""
+	parsed, err := parseQuery(query)
+	if err != nil {
+		return "*"
+	}
+	for _, column := range parsed.Columns {
+		for _, source := range column.Sources {
+			if source.Column != "" {
+				return source.Column
+			}
+		}
+	}
+	return "*"
 }
 
 func HandlePostgres(w http.ResponseWriter, r *http.Request, prodConn *connections.ProdConn, connectors connections.WorkspaceConnectors) {
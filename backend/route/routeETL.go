@@ -0,0 +1,650 @@
+package route
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"foo/backend/connections"
+	"foo/backend/etl"
+	"io"
+	"log"
+	"net/http"
+	"strconv"
+)
+
+func getScheduler() *etl.Scheduler {
+	schedulerObj, ok := Reg.Get("etl.scheduler")
+	if !ok || schedulerObj == nil {
+		return nil
+	}
+	return schedulerObj.(*etl.Scheduler)
+}
+
+func GetSchedules(w http.ResponseWriter, r *http.Request, prodConn *connections.ProdConn, connectors connections.WorkspaceConnectors) {
+	if r.Method != http.MethodGet {
+		writeJSONErrorResponse(w, http.StatusMethodNotAllowed, "Only GET method is allowed")
+		return
+	}
+
+	scheduler := getScheduler()
+	if scheduler == nil {
+		writeJSONErrorResponse(w, http.StatusServiceUnavailable, "ETL scheduler not running")
+		return
+	}
+
+	writeJSONResponse(w, http.StatusOK, "Refresh schedules", scheduler.Schedules())
+}
+
+func getStreams() *etl.StreamManager {
+	streamsObj, ok := Reg.Get("etl.streams")
+	if !ok || streamsObj == nil {
+		return nil
+	}
+	return streamsObj.(*etl.StreamManager)
+}
+
+// GetStreams reports each running stream step's consumer and what it has written.
+func GetStreams(w http.ResponseWriter, r *http.Request, prodConn *connections.ProdConn, connectors connections.WorkspaceConnectors) {
+	if r.Method != http.MethodGet {
+		writeJSONErrorResponse(w, http.StatusMethodNotAllowed, "Only GET method is allowed")
+		return
+	}
+
+	streams := getStreams()
+	if streams == nil {
+		writeJSONErrorResponse(w, http.StatusServiceUnavailable, "ETL streams not running")
+		return
+	}
+
+	writeJSONResponse(w, http.StatusOK, "Stream steps", streams.Statuses())
+}
+
+// GetRuns lists recent pipeline runs, newest first. Filters: pipeline_id,
+// parent_run_id (the chunks of a backfill), status, table (runs that
+// successfully wrote that step table) and limit.
+func GetRuns(w http.ResponseWriter, r *http.Request, prodConn *connections.ProdConn, connectors connections.WorkspaceConnectors) {
+	if r.Method != http.MethodGet {
+		writeJSONErrorResponse(w, http.StatusMethodNotAllowed, "Only GET method is allowed")
+		return
+	}
+
+	query := r.URL.Query()
+	filter := etl.RunFilter{
+		Status: etl.RunStatus(query.Get("status")),
+		Table:  query.Get("table"),
+	}
+	var err error
+	if value := query.Get("pipeline_id"); value != "" {
+		if filter.PipelineID, err = strconv.Atoi(value); err != nil {
+			writeJSONErrorResponse(w, http.StatusBadRequest, "Invalid pipeline_id")
+			return
+		}
+	}
+	if value := query.Get("parent_run_id"); value != "" {
+		if filter.ParentRunID, err = strconv.Atoi(value); err != nil {
+			writeJSONErrorResponse(w, http.StatusBadRequest, "Invalid parent_run_id")
+			return
+		}
+	}
+	if value := query.Get("limit"); value != "" {
+		if filter.Limit, err = strconv.Atoi(value); err != nil {
+			writeJSONErrorResponse(w, http.StatusBadRequest, "Invalid limit")
+			return
+		}
+	}
+
+	runs, err := etl.NewHistory(prodConn.Conn).ListRuns(filter)
+	if err != nil {
+		writeJSONErrorResponse(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	writeJSONResponse(w, http.StatusOK, fmt.Sprintf("%d runs found", len(runs)), runs)
+}
+
+func GetRun(w http.ResponseWriter, r *http.Request, prodConn *connections.ProdConn, connectors connections.WorkspaceConnectors) {
+	if r.Method != http.MethodGet {
+		writeJSONErrorResponse(w, http.StatusMethodNotAllowed, "Only GET method is allowed")
+		return
+	}
+
+	runID, err := strconv.Atoi(r.PathValue("id"))
+	if err != nil {
+		writeJSONErrorResponse(w, http.StatusBadRequest, "Invalid run id")
+		return
+	}
+
+	run, err := etl.NewHistory(prodConn.Conn).GetRun(runID)
+	if errors.Is(err, sql.ErrNoRows) {
+		writeJSONErrorResponse(w, http.StatusNotFound, "Run not found")
+		return
+	}
+	if err != nil {
+		writeJSONErrorResponse(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	writeJSONResponse(w, http.StatusOK, fmt.Sprint("Run ", runID, " found"), run)
+}
+
+func getExecutor() *etl.Executor {
+	executorObj, ok := Reg.Get("etl.executor")
+	if !ok || executorObj == nil {
+		return nil
+	}
+	return executorObj.(*etl.Executor)
+}
+
+func writeETLError(w http.ResponseWriter, err error) {
+	var validationErr *etl.ValidationError
+	switch {
+	case errors.As(err, &validationErr):
+		writeJSONResponse(w, http.StatusBadRequest, validationErr.Error(), validationErr.Problems)
+	case errors.Is(err, etl.ErrNotFound):
+		writeJSONErrorResponse(w, http.StatusNotFound, "Not found")
+	default:
+		writeJSONErrorResponse(w, http.StatusInternalServerError, err.Error())
+	}
+}
+
+func pathID(r *http.Request, name string) (int, error) {
+	id, err := strconv.Atoi(r.PathValue(name))
+	if err != nil {
+		return 0, fmt.Errorf("invalid %s", name)
+	}
+	return id, nil
+}
+
+// Pipelines lists every pipeline with its steps (GET) or creates one (POST).
+func Pipelines(w http.ResponseWriter, r *http.Request, prodConn *connections.ProdConn, connectors connections.WorkspaceConnectors) {
+	store := etl.NewStore(prodConn.Conn)
+
+	switch r.Method {
+	case http.MethodGet:
+		pipelines, err := store.ListPipelines()
+		if err != nil {
+			writeETLError(w, err)
+			return
+		}
+		writeJSONResponse(w, http.StatusOK, fmt.Sprintf("%d pipelines found", len(pipelines)), pipelines)
+
+	case http.MethodPost:
+		var pipeline etl.Pipeline
+		if err := json.NewDecoder(r.Body).Decode(&pipeline); err != nil {
+			writeJSONErrorResponse(w, http.StatusBadRequest, "Failed to decode request body")
+			return
+		}
+		if err := store.CreatePipeline(&pipeline); err != nil {
+			writeETLError(w, err)
+			return
+		}
+		writeJSONResponse(w, http.StatusCreated, fmt.Sprint("Pipeline ", pipeline.ID, " created"), pipeline)
+
+	default:
+		writeJSONErrorResponse(w, http.StatusMethodNotAllowed, "Only GET and POST methods are allowed")
+	}
+}
+
+func Pipeline(w http.ResponseWriter, r *http.Request, prodConn *connections.ProdConn, connectors connections.WorkspaceConnectors) {
+	pipelineID, err := pathID(r, "id")
+	if err != nil {
+		writeJSONErrorResponse(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	store := etl.NewStore(prodConn.Conn)
+
+	switch r.Method {
+	case http.MethodGet:
+		pipeline, err := store.GetPipeline(pipelineID)
+		if err != nil {
+			writeETLError(w, err)
+			return
+		}
+		writeJSONResponse(w, http.StatusOK, fmt.Sprint("Pipeline ", pipelineID, " found"), pipeline)
+
+	case http.MethodPut:
+		var pipeline etl.Pipeline
+		if err := json.NewDecoder(r.Body).Decode(&pipeline); err != nil {
+			writeJSONErrorResponse(w, http.StatusBadRequest, "Failed to decode request body")
+			return
+		}
+		pipeline.ID = pipelineID
+		if err := store.UpdatePipeline(&pipeline); err != nil {
+			writeETLError(w, err)
+			return
+		}
+		updated, err := store.GetPipeline(pipelineID)
+		if err != nil {
+			writeETLError(w, err)
+			return
+		}
+		writeJSONResponse(w, http.StatusOK, fmt.Sprint("Pipeline ", pipelineID, " updated"), updated)
+
+	case http.MethodDelete:
+		if err := store.DeletePipeline(pipelineID); err != nil {
+			writeETLError(w, err)
+			return
+		}
+		writeJSONResponse(w, http.StatusOK, fmt.Sprint("Pipeline ", pipelineID, " deleted"), nil)
+
+	default:
+		writeJSONErrorResponse(w, http.StatusMethodNotAllowed, "Only GET, PUT and DELETE methods are allowed")
+	}
+}
+
+func PipelineSteps(w http.ResponseWriter, r *http.Request, prodConn *connections.ProdConn, connectors connections.WorkspaceConnectors) {
+	pipelineID, err := pathID(r, "id")
+	if err != nil {
+		writeJSONErrorResponse(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	store := etl.NewStore(prodConn.Conn)
+
+	switch r.Method {
+	case http.MethodGet:
+		pipeline, err := store.GetPipeline(pipelineID)
+		if err != nil {
+			writeETLError(w, err)
+			return
+		}
+		writeJSONResponse(w, http.StatusOK, fmt.Sprintf("%d steps found", len(pipeline.Steps)), pipeline.Steps)
+
+	case http.MethodPost:
+		var step etl.Step
+		if err := json.NewDecoder(r.Body).Decode(&step); err != nil {
+			writeJSONErrorResponse(w, http.StatusBadRequest, "Failed to decode request body")
+			return
+		}
+		step.ID = 0
+		step.PipelineID = pipelineID
+		if err := store.CreateStep(&step); err != nil {
+			writeETLError(w, err)
+			return
+		}
+		writeJSONResponse(w, http.StatusCreated, fmt.Sprint("Step ", step.ID, " created"), step)
+
+	default:
+		writeJSONErrorResponse(w, http.StatusMethodNotAllowed, "Only GET and POST methods are allowed")
+	}
+}
+
+func PipelineStep(w http.ResponseWriter, r *http.Request, prodConn *connections.ProdConn, connectors connections.WorkspaceConnectors) {
+	pipelineID, err := pathID(r, "id")
+	if err != nil {
+		writeJSONErrorResponse(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	stepID, err := pathID(r, "step_id")
+	if err != nil {
+		writeJSONErrorResponse(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	store := etl.NewStore(prodConn.Conn)
+
+	switch r.Method {
+	case http.MethodGet:
+		pipeline, err := store.GetPipeline(pipelineID)
+		if err != nil {
+			writeETLError(w, err)
+			return
+		}
+		step := pipeline.GetStep(stepID)
+		if step == nil {
+			writeJSONErrorResponse(w, http.StatusNotFound, "Step not found")
+			return
+		}
+		writeJSONResponse(w, http.StatusOK, fmt.Sprint("Step ", stepID, " found"), step)
+
+	case http.MethodPut:
+		var step etl.Step
+		if err := json.NewDecoder(r.Body).Decode(&step); err != nil {
+			writeJSONErrorResponse(w, http.StatusBadRequest, "Failed to decode request body")
+			return
+		}
+		step.ID = stepID
+		step.PipelineID = pipelineID
+		previous, err := store.UpdateStep(&step)
+		if err != nil {
+			writeETLError(w, err)
+			return
+		}
+		if step.OutputChanged(previous) {
+			dropStepOutput(store, pipelineID, previous)
+		}
+		writeJSONResponse(w, http.StatusOK, fmt.Sprint("Step ", stepID, " updated"), step)
+
+	case http.MethodDelete:
+		deleted, err := store.DeleteStep(pipelineID, stepID)
+		if err != nil {
+			writeETLError(w, err)
+			return
+		}
+		dropStepOutput(store, pipelineID, deleted)
+		writeJSONResponse(w, http.StatusOK, fmt.Sprint("Step ", stepID, " deleted"), nil)
+
+	default:
+		writeJSONErrorResponse(w, http.StatusMethodNotAllowed, "Only GET, PUT and DELETE methods are allowed")
+	}
+}
+
+// dropStepOutput removes a step's old output table so a changed query is not
+// inserted into a table with the previous columns.
+func dropStepOutput(store *etl.Store, pipelineID int, step *etl.Step) {
+	executor := getExecutor()
+	if executor == nil {
+		return
+	}
+	workspaceID := 1
+	if pipeline, err := store.GetPipeline(pipelineID); err == nil {
+		workspaceID = pipeline.WorkspaceID
+	}
+	if err := executor.DropOutput(workspaceID, step); err != nil {
+		log.Printf("Error dropping output of step %d: %v", step.ID, err)
+	}
+}
+
+func ReorderPipelineSteps(w http.ResponseWriter, r *http.Request, prodConn *connections.ProdConn, connectors connections.WorkspaceConnectors) {
+	if r.Method != http.MethodPut && r.Method != http.MethodPost {
+		writeJSONErrorResponse(w, http.StatusMethodNotAllowed, "Only PUT and POST methods are allowed")
+		return
+	}
+	pipelineID, err := pathID(r, "id")
+	if err != nil {
+		writeJSONErrorResponse(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	var req struct {
+		StepIDs []int `json:"step_ids"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeJSONErrorResponse(w, http.StatusBadRequest, "Failed to decode request body")
+		return
+	}
+
+	store := etl.NewStore(prodConn.Conn)
+	if err := store.ReorderSteps(pipelineID, req.StepIDs); err != nil {
+		writeETLError(w, err)
+		return
+	}
+	pipeline, err := store.GetPipeline(pipelineID)
+	if err != nil {
+		writeETLError(w, err)
+		return
+	}
+	writeJSONResponse(w, http.StatusOK, fmt.Sprint("Pipeline ", pipelineID, " reordered"), pipeline.Steps)
+}
+
+// PipelineWatermarks lists the high-water marks of a pipeline's incremental
+// steps. DELETE resets them (or only step_id's) so the next run is a full load.
+func PipelineWatermarks(w http.ResponseWriter, r *http.Request, prodConn *connections.ProdConn, connectors connections.WorkspaceConnectors) {
+	pipelineID, err := pathID(r, "id")
+	if err != nil {
+		writeJSONErrorResponse(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	executor := getExecutor()
+	if executor == nil {
+		writeJSONErrorResponse(w, http.StatusServiceUnavailable, "ETL executor not running")
+		return
+	}
+	pipeline, err := etl.NewStore(prodConn.Conn).GetPipeline(pipelineID)
+	if err != nil {
+		writeETLError(w, err)
+		return
+	}
+
+	switch r.Method {
+	case http.MethodGet:
+		watermarks, err := executor.Watermarks(pipeline)
+		if err != nil {
+			writeJSONErrorResponse(w, http.StatusInternalServerError, err.Error())
+			return
+		}
+		writeJSONResponse(w, http.StatusOK, fmt.Sprintf("%d watermarks found", len(watermarks)), watermarks)
+
+	case http.MethodDelete:
+		steps := pipeline.Steps
+		if value := r.URL.Query().Get("step_id"); value != "" {
+			stepID, err := strconv.Atoi(value)
+			if err != nil {
+				writeJSONErrorResponse(w, http.StatusBadRequest, "Invalid step_id")
+				return
+			}
+			step := pipeline.GetStep(stepID)
+			if step == nil {
+				writeJSONErrorResponse(w, http.StatusNotFound, "Step not found")
+				return
+			}
+			steps = []*etl.Step{step}
+		}
+		for _, step := range steps {
+			if err := executor.ResetWatermark(pipeline.WorkspaceID, step.ID); err != nil {
+				writeJSONErrorResponse(w, http.StatusInternalServerError, err.Error())
+				return
+			}
+		}
+		writeJSONResponse(w, http.StatusOK, fmt.Sprint("Watermarks of pipeline ", pipelineID, " reset"), nil)
+
+	default:
+		writeJSONErrorResponse(w, http.StatusMethodNotAllowed, "Only GET and DELETE methods are allowed")
+	}
+}
+
+// PipelineBackfill starts reprocessing the pipeline, or step_id and its
+// descendants, over [from, to) in chunks and returns the backfill's run at once.
+// Its progress is at /api/etl/runs/{id}, which lists the run of every chunk.
+func PipelineBackfill(w http.ResponseWriter, r *http.Request, prodConn *connections.ProdConn, connectors connections.WorkspaceConnectors) {
+	if r.Method != http.MethodPost {
+		writeJSONErrorResponse(w, http.StatusMethodNotAllowed, "Only POST method is allowed")
+		return
+	}
+	pipelineID, err := pathID(r, "id")
+	if err != nil {
+		writeJSONErrorResponse(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	executor := getExecutor()
+	if executor == nil {
+		writeJSONErrorResponse(w, http.StatusServiceUnavailable, "ETL executor not running")
+		return
+	}
+
+	var req etl.BackfillRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeJSONErrorResponse(w, http.StatusBadRequest, "Failed to decode request body")
+		return
+	}
+	opts, err := req.Options()
+	if err != nil {
+		writeETLError(w, err)
+		return
+	}
+	pipeline, err := etl.NewStore(prodConn.Conn).GetPipeline(pipelineID)
+	if err != nil {
+		writeETLError(w, err)
+		return
+	}
+
+	run, err := executor.StartBackfill(pipeline, opts)
+	if errors.Is(err, etl.ErrPipelineRunning) {
+		writeJSONErrorResponse(w, http.StatusConflict, err.Error())
+		return
+	}
+	if err != nil {
+		writeETLError(w, err)
+		return
+	}
+	w.Header().Set("Location", fmt.Sprintf("/api/etl/runs/%d", run.ID))
+	writeJSONResponse(w, http.StatusAccepted, fmt.Sprintf("Backfill of pipeline %d started as run %d", pipelineID, run.ID), run)
+}
+
+// StepPreview runs a step against a sample of its input without writing anything.
+// Under /steps/{step_id}/preview it previews the saved step, or the edited version
+// of it in the body; under /preview the body's step is a new one.
+func StepPreview(w http.ResponseWriter, r *http.Request, prodConn *connections.ProdConn, connectors connections.WorkspaceConnectors) {
+	if r.Method != http.MethodPost {
+		writeJSONErrorResponse(w, http.StatusMethodNotAllowed, "Only POST method is allowed")
+		return
+	}
+	pipelineID, err := pathID(r, "id")
+	if err != nil {
+		writeJSONErrorResponse(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	executor := getExecutor()
+	if executor == nil {
+		writeJSONErrorResponse(w, http.StatusServiceUnavailable, "ETL executor not running")
+		return
+	}
+
+	var req etl.PreviewRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil && err != io.EOF {
+		writeJSONErrorResponse(w, http.StatusBadRequest, "Failed to decode request body")
+		return
+	}
+	opts, err := req.Options()
+	if err != nil {
+		writeETLError(w, err)
+		return
+	}
+	pipeline, err := etl.NewStore(prodConn.Conn).GetPipeline(pipelineID)
+	if err != nil {
+		writeETLError(w, err)
+		return
+	}
+
+	step := req.Step
+	if r.PathValue("step_id") != "" {
+		stepID, err := pathID(r, "step_id")
+		if err != nil {
+			writeJSONErrorResponse(w, http.StatusBadRequest, err.Error())
+			return
+		}
+		saved := pipeline.GetStep(stepID)
+		if saved == nil {
+			writeJSONErrorResponse(w, http.StatusNotFound, "Step not found")
+			return
+		}
+		if step == nil {
+			step = saved
+		} else if step.Checks == nil {
+			step.Checks = saved.Checks
+		}
+		step.ID = stepID
+	} else if step == nil {
+		writeJSONErrorResponse(w, http.StatusBadRequest, "A step to preview is required")
+		return
+	}
+	step.PipelineID = pipelineID
+
+	preview, err := executor.Preview(r.Context(), pipeline, step, opts)
+	if err != nil {
+		writeETLError(w, err)
+		return
+	}
+	message := fmt.Sprintf("Preview of step %d returned %d rows", step.ID, len(preview.Rows))
+	if !preview.Passed {
+		message += ", checks failed"
+	}
+	writeJSONResponse(w, http.StatusOK, message, preview)
+}
+
+// StepChecks lists (GET) or adds (POST) the data-quality checks of a step.
+func StepChecks(w http.ResponseWriter, r *http.Request, prodConn *connections.ProdConn, connectors connections.WorkspaceConnectors) {
+	pipelineID, err := pathID(r, "id")
+	if err != nil {
+		writeJSONErrorResponse(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	stepID, err := pathID(r, "step_id")
+	if err != nil {
+		writeJSONErrorResponse(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	store := etl.NewStore(prodConn.Conn)
+
+	switch r.Method {
+	case http.MethodGet:
+		checks, err := store.ListChecks(pipelineID, stepID)
+		if err != nil {
+			writeETLError(w, err)
+			return
+		}
+		writeJSONResponse(w, http.StatusOK, fmt.Sprintf("%d checks found", len(checks)), checks)
+
+	case http.MethodPost:
+		var check etl.Check
+		if err := json.NewDecoder(r.Body).Decode(&check); err != nil {
+			writeJSONErrorResponse(w, http.StatusBadRequest, "Failed to decode request body")
+			return
+		}
+		check.StepID = stepID
+		if err := store.CreateCheck(pipelineID, &check); err != nil {
+			writeETLError(w, err)
+			return
+		}
+		writeJSONResponse(w, http.StatusCreated, "Check created", check)
+
+	default:
+		writeJSONErrorResponse(w, http.StatusMethodNotAllowed, "Only GET and POST methods are allowed")
+	}
+}
+
+func StepCheck(w http.ResponseWriter, r *http.Request, prodConn *connections.ProdConn, connectors connections.WorkspaceConnectors) {
+	pipelineID, err := pathID(r, "id")
+	if err != nil {
+		writeJSONErrorResponse(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	stepID, err := pathID(r, "step_id")
+	if err != nil {
+		writeJSONErrorResponse(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	checkID, err := pathID(r, "check_id")
+	if err != nil {
+		writeJSONErrorResponse(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	store := etl.NewStore(prodConn.Conn)
+
+	switch r.Method {
+	case http.MethodGet:
+		checks, err := store.ListChecks(pipelineID, stepID)
+		if err != nil {
+			writeETLError(w, err)
+			return
+		}
+		for _, check := range checks {
+			if check.ID == checkID {
+				writeJSONResponse(w, http.StatusOK, fmt.Sprint("Check ", checkID, " found"), check)
+				return
+			}
+		}
+		writeJSONErrorResponse(w, http.StatusNotFound, "Check not found")
+
+	case http.MethodPut:
+		var check etl.Check
+		if err := json.NewDecoder(r.Body).Decode(&check); err != nil {
+			writeJSONErrorResponse(w, http.StatusBadRequest, "Failed to decode request body")
+			return
+		}
+		check.ID = checkID
+		check.StepID = stepID
+		if err := store.UpdateCheck(pipelineID, &check); err != nil {
+			writeETLError(w, err)
+			return
+		}
+		writeJSONResponse(w, http.StatusOK, fmt.Sprint("Check ", checkID, " updated"), check)
+
+	case http.MethodDelete:
+		if err := store.DeleteCheck(pipelineID, stepID, checkID); err != nil {
+			writeETLError(w, err)
+			return
+		}
+		writeJSONResponse(w, http.StatusOK, fmt.Sprint("Check ", checkID, " deleted"), nil)
+
+	default:
+		writeJSONErrorResponse(w, http.StatusMethodNotAllowed, "Only GET, PUT and DELETE methods are allowed")
+	}
+}
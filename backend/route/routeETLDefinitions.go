@@ -0,0 +1,138 @@
+package route
+
+import (
+	"fmt"
+	"foo/backend/connections"
+	"foo/backend/etl"
+	"io"
+	"log"
+	"net/http"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+var fileNamePattern = regexp.MustCompile(`[^a-z0-9]+`)
+
+func schemaParam(r *http.Request, name string) string {
+	if schema := r.URL.Query().Get(name); schema != "" {
+		return schema
+	}
+	return etl.ProdSchema
+}
+
+func dryRunParam(r *http.Request) bool {
+	dryRun, _ := strconv.ParseBool(r.URL.Query().Get("dry_run"))
+	return dryRun
+}
+
+// ExportPipeline downloads a pipeline's definition. Query: schema (default prod)
+// and format, yaml (default) or json.
+func ExportPipeline(w http.ResponseWriter, r *http.Request, prodConn *connections.ProdConn, connectors connections.WorkspaceConnectors) {
+	if r.Method != http.MethodGet {
+		writeJSONErrorResponse(w, http.StatusMethodNotAllowed, "Only GET method is allowed")
+		return
+	}
+	pipelineID, err := pathID(r, "id")
+	if err != nil {
+		writeJSONErrorResponse(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	def, err := etl.NewStore(prodConn.Conn).ExportPipeline(schemaParam(r, "schema"), pipelineID)
+	if err != nil {
+		writeETLError(w, err)
+		return
+	}
+	format := r.URL.Query().Get("format")
+	data, err := def.Marshal(format)
+	if err != nil {
+		writeETLError(w, err)
+		return
+	}
+
+	extension, contentType := "yaml", "application/yaml"
+	if format == "json" {
+		extension, contentType = "json", "application/json"
+	}
+	fileName := strings.Trim(fileNamePattern.ReplaceAllString(strings.ToLower(def.Name), "-"), "-")
+	w.Header().Set("Content-Type", contentType)
+	w.Header().Set("Content-Disposition", fmt.Sprintf(`attachment; filename="%s.%s"`, fileName, extension))
+	w.WriteHeader(http.StatusOK)
+	w.Write(data)
+}
+
+// ImportPipeline creates or updates the pipeline described by the YAML or JSON
+// body. Query: schema (default prod) and dry_run to only list the changes.
+func ImportPipeline(w http.ResponseWriter, r *http.Request, prodConn *connections.ProdConn, connectors connections.WorkspaceConnectors) {
+	if r.Method != http.MethodPost {
+		writeJSONErrorResponse(w, http.StatusMethodNotAllowed, "Only POST method is allowed")
+		return
+	}
+	data, err := io.ReadAll(r.Body)
+	if err != nil {
+		writeJSONErrorResponse(w, http.StatusBadRequest, "Failed to read request body")
+		return
+	}
+	def, err := etl.ParseDefinition(data)
+	if err != nil {
+		writeETLError(w, err)
+		return
+	}
+
+	result, err := etl.NewStore(prodConn.Conn).ImportPipeline(schemaParam(r, "schema"), def, dryRunParam(r))
+	if err != nil {
+		writeETLError(w, err)
+		return
+	}
+	dropImportedOutputs(result)
+	writeJSONResponse(w, http.StatusOK, importMessage(result), result)
+}
+
+// PromotePipeline copies a pipeline's definition between schemas. Query: from
+// (the schema the pipeline id is in, default dev), to (default prod) and dry_run.
+func PromotePipeline(w http.ResponseWriter, r *http.Request, prodConn *connections.ProdConn, connectors connections.WorkspaceConnectors) {
+	if r.Method != http.MethodPost {
+		writeJSONErrorResponse(w, http.StatusMethodNotAllowed, "Only POST method is allowed")
+		return
+	}
+	pipelineID, err := pathID(r, "id")
+	if err != nil {
+		writeJSONErrorResponse(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	from := r.URL.Query().Get("from")
+	if from == "" {
+		from = etl.DevSchema
+	}
+
+	result, err := etl.NewStore(prodConn.Conn).PromotePipeline(from, schemaParam(r, "to"), pipelineID, dryRunParam(r))
+	if err != nil {
+		writeETLError(w, err)
+		return
+	}
+	dropImportedOutputs(result)
+	writeJSONResponse(w, http.StatusOK, importMessage(result), result)
+}
+
+// dropImportedOutputs removes the output tables of steps an import deleted or
+// changed, as updating a step one at a time does.
+func dropImportedOutputs(result *etl.ImportResult) {
+	executor := getExecutor()
+	if executor == nil {
+		return
+	}
+	if err := executor.DropImportedOutputs(result); err != nil {
+		log.Printf("Error after importing pipeline %q: %v", result.Name, err)
+	}
+}
+
+func importMessage(result *etl.ImportResult) string {
+	switch {
+	case len(result.Changes) == 0:
+		return fmt.Sprintf("Pipeline %q in %s is up to date", result.Name, result.Schema)
+	case result.DryRun:
+		return fmt.Sprintf("%d changes would be made to pipeline %q in %s", len(result.Changes), result.Name, result.Schema)
+	}
+	return fmt.Sprintf("%d changes made to pipeline %q in %s", len(result.Changes), result.Name, result.Schema)
+}
@@ -0,0 +1,65 @@
+package route
+
+import (
+	"foo/backend/connections"
+	"foo/backend/etl"
+	"foo/backend/lineage"
+	"foo/simData"
+	"net/http"
+	"sort"
+	"strings"
+)
+
+// lineageSources lists the simulator's data source tables, the start of every lineage.
+func lineageSources() []connections.TableDefinition {
+	sources := []connections.TableDefinition{}
+	dataSourcesObj, ok := Reg.Get("simData.dataSources")
+	if !ok || dataSourcesObj == nil {
+		return sources
+	}
+	for _, dataSource := range dataSourcesObj.(map[string]*simData.DataSource) {
+		if dataSource.Table != nil {
+			sources = append(sources, *dataSource.Table)
+		}
+	}
+	sort.Slice(sources, func(i, j int) bool {
+		return sources[i].Name < sources[j].Name
+	})
+	return sources
+}
+
+// Lineage serves the column-level lineage graph. Without a table it returns the whole
+// graph; with one it returns what feeds it and what it feeds, optionally narrowed to a
+// column and a direction (upstream, downstream or both).
+func Lineage(w http.ResponseWriter, r *http.Request, prodConn *connections.ProdConn, connectors connections.WorkspaceConnectors) {
+	if r.Method != http.MethodGet {
+		writeJSONErrorResponse(w, http.StatusMethodNotAllowed, "Only GET method is allowed")
+		return
+	}
+
+	pipelines, err := etl.LoadPipelines(prodConn.Conn)
+	if err != nil {
+		writeETLError(w, err)
+		return
+	}
+	graph := lineage.Build(pipelines, lineageSources())
+
+	query := r.URL.Query()
+	table := strings.TrimSpace(query.Get("table"))
+	if table == "" {
+		writeJSONResponse(w, http.StatusOK, "Lineage", graph)
+		return
+	}
+
+	if _, err := graph.Find(table); err != nil {
+		writeJSONErrorResponse(w, http.StatusNotFound, err.Error())
+		return
+	}
+	sub, err := graph.Lineage(table, strings.ToLower(strings.TrimSpace(query.Get("column"))), query.Get("direction"))
+	if err != nil {
+		writeJSONErrorResponse(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	sub.Problems = graph.Problems
+	writeJSONResponse(w, http.StatusOK, "Lineage of "+table, sub)
+}
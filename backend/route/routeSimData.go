@@ -2,9 +2,11 @@ package route
 
 import (
 	"encoding/json"
+	"errors"
 	"fmt"
 	"foo/backend/connections"
 	"foo/simData"
+	"io"
 	"net/http"
 	"time"
 )
@@ -108,3 +110,96 @@ func SetNode(w http.ResponseWriter, r *http.Request, prodConn *connections.ProdC
 	message := fmt.Sprint("Node ", req.NodeID, " updated")
 	writeJSONResponse(w, http.StatusOK, message, factory.GetNodeData(req.NodeID))
 }
+
+func getSimControl() simData.Control {
+	controlObj, ok := Reg.Get("simData.control")
+	if !ok || controlObj == nil {
+		return nil
+	}
+	return controlObj.(simData.Control)
+}
+
+// SimControl reports the state of the simulation (GET), or pauses, resumes,
+// steps, changes the arrival rate of or resets it (POST .../control/{action}).
+func SimControl(w http.ResponseWriter, r *http.Request, prodConn *connections.ProdConn, connectors connections.WorkspaceConnectors) {
+	control := getSimControl()
+	if control == nil {
+		writeJSONErrorResponse(w, http.StatusServiceUnavailable, "Simulation is not running")
+		return
+	}
+
+	switch r.Method {
+	case http.MethodGet:
+		writeJSONResponse(w, http.StatusOK, "Simulation status", control.ControlStatus())
+
+	case http.MethodPost:
+		var command simData.ControlCommand
+		if err := json.NewDecoder(r.Body).Decode(&command); err != nil && err != io.EOF {
+			writeJSONErrorResponse(w, http.StatusBadRequest, "Failed to decode request body")
+			return
+		}
+		if action := r.PathValue("action"); action != "" {
+			command.Action = action
+		}
+
+		status, err := control.Control(command)
+		var controlErr *simData.ControlError
+		if errors.As(err, &controlErr) {
+			writeJSONErrorResponse(w, http.StatusBadRequest, controlErr.Error())
+			return
+		} else if err != nil {
+			writeJSONErrorResponse(w, http.StatusInternalServerError, err.Error())
+			return
+		}
+		writeJSONResponse(w, http.StatusOK, fmt.Sprint("Simulation ", command.Action, " done"), status)
+
+	default:
+		writeJSONErrorResponse(w, http.StatusMethodNotAllowed, "Only GET and POST methods are allowed")
+	}
+}
+
+// SimSnapshot downloads the state of the running simulation (GET), or carries
+// on from an uploaded snapshot instead (POST).
+func SimSnapshot(w http.ResponseWriter, r *http.Request, prodConn *connections.ProdConn, connectors connections.WorkspaceConnectors) {
+	control := getSimControl()
+	if control == nil {
+		writeJSONErrorResponse(w, http.StatusServiceUnavailable, "Simulation is not running")
+		return
+	}
+
+	switch r.Method {
+	case http.MethodGet:
+		snapshot, err := control.Snapshot()
+		var controlErr *simData.ControlError
+		if errors.As(err, &controlErr) {
+			writeJSONErrorResponse(w, http.StatusBadRequest, controlErr.Error())
+			return
+		} else if err != nil {
+			writeJSONErrorResponse(w, http.StatusInternalServerError, err.Error())
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=\"snapshot-%s.json\"", snapshot.Time.Format("20060102-150405")))
+		json.NewEncoder(w).Encode(snapshot)
+
+	case http.MethodPost:
+		var snapshot simData.Snapshot
+		if err := json.NewDecoder(r.Body).Decode(&snapshot); err != nil {
+			writeJSONErrorResponse(w, http.StatusBadRequest, "Failed to decode snapshot")
+			return
+		}
+		status, err := control.Restore(&snapshot)
+		var controlErr *simData.ControlError
+		if errors.As(err, &controlErr) {
+			writeJSONErrorResponse(w, http.StatusBadRequest, controlErr.Error())
+			return
+		} else if err != nil {
+			writeJSONErrorResponse(w, http.StatusInternalServerError, err.Error())
+			return
+		}
+		writeJSONResponse(w, http.StatusOK, "Simulation restored", status)
+
+	default:
+		writeJSONErrorResponse(w, http.StatusMethodNotAllowed, "Only GET and POST methods are allowed")
+	}
+}
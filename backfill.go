@@ -0,0 +1,97 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"os"
+	"os/signal"
+	"syscall"
+
+	"foo/backend/connections"
+	"foo/backend/etl"
+	"foo/services"
+	"foo/services/util"
+)
+
+/*
+go run . backfill -pipeline 1 -from 2025-01-01 -to 2025-02-01 [-step 3] [-chunk 1d] [-parallel 4]
+
+Runs a backfill without starting the server and prints its outcome as JSON.
+*/
+
+func runBackfill(config *util.Config, args []string) int {
+	flags := flag.NewFlagSet("backfill", flag.ContinueOnError)
+	pipelineID := flags.Int("pipeline", 0, "pipeline to backfill")
+	stepID := flags.Int("step", 0, "only backfill this step and the steps that read from it")
+	from := flags.String("from", "", "start of the window, inclusive")
+	to := flags.String("to", "", "end of the window, exclusive")
+	chunk := flags.String("chunk", "", "length of each chunk, e.g. 6h or 1d (default 1d)")
+	parallel := flags.Int("parallel", 0, "chunks run at once (default 4)")
+	if err := flags.Parse(args); err != nil {
+		return 2
+	}
+	if *pipelineID == 0 {
+		fmt.Println("backfill: -pipeline is required")
+		return 2
+	}
+
+	req := etl.BackfillRequest{From: *from, To: *to, Chunk: *chunk, Parallelism: *parallel}
+	if *stepID != 0 {
+		req.StepID = stepID
+	}
+	opts, err := req.Options()
+	if err != nil {
+		fmt.Printf("backfill: %v\n", err)
+		return 2
+	}
+
+	prodConn, connectors, err := openConnections(config)
+	if err != nil {
+		fmt.Println(err)
+		return 1
+	}
+
+	pipeline, err := etl.LoadPipeline(prodConn.Conn, *pipelineID)
+	if err != nil {
+		fmt.Printf("Error loading pipeline %d: %v\n", *pipelineID, err)
+		return 1
+	}
+
+	ctx, cancel := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer cancel()
+	executor := etl.NewExecutor(ctx, connectors, etl.NewHistory(prodConn.Conn))
+	backfill, err := executor.Backfill(ctx, pipeline, opts)
+	if err != nil {
+		fmt.Printf("Error backfilling pipeline %d: %v\n", *pipelineID, err)
+		return 1
+	}
+
+	output, _ := json.MarshalIndent(backfill, "", "  ")
+	fmt.Println(string(output))
+	if backfill.Status != etl.StatusSuccess {
+		return 1
+	}
+	return 0
+}
+
+// openConnections starts only the connections service, for commands that run
+// without the server.
+func openConnections(config *util.Config) (*connections.ProdConn, connections.WorkspaceConnectors, error) {
+	registry := util.NewRegistry()
+	if err := services.NewConnectionsService(config, registry).Start(context.Background()); err != nil {
+		return nil, nil, fmt.Errorf("error starting connections service: %v", err)
+	}
+	prodConnVal, _ := registry.Get("prodDB")
+	prodConn, ok := prodConnVal.(*connections.ProdConn)
+	if !ok {
+		return nil, nil, fmt.Errorf("production database connection not found")
+	}
+	connectorsVal, _ := registry.Get("workspaceConnectors")
+	connectors, ok := connectorsVal.(connections.WorkspaceConnectors)
+	if !ok {
+		return nil, nil, fmt.Errorf("workspace connectors not found")
+	}
+	return prodConn, connectors, nil
+}
@@ -40,6 +40,17 @@ func main() {
 		os.Exit(1)
 	}
 
+	if len(os.Args) > 1 {
+		switch os.Args[1] {
+		case "backfill":
+			os.Exit(runBackfill(config, os.Args[2:]))
+		case "export":
+			os.Exit(runExport(config, os.Args[2:]))
+		case "import":
+			os.Exit(runImport(config, os.Args[2:]))
+		}
+	}
+
 	manager := services.NewManager()
 
 	util := manager.GetRegistry()
@@ -78,6 +89,6 @@ func createService(config *util.Config, registry *util.Registry, manager *servic
 	simDataService := services.NewSimulatedService(registry)
 	manager.Register(simDataService)
 
-	etlService := services.NewEtlService()
+	etlService := services.NewEtlService(registry)
 	manager.Register(etlService)
 }
@@ -0,0 +1,99 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"os"
+
+	"foo/backend/etl"
+	"foo/services/util"
+)
+
+/*
+go run . export -pipeline 1 [-schema prod] [-format yaml] [-o pipeline.yaml]
+go run . import [-schema prod] [-dry-run] pipeline.yaml
+
+Export writes a pipeline's definition to a file (or stdout) for review in git; import
+makes a schema match a definition file, printing the changes it made or would make.
+*/
+
+func runExport(config *util.Config, args []string) int {
+	flags := flag.NewFlagSet("export", flag.ContinueOnError)
+	pipelineID := flags.Int("pipeline", 0, "pipeline to export")
+	schema := flags.String("schema", etl.ProdSchema, "schema the pipeline is in: dev, staging or prod")
+	format := flags.String("format", "yaml", "yaml or json")
+	output := flags.String("o", "", "file to write, stdout if empty")
+	if err := flags.Parse(args); err != nil {
+		return 2
+	}
+	if *pipelineID == 0 {
+		fmt.Println("export: -pipeline is required")
+		return 2
+	}
+
+	prodConn, _, err := openConnections(config)
+	if err != nil {
+		fmt.Println(err)
+		return 1
+	}
+	def, err := etl.NewStore(prodConn.Conn).ExportPipeline(*schema, *pipelineID)
+	if err != nil {
+		fmt.Printf("Error exporting pipeline %d: %v\n", *pipelineID, err)
+		return 1
+	}
+	data, err := def.Marshal(*format)
+	if err != nil {
+		fmt.Printf("export: %v\n", err)
+		return 2
+	}
+
+	if *output == "" {
+		os.Stdout.Write(data)
+		return 0
+	}
+	if err := os.WriteFile(*output, data, 0644); err != nil {
+		fmt.Printf("Error writing %s: %v\n", *output, err)
+		return 1
+	}
+	return 0
+}
+
+func runImport(config *util.Config, args []string) int {
+	flags := flag.NewFlagSet("import", flag.ContinueOnError)
+	schema := flags.String("schema", etl.ProdSchema, "schema to import into: dev, staging or prod")
+	dryRun := flags.Bool("dry-run", false, "list the changes without making them")
+	if err := flags.Parse(args); err != nil {
+		return 2
+	}
+	if flags.NArg() != 1 {
+		fmt.Println("import: expected one definition file")
+		return 2
+	}
+
+	data, err := os.ReadFile(flags.Arg(0))
+	if err != nil {
+		fmt.Printf("Error reading %s: %v\n", flags.Arg(0), err)
+		return 1
+	}
+	def, err := etl.ParseDefinition(data)
+	if err != nil {
+		fmt.Printf("import: %v\n", err)
+		return 2
+	}
+
+	prodConn, _, err := openConnections(config)
+	if err != nil {
+		fmt.Println(err)
+		return 1
+	}
+	result, err := etl.NewStore(prodConn.Conn).ImportPipeline(*schema, def, *dryRun)
+	if err != nil {
+		fmt.Printf("Error importing %s: %v\n", flags.Arg(0), err)
+		return 1
+	}
+
+	output, _ := json.MarshalIndent(result, "", "  ")
+	fmt.Println(string(output))
+	return 0
+}
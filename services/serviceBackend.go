@@ -68,6 +68,28 @@ func (s *BackendService) Start(ctx context.Context) error {
 	s.mux.HandleFunc("/api/query/run", makeHandler(route.RunQuery))
 	s.mux.HandleFunc("/api/simdata/get_node", makeHandler(route.GetNode))
 	s.mux.HandleFunc("/api/simdata/set_node", makeHandler(route.SetNode))
+	s.mux.HandleFunc("/api/simdata/control", makeHandler(route.SimControl))
+	s.mux.HandleFunc("/api/simdata/control/{action}", makeHandler(route.SimControl))
+	s.mux.HandleFunc("/api/simdata/snapshot", makeHandler(route.SimSnapshot))
+	s.mux.HandleFunc("/api/etl/schedules", makeHandler(route.GetSchedules))
+	s.mux.HandleFunc("/api/etl/streams", makeHandler(route.GetStreams))
+	s.mux.HandleFunc("/api/etl/runs", makeHandler(route.GetRuns))
+	s.mux.HandleFunc("/api/etl/runs/{id}", makeHandler(route.GetRun))
+	s.mux.HandleFunc("/api/etl/pipelines", makeHandler(route.Pipelines))
+	s.mux.HandleFunc("/api/etl/pipelines/{id}", makeHandler(route.Pipeline))
+	s.mux.HandleFunc("/api/etl/pipelines/{id}/steps", makeHandler(route.PipelineSteps))
+	s.mux.HandleFunc("/api/etl/pipelines/{id}/steps/order", makeHandler(route.ReorderPipelineSteps))
+	s.mux.HandleFunc("/api/etl/pipelines/{id}/steps/{step_id}", makeHandler(route.PipelineStep))
+	s.mux.HandleFunc("/api/etl/pipelines/{id}/steps/{step_id}/checks", makeHandler(route.StepChecks))
+	s.mux.HandleFunc("/api/etl/pipelines/{id}/steps/{step_id}/checks/{check_id}", makeHandler(route.StepCheck))
+	s.mux.HandleFunc("/api/etl/pipelines/{id}/preview", makeHandler(route.StepPreview))
+	s.mux.HandleFunc("/api/etl/pipelines/{id}/steps/{step_id}/preview", makeHandler(route.StepPreview))
+	s.mux.HandleFunc("/api/etl/pipelines/{id}/watermarks", makeHandler(route.PipelineWatermarks))
+	s.mux.HandleFunc("/api/etl/pipelines/{id}/backfill", makeHandler(route.PipelineBackfill))
+	s.mux.HandleFunc("/api/etl/pipelines/{id}/export", makeHandler(route.ExportPipeline))
+	s.mux.HandleFunc("/api/etl/pipelines/{id}/promote", makeHandler(route.PromotePipeline))
+	s.mux.HandleFunc("/api/etl/import", makeHandler(route.ImportPipeline))
+	s.mux.HandleFunc("/api/lineage", makeHandler(route.Lineage))
 
 	<-ctx.Done()
 	return nil
@@ -99,8 +99,8 @@ func (c *ConnectionsService) monitorConnections() {
 		}
 
 		// Monitor PostgreSQL connections
-		for name, conn := range workspace.PostgresDB {
-			if conn == nil || conn.Conn == nil {
+		for name, conn := range workspace.PostgresConns() {
+			if conn == nil || !conn.Connected() {
 				log.Printf("Warning: PostgreSQL connection %s is nil", name)
 				continue
 			}
@@ -111,7 +111,7 @@ func (c *ConnectionsService) monitorConnections() {
 		}
 
 		// Monitor CSV connections
-		for name, conn := range workspace.CSVfile {
+		for name, conn := range workspace.CSVConns() {
 			if conn == nil {
 				log.Printf("Warning: CSV connection %s is nil", name)
 				continue
@@ -127,7 +127,7 @@ func (c *ConnectionsService) monitorConnections() {
 		}
 
 		// Monitor Kafka connections
-		for name, conn := range workspace.Kafka {
+		for name, conn := range workspace.KafkaConns() {
 			if conn == nil {
 				log.Printf("Warning: Kafka connection %s is nil", name)
 				continue
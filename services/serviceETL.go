@@ -1,12 +1,29 @@
 package services
 
-import "context"
+import (
+	"context"
+	"fmt"
+	"foo/backend/connections"
+	"foo/backend/etl"
+	"foo/services/util"
+	"log"
+	"sync"
+)
 
 type ETLService struct {
+	mutex     sync.RWMutex
+	registry  *util.Registry
+	prodConn  *connections.ProdConn
+	executor  *etl.Executor
+	scheduler *etl.Scheduler
+	streams   *etl.StreamManager
+	wg        sync.WaitGroup
 }
 
-func NewEtlService() *ETLService {
-	return &ETLService{}
+func NewEtlService(registry *util.Registry) *ETLService {
+	return &ETLService{
+		registry: registry,
+	}
 }
 
 func (e *ETLService) Name() string {
@@ -14,9 +31,90 @@ func (e *ETLService) Name() string {
 }
 
 func (e *ETLService) Start(ctx context.Context) error {
+	e.mutex.Lock()
+
+	prodConnVal, ok := e.registry.Get("prodDB")
+	if !ok || prodConnVal == nil {
+		e.mutex.Unlock()
+		return fmt.Errorf("production database connection not found in registry")
+	}
+	prodConn, ok := prodConnVal.(*connections.ProdConn)
+	if !ok {
+		e.mutex.Unlock()
+		return fmt.Errorf("invalid type for production connection in registry")
+	}
+
+	connectorsVal, ok := e.registry.Get("workspaceConnectors")
+	if !ok || connectorsVal == nil {
+		e.mutex.Unlock()
+		return fmt.Errorf("workspace connectors not found in registry")
+	}
+	connectors, ok := connectorsVal.(connections.WorkspaceConnectors)
+	if !ok {
+		e.mutex.Unlock()
+		return fmt.Errorf("invalid type for workspace connectors in registry")
+	}
+
+	e.prodConn = prodConn
+	e.executor = etl.NewExecutor(ctx, connectors, etl.NewHistory(prodConn.Conn))
+
+	e.scheduler = etl.NewScheduler(prodConn.Conn, e.executor)
+	if err := e.scheduler.Reload(); err != nil {
+		log.Printf("Error loading refresh schedules: %v", err)
+	}
+	e.streams = etl.NewStreamManager(prodConn.Conn, e.executor)
+	e.mutex.Unlock()
+
+	e.registry.Register("etl.executor", e.executor)
+	e.registry.Register("etl.scheduler", e.scheduler)
+	e.registry.Register("etl.streams", e.streams)
+
+	e.wg.Add(1)
+	go func() {
+		defer e.wg.Done()
+		e.scheduler.Run(ctx)
+	}()
+
+	e.wg.Add(1)
+	go func() {
+		defer e.wg.Done()
+		e.streams.Run(ctx)
+	}()
+
+	e.runUnscheduled(ctx)
+
+	<-ctx.Done()
+	e.wg.Wait()
 	return nil
 }
 
+// runUnscheduled runs the pipelines no data source refreshes once at startup;
+// the scheduler takes care of the rest.
+func (e *ETLService) runUnscheduled(ctx context.Context) {
+	pipelines, err := e.GetPipelines()
+	if err != nil {
+		log.Printf("Error loading ETL pipelines: %v", err)
+		return
+	}
+	log.Printf("Loaded %d ETL pipelines", len(pipelines))
+	for _, pipeline := range pipelines {
+		if e.scheduler.HasPipeline(pipeline.ID) {
+			continue
+		}
+		if _, err := e.executor.RunPipeline(ctx, pipeline, etl.RunOptions{TriggeredBy: etl.TriggerStartup}); err != nil {
+			log.Printf("Error running pipeline %d (%s): %v", pipeline.ID, pipeline.Name, err)
+		}
+	}
+}
+
+// GetPipelines reads the pipelines as they are now, so changes made through the
+// ETL endpoints are picked up.
+func (e *ETLService) GetPipelines() ([]*etl.Pipeline, error) {
+	e.mutex.RLock()
+	defer e.mutex.RUnlock()
+	return etl.LoadPipelines(e.prodConn.Conn)
+}
+
 func (e *ETLService) Stop(ctx context.Context) error {
 	return nil
 }
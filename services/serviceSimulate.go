@@ -2,20 +2,26 @@ package services
 
 import (
 	"context"
+	"encoding/json"
+	"fmt"
 	"foo/services/util"
 	"foo/simData"
+	"log"
+	"strconv"
 	"sync"
 )
 
 type SimulatedService struct {
 	dataSources map[string]*simData.DataSource
 	factory     *simData.Factory
+	engine      string
 	mutex       sync.RWMutex
 	wg          sync.WaitGroup
 	registry    *util.Registry
 
 	simCtx    context.Context
 	simCancel context.CancelFunc
+	simDone   chan struct{}
 }
 
 func NewSimulatedService(registry *util.Registry) *SimulatedService {
@@ -32,36 +38,211 @@ func (s *SimulatedService) Start(ctx context.Context) error {
 	s.wg.Add(1)
 	s.mutex.Lock()
 
-	s.simCtx, s.simCancel = context.WithCancel(context.Background())
-
 	s.dataSources = simData.IntialiseConnections(s.registry)
 
-	s.factory = simData.IntiliaseFactory(s.dataSources)
+	if err := s.newFactory(); err != nil {
+		s.mutex.Unlock()
+		s.wg.Done()
+		return err
+	}
 
-	s.mutex.Unlock()
+	engine, err := simData.ParseEngine(util.GetEnvWithDefault("SIM_ENGINE", ""), s.factory.Seeded())
+	if err != nil {
+		s.mutex.Unlock()
+		s.wg.Done()
+		return err
+	}
+	s.engine = engine
 
-	simData.SetRegistry(s.registry)
+	var restored *simData.EventEngine
+	if path := util.GetEnvWithDefault("SIM_SNAPSHOT", ""); path != "" {
+		snapshot, err := simData.LoadSnapshot(path)
+		if err == nil {
+			restored, err = snapshot.Restore(s.dataSources)
+		}
+		if err == nil {
+			s.useRestored(restored)
+		} else {
+			s.mutex.Unlock()
+			s.wg.Done()
+			return err
+		}
+		log.Printf("Restored simulation snapshot from %s", path)
+	}
 
-	s.registry.Register("simData.factory", s.factory)
+	simData.SetRegistry(s.registry)
 	s.registry.Register("simData.dataSources", s.dataSources)
+	s.registry.Register("simData.control", simData.Control(s))
+
+	s.run(restored)
+	s.mutex.Unlock()
 
 	go func() {
 		defer s.wg.Done()
-
-		simData.SimulateData(s.dataSources, s.factory, s.simCtx)
-
 		<-ctx.Done()
 	}()
 
 	return nil
 }
 
-func (s *SimulatedService) Stop(ctx context.Context) error {
+// newFactory builds the factory and its clock from the environment. Called with
+// the mutex held.
+func (s *SimulatedService) newFactory() error {
+	if layout := util.GetEnvWithDefault("FACTORY_LAYOUT", ""); layout != "" {
+		factory, err := simData.LoadFactoryFile(layout, s.dataSources)
+		if err != nil {
+			return err
+		}
+		log.Printf("Loaded factory layout from %s", layout)
+		s.factory = factory
+	} else {
+		s.factory = simData.IntiliaseFactory(s.dataSources)
+	}
+
+	if seed := util.GetEnvWithDefault("SIM_SEED", ""); seed != "" {
+		value, err := strconv.ParseInt(seed, 10, 64)
+		if err != nil {
+			return fmt.Errorf("invalid SIM_SEED %q: %v", seed, err)
+		}
+		s.factory.SetSeed(value)
+	}
+
+	if err := newClock(); err != nil {
+		return err
+	}
+
+	s.registry.Register("simData.factory", s.factory)
+	return nil
+}
+
+func newClock() error {
+	clock, err := simData.ParseClock(util.GetEnvWithDefault("SIM_SPEED", ""), util.GetEnvWithDefault("SIM_START", ""))
+	if err != nil {
+		return err
+	}
+	simData.SetClock(clock)
+	return nil
+}
+
+// useRestored replaces the factory with the one restored from a snapshot, which
+// runs on the event engine. Called with the mutex held.
+func (s *SimulatedService) useRestored(engine *simData.EventEngine) {
+	s.engine = simData.EngineEvents
+	s.factory = engine.Factory()
+	s.registry.Register("simData.factory", s.factory)
+}
+
+// run starts the simulation of the current factory, or carries on the restored
+// engine. Called with the mutex held.
+func (s *SimulatedService) run(restored *simData.EventEngine) {
+	s.simCtx, s.simCancel = context.WithCancel(context.Background())
+	s.simDone = make(chan struct{})
+
+	go func(factory *simData.Factory, ctx context.Context, done chan struct{}) {
+		defer close(done)
+		switch {
+		case restored != nil:
+			simData.RunEvents(restored, ctx)
+		case s.engine == simData.EngineEvents:
+			simData.SimulateEvents(s.dataSources, factory, ctx)
+		default:
+			simData.SimulateData(s.dataSources, factory, ctx)
+		}
+	}(s.factory, s.simCtx, s.simDone)
+}
+
+// halt stops the running simulation and waits for it. Called with the mutex held.
+func (s *SimulatedService) halt() {
+	if s.simCancel == nil {
+		return
+	}
+	s.simCancel()
+	<-s.simDone
+	s.simCancel = nil
+}
+
+func (s *SimulatedService) Control(command simData.ControlCommand) (*simData.ControlStatus, error) {
 	s.mutex.Lock()
-	if s.simCancel != nil {
-		s.simCancel()
+	stepped := 0
+	if command.Action == simData.ControlReset {
+		if s.simCancel == nil {
+			s.mutex.Unlock()
+			return nil, &simData.ControlError{Message: "the simulation is not running"}
+		}
+		s.halt()
+		if err := s.newFactory(); err != nil {
+			s.mutex.Unlock()
+			return nil, err
+		}
+		s.run(nil)
+		log.Println("Simulation reset")
+	} else {
+		var err error
+		if stepped, err = simData.ApplyControl(s.factory, command); err != nil {
+			s.mutex.Unlock()
+			return nil, err
+		}
+	}
+	status := simData.CurrentStatus(s.factory, s.engine)
+	s.mutex.Unlock()
+
+	s.broadcastControl(simData.ControlMessage{Command: command, Status: status, Stepped: stepped})
+	return status, nil
+}
+
+func (s *SimulatedService) broadcastControl(controlMessage simData.ControlMessage) {
+	message, err := json.Marshal(controlMessage)
+	if err != nil {
+		log.Printf("Error encoding control message: %v", err)
+		return
 	}
+	s.registry.BroadcastToChannel(simData.ControlTopic, message)
+}
+
+func (s *SimulatedService) Snapshot() (*simData.Snapshot, error) {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+	return simData.TakeSnapshot()
+}
+
+// Restore stops the running simulation and carries on from snapshot instead.
+func (s *SimulatedService) Restore(snapshot *simData.Snapshot) (*simData.ControlStatus, error) {
+	s.mutex.Lock()
+	if s.simCancel == nil {
+		s.mutex.Unlock()
+		return nil, &simData.ControlError{Message: "the simulation is not running"}
+	}
+	engine, err := snapshot.Restore(s.dataSources)
+	if err != nil {
+		s.mutex.Unlock()
+		return nil, &simData.ControlError{Message: err.Error()}
+	}
+	s.halt()
+	if err := newClock(); err != nil {
+		s.mutex.Unlock()
+		return nil, err
+	}
+	s.useRestored(engine)
+	s.run(engine)
+	status := simData.CurrentStatus(s.factory, s.engine)
+	s.mutex.Unlock()
+	log.Println("Simulation restored from snapshot")
+
+	s.broadcastControl(simData.ControlMessage{Command: simData.ControlCommand{Action: simData.ControlRestore}, Status: status})
+	return status, nil
+}
+
+func (s *SimulatedService) ControlStatus() *simData.ControlStatus {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+	return simData.CurrentStatus(s.factory, s.engine)
+}
+
+func (s *SimulatedService) Stop(ctx context.Context) error {
+	s.mutex.Lock()
+	s.halt()
 	s.mutex.Unlock()
+	simData.CloseConnections()
 
 	s.wg.Wait()
 	<-ctx.Done()
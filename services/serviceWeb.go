@@ -2,7 +2,9 @@ package services
 
 import (
 	"context"
+	"encoding/json"
 	"foo/services/util"
+	"foo/simData"
 	"foo/web"
 	"log"
 	"strings"
@@ -248,10 +250,41 @@ func (c *Client) readPump(reg *util.Registry) {
 			topic := strings.TrimPrefix(msgStr, "unsubscribe:")
 			delete(c.topics, topic)
 			reg.UnregisterWSChannel(topic, c.send)
+		} else if strings.HasPrefix(msgStr, "control:") {
+			// Example: "control:pause" or "control:step 10", the result is
+			// broadcast on the sim.control topic
+			c.handleControl(reg, strings.TrimPrefix(msgStr, "control:"))
 		}
 	}
 }
 
+func (c *Client) handleControl(reg *util.Registry, text string) {
+	controlObj, ok := reg.Get("simData.control")
+	if !ok || controlObj == nil {
+		c.sendControlError("simulation is not running")
+		return
+	}
+
+	command, err := simData.ParseControlCommand(text)
+	if err == nil {
+		_, err = controlObj.(simData.Control).Control(command)
+	}
+	if err != nil {
+		c.sendControlError(err.Error())
+	}
+}
+
+func (c *Client) sendControlError(message string) {
+	response, err := json.Marshal(map[string]string{"topic": simData.ControlTopic, "error": message})
+	if err != nil {
+		return
+	}
+	select {
+	case c.send <- response:
+	default:
+	}
+}
+
 func (s *WebService) Stop(ctx context.Context) error {
 	s.clientsMutex.Lock()
 	for client, registered := range s.hub.clients {
@@ -0,0 +1,234 @@
+package simData
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+)
+
+/*
+An assembly station given a bill of materials builds a product out of component parts. Parts that
+arrive at it wait in its kit, and once the kit and the stock of the inventories it draws from hold
+every component in the quantities needed, the components are consumed and the part that completed
+the kit carries on as the product, a new part with the components as its children. The inventories
+an assembly draws from keep the parts they store instead of passing them on, so their stock only
+goes down as assemblies use it. Products can be components of other products, so the genealogy of
+a finished part is the tree of its children.
+*/
+
+// assembledMaterial is what products are made of, whatever their components are
+const assembledMaterial = "Mixed"
+
+// drawing stops two assemblies taking the same stock, as inventories only add
+// to their stock meanwhile
+var drawing sync.Mutex
+
+type BOMLayout struct {
+	Product    string            `json:"product" yaml:"product"`
+	Components []ComponentLayout `json:"components" yaml:"components"`
+	// From are the inventories whose stock the assembly draws components from
+	From []string `json:"from,omitempty" yaml:"from,omitempty"`
+}
+
+// ComponentLayout matches parts by material or by the product they are.
+type ComponentLayout struct {
+	Material string `json:"material,omitempty" yaml:"material,omitempty"`
+	Type     string `json:"type,omitempty" yaml:"type,omitempty"`
+	Quantity int    `json:"quantity" yaml:"quantity"`
+}
+
+func (b *BOMLayout) validate(id string, byID map[string]*NodeLayout) []string {
+	var problems []string
+	if strings.TrimSpace(b.Product) == "" {
+		problems = append(problems, fmt.Sprintf("node %q has a bom without a product", id))
+	}
+	if len(b.Components) == 0 {
+		problems = append(problems, fmt.Sprintf("node %q has a bom without components", id))
+	}
+	for i, component := range b.Components {
+		if (component.Material == "") == (component.Type == "") {
+			problems = append(problems, fmt.Sprintf("node %q: bom component %d needs either a material or a type", id, i+1))
+		}
+		if component.Quantity < 1 {
+			problems = append(problems, fmt.Sprintf("node %q: bom component %d needs a quantity of at least 1", id, i+1))
+		}
+	}
+	for _, from := range b.From {
+		if inventory := byID[from]; inventory == nil || inventory.Type != "inventory" {
+			problems = append(problems, fmt.Sprintf("node %q draws components from %q, which is not an inventory", id, from))
+		}
+	}
+	return problems
+}
+
+func (b *BOMLayout) bom(f *Factory) *BOM {
+	bom := &BOM{Product: b.Product}
+	for _, component := range b.Components {
+		bom.Components = append(bom.Components, Component(component))
+	}
+	for _, from := range b.From {
+		inventory := f.GetNode(from).(*InventoryNode)
+		inventory.Keep = true
+		bom.From = append(bom.From, inventory)
+	}
+	return bom
+}
+
+type BOM struct {
+	Product    string
+	Components []Component
+	From       []*InventoryNode
+}
+
+type Component struct {
+	Material string
+	Type     string
+	Quantity int
+}
+
+func (c Component) matches(p *Part) bool {
+	if c.Type != "" {
+		return p.Type == c.Type
+	}
+	return p.Material == c.Material
+}
+
+// missing is how many of each component the kit still needs.
+func (b *BOM) missing(kit []*Part) []int {
+	missing := make([]int, len(b.Components))
+	for i, component := range b.Components {
+		missing[i] = component.Quantity
+	}
+	for _, part := range kit {
+		if i := b.line(part, missing); i >= 0 {
+			missing[i]--
+		}
+	}
+	return missing
+}
+
+// line is the first component part is and that is still missing, -1 if none.
+func (b *BOM) line(part *Part, missing []int) int {
+	for i, component := range b.Components {
+		if missing[i] > 0 && component.matches(part) {
+			return i
+		}
+	}
+	return -1
+}
+
+// assemble adds p to the kit and builds the product once every component is
+// there. Called with the mutex held.
+func (as *AssemblyStationNode) assemble(p *Part, connections map[string]*DataSource) FactoryNode {
+	missing := as.BOM.missing(as.Kit)
+	line := as.BOM.line(p, missing)
+	if line < 0 {
+		logging("Part %s is not a missing component of %s at %s\n", p.ID, as.BOM.Product, as.ID)
+		return as.ErrorNode
+	}
+	missing[line]--
+	as.Kit = append(as.Kit, p)
+
+	drawn := as.draw(missing, connections)
+	if drawn == nil {
+		logging("Assembly station %s waiting for components of %s\n", as.ID, as.BOM.Product)
+		return nil
+	}
+	kit := as.Kit
+	as.Kit = nil
+
+	// p carries on as the product, so a copy of it takes its place among the
+	// components, last in the kit
+	component := &Part{}
+	*component = *p
+	kit[len(kit)-1] = component
+	components := append(kit, drawn...)
+	as.Assembled++
+	*p = Part{
+		ID:             fmt.Sprintf("%s-%s%d", as.ID, strings.ToLower(as.BOM.Product), as.Assembled),
+		Type:           as.BOM.Product,
+		Material:       assembledMaterial,
+		Components:     components,
+		TimesAssembled: 1,
+	}
+	for _, child := range components {
+		child.ParentID = p.ID
+		p.Weight += child.Weight
+		p.DefectsCount += child.DefectsCount
+	}
+	p.Weight += 2.0
+
+	logging("Assembly station %s built %s %s from %d components\n", as.ID, p.Type, p.ID, len(components))
+	if conn, exists := connections["part_genealogy"]; exists {
+		for _, child := range components {
+			conn.Appender(child, &as.Node, conn.DataMapper(child, as))
+		}
+	}
+
+	if node := as.route(p); node != nil {
+		return node
+	}
+	return as.ErrorNode
+}
+
+// draw takes the missing components from the stock of the inventories the
+// assembly draws from, or nothing and returns nil if they don't hold them all.
+// Called with the mutex held.
+func (as *AssemblyStationNode) draw(missing []int, connections map[string]*DataSource) []*Part {
+	drawing.Lock()
+	defer drawing.Unlock()
+
+	drawn := []*Part{}
+	taken := make(map[*InventoryNode][]int)
+	for _, inventory := range as.BOM.From {
+		inventory.Mu.Lock()
+		for i, part := range inventory.StoredParts {
+			if line := as.BOM.line(part, missing); line >= 0 {
+				missing[line]--
+				drawn = append(drawn, part)
+				taken[inventory] = append(taken[inventory], i)
+			}
+		}
+		inventory.Mu.Unlock()
+	}
+	for _, count := range missing {
+		if count > 0 {
+			return nil
+		}
+	}
+
+	for _, inventory := range as.BOM.From {
+		if len(taken[inventory]) == 0 {
+			continue
+		}
+		inventory.Mu.Lock()
+		inventory.issue(taken[inventory], connections)
+		inventory.Mu.Unlock()
+	}
+	return drawn
+}
+
+// issue removes the stored parts at indexes, which are in order, from stock.
+// Called with the mutex held.
+func (inv *InventoryNode) issue(indexes []int, connections map[string]*DataSource) {
+	issued := make([]*Part, 0, len(indexes))
+	kept := inv.StoredParts[:0]
+	next := 0
+	for i, part := range inv.StoredParts {
+		if next < len(indexes) && indexes[next] == i {
+			issued = append(issued, part)
+			next++
+			continue
+		}
+		kept = append(kept, part)
+	}
+	inv.StoredParts = kept
+	inv.CurrentStored -= len(issued)
+
+	for _, part := range issued {
+		logging("Part %s issued from inventory %s\n", part.ID, inv.ID)
+		if conn, exists := connections["inventory_tracking"]; exists {
+			conn.Appender(part, &inv.Node, conn.DataMapper(part, inv))
+		}
+	}
+}
@@ -0,0 +1,82 @@
+package simData
+
+import (
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestBOMMissing(t *testing.T) {
+	bom := &BOM{Product: "Frame", Components: []Component{
+		{Material: "Steel", Quantity: 2},
+		{Type: "Bracket", Quantity: 1},
+	}}
+	steel, bracket, plastic := &Part{Material: "Steel"}, &Part{Material: "Mixed", Type: "Bracket"}, &Part{Material: "Plastic"}
+	tests := []struct {
+		name string
+		kit  []*Part
+		want []int
+	}{
+		{name: "empty kit", want: []int{2, 1}},
+		{name: "one steel", kit: []*Part{steel}, want: []int{1, 1}},
+		{name: "more steel than needed", kit: []*Part{steel, steel, steel}, want: []int{0, 1}},
+		{name: "matched by type", kit: []*Part{bracket}, want: []int{2, 0}},
+		{name: "not a component", kit: []*Part{plastic}, want: []int{2, 1}},
+		{name: "complete", kit: []*Part{steel, bracket, steel}, want: []int{0, 0}},
+	}
+	for _, test := range tests {
+		if got := bom.missing(test.kit); !reflect.DeepEqual(got, test.want) {
+			t.Errorf("%s: missing = %v, want %v", test.name, got, test.want)
+		}
+	}
+}
+
+func TestAssemble(t *testing.T) {
+	quietLogs(t)
+	SetClock(NewVirtualClock(simulationStart))
+	reject, next := &Node{ID: "reject"}, &Node{ID: "packer"}
+	stock := NewInventoryNode("stock", 10, []string{"Plastic"}, time.Second)
+	stock.Keep = true
+	stock.StoredParts = []*Part{{ID: "plastic1", Material: "Plastic"}, {ID: "plastic2", Material: "Plastic"}}
+	stock.CurrentStored = 2
+
+	station := NewAssemblyStationNode("assembly", time.Second, nil)
+	station.ErrorNode = reject
+	station.NextNodes = map[string]FactoryNode{"packer": next}
+	station.BOM = &BOM{Product: "Widget", From: []*InventoryNode{stock}, Components: []Component{
+		{Material: "Steel", Quantity: 2},
+		{Material: "Plastic", Quantity: 1},
+	}}
+	sources := map[string]*DataSource{}
+
+	if got := station.Process(&Part{ID: "aluminum1", Material: "Aluminum"}, sources); got != reject {
+		t.Errorf("a part that is not a component went to %v, want reject", got)
+	}
+	if got := station.Process(&Part{ID: "steel1", Material: "Steel", Weight: 1}, sources); got != nil {
+		t.Errorf("the first steel part went to %s, want it kept in the kit", got.GetID())
+	}
+	product := &Part{ID: "steel2", Material: "Steel", Weight: 1, DefectsCount: 1}
+	if got := station.Process(product, sources); got != next {
+		t.Fatalf("the product went to %v, want packer", got)
+	}
+
+	if product.ID != "assembly-widget1" || product.Type != "Widget" || product.Material != assembledMaterial {
+		t.Errorf("got product %s of type %s made of %s", product.ID, product.Type, product.Material)
+	}
+	var components []string
+	for _, component := range product.Components {
+		components = append(components, component.ID)
+		if component.ParentID != product.ID {
+			t.Errorf("component %s has parent %q", component.ID, component.ParentID)
+		}
+	}
+	if want := []string{"steel1", "steel2", "plastic1"}; !reflect.DeepEqual(components, want) {
+		t.Errorf("got components %v, want %v", components, want)
+	}
+	if product.Weight != 4 || product.DefectsCount != 1 {
+		t.Errorf("got weight %v and %d defects, want 4 and 1", product.Weight, product.DefectsCount)
+	}
+	if len(station.Kit) != 0 || stock.CurrentStored != 1 || len(stock.StoredParts) != 1 || stock.StoredParts[0].ID != "plastic2" {
+		t.Errorf("after assembling, the kit holds %d parts and the stock %d", len(station.Kit), stock.CurrentStored)
+	}
+}
@@ -0,0 +1,289 @@
+package simData
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"math/rand"
+	"time"
+)
+
+/*
+Machines given a breakdown in their layout fail after a random amount of processing time, drawn
+around their mean time between failures, and stay Faulty for a repair drawn around their mean
+time to repair. While a machine is down its queue either waits for it or, when rerouted, goes
+back to its station to be shared out among the other members. A repair can need a worker from
+the machine's station, who takes no parts until it is done, and the machine stays down for as
+long as no worker is free. Every repair is written to the machine_downtime data source.
+*/
+
+const (
+	DistributionExponential = "exponential"
+	DistributionFixed       = "fixed"
+	DistributionNormal      = "normal"
+
+	WhenDownBlock   = "block"
+	WhenDownReroute = "reroute"
+
+	// how often a broken machine looks for a free worker to repair it
+	repairWorkerPoll = time.Minute
+)
+
+type BreakdownLayout struct {
+	MTBF string `json:"mtbf" yaml:"mtbf"`
+	MTTR string `json:"mttr" yaml:"mttr"`
+	// Distribution of the times around their means, exponential when empty
+	Distribution string `json:"distribution,omitempty" yaml:"distribution,omitempty"`
+	// WhenDown is what happens to the machine's queue while it is down, block when empty
+	WhenDown     string `json:"when_down,omitempty" yaml:"when_down,omitempty"`
+	RepairWorker bool   `json:"repair_worker,omitempty" yaml:"repair_worker,omitempty"`
+}
+
+func (b *BreakdownLayout) validate(id string) []string {
+	var problems []string
+	for _, field := range []struct{ name, value string }{{"mtbf", b.MTBF}, {"mttr", b.MTTR}} {
+		if duration, err := time.ParseDuration(field.value); err != nil || duration <= 0 {
+			problems = append(problems, fmt.Sprintf("node %q needs a positive breakdown %s, got %q", id, field.name, field.value))
+		}
+	}
+	switch b.Distribution {
+	case "", DistributionExponential, DistributionFixed, DistributionNormal:
+	default:
+		problems = append(problems, fmt.Sprintf("node %q has unknown breakdown distribution %q", id, b.Distribution))
+	}
+	switch b.WhenDown {
+	case "", WhenDownBlock, WhenDownReroute:
+	default:
+		problems = append(problems, fmt.Sprintf("node %q has unknown breakdown when_down %q", id, b.WhenDown))
+	}
+	return problems
+}
+
+func (b *BreakdownLayout) breakdown(rng *rand.Rand) *Breakdown {
+	mtbf, _ := time.ParseDuration(b.MTBF)
+	mttr, _ := time.ParseDuration(b.MTTR)
+	breakdown := &Breakdown{
+		MTBF:         mtbf,
+		MTTR:         mttr,
+		Distribution: b.Distribution,
+		WhenDown:     b.WhenDown,
+		RepairWorker: b.RepairWorker,
+		rng:          rng,
+	}
+	if breakdown.Distribution == "" {
+		breakdown.Distribution = DistributionExponential
+	}
+	if breakdown.WhenDown == "" {
+		breakdown.WhenDown = WhenDownBlock
+	}
+	return breakdown
+}
+
+type Breakdown struct {
+	MTBF         time.Duration
+	MTTR         time.Duration
+	Distribution string
+	WhenDown     string
+	RepairWorker bool
+
+	// Uptime is the processing time since the machine was last repaired, and it
+	// breaks down once that reaches NextFailure
+	Uptime      time.Duration
+	NextFailure time.Duration
+	// Down is the current downtime, nil while the machine works
+	Down *Downtime
+	// Last is the most recent downtime that ended
+	Last *Downtime
+
+	rng *rand.Rand
+}
+
+type Downtime struct {
+	StartedAt       time.Time     `json:"started_at"`
+	RepairStartedAt time.Time     `json:"repair_started_at,omitempty"`
+	EndedAt         time.Time     `json:"ended_at,omitempty"`
+	RepairTime      time.Duration `json:"repair_time"`
+	Uptime          time.Duration `json:"uptime"`
+	WorkerID        string        `json:"worker_id,omitempty"`
+}
+
+// draw is a random duration around mean.
+func (b *Breakdown) draw(mean time.Duration) time.Duration {
+	var d time.Duration
+	switch b.Distribution {
+	case DistributionFixed:
+		d = mean
+	case DistributionNormal:
+		d = time.Duration(float64(mean) * (1 + b.rng.NormFloat64()/4))
+	default:
+		d = time.Duration(float64(mean) * b.rng.ExpFloat64())
+	}
+	// A draw of nothing would have the machine fail on every part
+	if d < time.Second {
+		d = time.Second
+	}
+	return d
+}
+
+func (n *Node) setHeld(machineID string) {
+	n.Mu.Lock()
+	defer n.Mu.Unlock()
+	n.heldFor = machineID
+}
+
+// available is whether a station can send node parts: not while it is stalled,
+// or a machine down with its queue rerouted.
+func available(node FactoryNode) bool {
+	return !node.base().stalled() && !rerouted(node)
+}
+
+// rerouted is whether node is down and has its parts sent elsewhere meanwhile.
+func rerouted(node FactoryNode) bool {
+	n := node.base()
+	n.Mu.Lock()
+	defer n.Mu.Unlock()
+	return n.Breakdown != nil && n.Breakdown.Down != nil && n.Breakdown.WhenDown == WhenDownReroute
+}
+
+// breaksDown counts the part n has just processed towards its uptime, and
+// returns whether n has now broken down.
+func breaksDown(n *Node) bool {
+	n.Mu.Lock()
+	defer n.Mu.Unlock()
+	b := n.Breakdown
+	// Another server may have found the machine broken down already
+	if b == nil || b.Down != nil {
+		return false
+	}
+	if b.NextFailure == 0 {
+		b.NextFailure = b.draw(b.MTBF)
+	}
+	b.Uptime += n.ProcessingTime
+	return b.Uptime >= b.NextFailure
+}
+
+// startDowntime takes n out of service, and returns how many parts it rerouted
+// to its station.
+func startDowntime(n *Node) int {
+	n.Mu.Lock()
+	b := n.Breakdown
+	b.Down = &Downtime{StartedAt: Now(), Uptime: b.Uptime, RepairTime: b.draw(b.MTTR)}
+	n.SetEvent(Faulty)
+	n.Mu.Unlock()
+
+	logPartState("", Faulty, n.ID)
+	logging("Machine %s broke down after %s of uptime\n", n.ID, b.Uptime)
+	if b.WhenDown == WhenDownReroute {
+		return reroute(n)
+	}
+	return 0
+}
+
+// startRepair starts repairing n, once a worker from its station is free if it
+// needs one, and returns whether it started.
+func startRepair(n *Node) bool {
+	b := n.Breakdown
+	if b.RepairWorker {
+		worker := freeWorker(n)
+		if worker == nil {
+			return false
+		}
+		b.Down.WorkerID = worker.ID
+		logging("Worker %s is repairing machine %s\n", worker.ID, n.ID)
+	}
+	b.Down.RepairStartedAt = Now()
+	return true
+}
+
+// freeWorker holds the first idle worker of n's station for its repair.
+func freeWorker(n *Node) *Node {
+	if n.Station == nil {
+		return nil
+	}
+	for _, member := range sortedNodes(n.Station.GetNodesWithin()) {
+		if member.GetType() != NodeTypeWorker {
+			continue
+		}
+		worker := member.base()
+		worker.Mu.Lock()
+		free := worker.GetEvent() == Idle && worker.heldFor == "" && !worker.offShift
+		if free {
+			worker.heldFor = n.ID
+		}
+		worker.Mu.Unlock()
+		if free {
+			return worker
+		}
+	}
+	return nil
+}
+
+// endDowntime puts n back in service, records its downtime and returns the ID
+// of the worker who repaired it, if any.
+func endDowntime(n *Node, connections map[string]*DataSource) string {
+	n.Mu.Lock()
+	b := n.Breakdown
+	down := b.Down
+	down.EndedAt = Now()
+	b.Down, b.Last = nil, down
+	b.Uptime = 0
+	b.NextFailure = b.draw(b.MTBF)
+	if machine, ok := n.self().(*CuttingMachineNode); ok {
+		machine.TimeSinceLastRepair = 0
+	}
+	n.SetEvent(Idle)
+	n.Mu.Unlock()
+
+	if down.WorkerID != "" && n.Station != nil {
+		if worker := n.Station.GetNodesWithin()[down.WorkerID]; worker != nil {
+			worker.base().setHeld("")
+		}
+	}
+	logPartState("", Idle, n.ID)
+	logging("Machine %s repaired after %s down\n", n.ID, down.EndedAt.Sub(down.StartedAt))
+
+	if conn, exists := connections["machine_downtime"]; exists {
+		conn.Appender(nil, n, conn.DataMapper(nil, n))
+	}
+	return down.WorkerID
+}
+
+// repair keeps n down until it is repaired, and returns false if ctx ended first.
+func repair(ctx context.Context, n *Node, connections map[string]*DataSource) bool {
+	startDowntime(n)
+	for !startRepair(n) {
+		if !clock.Sleep(ctx, repairWorkerPoll) {
+			return false
+		}
+	}
+	if !clock.Sleep(ctx, n.Breakdown.Down.RepairTime) {
+		return false
+	}
+	endDowntime(n, connections)
+	return true
+}
+
+// reroute sends the parts waiting for n back to its station, and returns how
+// many it sent.
+func reroute(n *Node) int {
+	if n.Station == nil {
+		return 0
+	}
+	sent := 0
+	for {
+		var part *Part
+		select {
+		case part = <-n.Queue:
+		default:
+			return sent
+		}
+		if !queuePart(n.Station, part) {
+			if !queuePart(n, part) {
+				log.Printf("Queue full, dropping part %s rerouted from %s", part.ID, n.ID)
+			}
+			return sent
+		}
+		logPartTransition(part.ID, n.ID, n.Station.GetID())
+		sent++
+	}
+}
@@ -0,0 +1,90 @@
+package simData
+
+import (
+	"math/rand"
+	"testing"
+	"time"
+)
+
+func TestBreakdownDraw(t *testing.T) {
+	rng := rand.New(rand.NewSource(1))
+	fixed := (&BreakdownLayout{MTBF: "1h", MTTR: "10m", Distribution: DistributionFixed}).breakdown(rng)
+	if got := fixed.draw(fixed.MTBF); got != time.Hour {
+		t.Errorf("a fixed draw around an hour got %s", got)
+	}
+	exponential := (&BreakdownLayout{MTBF: "1ms", MTTR: "1ms"}).breakdown(rng)
+	if exponential.Distribution != DistributionExponential || exponential.WhenDown != WhenDownBlock {
+		t.Errorf("got distribution %q and when_down %q by default", exponential.Distribution, exponential.WhenDown)
+	}
+	for i := 0; i < 100; i++ {
+		if got := exponential.draw(exponential.MTBF); got < time.Second {
+			t.Fatalf("drew %s, want at least a second", got)
+		}
+	}
+	normal := (&BreakdownLayout{MTBF: "1h", MTTR: "10m", Distribution: DistributionNormal}).breakdown(rng)
+	var total time.Duration
+	for i := 0; i < 1000; i++ {
+		total += normal.draw(normal.MTBF)
+	}
+	if mean := total / 1000; mean < 55*time.Minute || mean > 65*time.Minute {
+		t.Errorf("normal draws around an hour have a mean of %s", mean)
+	}
+}
+
+func TestBreaksDown(t *testing.T) {
+	machine := &Node{ID: "cutter", ProcessingTime: time.Second}
+	machine.Breakdown = (&BreakdownLayout{MTBF: "3s", MTTR: "1m", Distribution: DistributionFixed}).breakdown(rand.New(rand.NewSource(1)))
+	for part := 1; part <= 3; part++ {
+		if got, want := breaksDown(machine), part == 3; got != want {
+			t.Errorf("part %d: breaksDown = %v, want %v", part, got, want)
+		}
+	}
+	machine.Breakdown.Down = &Downtime{}
+	if breaksDown(machine) {
+		t.Error("a machine already down broke down again")
+	}
+	if breaksDown(&Node{ID: "reliable"}) {
+		t.Error("a machine without a breakdown broke down")
+	}
+}
+
+func TestRepairWithWorker(t *testing.T) {
+	quietLogs(t)
+	clockAt(0)
+	worker := NewWorkerNode("worker1", "Ann", "Cutting", 3, time.Second)
+	station := &Node{ID: "station", NodeVersion: NodeTypeStation, Queue: make(chan *Part, 5)}
+	station.NodesWithin = map[string]FactoryNode{"worker1": worker}
+	machine := &Node{ID: "cutter", ProcessingTime: time.Second, Queue: make(chan *Part, 5), Station: station}
+	machine.Breakdown = (&BreakdownLayout{MTBF: "1h", MTTR: "10m", Distribution: DistributionFixed, WhenDown: WhenDownReroute, RepairWorker: true}).breakdown(rand.New(rand.NewSource(1)))
+	machine.Breakdown.Uptime = time.Hour
+	machine.Queue <- &Part{ID: "part1"}
+	machine.Queue <- &Part{ID: "part2"}
+
+	if rerouted := startDowntime(machine); rerouted != 2 || len(station.Queue) != 2 {
+		t.Errorf("rerouted %d parts, and the station holds %d, want 2", rerouted, len(station.Queue))
+	}
+	if !rerouted(machine) || available(machine) || machine.GetEvent() != Faulty || !machine.out() {
+		t.Errorf("a machine down with its queue rerouted is in state %s", machine.GetEvent())
+	}
+
+	worker.setHeld("press")
+	if startRepair(machine) {
+		t.Fatal("the repair started while the only worker was held for another")
+	}
+	worker.setHeld("")
+	if !startRepair(machine) || worker.heldFor != "cutter" || !worker.stalled() {
+		t.Fatalf("the repair did not hold the free worker, who is held for %q", worker.heldFor)
+	}
+
+	clockAt(10 * time.Minute)
+	if got := endDowntime(machine, map[string]*DataSource{}); got != "worker1" {
+		t.Errorf("endDowntime returned worker %q", got)
+	}
+	b := machine.Breakdown
+	if b.Down != nil || b.Uptime != 0 || b.NextFailure != time.Hour || machine.GetEvent() != Idle || worker.heldFor != "" {
+		t.Errorf("after the repair got down %v, uptime %s and state %s, worker held for %q", b.Down, b.Uptime, machine.GetEvent(), worker.heldFor)
+	}
+	if b.Last == nil || b.Last.Uptime != time.Hour || b.Last.EndedAt.Sub(b.Last.StartedAt) != 10*time.Minute {
+		t.Errorf("recorded downtime %+v", b.Last)
+	}
+}
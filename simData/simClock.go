@@ -0,0 +1,320 @@
+package simData
+
+import (
+	"container/heap"
+	"context"
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+/*
+The simulation reads the time and waits through a Clock, so it can run faster than real
+time. A scaled clock runs at N times real time. The virtual clock runs as fast as possible:
+the simulation's goroutines join it, and whenever all of them are sleeping it jumps
+straight to the earliest wake up. Timestamps written to data sources come from Now, so they
+follow the simulated time.
+*/
+
+const SpeedFast = "fast"
+
+type Clock interface {
+	Now() time.Time
+	// Sleep waits for d of simulated time, and returns false if ctx ended first
+	Sleep(ctx context.Context, d time.Duration) bool
+	// Join and Leave count the goroutines taking part in the simulation, which
+	// the virtual clock needs to know when all of them are waiting
+	Join(n int)
+	Leave()
+	// Pause stops simulated time, and holds every Sleep until Resume
+	Pause()
+	Resume()
+	Paused() bool
+}
+
+var clock Clock = NewScaledClock(1, time.Now())
+
+// SetClock changes the clock the simulation runs on. It must be called before
+// the simulation starts.
+func SetClock(c Clock) {
+	clock = c
+}
+
+// Now is the simulated time.
+func Now() time.Time {
+	return clock.Now()
+}
+
+// ParseClock makes the clock for a speed of "1" (real time), "N" for N times
+// real time or "fast", starting at start (now when empty, else RFC 3339 or a date).
+func ParseClock(speed string, start string) (Clock, error) {
+	startTime := time.Now()
+	if start = strings.TrimSpace(start); start != "" {
+		var err error
+		if startTime, err = time.Parse(time.RFC3339, start); err != nil {
+			if startTime, err = time.Parse("2006-01-02", start); err != nil {
+				return nil, fmt.Errorf("invalid simulation start %q, expected RFC 3339 or YYYY-MM-DD", start)
+			}
+		}
+	}
+
+	switch speed = strings.ToLower(strings.TrimSpace(speed)); speed {
+	case "":
+		return NewScaledClock(1, startTime), nil
+	case SpeedFast, "max":
+		return NewVirtualClock(startTime), nil
+	}
+	factor, err := strconv.ParseFloat(strings.TrimSuffix(speed, "x"), 64)
+	if err != nil || factor <= 0 {
+		return nil, fmt.Errorf("invalid simulation speed %q, expected a positive number or %q", speed, SpeedFast)
+	}
+	return NewScaledClock(factor, startTime), nil
+}
+
+// pauser holds callers of wait while paused.
+type pauser struct {
+	pauseMu sync.Mutex
+	paused  bool
+	resumed chan struct{}
+}
+
+func (p *pauser) Pause() {
+	p.pauseMu.Lock()
+	defer p.pauseMu.Unlock()
+	if !p.paused {
+		p.paused = true
+		p.resumed = make(chan struct{})
+	}
+}
+
+func (p *pauser) Resume() {
+	p.pauseMu.Lock()
+	defer p.pauseMu.Unlock()
+	if p.paused {
+		p.paused = false
+		close(p.resumed)
+	}
+}
+
+func (p *pauser) Paused() bool {
+	p.pauseMu.Lock()
+	defer p.pauseMu.Unlock()
+	return p.paused
+}
+
+// wait blocks while paused, and returns false if ctx ended first.
+func (p *pauser) wait(ctx context.Context) bool {
+	p.pauseMu.Lock()
+	if !p.paused {
+		p.pauseMu.Unlock()
+		return ctx.Err() == nil
+	}
+	resumed := p.resumed
+	p.pauseMu.Unlock()
+
+	select {
+	case <-resumed:
+		return true
+	case <-ctx.Done():
+		return false
+	}
+}
+
+// scaledClock runs at speed times real time from start, not counting the time
+// spent paused.
+type scaledClock struct {
+	pauser
+	speed float64
+	start time.Time
+
+	mu       sync.Mutex
+	began    time.Time
+	pausedAt time.Time
+}
+
+func NewScaledClock(speed float64, start time.Time) Clock {
+	return &scaledClock{speed: speed, start: start, began: time.Now()}
+}
+
+func (c *scaledClock) Now() time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	elapsed := time.Since(c.began)
+	if !c.pausedAt.IsZero() {
+		elapsed = c.pausedAt.Sub(c.began)
+	}
+	return c.start.Add(time.Duration(float64(elapsed) * c.speed))
+}
+
+func (c *scaledClock) Sleep(ctx context.Context, d time.Duration) bool {
+	wake := c.Now().Add(d)
+	for {
+		if !c.wait(ctx) {
+			return false
+		}
+		remaining := wake.Sub(c.Now())
+		if remaining <= 0 {
+			return true
+		}
+		timer := time.NewTimer(time.Duration(float64(remaining) / c.speed))
+		select {
+		case <-timer.C:
+		case <-ctx.Done():
+			timer.Stop()
+			return false
+		}
+	}
+}
+
+func (c *scaledClock) Join(n int) {}
+func (c *scaledClock) Leave()     {}
+
+func (c *scaledClock) Pause() {
+	c.mu.Lock()
+	if c.pausedAt.IsZero() {
+		c.pausedAt = time.Now()
+	}
+	c.mu.Unlock()
+	c.pauser.Pause()
+}
+
+func (c *scaledClock) Resume() {
+	c.mu.Lock()
+	if !c.pausedAt.IsZero() {
+		c.began = c.began.Add(time.Since(c.pausedAt))
+		c.pausedAt = time.Time{}
+	}
+	c.mu.Unlock()
+	c.pauser.Resume()
+}
+
+type sleeper struct {
+	wake  time.Time
+	order int
+	done  chan struct{}
+	index int
+}
+
+type sleepers []*sleeper
+
+func (s sleepers) Len() int { return len(s) }
+func (s sleepers) Less(i, j int) bool {
+	if !s[i].wake.Equal(s[j].wake) {
+		return s[i].wake.Before(s[j].wake)
+	}
+	return s[i].order < s[j].order
+}
+func (s sleepers) Swap(i, j int) {
+	s[i], s[j] = s[j], s[i]
+	s[i].index, s[j].index = i, j
+}
+func (s *sleepers) Push(x any) {
+	item := x.(*sleeper)
+	item.index = len(*s)
+	*s = append(*s, item)
+}
+func (s *sleepers) Pop() any {
+	old := *s
+	item := old[len(old)-1]
+	*s = old[:len(old)-1]
+	item.index = -1
+	return item
+}
+
+// virtualClock only moves when every goroutine that joined it is asleep, and
+// it isn't paused.
+type virtualClock struct {
+	mu      sync.Mutex
+	paused  bool
+	now     time.Time
+	active  int
+	order   int
+	waiting sleepers
+}
+
+func NewVirtualClock(start time.Time) Clock {
+	return &virtualClock{now: start}
+}
+
+func (c *virtualClock) Now() time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.now
+}
+
+func (c *virtualClock) Sleep(ctx context.Context, d time.Duration) bool {
+	c.mu.Lock()
+	if ctx.Err() != nil {
+		c.mu.Unlock()
+		return false
+	}
+	c.order++
+	s := &sleeper{wake: c.now.Add(d), order: c.order, done: make(chan struct{})}
+	heap.Push(&c.waiting, s)
+	c.active--
+	c.advance()
+	c.mu.Unlock()
+
+	select {
+	case <-s.done:
+		return true
+	case <-ctx.Done():
+		c.mu.Lock()
+		defer c.mu.Unlock()
+		if s.index >= 0 {
+			heap.Remove(&c.waiting, s.index)
+			c.active++
+		}
+		return false
+	}
+}
+
+// advance wakes the earliest sleepers once nobody is running. Called with mu held.
+func (c *virtualClock) advance() {
+	if c.paused || c.active > 0 || len(c.waiting) == 0 {
+		return
+	}
+	next := c.waiting[0].wake
+	if next.After(c.now) {
+		c.now = next
+	}
+	for len(c.waiting) > 0 && !c.waiting[0].wake.After(c.now) {
+		s := heap.Pop(&c.waiting).(*sleeper)
+		c.active++
+		close(s.done)
+	}
+}
+
+func (c *virtualClock) Join(n int) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.active += n
+}
+
+func (c *virtualClock) Leave() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.active--
+	c.advance()
+}
+
+func (c *virtualClock) Pause() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.paused = true
+}
+
+func (c *virtualClock) Resume() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.paused = false
+	c.advance()
+}
+
+func (c *virtualClock) Paused() bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.paused
+}
@@ -0,0 +1,126 @@
+package simData
+
+import (
+	"context"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestParseClock(t *testing.T) {
+	tests := []struct {
+		speed, start string
+		virtual      bool
+		startAt      time.Time
+		invalid      bool
+	}{
+		{speed: "", start: "2024-01-01", startAt: time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)},
+		{speed: "60x", start: "2024-01-01T06:00:00Z", startAt: simulationStart},
+		{speed: " Fast ", start: "2024-01-01T06:00:00Z", virtual: true, startAt: simulationStart},
+		{speed: "max", virtual: true},
+		{speed: "0", invalid: true},
+		{speed: "slow", invalid: true},
+		{speed: "1", start: "monday", invalid: true},
+	}
+	for _, test := range tests {
+		c, err := ParseClock(test.speed, test.start)
+		if test.invalid {
+			if err == nil {
+				t.Errorf("ParseClock(%q, %q) should fail", test.speed, test.start)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("ParseClock(%q, %q): %v", test.speed, test.start, err)
+			continue
+		}
+		if _, virtual := c.(*virtualClock); virtual != test.virtual {
+			t.Errorf("ParseClock(%q) got a %T", test.speed, c)
+		}
+		if !test.startAt.IsZero() && c.Now().Sub(test.startAt) > time.Minute {
+			t.Errorf("ParseClock(%q, %q) starts at %s", test.speed, test.start, c.Now())
+		}
+	}
+}
+
+func TestVirtualClockWakesInOrder(t *testing.T) {
+	c := NewVirtualClock(simulationStart)
+	ctx := context.Background()
+	var mu sync.Mutex
+	var woke []time.Duration
+	sleep := func(naps ...time.Duration) {
+		defer c.Leave()
+		for _, nap := range naps {
+			if !c.Sleep(ctx, nap) {
+				t.Error("a sleep ended early")
+				return
+			}
+			mu.Lock()
+			woke = append(woke, c.Now().Sub(simulationStart))
+			mu.Unlock()
+		}
+	}
+
+	var wg sync.WaitGroup
+	wg.Add(2)
+	c.Join(2)
+	go func() { defer wg.Done(); sleep(5 * time.Minute) }()
+	go func() { defer wg.Done(); sleep(2*time.Minute, 10*time.Minute) }()
+	wg.Wait()
+
+	want := []time.Duration{2 * time.Minute, 5 * time.Minute, 12 * time.Minute}
+	if len(woke) != len(want) {
+		t.Fatalf("got wake ups at %v, want %v", woke, want)
+	}
+	for i := range want {
+		if woke[i] != want[i] {
+			t.Errorf("got wake ups at %v, want %v", woke, want)
+			break
+		}
+	}
+}
+
+func TestVirtualClockPauseAndCancel(t *testing.T) {
+	c := NewVirtualClock(simulationStart)
+	c.Pause()
+	c.Join(1)
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan bool)
+	go func() { done <- c.Sleep(ctx, time.Hour) }()
+
+	time.Sleep(10 * time.Millisecond)
+	if !c.Now().Equal(simulationStart) {
+		t.Errorf("a paused clock moved to %s", c.Now())
+	}
+	cancel()
+	if <-done {
+		t.Error("a cancelled sleep returned true")
+	}
+
+	c.Resume()
+	if !c.Sleep(context.Background(), time.Minute) || !c.Now().Equal(simulationStart.Add(time.Minute)) {
+		t.Errorf("after resuming, a minute's sleep ended at %s", c.Now())
+	}
+}
+
+func TestScaledClock(t *testing.T) {
+	c := NewScaledClock(3600, simulationStart)
+	began := time.Now()
+	if !c.Sleep(context.Background(), time.Minute) {
+		t.Fatal("the sleep ended early")
+	}
+	if took := time.Since(began); took > time.Second {
+		t.Errorf("a simulated minute at 3600x took %s", took)
+	}
+	if simulated := c.Now().Sub(simulationStart); simulated < time.Minute {
+		t.Errorf("the clock moved %s over a minute's sleep", simulated)
+	}
+
+	c.Pause()
+	paused := c.Now()
+	time.Sleep(5 * time.Millisecond)
+	if !c.Now().Equal(paused) {
+		t.Errorf("a paused clock moved from %s to %s", paused, c.Now())
+	}
+	c.Resume()
+}
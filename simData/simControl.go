@@ -0,0 +1,147 @@
+package simData
+
+import (
+	"fmt"
+	"strings"
+	"time"
+)
+
+/*
+Controls for a running simulation. Pausing stops the clock: node goroutines hold at their next
+sleep and the event engine between events, so queues can be inspected while nothing moves.
+Stepping runs single events, so it needs the event engine. Resetting rebuilds the factory and
+restoring a snapshot replaces it, which only the service that started the simulation knows how
+to do, so it implements Control and every command, from the API or a WebSocket, goes through it.
+*/
+
+const (
+	ControlTopic = "sim.control"
+
+	ControlPause  = "pause"
+	ControlResume = "resume"
+	ControlStep   = "step"
+	ControlRate   = "rate"
+	ControlReset  = "reset"
+	// Restores are only broadcast, snapshots are restored through their own endpoint
+	ControlRestore = "restore"
+
+	maxStepEvents = 100000
+)
+
+type Control interface {
+	Control(command ControlCommand) (*ControlStatus, error)
+	ControlStatus() *ControlStatus
+	Snapshot() (*Snapshot, error)
+	Restore(snapshot *Snapshot) (*ControlStatus, error)
+}
+
+type ControlCommand struct {
+	Action string `json:"action"`
+	Events int    `json:"events,omitempty"`
+	Rate   int    `json:"rate,omitempty"`
+}
+
+type ControlStatus struct {
+	Engine string    `json:"engine"`
+	Paused bool      `json:"paused"`
+	Rate   int       `json:"rate"`
+	Seed   int64     `json:"seed"`
+	Time   time.Time `json:"time"`
+	Events int       `json:"events,omitempty"`
+}
+
+// ControlMessage is what is broadcast on ControlTopic after every command.
+type ControlMessage struct {
+	Command ControlCommand `json:"command"`
+	Status  *ControlStatus `json:"status"`
+	Stepped int            `json:"stepped,omitempty"`
+}
+
+// ControlError is a command that can't be carried out as asked.
+type ControlError struct {
+	Message string
+}
+
+func (e *ControlError) Error() string {
+	return e.Message
+}
+
+// ParseControlCommand reads a WebSocket command such as "pause", "step 10" or "rate 5".
+func ParseControlCommand(text string) (ControlCommand, error) {
+	fields := strings.Fields(text)
+	if len(fields) == 0 {
+		return ControlCommand{}, &ControlError{Message: "empty control command"}
+	}
+	command := ControlCommand{Action: strings.ToLower(fields[0])}
+	if len(fields) > 2 {
+		return command, &ControlError{Message: fmt.Sprintf("too many arguments for %s", command.Action)}
+	}
+	if len(fields) == 2 {
+		var value int
+		if _, err := fmt.Sscan(fields[1], &value); err != nil {
+			return command, &ControlError{Message: fmt.Sprintf("invalid number %q for %s", fields[1], command.Action)}
+		}
+		switch command.Action {
+		case ControlStep:
+			command.Events = value
+		case ControlRate:
+			command.Rate = value
+		default:
+			return command, &ControlError{Message: fmt.Sprintf("%s takes no arguments", command.Action)}
+		}
+	}
+	return command, nil
+}
+
+// ApplyControl carries out every command but reset on the running simulation,
+// and returns how many events were stepped.
+func ApplyControl(factory *Factory, command ControlCommand) (int, error) {
+	switch command.Action {
+	case ControlPause:
+		clock.Pause()
+	case ControlResume:
+		clock.Resume()
+	case ControlStep:
+		engine, ok := clock.(*EventEngine)
+		if !ok {
+			return 0, &ControlError{Message: fmt.Sprintf("stepping needs the %s engine", EngineEvents)}
+		}
+		events := command.Events
+		if events == 0 {
+			events = 1
+		}
+		if events < 0 || events > maxStepEvents {
+			return 0, &ControlError{Message: fmt.Sprintf("events must be between 1 and %d", maxStepEvents)}
+		}
+		ran, err := engine.StepPaused(events)
+		if err != nil {
+			return 0, &ControlError{Message: err.Error()}
+		}
+		return ran, nil
+	case ControlRate:
+		if command.Rate <= 0 {
+			return 0, &ControlError{Message: "rate must be a positive number"}
+		}
+		factory.SetRate(command.Rate)
+	case ControlReset:
+		return 0, &ControlError{Message: "reset must be carried out by the simulation service"}
+	default:
+		return 0, &ControlError{Message: fmt.Sprintf("unknown control action %q", command.Action)}
+	}
+	return 0, nil
+}
+
+// CurrentStatus describes the simulation running factory on engine.
+func CurrentStatus(factory *Factory, engine string) *ControlStatus {
+	status := &ControlStatus{
+		Engine: engine,
+		Paused: clock.Paused(),
+		Rate:   factory.Rate(),
+		Seed:   factory.Seed(),
+		Time:   Now(),
+	}
+	if events, ok := clock.(*EventEngine); ok {
+		status.Events = events.Ran()
+	}
+	return status
+}
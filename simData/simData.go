@@ -8,12 +8,18 @@ import (
 	"log"
 	"math/rand"
 	"os"
+	"path/filepath"
 	"sync"
 	"time"
 
 	_ "github.com/lib/pq"
 )
 
+const defaultRate = 3
+
+// materials are what new parts are made of, and what inventories check them against
+var materials = []string{"Steel", "Aluminum", "Plastic", "Electronics"}
+
 var logPath = ""
 var reg *util.Registry
 
@@ -138,32 +144,42 @@ func abs(x int) int {
 	return x
 }
 func SimulateData(connections map[string]*DataSource, factory *Factory, ctx context.Context) {
-	defer CloseConnections()
 	var wg sync.WaitGroup
 
 	createLogFile()
+	log.Printf("Simulating with seed %d from %s", factory.Seed(), Now().Format(time.RFC3339))
 	totalNodes := len(factory.nodes)
 	simulationCtx, cancel := context.WithCancel(ctx)
 	defer cancel()
 
 	wg.Add(totalNodes + 1)
+	clock.Join(totalNodes + 1)
 	for _, node := range factory.nodes {
 		go node.Start(&wg, connections, simulationCtx)
 	}
-	start := factory.GetNode("start")
-	rate := 3
-	go addParts(start, rate, &wg, simulationCtx)
+	if workers := shiftWorkers(factory); len(workers) > 0 {
+		wg.Add(1)
+		clock.Join(1)
+		go runShifts(simulationCtx, workers, connections, &wg)
+	}
+	if factory.orders != nil {
+		go runOrders(simulationCtx, factory, connections, &wg)
+	} else {
+		start := factory.GetNode("start")
+		go addParts(start, factory.Rate, factory.stream(arrivalsStream), &wg, simulationCtx)
+	}
 
 	<-ctx.Done()
 	log.Println("Simulation context cancelled, shutting down gracefully")
 
 	cancel()
 
+	// Every goroutine leaves once ctx ends, and none may still be sending when
+	// the queues close
+	wg.Wait()
 	for _, node := range factory.nodes {
 		close(node.GetQueue())
 	}
-
-	wg.Wait()
 	log.Println("All simulation goroutines have finished")
 }
 
@@ -172,8 +188,9 @@ func getQueueLength(queue chan *Part) int {
 	return queueLen
 }
 
-func addParts(start FactoryNode, rate int, wg *sync.WaitGroup, ctx context.Context) {
+func addParts(start FactoryNode, rate func() int, rng *rand.Rand, wg *sync.WaitGroup, ctx context.Context) {
 	defer wg.Done()
+	defer clock.Leave()
 	counter := 0
 
 	for {
@@ -183,21 +200,28 @@ func addParts(start FactoryNode, rate int, wg *sync.WaitGroup, ctx context.Conte
 			return
 		default:
 			counter++
-			part := &Part{ID: "part" + fmt.Sprint(counter), Cutattempts: 0}
+			part := newPart(counter, rng)
 
-			select {
-			case start.GetQueue() <- part:
-				// log.Printf("Added new part: %s", part.ID)
-			case <-time.After(500 * time.Millisecond):
+			if !sendPart(ctx, start, part) && ctx.Err() == nil {
 				log.Printf("Queue full, skipping part: %s", part.ID)
 			}
 
-			duration := float64(time.Second) / ((rand.Float64() * float64(rate) / 2) + 0.75)
-			time.Sleep(time.Duration(duration))
+			clock.Sleep(ctx, arrivalInterval(rng, rate()))
 		}
 	}
 }
 
+// newPart is the numbered part arriving at the start of the line. It is made of
+// one of the materials, as inventories turn away parts of any other.
+func newPart(number int, rng *rand.Rand) *Part {
+	return &Part{ID: "part" + fmt.Sprint(number), Cutattempts: 0, Material: materials[rng.Intn(len(materials))]}
+}
+
+// arrivalInterval is the time until the next part arrives at the start of the line.
+func arrivalInterval(rng *rand.Rand, rate int) time.Duration {
+	return time.Duration(float64(time.Second) / ((rng.Float64() * float64(rate) / 2) + 0.75))
+}
+
 func CloseConnections() {
 	connectors := connections.GetWorkspaceConnectors()
 	if connectors != nil {
@@ -205,10 +229,20 @@ func CloseConnections() {
 	}
 }
 
+// logDir is where the simulation log is written: SIM_LOG_DIR, or a directory in
+// the system's temporary directory so runs never write into the source tree.
+func logDir() string {
+	return util.GetEnvWithDefault("SIM_LOG_DIR", filepath.Join(os.TempDir(), "simData", "log_data"))
+}
+
+// createLogFile starts each run with an empty log.
 func createLogFile() {
-	// timestamp := time.Now().Format("2006-01-02-15-04-05")
-	// logPath = fmt.Sprintf("simData/log_data/log_%s.txt", timestamp)
-	os.RemoveAll("simData/log_data")
-	os.MkdirAll("simData/log_data", 0755)
-	logPath = "simData/log_data/log.txt"
+	dir := logDir()
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		log.Printf("Error creating log directory %s: %v", dir, err)
+	}
+	logPath = filepath.Join(dir, "log.txt")
+	if err := os.Remove(logPath); err != nil && !os.IsNotExist(err) {
+		log.Printf("Error clearing log %s: %v", logPath, err)
+	}
 }
@@ -0,0 +1,63 @@
+package simData
+
+import (
+	"math/rand"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestCreateLogFile(t *testing.T) {
+	previous := logPath
+	defer func() { logPath = previous }()
+	dir := filepath.Join(t.TempDir(), "logs")
+	t.Setenv("SIM_LOG_DIR", dir)
+
+	createLogFile()
+	if want := filepath.Join(dir, "log.txt"); logPath != want {
+		t.Fatalf("got log path %q, want %q", logPath, want)
+	}
+	if _, err := logging("part=%s;state=%s\n", "part1", "Idle"); err != nil {
+		t.Fatalf("logging: %v", err)
+	}
+	other := filepath.Join(dir, "kept.txt")
+	if err := os.WriteFile(other, []byte("kept"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	createLogFile()
+	if _, err := os.Stat(logPath); !os.IsNotExist(err) {
+		t.Errorf("a new run should start with an empty log, got %v", err)
+	}
+	if _, err := os.Stat(other); err != nil {
+		t.Errorf("clearing the log removed other files in its directory: %v", err)
+	}
+}
+
+func TestNewPartsSuitRawInventory(t *testing.T) {
+	factory, err := DefaultFactoryLayout().Build(map[string]*DataSource{})
+	if err != nil {
+		t.Fatalf("Build: %v", err)
+	}
+	inventory, ok := factory.GetNode("raw_inventory").(*InventoryNode)
+	if !ok {
+		t.Fatal("the default layout has no raw_inventory")
+	}
+	allowed := make(map[string]bool)
+	for _, material := range inventory.AllowedTypes {
+		allowed[material] = true
+	}
+
+	rng := rand.New(rand.NewSource(1))
+	seen := make(map[string]bool)
+	for i := 1; i <= 200; i++ {
+		part := newPart(i, rng)
+		if !allowed[part.Material] {
+			t.Fatalf("part %s is made of %q, which raw_inventory turns away", part.ID, part.Material)
+		}
+		seen[part.Material] = true
+	}
+	if len(seen) != len(materials) {
+		t.Errorf("200 parts were made of %d materials, want all %d", len(seen), len(materials))
+	}
+}
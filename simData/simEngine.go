@@ -0,0 +1,516 @@
+package simData
+
+import (
+	"container/heap"
+	"context"
+	"fmt"
+	"log"
+	"math/rand"
+	"strings"
+	"sync"
+	"time"
+)
+
+/*
+The event engine runs the same factory as SimulateData without a goroutine per node. Everything
+a node goroutine would sleep through (processing, the transfer to the next node, waiting for
+room in a full queue, the gap between arrivals) becomes an event on a queue ordered by simulated
+time, and a single loop runs the events in order. Nodes are processed with the same Process
+calls, logs and data sources, but nothing depends on the scheduler: a seed gives the same run
+every time, and the clock jumps from one event to the next instead of polling.
+*/
+
+const (
+	EngineGoroutines = "goroutines"
+	EngineEvents     = "events"
+)
+
+// ParseEngine checks the name of a simulation engine. When empty, seeded runs use
+// the event engine, which is the one that reproduces a run, and others goroutines.
+func ParseEngine(name string, seeded bool) (string, error) {
+	switch name = strings.ToLower(strings.TrimSpace(name)); name {
+	case "":
+		if seeded {
+			return EngineEvents, nil
+		}
+		return EngineGoroutines, nil
+	case EngineGoroutines:
+		return EngineGoroutines, nil
+	case EngineEvents:
+		return EngineEvents, nil
+	}
+	return "", fmt.Errorf("unknown simulation engine %q, expected %q or %q", name, EngineGoroutines, EngineEvents)
+}
+
+type eventKind int
+
+const (
+	// a new part arrives at the start of the line
+	eventArrive eventKind = iota
+	// the arriving part is tried again once start has had time to make room
+	eventArriveRetry
+	// node has processed part
+	eventFinish
+	// node passes part on to next
+	eventTransfer
+	eventTransferRetry
+	// next stayed full, so part is rejected to next instead
+	eventRejectRetry
+	// node is down, and starts its repair once a worker is free if it needs one
+	eventRepairStart
+	eventRepairEnd
+	eventMaintenanceEnd
+	// workers start or end a shift or break
+	eventShift
+	// orders are placed, shipped and released for
+	eventOrders
+	// a server's batch has waited as long as it can to fill
+	eventBatchTimeout
+)
+
+var eventKindNames = []string{"arrive", "arrive_retry", "finish", "transfer", "transfer_retry", "reject_retry", "repair_start", "repair_end", "maintenance_end", "shift", "orders", "batch_timeout"}
+
+func (k eventKind) String() string {
+	return eventKindNames[k]
+}
+
+// event is plain data rather than a closure, so pending events can be saved in snapshots.
+type event struct {
+	at     time.Time
+	seq    int
+	kind   eventKind
+	node   FactoryNode
+	server int
+	next   FactoryNode
+	part   *Part
+	index  int
+}
+
+type eventQueue []*event
+
+func (q eventQueue) Len() int { return len(q) }
+func (q eventQueue) Less(i, j int) bool {
+	if !q[i].at.Equal(q[j].at) {
+		return q[i].at.Before(q[j].at)
+	}
+	return q[i].seq < q[j].seq
+}
+func (q eventQueue) Swap(i, j int) {
+	q[i], q[j] = q[j], q[i]
+	q[i].index, q[j].index = i, j
+}
+func (q *eventQueue) Push(x any) {
+	item := x.(*event)
+	item.index = len(*q)
+	*q = append(*q, item)
+}
+func (q *eventQueue) Pop() any {
+	old := *q
+	item := old[len(old)-1]
+	*q = old[:len(old)-1]
+	item.index = -1
+	return item
+}
+
+// EventEngine is also the simulation's Clock while it runs, so data sources are
+// stamped with the time of the event being run.
+type EventEngine struct {
+	pauser
+	factory     *Factory
+	connections map[string]*DataSource
+	rng         *rand.Rand
+
+	// stepMu is held while an event runs, so steps asked for while paused
+	// never overlap with the run loop
+	stepMu sync.Mutex
+	mu     sync.RWMutex
+	now    time.Time
+	seq    int
+	ran    int
+	parts  int
+	events eventQueue
+}
+
+func NewEventEngine(factory *Factory, connections map[string]*DataSource, start time.Time) *EventEngine {
+	engine := newEventEngine(factory, connections, start)
+	if len(shiftWorkers(factory)) > 0 {
+		engine.schedule(0, &event{kind: eventShift})
+	}
+	if factory.orders != nil {
+		engine.schedule(0, &event{kind: eventOrders})
+	} else {
+		engine.schedule(0, &event{kind: eventArrive})
+	}
+	return engine
+}
+
+func newEventEngine(factory *Factory, connections map[string]*DataSource, start time.Time) *EventEngine {
+	for _, node := range factory.nodes {
+		node.base().open(start)
+	}
+	return &EventEngine{
+		factory:     factory,
+		connections: connections,
+		rng:         factory.stream(arrivalsStream),
+		now:         start,
+	}
+}
+
+func (e *EventEngine) Now() time.Time {
+	e.mu.RLock()
+	defer e.mu.RUnlock()
+	return e.now
+}
+
+// Sleep is only part of the Clock interface, nothing sleeps under the event engine.
+func (e *EventEngine) Sleep(ctx context.Context, d time.Duration) bool {
+	return ctx.Err() == nil
+}
+
+func (e *EventEngine) Join(n int) {}
+func (e *EventEngine) Leave()     {}
+
+func (e *EventEngine) Factory() *Factory {
+	return e.factory
+}
+
+// Ran is the number of events run so far.
+func (e *EventEngine) Ran() int {
+	e.mu.RLock()
+	defer e.mu.RUnlock()
+	return e.ran
+}
+
+func (e *EventEngine) schedule(after time.Duration, next *event) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	e.seq++
+	next.at = e.now.Add(after)
+	next.seq = e.seq
+	heap.Push(&e.events, next)
+}
+
+// next is the time of the next event, false when there are none.
+func (e *EventEngine) next() (time.Time, bool) {
+	e.mu.RLock()
+	defer e.mu.RUnlock()
+	if len(e.events) == 0 {
+		return time.Time{}, false
+	}
+	return e.events[0].at, true
+}
+
+// StepPaused runs up to n events while the engine is paused, and returns how
+// many ran.
+func (e *EventEngine) StepPaused(n int) (int, error) {
+	e.stepMu.Lock()
+	defer e.stepMu.Unlock()
+	if !e.Paused() {
+		return 0, fmt.Errorf("pause the simulation before stepping it")
+	}
+	ran := 0
+	for ran < n && e.Step() {
+		ran++
+	}
+	return ran, nil
+}
+
+// Step runs the next event, and returns false when there are none left.
+func (e *EventEngine) Step() bool {
+	e.mu.Lock()
+	if len(e.events) == 0 {
+		e.mu.Unlock()
+		return false
+	}
+	next := heap.Pop(&e.events).(*event)
+	e.now = next.at
+	e.ran++
+	e.mu.Unlock()
+
+	e.run(next)
+	return true
+}
+
+func (e *EventEngine) run(ev *event) {
+	switch ev.kind {
+	case eventArrive:
+		e.parts++
+		part := newPart(e.parts, e.rng)
+		if !e.arrived(part, queuePart(e.start(), part)) {
+			e.schedule(sendTimeout, &event{kind: eventArriveRetry, part: part})
+		}
+	case eventArriveRetry:
+		if !e.arrived(ev.part, queuePart(e.start(), ev.part)) {
+			log.Printf("Queue full, skipping part: %s", ev.part.ID)
+			e.schedule(arrivalInterval(e.rng, e.factory.Rate()), &event{kind: eventArrive})
+		}
+	case eventFinish:
+		e.finish(ev.node, ev.server)
+	case eventTransfer:
+		if !e.transferred(ev.node, ev.server, ev.part, ev.next) {
+			e.schedule(sendTimeout, &event{kind: eventTransferRetry, node: ev.node, server: ev.server, part: ev.part, next: ev.next})
+		}
+	case eventTransferRetry:
+		if !e.transferred(ev.node, ev.server, ev.part, ev.next) {
+			log.Printf("Next node queue full, rejecting part %s", ev.part.ID)
+			e.reject(ev.node, ev.server, ev.part)
+		}
+	case eventRejectRetry:
+		if !e.rejected(ev.node, ev.server, ev.part, ev.next) {
+			log.Printf("Reject queue full, dropping part %s", ev.part.ID)
+			e.release(ev.node, ev.server)
+		}
+	case eventRepairStart:
+		e.startRepair(ev.node)
+	case eventRepairEnd:
+		if worker := endDowntime(ev.node.base(), e.connections); worker != "" {
+			e.wake(e.factory.GetNode(worker))
+		}
+		e.wake(ev.node)
+	case eventShift:
+		if next := updateShifts(shiftWorkers(e.factory), e.connections); !next.IsZero() {
+			e.schedule(next.Sub(e.Now()), &event{kind: eventShift})
+		}
+		// Anything that stalled for want of a worker can carry on
+		for _, node := range sortedNodes(e.factory.nodes) {
+			e.wake(node)
+		}
+	case eventOrders:
+		if wait := e.releaseOrders(); wait > 0 {
+			e.schedule(wait, &event{kind: eventOrders})
+		}
+	case eventMaintenanceEnd:
+		ev.node.(maintainedNode).endMaintenance(e.connections)
+		e.wake(ev.node)
+	case eventBatchTimeout:
+		e.wake(ev.node)
+	}
+}
+
+// releaseOrders releases the part the orders call for, and returns how long
+// until they should be looked at again.
+func (e *EventEngine) releaseOrders() time.Duration {
+	number := func() int {
+		e.parts++
+		return e.parts
+	}
+	send := func(part *Part) bool {
+		if !queuePart(e.start(), part) {
+			return false
+		}
+		e.wake(e.start())
+		return true
+	}
+	return releaseOrders(e.factory.orders, e.start(), e.connections, e.rng, e.factory.Rate(), number, send)
+}
+
+func (e *EventEngine) start() FactoryNode {
+	return e.factory.GetNode("start")
+}
+
+// Run steps through events until ctx ends. With a pace clock, each gap between
+// events is slept on it, otherwise the events run as fast as possible.
+func (e *EventEngine) Run(ctx context.Context, pace Clock) {
+	for e.wait(ctx) {
+		at, ok := e.next()
+		if !ok {
+			return
+		}
+		if wait := at.Sub(e.Now()); pace != nil && wait > 0 && !pace.Sleep(ctx, wait) {
+			return
+		}
+
+		e.stepMu.Lock()
+		if !e.Paused() {
+			e.Step()
+		}
+		e.stepMu.Unlock()
+	}
+}
+
+// arrived starts the next arrival once part is queued at start, and returns sent.
+func (e *EventEngine) arrived(part *Part, sent bool) bool {
+	if sent {
+		e.wake(e.start())
+		e.schedule(arrivalInterval(e.rng, e.factory.Rate()), &event{kind: eventArrive})
+	}
+	return sent
+}
+
+// wake loads node's free servers with the parts in its queue, and starts each
+// whose batch is ready, unless node is stalled or down.
+func (e *EventEngine) wake(n FactoryNode) {
+	node := n.base()
+	if node.stalled() || node.out() {
+		return
+	}
+
+	busy := false
+	for _, server := range node.servers() {
+		if server.Busy {
+			busy = true
+			continue
+		}
+		loading := len(server.Batch) > 0
+		drained := false
+		for len(server.Batch) < node.Batch.size() {
+			var part *Part
+			select {
+			case part = <-n.GetQueue():
+			default:
+				drained = true
+			}
+			if drained {
+				break
+			}
+			server.load(part)
+		}
+		if !node.Batch.ready(len(server.Batch), server.Loaded, drained) {
+			// The batch waits to fill, until the timeout if it has one
+			if !loading && len(server.Batch) > 0 && node.Batch.Timeout > 0 {
+				e.schedule(node.Batch.Timeout, &event{kind: eventBatchTimeout, node: n, server: server.Index})
+			}
+			continue
+		}
+
+		busy = true
+		node.begin(server, e.connections)
+		e.schedule(n.GetProcessingTime(), &event{kind: eventFinish, node: n, server: server.Index})
+	}
+	if !busy && n.GetEvent() != Idle {
+		n.SetEvent(Idle)
+		logPartState("", n.GetEvent(), n.GetID())
+	}
+}
+
+// finish sends each part of the server's batch on once it is processed.
+func (e *EventEngine) finish(n FactoryNode, index int) {
+	server := n.base().servers()[index]
+	for _, part := range server.Batch {
+		finishProcessing(part, n)
+	}
+	for i, part := range server.Batch {
+		nextNode := server.Next[i]
+		if nextNode == nil {
+			continue
+		}
+		server.Out++
+		n.SetEvent(Idle)
+		logPartState(part.ID, n.GetEvent(), n.GetID())
+		logPartTransition(part.ID, n.GetID(), nextNode.GetID())
+		e.schedule(transferTime, &event{kind: eventTransfer, node: n, server: index, part: part, next: nextNode})
+	}
+	if server.Out == 0 {
+		e.free(n, server)
+	}
+}
+
+// transferred frees n once part is queued at nextNode, and returns sent.
+func (e *EventEngine) transferred(n FactoryNode, server int, part *Part, nextNode FactoryNode) bool {
+	if !queuePart(nextNode, part) {
+		return false
+	}
+	logPartState(part.ID, nextNode.GetEvent(), nextNode.GetID())
+	e.wake(nextNode)
+	e.release(n, server)
+	return true
+}
+
+func (e *EventEngine) reject(n FactoryNode, server int, part *Part) {
+	errorNode := n.GetErrorNode()
+	if errorNode == nil {
+		log.Printf("No reject node, dropping part %s", part.ID)
+		e.release(n, server)
+		return
+	}
+	if !e.rejected(n, server, part, errorNode) {
+		e.schedule(sendTimeout, &event{kind: eventRejectRetry, node: n, server: server, part: part, next: errorNode})
+	}
+}
+
+// rejected frees n once part is queued at errorNode, and returns sent.
+func (e *EventEngine) rejected(n FactoryNode, server int, part *Part, errorNode FactoryNode) bool {
+	if !queuePart(errorNode, part) {
+		return false
+	}
+	e.wake(errorNode)
+	e.release(n, server)
+	return true
+}
+
+// release frees the server for its next batch once the last part of this one
+// has left n.
+func (e *EventEngine) release(n FactoryNode, index int) {
+	if queueLen := len(n.GetQueue()); queueLen > 0 {
+		logNodeQueue(n.GetID(), queueLen)
+	}
+	server := n.base().servers()[index]
+	if server.Out--; server.Out > 0 {
+		return
+	}
+	e.free(n, server)
+}
+
+// free records the server's batch as served, and starts it on the next unless
+// n now stops.
+func (e *EventEngine) free(n FactoryNode, server *Server) {
+	n.base().served(server, e.connections)
+	if e.stopped(n) {
+		return
+	}
+	e.wake(n)
+}
+
+// stopped takes n out of service if it breaks down or needs maintenance now a
+// server's batch has left, and returns whether it did.
+func (e *EventEngine) stopped(n FactoryNode) bool {
+	if breaksDown(n.base()) {
+		e.breakDown(n)
+		return true
+	}
+	if maintained, ok := n.(maintainedNode); ok {
+		if window := maintained.startMaintenance(); window != nil {
+			e.schedule(window.Duration, &event{kind: eventMaintenanceEnd, node: n})
+			return true
+		}
+	}
+	return false
+}
+
+// breakDown keeps n out of service until it is repaired.
+func (e *EventEngine) breakDown(n FactoryNode) {
+	if rerouted := startDowntime(n.base()); rerouted > 0 {
+		e.wake(n.GetStation())
+	}
+	e.startRepair(n)
+}
+
+func (e *EventEngine) startRepair(n FactoryNode) {
+	if !startRepair(n.base()) {
+		e.schedule(repairWorkerPoll, &event{kind: eventRepairStart, node: n})
+		return
+	}
+	e.schedule(n.base().Breakdown.Down.RepairTime, &event{kind: eventRepairEnd, node: n})
+}
+
+// SimulateEvents runs the factory on the event engine until ctx ends.
+func SimulateEvents(connections map[string]*DataSource, factory *Factory, ctx context.Context) {
+	RunEvents(NewEventEngine(factory, connections, clock.Now()), ctx)
+}
+
+// RunEvents runs engine until ctx ends. It keeps to the pace of the current
+// clock, unless that clock runs as fast as possible.
+func RunEvents(engine *EventEngine, ctx context.Context) {
+	createLogFile()
+	var pace Clock
+	switch clock.(type) {
+	case *virtualClock, *EventEngine:
+	default:
+		pace = clock
+	}
+	SetClock(engine)
+	log.Printf("Simulating events with seed %d from %s", engine.factory.Seed(), Now().Format(time.RFC3339))
+
+	engine.Run(ctx, pace)
+	log.Printf("Event simulation stopped after %d events at %s", engine.Ran(), Now().Format(time.RFC3339))
+}
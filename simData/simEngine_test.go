@@ -0,0 +1,204 @@
+package simData
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// lineLayout is a line with one server per node and no stations, so parts
+// reach every node in the order they arrive under either engine, and each
+// node draws from its random stream in the same order.
+const lineLayout = `
+version: 1
+name: line
+seed: 42
+nodes:
+  - {id: reject, type: reject}
+  - {id: start, type: start}
+  - {id: complete, type: complete}
+  - {id: cutter, type: cutting_machine, processing_time: 500ms, failure_rate: 0.05, tools: [SteelBlade]}
+  - {id: sensor, type: sensor_machine, processing_time: 400ms, failure_chance: 0.1}
+  - {id: packer, type: packaging, processing_time: 300ms, packaging_type: Box}
+edges:
+  - {from: start, to: cutter}
+  - {from: cutter, to: sensor}
+  - {from: sensor, to: packer}
+  - {from: packer, to: complete}
+`
+
+// engineRun is what a run of lineLayout wrote: the log lines about each part,
+// and the rows its data sources wrote about each part and machine.
+type engineRun struct {
+	mu    sync.Mutex
+	parts map[string][]string
+	rows  map[string][]string
+}
+
+func newEngineRun() *engineRun {
+	return &engineRun{parts: make(map[string][]string), rows: make(map[string][]string)}
+}
+
+// record keeps a row about a part, or else about a machine, without the
+// columns measuring time, which differ between the engines: a goroutine
+// notices a part in its queue up to idlePoll after it arrives.
+func (r *engineRun) record(source string, row map[string]interface{}) {
+	key, _ := row["part_id"].(string)
+	if key == "" {
+		machine, _ := row["machine_id"].(string)
+		key = "machine:" + machine
+	}
+	var columns []string
+	for column, value := range row {
+		if _, isTime := value.(time.Time); isTime || strings.HasSuffix(column, "seconds") || column == "utilisation" {
+			continue
+		}
+		columns = append(columns, fmt.Sprintf("%s=%v", column, value))
+	}
+	sort.Strings(columns)
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.rows[key] = append(r.rows[key], source+" "+strings.Join(columns, " "))
+}
+
+// readLog sorts the lines of the log at path by the part they are about. The
+// line logged as a part is queued at the next node is left out: it holds the
+// state that node is in, which depends on how soon a goroutine polls. So are
+// the lines of the reject node, which clears its queue when it takes a part,
+// and so drops whichever parts a goroutine finds waiting.
+func (r *engineRun) readLog(t *testing.T, path string) {
+	t.Helper()
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatalf("reading the simulation log: %v", err)
+	}
+	queued := make(map[string]bool)
+	for _, line := range strings.Split(string(data), "\n") {
+		switch {
+		case strings.HasPrefix(line, "part=") && !strings.HasPrefix(line, "part=;"):
+			part := strings.TrimPrefix(strings.SplitN(line, ";", 2)[0], "part=")
+			if queued[part] {
+				queued[part] = false
+				continue
+			}
+			if !strings.HasSuffix(line, ";node=reject") {
+				r.parts[part] = append(r.parts[part], line)
+			}
+		case strings.Contains(line, ";transition;"):
+			part := strings.SplitN(line, ";", 2)[0]
+			queued[part] = true
+			r.parts[part] = append(r.parts[part], line)
+		}
+	}
+}
+
+// finished is whether part has left the line, rejected or processed at
+// complete.
+func (r *engineRun) finished(part string) bool {
+	lines := r.parts[part]
+	if len(lines) == 0 {
+		return false
+	}
+	last := lines[len(lines)-1]
+	return strings.HasSuffix(last, ";reject") || last == "part="+part+";state=Processed;node=complete"
+}
+
+func lineFactory(t *testing.T, run *engineRun) (*Factory, map[string]*DataSource) {
+	t.Helper()
+	layout, err := ParseFactoryLayout([]byte(lineLayout))
+	if err != nil {
+		t.Fatal(err)
+	}
+	sources := IntialiseConnections(nil)
+	recordRows(sources, run.record)
+	factory, err := layout.Build(sources)
+	if err != nil {
+		t.Fatalf("Build: %v", err)
+	}
+	factory.SetRate(1)
+	return factory, sources
+}
+
+func runLineOnEvents(t *testing.T, until time.Duration) *engineRun {
+	run := newEngineRun()
+	path := quietLogs(t)
+	factory, sources := lineFactory(t, run)
+	engine := NewEventEngine(factory, sources, simulationStart)
+	SetClock(engine)
+	for engine.Now().Sub(simulationStart) < until && engine.Step() {
+	}
+	run.readLog(t, path)
+	return run
+}
+
+func runLineOnGoroutines(t *testing.T, until time.Duration) *engineRun {
+	run := newEngineRun()
+	quietLogs(t)
+	dir := t.TempDir()
+	t.Setenv("SIM_LOG_DIR", dir)
+	factory, sources := lineFactory(t, run)
+	SetClock(NewVirtualClock(simulationStart))
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		SimulateData(sources, factory, ctx)
+	}()
+	for Now().Sub(simulationStart) < until {
+		time.Sleep(time.Millisecond)
+	}
+	cancel()
+	<-done
+	run.readLog(t, filepath.Join(dir, "log.txt"))
+	return run
+}
+
+func TestEnginesAgree(t *testing.T) {
+	const until = 10 * time.Minute
+	events := runLineOnEvents(t, until)
+	goroutines := runLineOnGoroutines(t, until)
+
+	compared := 0
+	for part := 1; ; part++ {
+		id := fmt.Sprintf("part%d", part)
+		if !events.finished(id) || !goroutines.finished(id) {
+			break
+		}
+		compared++
+		if got, want := strings.Join(goroutines.parts[id], "\n"), strings.Join(events.parts[id], "\n"); got != want {
+			t.Errorf("%s was logged differently\ngoroutines:\n%s\nevents:\n%s", id, got, want)
+		}
+		if got, want := strings.Join(goroutines.rows[id], "\n"), strings.Join(events.rows[id], "\n"); got != want {
+			t.Errorf("%s has different rows\ngoroutines:\n%s\nevents:\n%s", id, got, want)
+		}
+	}
+	if compared < 100 {
+		t.Fatalf("only %d parts left the line under both engines", compared)
+	}
+	// Each machine's own Process logs the part again, which Node.Process doesn't
+	if lines := strings.Count(strings.Join(goroutines.parts["part1"], "\n"), "state=Processing;node=cutter"); lines != 2 {
+		t.Errorf("part1 was logged as processing at cutter %d times, want 2 as the cutting machine's Process runs", lines)
+	}
+
+	// The goroutines stop at a different point, so only the rows both wrote are compared
+	for _, machine := range []string{"cutter", "sensor", "packer"} {
+		key := "machine:" + machine
+		got, want := goroutines.rows[key], events.rows[key]
+		if len(got) == 0 || len(want) == 0 {
+			t.Errorf("%s wrote %d rows under goroutines and %d under events", machine, len(got), len(want))
+		}
+		for i := 0; i < len(got) && i < len(want); i++ {
+			if got[i] != want[i] {
+				t.Errorf("row %d of %s differs\ngoroutines: %s\nevents:     %s", i, machine, got[i], want[i])
+				break
+			}
+		}
+	}
+}
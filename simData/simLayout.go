@@ -0,0 +1,599 @@
+package simData
+
+import (
+	"bytes"
+	_ "embed"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"time"
+
+	"gopkg.in/yaml.v3"
+)
+
+/*
+Factory layouts describe a production line in a YAML or JSON file: its nodes with their
+type-specific parameters, which nodes make up each station, and the edges parts move
+along. LoadFactoryFile validates a layout and builds a *Factory from it, so a line can be
+changed without recompiling. layouts/default.yaml is the line the simulator runs when no
+FACTORY_LAYOUT file is given.
+*/
+
+const LayoutVersion = 1
+
+const defaultQueueSize = 500
+
+//go:embed layouts/default.yaml
+var defaultLayout []byte
+
+type FactoryLayout struct {
+	Version int    `json:"version" yaml:"version"`
+	Name    string `json:"name" yaml:"name"`
+	// Seed makes every run of the layout the same, a new seed is picked each run without it
+	Seed *int64 `json:"seed,omitempty" yaml:"seed,omitempty"`
+	// QueueSize is used for nodes that don't set their own
+	QueueSize int           `json:"queue_size,omitempty" yaml:"queue_size,omitempty"`
+	Nodes     []*NodeLayout `json:"nodes" yaml:"nodes"`
+	Edges     []EdgeLayout  `json:"edges" yaml:"edges"`
+	// Calendars give workers shifts, they work around the clock without one
+	Calendars []*CalendarLayout `json:"calendars,omitempty" yaml:"calendars,omitempty"`
+	// Orders release parts for demand, they arrive at the factory's rate without them
+	Orders *OrdersLayout `json:"orders,omitempty" yaml:"orders,omitempty"`
+}
+
+// NodeLayout holds the parameters of every node type; Validate rejects those
+// that don't apply to the node's type.
+type NodeLayout struct {
+	ID             string `json:"id" yaml:"id"`
+	Type           string `json:"type" yaml:"type"`
+	Name           string `json:"name,omitempty" yaml:"name,omitempty"`
+	ProcessingTime string `json:"processing_time,omitempty" yaml:"processing_time,omitempty"`
+	QueueSize      int    `json:"queue_size,omitempty" yaml:"queue_size,omitempty"`
+	// Routing is the policy picking the next node, or for a station the member,
+	// parts go to
+	Routing string `json:"routing,omitempty" yaml:"routing,omitempty"`
+
+	// station
+	Members []string `json:"members,omitempty" yaml:"members,omitempty"`
+	// inventory
+	Capacity     *int     `json:"capacity,omitempty" yaml:"capacity,omitempty"`
+	AllowedTypes []string `json:"allowed_types,omitempty" yaml:"allowed_types,omitempty"`
+	// cutting_machine
+	FailureRate *float64           `json:"failure_rate,omitempty" yaml:"failure_rate,omitempty"`
+	Tools       []string           `json:"tools,omitempty" yaml:"tools,omitempty"`
+	Maintenance *MaintenanceLayout `json:"maintenance,omitempty" yaml:"maintenance,omitempty"`
+	// worker
+	Department string `json:"department,omitempty" yaml:"department,omitempty"`
+	SkillLevel *int   `json:"skill_level,omitempty" yaml:"skill_level,omitempty"`
+	Calendar   string `json:"calendar,omitempty" yaml:"calendar,omitempty"`
+	// sensor_machine
+	Calibration   *float64 `json:"calibration,omitempty" yaml:"calibration,omitempty"`
+	FailureChance *float64 `json:"failure_chance,omitempty" yaml:"failure_chance,omitempty"`
+	// repair_station
+	RepairCapacity *int `json:"repair_capacity,omitempty" yaml:"repair_capacity,omitempty"`
+	// assembly_station
+	ToolsRequired []string   `json:"tools_required,omitempty" yaml:"tools_required,omitempty"`
+	BOM           *BOMLayout `json:"bom,omitempty" yaml:"bom,omitempty"`
+	// packaging
+	PackagingType string `json:"packaging_type,omitempty" yaml:"packaging_type,omitempty"`
+	// cutting_machine and sensor_machine
+	Breakdown *BreakdownLayout `json:"breakdown,omitempty" yaml:"breakdown,omitempty"`
+	// machines, the workers one of whom must be on shift for the machine to work
+	Operators []string `json:"operators,omitempty" yaml:"operators,omitempty"`
+	// machines, how many parts or batches of parts they work on side by side
+	Servers *int         `json:"servers,omitempty" yaml:"servers,omitempty"`
+	Batch   *BatchLayout `json:"batch,omitempty" yaml:"batch,omitempty"`
+}
+
+type EdgeLayout struct {
+	From string `json:"from" yaml:"from"`
+	To   string `json:"to" yaml:"to"`
+	// Weight is the edge's share of parts under weighted routing, 1 when unset
+	Weight *float64 `json:"weight,omitempty" yaml:"weight,omitempty"`
+	// When is a rule parts must match to go along the edge, such as DefectsCount > 0
+	When string `json:"when,omitempty" yaml:"when,omitempty"`
+}
+
+// LayoutError lists everything wrong with a layout.
+type LayoutError struct {
+	Problems []string
+}
+
+func (e *LayoutError) Error() string {
+	return "invalid factory layout: " + strings.Join(e.Problems, "; ")
+}
+
+var nodeTypeNames = map[string]NodeVersion{
+	"start":            NodeTypeStart,
+	"reject":           NodeTypeReject,
+	"complete":         NodeTypeComplete,
+	"cutting_machine":  NodeTypeCuttingMachine,
+	"worker":           NodeTypeWorker,
+	"inventory":        NodeTypeInventory,
+	"sensor_machine":   NodeTypeSensorMachine,
+	"repair_station":   NodeTypeRepairStation,
+	"assembly_station": NodeTypeAssemblyStation,
+	"packaging":        NodeTypePackaging,
+	"station":          NodeTypeStation,
+}
+
+// nodeParams are the type-specific parameters each node type takes
+var nodeParams = map[string][]string{
+	"station":          {"members"},
+	"inventory":        {"capacity", "allowed_types", "operators"},
+	"cutting_machine":  {"failure_rate", "tools", "maintenance", "breakdown", "operators", "servers", "batch"},
+	"worker":           {"department", "skill_level", "calendar"},
+	"sensor_machine":   {"calibration", "failure_chance", "breakdown", "operators", "servers", "batch"},
+	"repair_station":   {"repair_capacity", "operators", "servers", "batch"},
+	"assembly_station": {"tools_required", "bom", "operators", "servers", "batch"},
+	"packaging":        {"packaging_type", "operators", "servers", "batch"},
+}
+
+// requiredNodes are looked up by ID by the simulation, and have the type of the same name
+var requiredNodes = []string{"start", "reject", "complete"}
+
+func ParseFactoryLayout(data []byte) (*FactoryLayout, error) {
+	layout := &FactoryLayout{}
+	decoder := yaml.NewDecoder(bytes.NewReader(data))
+	decoder.KnownFields(true)
+	if err := decoder.Decode(layout); err != nil {
+		if err == io.EOF {
+			err = fmt.Errorf("file is empty")
+		}
+		return nil, &LayoutError{Problems: []string{fmt.Sprintf("could not read layout: %v", err)}}
+	}
+	return layout, nil
+}
+
+func DefaultFactoryLayout() *FactoryLayout {
+	layout, err := ParseFactoryLayout(defaultLayout)
+	if err != nil {
+		panic(err)
+	}
+	return layout
+}
+
+// LoadFactoryFile builds the factory described by the layout file at path.
+func LoadFactoryFile(path string, connections map[string]*DataSource) (*Factory, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("error reading factory layout: %v", err)
+	}
+	layout, err := ParseFactoryLayout(data)
+	if err != nil {
+		return nil, err
+	}
+	return layout.Build(connections)
+}
+
+func (l *FactoryLayout) Validate() error {
+	var problems []string
+	switch l.Version {
+	case LayoutVersion:
+	case 0:
+		problems = append(problems, "layout has no version")
+	default:
+		problems = append(problems, fmt.Sprintf("layout version %d is not supported, expected %d", l.Version, LayoutVersion))
+	}
+	if l.QueueSize < 0 {
+		problems = append(problems, "queue_size cannot be negative")
+	}
+
+	byID := make(map[string]*NodeLayout, len(l.Nodes))
+	for i, node := range l.Nodes {
+		if strings.TrimSpace(node.ID) == "" {
+			problems = append(problems, fmt.Sprintf("node %d has no id", i+1))
+			continue
+		}
+		if byID[node.ID] != nil {
+			problems = append(problems, fmt.Sprintf("node %q is defined twice", node.ID))
+			continue
+		}
+		byID[node.ID] = node
+		problems = append(problems, node.validate()...)
+	}
+	for _, id := range requiredNodes {
+		if node := byID[id]; node == nil || node.Type != id {
+			problems = append(problems, fmt.Sprintf("layout needs a %s node with id %q", id, id))
+		}
+	}
+
+	stationOf := make(map[string]string)
+	for _, node := range l.Nodes {
+		for _, member := range node.Members {
+			switch other := byID[member]; {
+			case other == nil:
+				problems = append(problems, fmt.Sprintf("station %q has unknown member %q", node.ID, member))
+			case other.Type == "station":
+				problems = append(problems, fmt.Sprintf("station %q cannot contain station %q", node.ID, member))
+			case stationOf[member] != "":
+				problems = append(problems, fmt.Sprintf("node %q is in both station %q and %q", member, stationOf[member], node.ID))
+			default:
+				stationOf[member] = node.ID
+			}
+		}
+	}
+
+	// Repairs and rerouted queues are handled within the machine's station
+	for _, node := range l.Nodes {
+		if node.Breakdown == nil {
+			continue
+		}
+		station := byID[stationOf[node.ID]]
+		if node.Breakdown.WhenDown == WhenDownReroute && station == nil {
+			problems = append(problems, fmt.Sprintf("node %q reroutes its queue when down, but is in no station", node.ID))
+		}
+		if node.Breakdown.RepairWorker && !hasWorker(station, byID) {
+			problems = append(problems, fmt.Sprintf("node %q needs a repair worker, but its station has no worker", node.ID))
+		}
+	}
+
+	calendars := make(map[string]*CalendarLayout)
+	calendarOf := make(map[string]string)
+	for i, calendar := range l.Calendars {
+		if strings.TrimSpace(calendar.ID) == "" {
+			problems = append(problems, fmt.Sprintf("calendar %d has no id", i+1))
+			continue
+		}
+		if calendars[calendar.ID] != nil {
+			problems = append(problems, fmt.Sprintf("calendar %q is defined twice", calendar.ID))
+			continue
+		}
+		calendars[calendar.ID] = calendar
+		problems = append(problems, calendar.validate()...)
+		for _, department := range calendar.Departments {
+			if other := calendarOf[department]; other != "" {
+				problems = append(problems, fmt.Sprintf("department %q is in both calendar %q and %q", department, other, calendar.ID))
+			}
+			calendarOf[department] = calendar.ID
+		}
+	}
+	for _, node := range l.Nodes {
+		if node.Calendar != "" && calendars[node.Calendar] == nil {
+			problems = append(problems, fmt.Sprintf("worker %q has unknown calendar %q", node.ID, node.Calendar))
+		}
+		for _, operator := range node.Operators {
+			if other := byID[operator]; other == nil || other.Type != "worker" {
+				problems = append(problems, fmt.Sprintf("node %q has operator %q, which is not a worker", node.ID, operator))
+			}
+		}
+	}
+
+	// Inventories an assembly draws from keep their stock for it
+	stocks := make(map[string]string)
+	for _, node := range l.Nodes {
+		if node.BOM == nil {
+			continue
+		}
+		problems = append(problems, node.BOM.validate(node.ID, byID)...)
+		for _, from := range node.BOM.From {
+			if byID[from] != nil && byID[from].Type == "inventory" {
+				stocks[from] = node.ID
+			}
+		}
+	}
+
+	if l.Orders != nil {
+		problems = append(problems, l.Orders.validate(byID)...)
+		if l.Orders.Release == ReleaseKanban {
+			stocks[l.Orders.stock()] = "orders"
+		}
+	}
+
+	seen := make(map[[2]string]bool)
+	exits := make(map[string]bool)
+	for _, edge := range l.Edges {
+		for _, end := range []string{edge.From, edge.To} {
+			if byID[end] == nil {
+				problems = append(problems, fmt.Sprintf("edge %s -> %s uses unknown node %q", edge.From, edge.To, end))
+			}
+		}
+		if edge.From == edge.To {
+			problems = append(problems, fmt.Sprintf("edge %s -> %s loops back to itself", edge.From, edge.To))
+		}
+		if seen[[2]string{edge.From, edge.To}] {
+			problems = append(problems, fmt.Sprintf("edge %s -> %s is defined twice", edge.From, edge.To))
+		}
+		seen[[2]string{edge.From, edge.To}] = true
+		if edge.Weight != nil && *edge.Weight <= 0 {
+			problems = append(problems, fmt.Sprintf("edge %s -> %s needs a positive weight", edge.From, edge.To))
+		}
+		if edge.When != "" {
+			if _, err := ParseRule(edge.When); err != nil {
+				problems = append(problems, fmt.Sprintf("edge %s -> %s has an invalid rule: %v", edge.From, edge.To, err))
+			}
+		}
+		exits[edge.From] = true
+		if assembly := stocks[edge.From]; assembly != "" {
+			problems = append(problems, fmt.Sprintf("edge %s -> %s leaves inventory %q, which keeps its stock for %q", edge.From, edge.To, edge.From, assembly))
+		}
+		if byID[edge.From] != nil && (byID[edge.From].Type == "reject" || byID[edge.From].Type == "complete") {
+			problems = append(problems, fmt.Sprintf("edge %s -> %s leaves a %s node", edge.From, edge.To, byID[edge.From].Type))
+		}
+	}
+	if byID["start"] != nil && !exits["start"] {
+		problems = append(problems, "start has no edges")
+	}
+
+	if len(problems) > 0 {
+		return &LayoutError{Problems: problems}
+	}
+	return nil
+}
+
+func (n *NodeLayout) validate() []string {
+	var problems []string
+	if _, ok := nodeTypeNames[n.Type]; !ok {
+		return []string{fmt.Sprintf("node %q has unknown type %q", n.ID, n.Type)}
+	}
+	if n.ProcessingTime != "" {
+		if duration, err := time.ParseDuration(n.ProcessingTime); err != nil || duration < 0 {
+			problems = append(problems, fmt.Sprintf("node %q has invalid processing_time %q", n.ID, n.ProcessingTime))
+		}
+	}
+	if n.QueueSize < 0 {
+		problems = append(problems, fmt.Sprintf("node %q has a negative queue_size", n.ID))
+	}
+	if n.Routing != "" {
+		switch {
+		case n.Type == "reject" || n.Type == "complete":
+			problems = append(problems, fmt.Sprintf("node %q: routing is not a parameter of %s nodes", n.ID, n.Type))
+		case !contains(routingPolicies, n.Routing):
+			problems = append(problems, fmt.Sprintf("node %q has unknown routing %q, expected one of %s", n.ID, n.Routing, strings.Join(routingPolicies, ", ")))
+		}
+	}
+
+	params := []struct {
+		name string
+		set  bool
+	}{
+		{"members", len(n.Members) > 0},
+		{"capacity", n.Capacity != nil},
+		{"allowed_types", len(n.AllowedTypes) > 0},
+		{"failure_rate", n.FailureRate != nil},
+		{"tools", len(n.Tools) > 0},
+		{"maintenance", n.Maintenance != nil},
+		{"department", n.Department != ""},
+		{"skill_level", n.SkillLevel != nil},
+		{"calendar", n.Calendar != ""},
+		{"calibration", n.Calibration != nil},
+		{"failure_chance", n.FailureChance != nil},
+		{"repair_capacity", n.RepairCapacity != nil},
+		{"tools_required", len(n.ToolsRequired) > 0},
+		{"bom", n.BOM != nil},
+		{"packaging_type", n.PackagingType != ""},
+		{"breakdown", n.Breakdown != nil},
+		{"operators", len(n.Operators) > 0},
+		{"servers", n.Servers != nil},
+		{"batch", n.Batch != nil},
+	}
+	for _, param := range params {
+		if param.set && !contains(nodeParams[n.Type], param.name) {
+			problems = append(problems, fmt.Sprintf("node %q: %s is not a parameter of %s nodes", n.ID, param.name, n.Type))
+		}
+	}
+
+	if n.Type == "station" && len(n.Members) == 0 {
+		problems = append(problems, fmt.Sprintf("station %q has no members", n.ID))
+	}
+	if n.Capacity != nil && *n.Capacity <= 0 {
+		problems = append(problems, fmt.Sprintf("node %q needs a positive capacity", n.ID))
+	}
+	if n.RepairCapacity != nil && *n.RepairCapacity <= 0 {
+		problems = append(problems, fmt.Sprintf("node %q needs a positive repair_capacity", n.ID))
+	}
+	if n.Servers != nil && *n.Servers <= 0 {
+		problems = append(problems, fmt.Sprintf("node %q needs a positive number of servers", n.ID))
+	}
+	// A worker fixes a defect with a chance of skill_level * 5%
+	if n.SkillLevel != nil && (*n.SkillLevel < 1 || *n.SkillLevel > 20) {
+		problems = append(problems, fmt.Sprintf("node %q needs a skill_level between 1 and 20", n.ID))
+	}
+	if n.Calibration != nil && *n.Calibration <= 0 {
+		problems = append(problems, fmt.Sprintf("node %q needs a positive calibration", n.ID))
+	}
+	if n.FailureRate != nil && (*n.FailureRate < 0 || *n.FailureRate > 1) {
+		problems = append(problems, fmt.Sprintf("node %q needs a failure_rate between 0 and 1", n.ID))
+	}
+	if n.FailureChance != nil && (*n.FailureChance < 0 || *n.FailureChance > 1) {
+		problems = append(problems, fmt.Sprintf("node %q needs a failure_chance between 0 and 1", n.ID))
+	}
+	if n.Maintenance != nil {
+		problems = append(problems, n.Maintenance.validate(n.ID)...)
+	}
+	if n.Breakdown != nil {
+		problems = append(problems, n.Breakdown.validate(n.ID)...)
+	}
+	if n.Batch != nil {
+		problems = append(problems, n.Batch.validate(n.ID)...)
+	}
+	return problems
+}
+
+func hasWorker(station *NodeLayout, byID map[string]*NodeLayout) bool {
+	if station == nil {
+		return false
+	}
+	for _, member := range station.Members {
+		if other := byID[member]; other != nil && other.Type == "worker" {
+			return true
+		}
+	}
+	return false
+}
+
+func contains(values []string, value string) bool {
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
+
+// Build validates the layout and creates its factory. Stations are added after
+// their members, and every node after reject, which AddNode makes the error node.
+func (l *FactoryLayout) Build(connections map[string]*DataSource) (*Factory, error) {
+	if err := l.Validate(); err != nil {
+		return nil, err
+	}
+	factory := &Factory{
+		nodes:       make(map[string]FactoryNode),
+		connections: connections,
+		seed:        NewSeed(),
+		layout:      l,
+	}
+	if l.Seed != nil {
+		factory.seed, factory.seeded = *l.Seed, true
+	}
+	queueSize := l.QueueSize
+	if queueSize == 0 {
+		queueSize = defaultQueueSize
+	}
+
+	var ordered []*NodeLayout
+	var stations []*NodeLayout
+	for _, node := range l.Nodes {
+		switch {
+		case node.ID == "reject":
+			ordered = append([]*NodeLayout{node}, ordered...)
+		case node.Type == "station":
+			stations = append(stations, node)
+		default:
+			ordered = append(ordered, node)
+		}
+	}
+
+	for _, layout := range append(ordered, stations...) {
+		size := layout.QueueSize
+		if size == 0 {
+			size = queueSize
+		}
+		processingTime, _ := time.ParseDuration(layout.ProcessingTime)
+		var within map[string]FactoryNode
+		if layout.Type == "station" {
+			within = stationMap(factory, layout.Members...)
+		}
+		node := layout.node()
+		factory.AddNode(layout.ID, node, within, processingTime, size)
+		if layout.Breakdown != nil {
+			node.base().Breakdown = layout.Breakdown.breakdown(factory.stream("breakdown:" + layout.ID))
+		}
+		node.base().Servers = newServers(intOr(layout.Servers, 1))
+		node.base().Batch = layout.Batch.batch()
+		for _, member := range within {
+			member.SetStation(node)
+		}
+	}
+	for _, layout := range l.Nodes {
+		factory.GetNode(layout.ID).base().Routing = NewRouting(layout.Routing, layout.Type == "station")
+	}
+	for _, edge := range l.Edges {
+		factory.AddEdges(edge.From, edge.To)
+		if edge.Weight == nil && edge.When == "" {
+			continue
+		}
+		route := &Route{}
+		if edge.Weight != nil {
+			route.Weight = *edge.Weight
+		}
+		if edge.When != "" {
+			route.When, _ = ParseRule(edge.When)
+		}
+		factory.GetNode(edge.From).base().Routing.Routes[edge.To] = route
+	}
+	// Members without edges of their own send parts on along their station's
+	for _, station := range stations {
+		for _, member := range factory.GetNode(station.ID).GetNodesWithin() {
+			if len(member.GetNextNodes()) == 0 {
+				member.SetNextNodes(factory.GetNode(station.ID).GetNextNodes())
+				member.base().Routing.Routes = factory.GetNode(station.ID).base().Routing.Routes
+			}
+		}
+	}
+
+	calendars := make(map[string]*Calendar)
+	departments := make(map[string]*Calendar)
+	for _, calendar := range l.Calendars {
+		calendars[calendar.ID] = calendar.calendar()
+		for _, department := range calendar.Departments {
+			departments[department] = calendars[calendar.ID]
+		}
+	}
+	for _, layout := range l.Nodes {
+		node := factory.GetNode(layout.ID)
+		for _, operator := range layout.Operators {
+			node.base().operators = append(node.base().operators, factory.GetNode(operator).base())
+		}
+		calendar := calendars[layout.Calendar]
+		if calendar == nil && layout.Type == "worker" {
+			calendar = departments[layout.Department]
+		}
+		if worker, ok := node.(*WorkerNode); ok && calendar != nil {
+			worker.Shift = &ShiftState{Calendar: calendar, Status: ShiftOff, rng: factory.stream("shifts:" + layout.ID)}
+			worker.offShift = true
+		}
+		if assembly, ok := node.(*AssemblyStationNode); ok && layout.BOM != nil {
+			assembly.BOM = layout.BOM.bom(factory)
+		}
+	}
+
+	if l.Orders != nil {
+		book, err := l.Orders.book(factory)
+		if err != nil {
+			return nil, fmt.Errorf("error reading orders: %v", err)
+		}
+		factory.orders = book
+		for _, id := range []string{"start", "complete", "reject"} {
+			factory.GetNode(id).base().orders = book
+		}
+		if book.Stock != nil {
+			book.Stock.orders = book
+		}
+	}
+	return factory, nil
+}
+
+func (n *NodeLayout) node() FactoryNode {
+	version := nodeTypeNames[n.Type]
+	switch n.Type {
+	case "start":
+		return &Start{Node: Node{ID: n.ID, NodeVersion: version}, Name: n.Name}
+	case "reject":
+		return &Reject{Node: Node{ID: n.ID, NodeVersion: version}, Name: n.Name}
+	case "complete":
+		return &Complete{Node: Node{ID: n.ID, NodeVersion: version}, Name: n.Name}
+	case "station":
+		return &Station{Node: Node{ID: n.ID, NodeVersion: version}, Name: n.Name}
+	case "inventory":
+		return &InventoryNode{Node: Node{ID: n.ID, NodeVersion: version}, Name: n.Name, Capacity: intOr(n.Capacity, defaultQueueSize), AllowedTypes: n.AllowedTypes}
+	case "cutting_machine":
+		return &CuttingMachineNode{Node: Node{ID: n.ID, NodeVersion: version}, Name: n.Name, FailureRate: floatOr(n.FailureRate, 0.01), Tools: n.Tools, Maintenance: n.Maintenance.maintenance()}
+	case "worker":
+		return &WorkerNode{Node: Node{ID: n.ID, NodeVersion: version}, Name: n.Name, Department: n.Department, SkillLevel: intOr(n.SkillLevel, 1)}
+	case "sensor_machine":
+		return &SensorMachineNode{Node: Node{ID: n.ID, NodeVersion: version}, Name: n.Name, Calibration: floatOr(n.Calibration, 1.0), FailureChance: floatOr(n.FailureChance, 0.02)}
+	case "repair_station":
+		return &RepairStationNode{Node: Node{ID: n.ID, NodeVersion: version}, Name: n.Name, RepairCapacity: intOr(n.RepairCapacity, 1)}
+	case "assembly_station":
+		return &AssemblyStationNode{Node: Node{ID: n.ID, NodeVersion: version}, Name: n.Name, ToolsRequired: n.ToolsRequired}
+	case "packaging":
+		return &PackagingNode{Node: Node{ID: n.ID, NodeVersion: version}, Name: n.Name, PackagingType: n.PackagingType}
+	}
+	return nil
+}
+
+func intOr(value *int, fallback int) int {
+	if value == nil {
+		return fallback
+	}
+	return *value
+}
+
+func floatOr(value *float64, fallback float64) float64 {
+	if value == nil {
+		return fallback
+	}
+	return *value
+}
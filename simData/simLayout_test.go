@@ -0,0 +1,180 @@
+package simData
+
+import (
+	"strings"
+	"testing"
+)
+
+// minimalLayout is the smallest valid line, which tests add nodes and edges to.
+const minimalLayout = `
+version: 1
+name: test line
+nodes:
+  - {id: reject, type: reject}
+  - {id: start, type: start}
+  - {id: complete, type: complete}
+`
+
+func TestDefaultFactoryLayout(t *testing.T) {
+	layout := DefaultFactoryLayout()
+	if err := layout.Validate(); err != nil {
+		t.Fatalf("default layout: %v", err)
+	}
+	factory, err := layout.Build(map[string]*DataSource{})
+	if err != nil {
+		t.Fatalf("Build: %v", err)
+	}
+	for _, node := range layout.Nodes {
+		if factory.GetNode(node.ID) == nil {
+			t.Errorf("node %q was not built", node.ID)
+		}
+	}
+	for _, node := range layout.Nodes {
+		if node.ID != "reject" && factory.GetNode(node.ID).GetErrorNode() != factory.GetNode("reject") {
+			t.Errorf("node %q does not send errors to reject", node.ID)
+		}
+	}
+}
+
+func TestFactoryLayoutValidate(t *testing.T) {
+	tests := []struct {
+		name     string
+		layout   string
+		problems []string
+	}{
+		{
+			name:   "minimal line",
+			layout: minimalLayout + "edges:\n  - {from: start, to: complete}\n",
+		},
+		{
+			name: "station with members",
+			layout: minimalLayout + `
+  - {id: cutter, type: cutting_machine, processing_time: 2s, failure_rate: 0.1, servers: 2}
+  - {id: welder, type: worker, skill_level: 4}
+  - {id: cutting, type: station, members: [cutter, welder], routing: round_robin}
+edges:
+  - {from: start, to: cutting}
+  - {from: cutting, to: complete, weight: 2}
+  - {from: cutting, to: reject, when: DefectsCount > 0}
+`,
+		},
+		{
+			name:     "unknown fields",
+			layout:   minimalLayout + "  - {id: cutter, type: cutting_machine, speed: 3}\n",
+			problems: []string{"could not read layout"},
+		},
+		{
+			name:     "no version",
+			layout:   strings.Replace(minimalLayout, "version: 1", "", 1) + "edges:\n  - {from: start, to: complete}\n",
+			problems: []string{"layout has no version"},
+		},
+		{
+			name: "required nodes",
+			layout: `
+version: 1
+nodes:
+  - {id: start, type: start}
+  - {id: complete, type: reject}
+edges:
+  - {from: start, to: complete}
+`,
+			problems: []string{`needs a reject node with id "reject"`, `needs a complete node with id "complete"`},
+		},
+		{
+			name: "node parameters",
+			layout: minimalLayout + `
+  - {id: cutter, type: cutting_machine, capacity: 4, failure_rate: 2}
+  - {id: worker, type: worker, skill_level: 30}
+  - {id: sensor, type: sensor_machine, calibration: 0, processing_time: soon}
+  - {id: cutter, type: cutting_machine}
+  - {id: robot, type: robot}
+edges:
+  - {from: start, to: cutter}
+`,
+			problems: []string{
+				`node "cutter": capacity is not a parameter of cutting_machine nodes`,
+				`node "cutter" needs a failure_rate between 0 and 1`,
+				`node "worker" needs a skill_level between 1 and 20`,
+				`node "sensor" has invalid processing_time "soon"`,
+				`node "sensor" needs a positive calibration`,
+				`node "cutter" is defined twice`,
+				`node "robot" has unknown type "robot"`,
+			},
+		},
+		{
+			name: "stations",
+			layout: minimalLayout + `
+  - {id: cutter, type: cutting_machine}
+  - {id: first, type: station, members: [cutter, missing]}
+  - {id: second, type: station, members: [cutter, first]}
+  - {id: empty, type: station}
+edges:
+  - {from: start, to: first}
+`,
+			problems: []string{
+				`station "first" has unknown member "missing"`,
+				`node "cutter" is in both station "first" and "second"`,
+				`station "second" cannot contain station "first"`,
+				`station "empty" has no members`,
+			},
+		},
+		{
+			name: "edges",
+			layout: minimalLayout + `
+  - {id: cutter, type: cutting_machine}
+edges:
+  - {from: cutter, to: cutter}
+  - {from: cutter, to: nowhere}
+  - {from: cutter, to: complete, weight: 0}
+  - {from: cutter, to: complete}
+  - {from: complete, to: reject}
+  - {from: cutter, to: reject, when: DefectsCount >}
+`,
+			problems: []string{
+				"edge cutter -> cutter loops back to itself",
+				`edge cutter -> nowhere uses unknown node "nowhere"`,
+				"edge cutter -> complete needs a positive weight",
+				"edge cutter -> complete is defined twice",
+				"edge complete -> reject leaves a complete node",
+				"edge cutter -> reject has an invalid rule",
+				"start has no edges",
+			},
+		},
+		{
+			name: "routing and operators",
+			layout: minimalLayout + `
+  - {id: cutter, type: cutting_machine, routing: random_walk, operators: [complete]}
+  - {id: worker, type: worker, calendar: nights}
+edges:
+  - {from: start, to: cutter}
+`,
+			problems: []string{
+				`node "cutter" has unknown routing "random_walk"`,
+				`node "cutter" has operator "complete", which is not a worker`,
+				`worker "worker" has unknown calendar "nights"`,
+			},
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			layout, err := ParseFactoryLayout([]byte(test.layout))
+			if err == nil {
+				err = layout.Validate()
+			}
+			if len(test.problems) == 0 {
+				if err != nil {
+					t.Fatalf("unexpected error: %v", err)
+				}
+				return
+			}
+			if err == nil {
+				t.Fatalf("expected problems %v", test.problems)
+			}
+			for _, problem := range test.problems {
+				if !strings.Contains(err.Error(), problem) {
+					t.Errorf("got %v\nwant a problem containing %q", err, problem)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,241 @@
+package simData
+
+import (
+	"context"
+	"fmt"
+	"time"
+)
+
+/*
+Every cut dulls a cutting machine's tool by an amount that depends on the tool, and a duller tool
+makes defects more likely. A tool that wears out completely breaks and has to be changed, which
+is all that happens under the run-to-failure policy. The fixed interval policy stops the machine
+for preventive maintenance after a set amount of processing time, and the condition policy
+changes the tool as soon as its dullness reaches a threshold. Machines are only stopped between
+parts, and every stop is written to the maintenance data source once it ends.
+*/
+
+const (
+	PolicyRunToFailure  = "run_to_failure"
+	PolicyFixedInterval = "fixed_interval"
+	PolicyCondition     = "condition"
+
+	MaintenanceToolFailure = "tool_failure"
+	MaintenanceToolChange  = "tool_change"
+	MaintenancePreventive  = "preventive_maintenance"
+
+	defaultToolChange          = 10 * time.Minute
+	defaultMaintenanceDuration = 30 * time.Minute
+	// dullness added per cut by tools that aren't in toolWear
+	defaultToolWear = 0.003
+)
+
+// toolWear is the dullness a cut adds with each tool on average. A tool is worn
+// out at a dullness of 1.
+var toolWear = map[string]float64{
+	"SteelBlade":    0.004,
+	"DiamondTip":    0.001,
+	"TitaniumBlade": 0.002,
+	"CarbideTip":    0.0015,
+	"LaserCutter":   0.0005,
+	"WaterJet":      0.0008,
+}
+
+type MaintenanceLayout struct {
+	// Policy is run_to_failure when empty
+	Policy string `json:"policy,omitempty" yaml:"policy,omitempty"`
+	// fixed_interval: processing time between preventive maintenance
+	Interval string `json:"interval,omitempty" yaml:"interval,omitempty"`
+	// condition: dullness at which the tool is changed
+	Threshold  *float64 `json:"threshold,omitempty" yaml:"threshold,omitempty"`
+	Duration   string   `json:"duration,omitempty" yaml:"duration,omitempty"`
+	ToolChange string   `json:"tool_change,omitempty" yaml:"tool_change,omitempty"`
+}
+
+func (m *MaintenanceLayout) validate(id string) []string {
+	var problems []string
+	switch m.Policy {
+	case "", PolicyRunToFailure:
+	case PolicyFixedInterval:
+		if m.Interval == "" {
+			problems = append(problems, fmt.Sprintf("node %q needs a maintenance interval for the %s policy", id, m.Policy))
+		}
+	case PolicyCondition:
+		if m.Threshold == nil {
+			problems = append(problems, fmt.Sprintf("node %q needs a maintenance threshold for the %s policy", id, m.Policy))
+		}
+	default:
+		problems = append(problems, fmt.Sprintf("node %q has unknown maintenance policy %q", id, m.Policy))
+	}
+	if m.Interval != "" && m.Policy != PolicyFixedInterval {
+		problems = append(problems, fmt.Sprintf("node %q: maintenance interval only applies to the %s policy", id, PolicyFixedInterval))
+	}
+	if m.Threshold != nil && m.Policy != PolicyCondition {
+		problems = append(problems, fmt.Sprintf("node %q: maintenance threshold only applies to the %s policy", id, PolicyCondition))
+	}
+	for _, field := range []struct{ name, value string }{{"interval", m.Interval}, {"duration", m.Duration}, {"tool_change", m.ToolChange}} {
+		if field.value == "" {
+			continue
+		}
+		if duration, err := time.ParseDuration(field.value); err != nil || duration <= 0 {
+			problems = append(problems, fmt.Sprintf("node %q needs a positive maintenance %s, got %q", id, field.name, field.value))
+		}
+	}
+	if m.Threshold != nil && (*m.Threshold <= 0 || *m.Threshold > 1) {
+		problems = append(problems, fmt.Sprintf("node %q needs a maintenance threshold above 0 and at most 1", id))
+	}
+	return problems
+}
+
+func (m *MaintenanceLayout) maintenance() *Maintenance {
+	maintenance := NewMaintenance()
+	if m == nil {
+		return maintenance
+	}
+	if m.Policy != "" {
+		maintenance.Policy = m.Policy
+	}
+	maintenance.Interval, _ = time.ParseDuration(m.Interval)
+	if m.Threshold != nil {
+		maintenance.Threshold = *m.Threshold
+	}
+	if m.Duration != "" {
+		maintenance.Duration, _ = time.ParseDuration(m.Duration)
+	}
+	if m.ToolChange != "" {
+		maintenance.ToolChange, _ = time.ParseDuration(m.ToolChange)
+	}
+	return maintenance
+}
+
+type Maintenance struct {
+	Policy     string
+	Interval   time.Duration
+	Threshold  float64
+	Duration   time.Duration
+	ToolChange time.Duration
+
+	// Cuts made since the tool was last changed
+	Cuts int
+	// Window is the stop under way, nil while the machine works
+	Window *MaintenanceWindow
+	// Last is the most recent stop that ended
+	Last *MaintenanceWindow
+}
+
+// NewMaintenance runs a machine's tools to failure.
+func NewMaintenance() *Maintenance {
+	return &Maintenance{
+		Policy:     PolicyRunToFailure,
+		Duration:   defaultMaintenanceDuration,
+		ToolChange: defaultToolChange,
+	}
+}
+
+type MaintenanceWindow struct {
+	Kind                string        `json:"kind"`
+	Tool                string        `json:"tool,omitempty"`
+	Dullness            float64       `json:"dullness"`
+	TimeSinceLastRepair time.Duration `json:"time_since_last_repair"`
+	Cuts                int           `json:"cuts"`
+	StartedAt           time.Time     `json:"started_at"`
+	EndedAt             time.Time     `json:"ended_at,omitempty"`
+	Duration            time.Duration `json:"duration"`
+}
+
+// maintainedNode is a node that can stop for maintenance between parts.
+type maintainedNode interface {
+	startMaintenance() *MaintenanceWindow
+	endMaintenance(connections map[string]*DataSource)
+}
+
+// tool is the tool the machine cuts with, the first of its tools.
+func (cm *CuttingMachineNode) tool() string {
+	if len(cm.Tools) == 0 {
+		return ""
+	}
+	return cm.Tools[0]
+}
+
+// wear dulls the tool by a cut. Called with the mutex held.
+func (cm *CuttingMachineNode) wear() {
+	wear, exists := toolWear[cm.tool()]
+	if !exists {
+		wear = defaultToolWear
+	}
+	cm.Dullness += wear * (0.5 + cm.GetRand().Float64())
+	if cm.Maintenance != nil {
+		cm.Maintenance.Cuts++
+	}
+}
+
+// startMaintenance stops the machine if its policy, or a worn out tool, calls
+// for it, and returns the stop.
+func (cm *CuttingMachineNode) startMaintenance() *MaintenanceWindow {
+	cm.Mu.Lock()
+	defer cm.Mu.Unlock()
+	m := cm.Maintenance
+	if m == nil || m.Window != nil {
+		return nil
+	}
+
+	window := &MaintenanceWindow{Tool: cm.tool(), Dullness: cm.Dullness, TimeSinceLastRepair: cm.TimeSinceLastRepair, Cuts: m.Cuts, StartedAt: Now()}
+	state := InMaintenance
+	switch {
+	case cm.Dullness >= 1:
+		window.Kind, window.Duration = MaintenanceToolFailure, m.ToolChange
+		state = Faulty
+	case m.Policy == PolicyFixedInterval && cm.TimeSinceLastRepair >= m.Interval:
+		window.Kind, window.Duration = MaintenancePreventive, m.Duration
+	case m.Policy == PolicyCondition && cm.Dullness >= m.Threshold:
+		window.Kind, window.Duration = MaintenanceToolChange, m.ToolChange
+	default:
+		return nil
+	}
+	m.Window = window
+	cm.SetEvent(state)
+
+	logPartState("", cm.GetEvent(), cm.ID)
+	logging("Machine %s stopped for %s with tool %s at dullness %.3f\n", cm.ID, window.Kind, window.Tool, window.Dullness)
+	return window
+}
+
+// endMaintenance puts the machine back in service with a new tool, and records
+// the stop.
+func (cm *CuttingMachineNode) endMaintenance(connections map[string]*DataSource) {
+	cm.Mu.Lock()
+	m := cm.Maintenance
+	window := m.Window
+	window.EndedAt = Now()
+	m.Window, m.Last = nil, window
+	m.Cuts = 0
+	cm.Dullness = 0
+	cm.TimeSinceLastRepair = 0
+	cm.SetEvent(Idle)
+	cm.Mu.Unlock()
+
+	logPartState("", cm.GetEvent(), cm.ID)
+	logging("Machine %s back in service after %s\n", cm.ID, window.Kind)
+
+	if conn, exists := connections["maintenance"]; exists {
+		conn.Appender(nil, &cm.Node, conn.DataMapper(nil, cm))
+	}
+}
+
+// maintain stops n for as long as any maintenance it needs takes, and returns
+// false if ctx ended first.
+func maintain(ctx context.Context, n FactoryNode, connections map[string]*DataSource) bool {
+	maintained, ok := n.(maintainedNode)
+	if !ok {
+		return true
+	}
+	window := maintained.startMaintenance()
+	if window == nil {
+		return true
+	}
+	if !clock.Sleep(ctx, window.Duration) {
+		return false
+	}
+	maintained.endMaintenance(connections)
+	return true
+}
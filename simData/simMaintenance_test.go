@@ -0,0 +1,70 @@
+package simData
+
+import (
+	"math/rand"
+	"testing"
+	"time"
+)
+
+func TestStartMaintenance(t *testing.T) {
+	tests := []struct {
+		name        string
+		policy      string
+		dullness    float64
+		sinceRepair time.Duration
+		want        string
+	}{
+		{name: "sharp tool runs on", policy: PolicyRunToFailure, dullness: 0.9},
+		{name: "worn out tool fails", policy: PolicyRunToFailure, dullness: 1, want: MaintenanceToolFailure},
+		{name: "interval not reached", policy: PolicyFixedInterval, sinceRepair: 59 * time.Minute},
+		{name: "interval reached", policy: PolicyFixedInterval, sinceRepair: time.Hour, want: MaintenancePreventive},
+		{name: "below threshold", policy: PolicyCondition, dullness: 0.69},
+		{name: "threshold reached", policy: PolicyCondition, dullness: 0.7, want: MaintenanceToolChange},
+		{name: "failure before threshold change", policy: PolicyCondition, dullness: 1.2, want: MaintenanceToolFailure},
+	}
+	quietLogs(t)
+	SetClock(NewVirtualClock(simulationStart))
+	for _, test := range tests {
+		machine := NewCuttingMachineNode("cutter", time.Second)
+		machine.Maintenance.Policy = test.policy
+		machine.Maintenance.Interval = time.Hour
+		machine.Maintenance.Threshold = 0.7
+		machine.Dullness, machine.TimeSinceLastRepair = test.dullness, test.sinceRepair
+
+		window := machine.startMaintenance()
+		if test.want == "" {
+			if window != nil {
+				t.Errorf("%s: stopped for %s, want no stop", test.name, window.Kind)
+			}
+			continue
+		}
+		if window == nil || window.Kind != test.want {
+			t.Errorf("%s: got %+v, want a stop for %s", test.name, window, test.want)
+			continue
+		}
+		if machine.startMaintenance() != nil {
+			t.Errorf("%s: a machine already stopped was stopped again", test.name)
+		}
+
+		machine.endMaintenance(map[string]*DataSource{})
+		if machine.Dullness != 0 || machine.TimeSinceLastRepair != 0 || machine.Event != Idle || machine.Maintenance.Last != window {
+			t.Errorf("%s: after the stop got dullness %v, %v since repair and state %s", test.name, machine.Dullness, machine.TimeSinceLastRepair, machine.Event)
+		}
+	}
+}
+
+func TestWornOutToolSpoilsEveryCut(t *testing.T) {
+	quietLogs(t)
+	machine := NewCuttingMachineNode("cutter", time.Second)
+	machine.FailureRate = 0
+	machine.rng = rand.New(rand.NewSource(1))
+	machine.Dullness = 1
+
+	part := &Part{ID: "part1"}
+	for i := 0; i < 20; i++ {
+		machine.Process(part, nil)
+	}
+	if part.DefectsCount != 20 {
+		t.Errorf("got %d defects from 20 cuts with a worn out tool, want 20", part.DefectsCount)
+	}
+}
@@ -35,6 +35,7 @@ const (
 	Processing
 	Processed
 	Faulty
+	InMaintenance
 )
 
 func (s MachineState) String() string {
@@ -47,6 +48,8 @@ func (s MachineState) String() string {
 		return "Processed"
 	case Faulty:
 		return "Faulty"
+	case InMaintenance:
+		return "Maintenance"
 	}
 	return "Unknown"
 }
@@ -66,6 +69,14 @@ type Part struct {
 	TimesRepaired  int
 	TimesAssembled int
 	SensorReadings map[string]float64
+	// Type is the product an assembly made the part as, empty for raw parts
+	Type       string
+	ParentID   string
+	Components []*Part
+	// Product and OrderID are what the part was released for, and OrderID the
+	// order it fulfilled once it has
+	Product string
+	OrderID string
 }
 type FactoryNode interface {
 	GetID() string
@@ -77,6 +88,7 @@ type FactoryNode interface {
 	GetProcessingTime() time.Duration
 	GetErrorNode() FactoryNode
 	GetStation() FactoryNode
+	GetRand() *rand.Rand
 
 	SetID(string)
 	SetType(NodeVersion)
@@ -87,11 +99,14 @@ type FactoryNode interface {
 	SetProcessingTime(time.Duration)
 	SetErrorNode(FactoryNode)
 	SetStation(FactoryNode)
+	SetRand(*rand.Rand)
 
 	Type() NodeVersion
 	Process(p *Part, c map[string]*DataSource) FactoryNode
 	Start(wg *sync.WaitGroup, connections map[string]*DataSource, ctx context.Context)
 	GetName() string
+
+	base() *Node
 }
 
 func (n *Node) GetName() string   { return "Node" }
@@ -102,7 +117,6 @@ func (n *Node) GetType() NodeVersion                   { return n.NodeVersion }
 func (n *Node) GetNodesWithin() map[string]FactoryNode { return n.NodesWithin }
 func (n *Node) GetNextNodes() map[string]FactoryNode   { return n.NextNodes }
 func (n *Node) GetQueue() chan *Part                   { return n.Queue }
-func (n *Node) GetEvent() MachineState                 { return n.Event }
 func (n *Node) GetProcessingTime() time.Duration       { return n.ProcessingTime }
 func (n *Node) GetErrorNode() FactoryNode              { return n.ErrorNode }
 func (n *Node) GetStation() FactoryNode                { return n.Station }
@@ -112,10 +126,44 @@ func (n *Node) SetType(t NodeVersion)                    { n.NodeVersion = t }
 func (n *Node) SetNodesWithin(nw map[string]FactoryNode) { n.NodesWithin = nw }
 func (n *Node) SetNextNodes(nn map[string]FactoryNode)   { n.NextNodes = nn }
 func (n *Node) SetQueue(q chan *Part)                    { n.Queue = q }
-func (n *Node) SetEvent(e MachineState)                  { n.Event = e }
 func (n *Node) SetProcessingTime(pt time.Duration)       { n.ProcessingTime = pt }
 func (n *Node) SetErrorNode(en FactoryNode)              { n.ErrorNode = en }
 func (n *Node) SetStation(s FactoryNode)                 { n.Station = s }
+func (n *Node) SetRand(r *rand.Rand)                     { n.rng = r }
+
+func (n *Node) base() *Node { return n }
+
+// GetEvent and SetEvent take a lock of their own, as neighbouring nodes read
+// the state while holding their own mutex, and sibling servers set it.
+func (n *Node) GetEvent() MachineState {
+	n.state.RLock()
+	defer n.state.RUnlock()
+	return n.Event
+}
+
+func (n *Node) SetEvent(e MachineState) {
+	n.state.Lock()
+	defer n.state.Unlock()
+	n.Event = e
+}
+
+// self is the node this Node is embedded in, whose Process the node's goroutine
+// calls rather than Node's own.
+func (n *Node) self() FactoryNode {
+	if n.outer != nil {
+		return n.outer
+	}
+	return n
+}
+
+// GetRand is the node's random stream, which the factory seeds. Nodes made
+// outside a factory get an unseeded one.
+func (n *Node) GetRand() *rand.Rand {
+	if n.rng == nil {
+		n.rng = rand.New(rand.NewSource(NewSeed()))
+	}
+	return n.rng
+}
 
 func clearChannel(queue chan *Part) {
 	for {
@@ -138,96 +186,193 @@ type Node struct {
 	ProcessingTime time.Duration
 	ErrorNode      FactoryNode
 	Station        FactoryNode
-
-	Mu sync.Mutex
+	// Breakdown is set for machines that break down and need repairs
+	Breakdown *Breakdown
+	// Routing picks the next node, or for a station the member, parts go to
+	Routing *Routing
+	// Servers work on parts from the queue side by side, in batches if Batch is set
+	Servers []*Server
+	Batch   *Batch
+
+	outer FactoryNode
+	// operators are the workers one of whom must be on shift for the node to work
+	operators []*Node
+	heldFor   string
+	offShift  bool
+	// orders is set on the nodes that release, complete and ship parts for orders
+	orders *OrderBook
+	// lastServer is the server whose batch last left the node
+	lastServer *Server
+	rng        *rand.Rand
+	Mu         sync.Mutex
+	state      sync.RWMutex
 }
 
 func (n *Node) Process(p *Part, c map[string]*DataSource) FactoryNode {
-	if len(n.NextNodes) > 0 {
-		for _, nextNode := range n.NextNodes {
-			return nextNode
-		}
+	n.Mu.Lock()
+	defer n.Mu.Unlock()
+	if nextNode := n.route(p); nextNode != nil {
+		return nextNode
 	}
 	return n.ErrorNode
 }
 
+const (
+	transferTime = time.Second
+	sendTimeout  = 500 * time.Millisecond
+	idlePoll     = 100 * time.Millisecond
+)
+
 func (n *Node) Start(wg *sync.WaitGroup, connections map[string]*DataSource, ctx context.Context) {
 	defer wg.Done()
+	defer clock.Leave()
+
+	// Every server but the first works on parts in a goroutine of its own
+	servers := n.servers()
+	n.open(Now())
+	wg.Add(len(servers) - 1)
+	clock.Join(len(servers) - 1)
+	for _, server := range servers[1:] {
+		go func() {
+			defer wg.Done()
+			defer clock.Leave()
+			n.serve(server, connections, ctx)
+		}()
+	}
+	n.serve(servers[0], connections, ctx)
+}
+
+// serve has server work on batches of parts from the queue until ctx ends or
+// the queue is closed.
+func (n *Node) serve(server *Server, connections map[string]*DataSource, ctx context.Context) {
+	self := n.self()
 
 	for {
-		select {
-		case <-ctx.Done():
-			log.Printf("Context cancelled, exiting node %s", n.ID)
-			return
+		// A worker held for a repair or off shift takes no parts, nor does a
+		// machine without its operators or one another server has stopped
+		if n.stalled() || n.out() {
+			if cancelled := noPartsAdded(ctx, n); cancelled {
+				return
+			}
+			continue
+		}
 
-		case part, ok := <-n.Queue:
-			if !ok {
-				log.Printf("Queue closed, exiting node %s", n.ID)
+		if !n.gather(ctx, server) {
+			return
+		}
+		if len(server.Batch) == 0 {
+			if cancelled := noPartsAdded(ctx, n); cancelled {
 				return
 			}
-			nextNode := processingPart(part, n, connections)
+			continue
+		}
 
-			if nextNode != nil {
-				n.Event = Idle
-				logPartState(part.ID, n.Event, n.ID)
+		processingBatch(ctx, server, self, connections)
 
+		sending := 0
+		for i, part := range server.Batch {
+			if nextNode := server.Next[i]; nextNode != nil {
+				n.SetEvent(Idle)
+				logPartState(part.ID, n.GetEvent(), n.ID)
 				logPartTransition(part.ID, n.ID, nextNode.GetID())
-				time.Sleep(time.Second)
-
-				select {
-				case nextNode.GetQueue() <- part:
-					logPartState(part.ID, nextNode.GetEvent(), nextNode.GetID())
-
-				case <-time.After(500 * time.Millisecond):
-					log.Printf("Next node queue full, rejecting part %s", part.ID)
-					n.ErrorNode.GetQueue() <- part
-				case <-ctx.Done():
-					log.Printf("Context cancelled while sending to next node, exiting %s", n.ID)
-					return
-				}
-
-				queueLen := getQueueLength(n.Queue)
-				if queueLen > 0 {
-					logNodeQueue(n.ID, queueLen)
-				}
+				sending++
 			}
-
-		default:
-			if cancelled := noPartsAdded(ctx, n); cancelled {
+		}
+		if sending > 0 && !clock.Sleep(ctx, transferTime) {
+			log.Printf("Context cancelled while sending to next node, exiting %s", n.ID)
+			return
+		}
+		for i, part := range server.Batch {
+			nextNode := server.Next[i]
+			if nextNode == nil {
+				continue
+			}
+			if sendPart(ctx, nextNode, part) {
+				logPartState(part.ID, nextNode.GetEvent(), nextNode.GetID())
+			} else if ctx.Err() != nil {
+				log.Printf("Context cancelled while sending to next node, exiting %s", n.ID)
 				return
+			} else {
+				log.Printf("Next node queue full, rejecting part %s", part.ID)
+				if !sendPart(ctx, n.ErrorNode, part) {
+					log.Printf("Reject queue full, dropping part %s", part.ID)
+				}
+			}
+		}
+		if sending > 0 {
+			queueLen := getQueueLength(n.Queue)
+			if queueLen > 0 {
+				logNodeQueue(n.ID, queueLen)
 			}
 		}
+		n.served(server, connections)
+
+		if breaksDown(n) && !repair(ctx, n, connections) {
+			log.Printf("Context cancelled during repair, exiting node %s", n.ID)
+			return
+		}
+		if !maintain(ctx, self, connections) {
+			log.Printf("Context cancelled during maintenance, exiting node %s", n.ID)
+			return
+		}
 	}
 }
 
-func processingPart(part *Part, n FactoryNode, connections map[string]*DataSource) FactoryNode {
+// processingBatch processes the server's batch together in one processing time.
+func processingBatch(ctx context.Context, server *Server, n FactoryNode, connections map[string]*DataSource) {
+	n.base().begin(server, connections)
+	clock.Sleep(ctx, n.GetProcessingTime())
+	for _, part := range server.Batch {
+		finishProcessing(part, n)
+	}
+}
+
+func beginProcessing(part *Part, n FactoryNode, connections map[string]*DataSource) FactoryNode {
 	n.SetEvent(Processing)
 
 	logPartState(part.ID, n.GetEvent(), n.GetID())
 
-	nextNode := n.Process(part, connections)
+	return n.Process(part, connections)
+}
 
-	time.Sleep(n.GetProcessingTime())
+func finishProcessing(part *Part, n FactoryNode) {
 	part.NodeHistory = append(part.NodeHistory, n)
 
 	n.SetEvent(Processed)
 	logPartState(part.ID, n.GetEvent(), n.GetID())
-
-	return nextNode
 }
 
 func noPartsAdded(ctx context.Context, n *Node) bool {
-	if n.Event != Idle {
-		n.Event = Idle
-		logPartState("", n.Event, n.ID)
+	if n.GetEvent() != Idle {
+		n.SetEvent(Idle)
+		logPartState("", n.GetEvent(), n.ID)
 	}
-	select {
-	case <-time.After(100 * time.Millisecond):
-		return false
-	case <-ctx.Done():
+	if !clock.Sleep(ctx, idlePoll) {
 		log.Printf("Context cancelled during idle, exiting node %s", n.ID)
 		return true
 	}
+	return false
+}
+
+// sendPart waits up to sendTimeout of simulated time for room in node's queue.
+func sendPart(ctx context.Context, node FactoryNode, part *Part) bool {
+	if queuePart(node, part) {
+		return true
+	}
+	if !clock.Sleep(ctx, sendTimeout) {
+		return false
+	}
+	return queuePart(node, part)
+}
+
+// queuePart adds part to node's queue if there is room.
+func queuePart(node FactoryNode, part *Part) bool {
+	select {
+	case node.GetQueue() <- part:
+		return true
+	default:
+		return false
+	}
 }
 
 type Start struct {
@@ -238,9 +383,9 @@ type Start struct {
 func (s *Start) Process(p *Part, connections map[string]*DataSource) FactoryNode {
 	s.Node.Mu.Lock()
 	defer s.Node.Mu.Unlock()
-	logPartState(p.ID, s.Event, s.ID)
+	logPartState(p.ID, s.GetEvent(), s.ID)
 
-	for _, node := range s.NextNodes {
+	if node := s.route(p); node != nil {
 		return node
 	}
 	return s.ErrorNode
@@ -263,11 +408,14 @@ func (r *Reject) Process(p *Part, connections map[string]*DataSource) FactoryNod
 	r.Node.Mu.Lock()
 	defer r.Node.Mu.Unlock()
 
-	logPartState(p.ID, r.Event, r.ID)
+	logPartState(p.ID, r.GetEvent(), r.ID)
 
 	if conn, exists := connections["reject"]; exists {
 		conn.Appender(p, &r.Node, conn.DataMapper(p, &r.Node))
 	}
+	if r.orders != nil {
+		r.orders.complete(p, &r.Node, connections)
+	}
 	clearChannel(r.Queue)
 	return nil
 }
@@ -288,11 +436,14 @@ type Complete struct {
 func (c *Complete) Process(p *Part, connections map[string]*DataSource) FactoryNode {
 	c.Node.Mu.Lock()
 	defer c.Node.Mu.Unlock()
-	logPartState(p.ID, c.Event, c.ID)
+	logPartState(p.ID, c.GetEvent(), c.ID)
 
 	if conn, exists := connections["complete"]; exists {
 		conn.Appender(p, &c.Node, conn.DataMapper(p, &c.Node))
 	}
+	if c.orders != nil {
+		c.orders.complete(p, &c.Node, connections)
+	}
 
 	clearChannel(c.Queue)
 	return nil
@@ -312,7 +463,10 @@ type Station struct {
 }
 
 func (s *Station) Process(p *Part, connections map[string]*DataSource) FactoryNode {
-	logPartState(p.ID, s.Event, s.ID)
+	s.Mu.Lock()
+	defer s.Mu.Unlock()
+
+	logPartState(p.ID, s.GetEvent(), s.ID)
 
 	childNodes := s.NodesWithin
 	var rejectNode FactoryNode
@@ -320,10 +474,7 @@ func (s *Station) Process(p *Part, connections map[string]*DataSource) FactoryNo
 	if rejectNode, exists = s.GetNextNodes()["Reject"]; !exists || rejectNode == nil {
 		rejectNode = s.ErrorNode
 		if rejectNode == nil && len(s.NextNodes) > 0 {
-			for _, node := range s.NextNodes {
-				rejectNode = node
-				break
-			}
+			rejectNode = pickNode(s.GetRand(), s.NextNodes)
 		}
 		if rejectNode == nil {
 			logging("Warning: No reject node found for station %s and no fallback available\n", s.ID)
@@ -331,24 +482,41 @@ func (s *Station) Process(p *Part, connections map[string]*DataSource) FactoryNo
 		}
 	}
 
-	earliestNode := rejectNode
-
-	for _, node := range childNodes {
+	routing := s.Routing
+	if routing == nil {
+		routing = NewRouting("", true)
+	}
+	// Stalled members are only sent parts to wait for them when no one else can take them
+	var waitingNode FactoryNode
+	var ready []FactoryNode
+
+	// Idle first members are tried from a random one onwards, so idle members
+	// share the work
+	members := sortedNodes(childNodes)
+	offset := 0
+	if len(members) > 0 && routing.Policy == RoutingIdleFirst {
+		offset = s.GetRand().Intn(len(members))
+	}
+	for i := range members {
+		node := members[(offset+i)%len(members)]
 		if len(node.GetNextNodes()) == 0 {
 			node.SetNextNodes(s.NextNodes)
 		}
 
-		if node.GetEvent() == Idle {
-			return node
-		}
-
-		if earliestNode == nil || len(node.GetQueue()) < len(earliestNode.GetQueue()) {
-			earliestNode = node
+		if !available(node) {
+			if !rerouted(node) && (waitingNode == nil || len(node.GetQueue()) < len(waitingNode.GetQueue())) {
+				waitingNode = node
+			}
+			continue
 		}
+		ready = append(ready, node)
 	}
 
-	if earliestNode != nil && earliestNode != rejectNode {
-		return earliestNode
+	if node := routing.pick(&s.Node, ready); node != nil {
+		return node
+	}
+	if waitingNode != nil {
+		return waitingNode
 	}
 
 	return s.ErrorNode
@@ -369,6 +537,7 @@ type CuttingMachineNode struct {
 	TimeSinceLastRepair time.Duration
 	Dullness            float64
 	Tools               []string
+	Maintenance         *Maintenance
 }
 
 func NewCuttingMachineNode(id string, processingTime time.Duration) *CuttingMachineNode {
@@ -382,6 +551,7 @@ func NewCuttingMachineNode(id string, processingTime time.Duration) *CuttingMach
 		FailureRate: 0.01,
 		Dullness:    0.0,
 		Tools:       []string{"SteelBlade"},
+		Maintenance: NewMaintenance(),
 	}
 }
 
@@ -389,18 +559,21 @@ func (cm *CuttingMachineNode) Process(p *Part, connections map[string]*DataSourc
 	cm.Node.Mu.Lock()
 	defer cm.Node.Mu.Unlock()
 
-	logPartState(p.ID, cm.Event, cm.ID)
+	logPartState(p.ID, cm.GetEvent(), cm.ID)
 
 	cm.TimeSinceLastRepair += cm.ProcessingTime
+	cm.wear()
 
-	if cm.ErrorNode != nil && rand.Float64() < cm.FailureRate {
+	if cm.ErrorNode != nil && cm.GetRand().Float64() < cm.FailureRate {
 		return cm.ErrorNode
 	}
 
-	if rand.Float64() < (0.1 + cm.Dullness*0.05) {
+	// A worn out tool, one maintenance would change as a tool failure, spoils
+	// every cut until it is changed
+	if cm.Dullness >= 1 || cm.GetRand().Float64() < (0.1+cm.Dullness*0.05) {
 		p.DefectsCount++
 	}
-	for _, node := range cm.NextNodes {
+	if node := cm.route(p); node != nil {
 		return node
 	}
 	return cm.ErrorNode
@@ -419,6 +592,8 @@ type WorkerNode struct {
 	Name       string
 	Department string
 	SkillLevel int
+	// Shift is set for workers who follow a shift calendar
+	Shift *ShiftState
 }
 
 func NewWorkerNode(id, name, dept string, skill int, processingTime time.Duration) *WorkerNode {
@@ -439,11 +614,11 @@ func (w *WorkerNode) Process(p *Part, connections map[string]*DataSource) Factor
 	w.Mu.Lock()
 	defer w.Mu.Unlock()
 
-	logPartState(p.ID, w.Event, w.ID)
+	logPartState(p.ID, w.GetEvent(), w.ID)
 
 	if p.DefectsCount > 0 {
-		fixChance := float64(w.SkillLevel) * 0.05
-		if rand.Float64() < fixChance {
+		fixChance := w.skill() * 0.05
+		if w.GetRand().Float64() < fixChance {
 			p.DefectsCount--
 			logging("Worker %s fixed a defect on part %s\n", w.ID, p.ID)
 		} else {
@@ -453,7 +628,7 @@ func (w *WorkerNode) Process(p *Part, connections map[string]*DataSource) Factor
 	} else {
 		logging("No defects found on part %s\n", p.ID)
 	}
-	for _, node := range w.NextNodes {
+	if node := w.route(p); node != nil {
 		return node
 	}
 	return w.ErrorNode
@@ -514,6 +689,9 @@ type InventoryNode struct {
 	StoredParts   []*Part
 	AllowedTypes  []string
 	CurrentStored int
+	// Keep is set for the inventories assemblies draw from, which hold on to
+	// the parts they store until they are issued
+	Keep bool
 }
 
 func NewInventoryNode(id string, capacity int, allowedTypes []string, processingTime time.Duration) *InventoryNode {
@@ -534,12 +712,12 @@ func (inv *InventoryNode) Process(p *Part, connections map[string]*DataSource) F
 	inv.Mu.Lock()
 	defer inv.Mu.Unlock()
 
-	logPartState(p.ID, inv.Event, inv.ID)
+	logPartState(p.ID, inv.GetEvent(), inv.ID)
 
 	// Check if this part type is allowed
 	allowed := false
 	for _, t := range inv.AllowedTypes {
-		if p.Material == t { // Using Material as PartType equivalent
+		if p.Material == t || p.Type == t { // Using Material as PartType equivalent
 			allowed = true
 			break
 		}
@@ -561,8 +739,15 @@ func (inv *InventoryNode) Process(p *Part, connections map[string]*DataSource) F
 	inv.CurrentStored++
 	logging("Part %s stored in inventory %s\n", p.ID, inv.ID)
 
+	if inv.Keep {
+		if conn, exists := connections["inventory_tracking"]; exists {
+			conn.Appender(p, &inv.Node, conn.DataMapper(p, inv))
+		}
+		return nil
+	}
+
 	// Pass to next node
-	for _, node := range inv.NextNodes {
+	if node := inv.route(p); node != nil {
 		return node
 	}
 	return inv.ErrorNode
@@ -600,10 +785,10 @@ func (s *SensorMachineNode) Process(p *Part, connections map[string]*DataSource)
 	s.Mu.Lock()
 	defer s.Mu.Unlock()
 
-	logPartState(p.ID, s.Event, s.ID)
+	logPartState(p.ID, s.GetEvent(), s.ID)
 
 	// Check for failure
-	if rand.Float64() < s.FailureChance {
+	if s.GetRand().Float64() < s.FailureChance {
 		logging("Sensor machine %s FAILED mid-scan for part %s!\n", s.ID, p.ID)
 		return s.ErrorNode
 	}
@@ -612,7 +797,7 @@ func (s *SensorMachineNode) Process(p *Part, connections map[string]*DataSource)
 	if p.SensorReadings == nil {
 		p.SensorReadings = make(map[string]float64)
 	}
-	dimension := 100.0 + rand.Float64()*5.0
+	dimension := 100.0 + s.GetRand().Float64()*5.0
 	p.SensorReadings["dimension"] = dimension * s.Calibration
 	logging("Sensor %s reading: dimension=%.2f for part %s\n", s.ID, p.SensorReadings["dimension"], p.ID)
 
@@ -622,7 +807,7 @@ func (s *SensorMachineNode) Process(p *Part, connections map[string]*DataSource)
 	}
 
 	// Pass to next node
-	for _, node := range s.NextNodes {
+	if node := s.route(p); node != nil {
 		return node
 	}
 	return s.ErrorNode
@@ -658,7 +843,7 @@ func (rs *RepairStationNode) Process(p *Part, connections map[string]*DataSource
 	rs.Mu.Lock()
 	defer rs.Mu.Unlock()
 
-	logPartState(p.ID, rs.Event, rs.ID)
+	logPartState(p.ID, rs.GetEvent(), rs.ID)
 	logging("Repair station %s checking for defects on part %s\n", rs.ID, p.ID)
 
 	if p.DefectsCount > 0 {
@@ -682,7 +867,7 @@ func (rs *RepairStationNode) Process(p *Part, connections map[string]*DataSource
 	}
 
 	// Pass to next node
-	for _, node := range rs.NextNodes {
+	if node := rs.route(p); node != nil {
 		return node
 	}
 	return rs.ErrorNode
@@ -700,6 +885,11 @@ type AssemblyStationNode struct {
 	Node
 	Name          string
 	ToolsRequired []string
+	// BOM is what the station assembles, nil if it works on parts one at a time
+	BOM *BOM
+	// Kit holds the components that arrived until the BOM is complete
+	Kit       []*Part
+	Assembled int
 }
 
 func NewAssemblyStationNode(id string, processingTime time.Duration, tools []string) *AssemblyStationNode {
@@ -718,9 +908,13 @@ func (as *AssemblyStationNode) Process(p *Part, connections map[string]*DataSour
 	as.Mu.Lock()
 	defer as.Mu.Unlock()
 
-	logPartState(p.ID, as.Event, as.ID)
+	logPartState(p.ID, as.GetEvent(), as.ID)
 	logging("Assembly station %s combining components for part %s\n", as.ID, p.ID)
 
+	if as.BOM != nil {
+		return as.assemble(p, connections)
+	}
+
 	// Example logic: each assembly step might add weight
 	p.Weight += 2.0
 	p.TimesAssembled++
@@ -735,7 +929,7 @@ func (as *AssemblyStationNode) Process(p *Part, connections map[string]*DataSour
 	}
 
 	// Pass to next node
-	for _, node := range as.NextNodes {
+	if node := as.route(p); node != nil {
 		return node
 	}
 	return as.ErrorNode
@@ -771,7 +965,7 @@ func (pack *PackagingNode) Process(p *Part, connections map[string]*DataSource)
 	pack.Mu.Lock()
 	defer pack.Mu.Unlock()
 
-	logPartState(p.ID, pack.Event, pack.ID)
+	logPartState(p.ID, pack.GetEvent(), pack.ID)
 
 	p.IsPackaged = true
 	logging("Part %s packaged using %s\n", p.ID, pack.PackagingType)
@@ -782,7 +976,7 @@ func (pack *PackagingNode) Process(p *Part, connections map[string]*DataSource)
 	}
 
 	// Pass to next node (usually Complete node)
-	for _, node := range pack.NextNodes {
+	if node := pack.route(p); node != nil {
 		return node
 	}
 	return pack.ErrorNode
@@ -809,7 +1003,7 @@ func IntialiseConnections(registry *util.Registry) map[string]*DataSource {
 				{Name: "operation_type", Type: connections.TypeText, Nullable: false},
 				{Name: "part_id", Type: connections.TypeText, Nullable: false},
 				{Name: "duration_seconds", Type: connections.TypeFloat, Nullable: false},
-				{Name: "timestamp", Type: connections.TypeDate, Nullable: false},
+				{Name: "timestamp", Type: connections.TypeTime, Nullable: false},
 			},
 		},
 		Conditions: func(n *Node, p *Part) bool {
@@ -842,7 +1036,7 @@ func IntialiseConnections(registry *util.Registry) map[string]*DataSource {
 				"operation_type":   operationType,
 				"part_id":          p.ID,
 				"duration_seconds": n.GetProcessingTime().Seconds(),
-				"timestamp":        time.Now(),
+				"timestamp":        Now(),
 			}
 		},
 	}
@@ -859,7 +1053,8 @@ func IntialiseConnections(registry *util.Registry) map[string]*DataSource {
 				{Name: "activity", Type: connections.TypeText, Nullable: false},
 				{Name: "part_id", Type: connections.TypeText, Nullable: false},
 				{Name: "skill_level", Type: connections.TypeInt, Nullable: false},
-				{Name: "timestamp", Type: connections.TypeDate, Nullable: false},
+				{Name: "shift", Type: connections.TypeText, Nullable: true},
+				{Name: "timestamp", Type: connections.TypeTime, Nullable: false},
 			},
 		},
 		Conditions: func(n *Node, p *Part) bool {
@@ -870,24 +1065,37 @@ func IntialiseConnections(registry *util.Registry) map[string]*DataSource {
 			activity := "Processing"
 			skillLevel := 1
 			department := "Unknown"
+			partID := ""
 
-			if ok {
-				department = worker.Department
-				skillLevel = worker.SkillLevel
-
+			if p != nil {
+				partID = p.ID
 				if p.DefectsCount > 0 {
 					activity = "Repairing"
 				}
 			}
+			if ok {
+				department = worker.Department
+				skillLevel = worker.SkillLevel
+			}
 
-			return map[string]interface{}{
+			dataPoints := map[string]interface{}{
 				"worker_id":   n.GetID(),
 				"department":  department,
 				"activity":    activity,
-				"part_id":     p.ID,
+				"part_id":     partID,
 				"skill_level": skillLevel,
-				"timestamp":   time.Now(),
+				"timestamp":   Now(),
+			}
+			// Shift changes are written without a part
+			if ok && worker.Shift != nil {
+				if p == nil {
+					dataPoints["activity"] = worker.Shift.Change
+				}
+				if worker.Shift.Shift != "" {
+					dataPoints["shift"] = worker.Shift.Shift
+				}
 			}
+			return dataPoints
 		},
 	}
 
@@ -903,7 +1111,7 @@ func IntialiseConnections(registry *util.Registry) map[string]*DataSource {
 				{Name: "action", Type: connections.TypeText, Nullable: false},
 				{Name: "current_stored", Type: connections.TypeInt, Nullable: false},
 				{Name: "max_capacity", Type: connections.TypeInt, Nullable: false},
-				{Name: "timestamp", Type: connections.TypeDate, Nullable: false},
+				{Name: "timestamp", Type: connections.TypeTime, Nullable: false},
 			},
 		},
 		Conditions: func(n *Node, p *Part) bool {
@@ -919,13 +1127,22 @@ func IntialiseConnections(registry *util.Registry) map[string]*DataSource {
 				maxCapacity = inventory.Capacity
 			}
 
+			// Parts that have a parent were issued to its assembly, and those
+			// with an order shipped for it
+			action := "Store"
+			if p.ParentID != "" {
+				action = "Issue"
+			} else if p.OrderID != "" {
+				action = "Ship"
+			}
+
 			return map[string]interface{}{
 				"inventory_id":   n.GetID(),
 				"part_id":        p.ID,
-				"action":         "Store",
+				"action":         action,
 				"current_stored": currentStored,
 				"max_capacity":   maxCapacity,
-				"timestamp":      time.Now(),
+				"timestamp":      Now(),
 			}
 		},
 	}
@@ -943,7 +1160,7 @@ func IntialiseConnections(registry *util.Registry) map[string]*DataSource {
 				{Name: "measurement_type", Type: connections.TypeText, Nullable: false},
 				{Name: "measurement_value", Type: connections.TypeFloat, Nullable: false},
 				{Name: "within_spec", Type: connections.TypeBoolean, Nullable: false},
-				{Name: "timestamp", Type: connections.TypeDate, Nullable: false},
+				{Name: "timestamp", Type: connections.TypeTime, Nullable: false},
 			},
 		},
 		Conditions: func(n *Node, p *Part) bool {
@@ -984,7 +1201,7 @@ func IntialiseConnections(registry *util.Registry) map[string]*DataSource {
 				"measurement_type":  measurementType,
 				"measurement_value": measurementValue,
 				"within_spec":       withinSpec,
-				"timestamp":         time.Now(),
+				"timestamp":         Now(),
 			}
 		},
 	}
@@ -1001,7 +1218,7 @@ func IntialiseConnections(registry *util.Registry) map[string]*DataSource {
 				{Name: "detected_at", Type: connections.TypeText, Nullable: false},
 				{Name: "times_repaired", Type: connections.TypeInt, Nullable: false},
 				{Name: "repairable", Type: connections.TypeBoolean, Nullable: false},
-				{Name: "timestamp", Type: connections.TypeDate, Nullable: false},
+				{Name: "timestamp", Type: connections.TypeTime, Nullable: false},
 			},
 		},
 		Conditions: func(n *Node, p *Part) bool {
@@ -1014,7 +1231,7 @@ func IntialiseConnections(registry *util.Registry) map[string]*DataSource {
 				"detected_at":    n.GetID(),
 				"times_repaired": p.TimesRepaired,
 				"repairable":     p.DefectsCount <= 3,
-				"timestamp":      time.Now(),
+				"timestamp":      Now(),
 			}
 		},
 	}
@@ -1031,7 +1248,7 @@ func IntialiseConnections(registry *util.Registry) map[string]*DataSource {
 				{Name: "total_processing_time", Type: connections.TypeFloat, Nullable: false},
 				{Name: "is_packaged", Type: connections.TypeBoolean, Nullable: false},
 				{Name: "station_id", Type: connections.TypeText, Nullable: false},
-				{Name: "timestamp", Type: connections.TypeDate, Nullable: false},
+				{Name: "timestamp", Type: connections.TypeTime, Nullable: false},
 			},
 		},
 		Conditions: func(n *Node, p *Part) bool {
@@ -1049,7 +1266,237 @@ func IntialiseConnections(registry *util.Registry) map[string]*DataSource {
 				"total_processing_time": float64(len(p.NodeHistory)) * 1.5,
 				"is_packaged":           p.IsPackaged,
 				"station_id":            n.GetID(),
-				"timestamp":             time.Now(),
+				"timestamp":             Now(),
+			}
+		},
+	}
+
+	// Written once a broken down machine is repaired, so there is no part
+	conns["machine_downtime"] = &DataSource{
+		Name:     "machine_downtime",
+		DataType: "postgres",
+		Table: &connections.TableDefinition{
+			Name:   "machine_downtime",
+			Schema: "test",
+			Columns: []connections.ColumnDefinition{
+				{Name: "machine_id", Type: connections.TypeText, Nullable: false},
+				{Name: "station_id", Type: connections.TypeText, Nullable: true},
+				{Name: "worker_id", Type: connections.TypeText, Nullable: true},
+				{Name: "started_at", Type: connections.TypeTime, Nullable: false},
+				{Name: "repair_started_at", Type: connections.TypeTime, Nullable: false},
+				{Name: "ended_at", Type: connections.TypeTime, Nullable: false},
+				{Name: "downtime_seconds", Type: connections.TypeFloat, Nullable: false},
+				{Name: "repair_seconds", Type: connections.TypeFloat, Nullable: false},
+				{Name: "uptime_seconds", Type: connections.TypeFloat, Nullable: false},
+				{Name: "timestamp", Type: connections.TypeTime, Nullable: false},
+			},
+		},
+		Conditions: func(n *Node, p *Part) bool {
+			return n.Breakdown != nil && n.Breakdown.Last != nil
+		},
+		DataMapper: func(p *Part, n FactoryNode) map[string]interface{} {
+			down := n.base().Breakdown.Last
+			dataPoints := map[string]interface{}{
+				"machine_id":        n.GetID(),
+				"started_at":        down.StartedAt,
+				"repair_started_at": down.RepairStartedAt,
+				"ended_at":          down.EndedAt,
+				"downtime_seconds":  down.EndedAt.Sub(down.StartedAt).Seconds(),
+				"repair_seconds":    down.EndedAt.Sub(down.RepairStartedAt).Seconds(),
+				"uptime_seconds":    down.Uptime.Seconds(),
+				"timestamp":         Now(),
+			}
+			if station := n.GetStation(); station != nil {
+				dataPoints["station_id"] = station.GetID()
+			}
+			if down.WorkerID != "" {
+				dataPoints["worker_id"] = down.WorkerID
+			}
+			return dataPoints
+		},
+	}
+
+	// Written once a cutting machine's maintenance or tool change ends, so there is no part
+	conns["maintenance"] = &DataSource{
+		Name:     "maintenance",
+		DataType: "postgres",
+		Table: &connections.TableDefinition{
+			Name:   "maintenance",
+			Schema: "test",
+			Columns: []connections.ColumnDefinition{
+				{Name: "machine_id", Type: connections.TypeText, Nullable: false},
+				{Name: "event_type", Type: connections.TypeText, Nullable: false},
+				{Name: "policy", Type: connections.TypeText, Nullable: false},
+				{Name: "tool", Type: connections.TypeText, Nullable: true},
+				{Name: "dullness", Type: connections.TypeFloat, Nullable: false},
+				{Name: "cuts", Type: connections.TypeInt, Nullable: false},
+				{Name: "operating_seconds", Type: connections.TypeFloat, Nullable: false},
+				{Name: "started_at", Type: connections.TypeTime, Nullable: false},
+				{Name: "ended_at", Type: connections.TypeTime, Nullable: false},
+				{Name: "duration_seconds", Type: connections.TypeFloat, Nullable: false},
+				{Name: "timestamp", Type: connections.TypeTime, Nullable: false},
+			},
+		},
+		Conditions: func(n *Node, p *Part) bool {
+			return n.NodeVersion == NodeTypeCuttingMachine
+		},
+		DataMapper: func(p *Part, n FactoryNode) map[string]interface{} {
+			machine, ok := n.(*CuttingMachineNode)
+			if !ok || machine.Maintenance == nil || machine.Maintenance.Last == nil {
+				return nil
+			}
+			window := machine.Maintenance.Last
+			dataPoints := map[string]interface{}{
+				"machine_id":        n.GetID(),
+				"event_type":        window.Kind,
+				"policy":            machine.Maintenance.Policy,
+				"dullness":          window.Dullness,
+				"cuts":              window.Cuts,
+				"operating_seconds": window.TimeSinceLastRepair.Seconds(),
+				"started_at":        window.StartedAt,
+				"ended_at":          window.EndedAt,
+				"duration_seconds":  window.EndedAt.Sub(window.StartedAt).Seconds(),
+				"timestamp":         Now(),
+			}
+			if window.Tool != "" {
+				dataPoints["tool"] = window.Tool
+			}
+			return dataPoints
+		},
+	}
+
+	// Written for each component once an assembly station builds its parent
+	conns["part_genealogy"] = &DataSource{
+		Name:     "part_genealogy",
+		DataType: "postgres",
+		Table: &connections.TableDefinition{
+			Name:   "part_genealogy",
+			Schema: "test",
+			Columns: []connections.ColumnDefinition{
+				{Name: "parent_id", Type: connections.TypeText, Nullable: false},
+				{Name: "product", Type: connections.TypeText, Nullable: false},
+				{Name: "part_id", Type: connections.TypeText, Nullable: false},
+				{Name: "component", Type: connections.TypeText, Nullable: false},
+				{Name: "assembly_id", Type: connections.TypeText, Nullable: false},
+				{Name: "timestamp", Type: connections.TypeTime, Nullable: false},
+			},
+		},
+		Conditions: func(n *Node, p *Part) bool {
+			return n.NodeVersion == NodeTypeAssemblyStation && p.ParentID != ""
+		},
+		DataMapper: func(p *Part, n FactoryNode) map[string]interface{} {
+			product := ""
+			if assembly, ok := n.(*AssemblyStationNode); ok && assembly.BOM != nil {
+				product = assembly.BOM.Product
+			}
+			component := p.Type
+			if component == "" {
+				component = p.Material
+			}
+
+			return map[string]interface{}{
+				"parent_id":   p.ParentID,
+				"product":     product,
+				"part_id":     p.ID,
+				"component":   component,
+				"assembly_id": n.GetID(),
+				"timestamp":   Now(),
+			}
+		},
+	}
+
+	// Written when an order is placed, becomes late and is fulfilled, so there is no part
+	conns["orders"] = &DataSource{
+		Name:     "orders",
+		DataType: "postgres",
+		Table: &connections.TableDefinition{
+			Name:   "orders",
+			Schema: "test",
+			Columns: []connections.ColumnDefinition{
+				{Name: "order_id", Type: connections.TypeText, Nullable: false},
+				{Name: "product", Type: connections.TypeText, Nullable: false},
+				{Name: "status", Type: connections.TypeText, Nullable: false},
+				{Name: "quantity", Type: connections.TypeInt, Nullable: false},
+				{Name: "released", Type: connections.TypeInt, Nullable: false},
+				{Name: "fulfilled", Type: connections.TypeInt, Nullable: false},
+				{Name: "placed_at", Type: connections.TypeTime, Nullable: false},
+				{Name: "due_at", Type: connections.TypeTime, Nullable: false},
+				{Name: "fulfilled_at", Type: connections.TypeTime, Nullable: true},
+				{Name: "lateness_seconds", Type: connections.TypeFloat, Nullable: false},
+				{Name: "backlog", Type: connections.TypeInt, Nullable: false},
+				{Name: "wip", Type: connections.TypeInt, Nullable: false},
+				{Name: "release_policy", Type: connections.TypeText, Nullable: false},
+				{Name: "timestamp", Type: connections.TypeTime, Nullable: false},
+			},
+		},
+		Conditions: func(n *Node, p *Part) bool {
+			return n.orders != nil && n.orders.Last != nil
+		},
+		DataMapper: func(p *Part, n FactoryNode) map[string]interface{} {
+			book := n.base().orders
+			order := book.Last
+			dataPoints := map[string]interface{}{
+				"order_id":         order.ID,
+				"product":          order.Product,
+				"status":           order.Status,
+				"quantity":         order.Quantity,
+				"released":         order.Released,
+				"fulfilled":        order.Fulfilled,
+				"placed_at":        order.PlacedAt,
+				"due_at":           order.DueAt,
+				"lateness_seconds": Now().Sub(order.DueAt).Seconds(),
+				"backlog":          book.backlog(),
+				"wip":              book.Released - book.Left,
+				"release_policy":   book.Release,
+				"timestamp":        Now(),
+			}
+			if !order.FulfilledAt.IsZero() {
+				dataPoints["fulfilled_at"] = order.FulfilledAt
+			}
+			return dataPoints
+		},
+	}
+
+	// Written for machines once the last part of a server's batch has left it, so there is no part
+	conns["server_utilisation"] = &DataSource{
+		Name:     "server_utilisation",
+		DataType: "postgres",
+		Table: &connections.TableDefinition{
+			Name:   "server_utilisation",
+			Schema: "test",
+			Columns: []connections.ColumnDefinition{
+				{Name: "machine_id", Type: connections.TypeText, Nullable: false},
+				{Name: "server", Type: connections.TypeInt, Nullable: false},
+				{Name: "batch_size", Type: connections.TypeInt, Nullable: false},
+				{Name: "busy_seconds", Type: connections.TypeFloat, Nullable: false},
+				{Name: "total_busy_seconds", Type: connections.TypeFloat, Nullable: false},
+				{Name: "parts", Type: connections.TypeInt, Nullable: false},
+				{Name: "batches", Type: connections.TypeInt, Nullable: false},
+				{Name: "utilisation", Type: connections.TypeFloat, Nullable: false},
+				{Name: "timestamp", Type: connections.TypeTime, Nullable: false},
+			},
+		},
+		// Written by Node.served, which maps the row while the node's mutex is held
+		Conditions: func(n *Node, p *Part) bool {
+			nodeType := n.NodeVersion
+			return nodeType == NodeTypeCuttingMachine ||
+				nodeType == NodeTypeSensorMachine ||
+				nodeType == NodeTypeRepairStation ||
+				nodeType == NodeTypeAssemblyStation ||
+				nodeType == NodeTypePackaging
+		},
+		DataMapper: func(p *Part, n FactoryNode) map[string]interface{} {
+			server := n.base().lastServer
+			return map[string]interface{}{
+				"machine_id":         n.GetID(),
+				"server":             server.Index,
+				"batch_size":         len(server.Batch),
+				"busy_seconds":       server.Last.Seconds(),
+				"total_busy_seconds": server.BusyTime.Seconds(),
+				"parts":              server.Parts,
+				"batches":            server.Batches,
+				"utilisation":        server.Utilisation(Now()),
+				"timestamp":          Now(),
 			}
 		},
 	}
@@ -1065,7 +1512,7 @@ func IntialiseConnections(registry *util.Registry) map[string]*DataSource {
 				{Name: "part_id", Type: connections.TypeText, Nullable: false},
 				{Name: "cut_attempts", Type: connections.TypeInt, Nullable: false},
 				{Name: "cut_val", Type: connections.TypeInt, Nullable: false},
-				{Name: "timestamp", Type: connections.TypeDate, Nullable: false},
+				{Name: "timestamp", Type: connections.TypeTime, Nullable: false},
 			},
 		},
 		Conditions: func(n *Node, p *Part) bool {
@@ -1076,7 +1523,7 @@ func IntialiseConnections(registry *util.Registry) map[string]*DataSource {
 				"part_id":      p.ID,
 				"cut_attempts": p.Cutattempts,
 				"cut_val":      p.CutVal,
-				"timestamp":    time.Now(),
+				"timestamp":    Now(),
 			}
 		},
 	}
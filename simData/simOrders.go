@@ -0,0 +1,598 @@
+package simData
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"log"
+	"math/rand"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"gopkg.in/yaml.v3"
+)
+
+/*
+A layout with orders releases parts for customer demand instead of at a random rate. Orders for
+a quantity of a product, due some time after they are placed, come from a file, the layout itself
+or a demand distribution. Under the push policy parts are released for the open orders at the
+arrival rate, and under CONWIP only while fewer than a set number of parts are in the line. A part
+completing the line fulfils the earliest due open order for its product, which is its type if an
+assembly made it and its material otherwise. Under kanban the line keeps a stock of every product
+in an inventory, finished_inventory unless the layout names another, and orders are shipped from
+it, each part shipped releasing a part to replace it. Placed, late and fulfilled orders are
+written to the orders data source. Parts released for a product that is a material are made of
+it, the others of a random material.
+*/
+
+const (
+	ReleasePush   = "push"
+	ReleaseCONWIP = "conwip"
+	ReleaseKanban = "kanban"
+
+	OrderOpen      = "open"
+	OrderLate      = "late"
+	OrderFulfilled = "fulfilled"
+
+	ordersStream = "orders"
+	defaultStock = "finished_inventory"
+	// how often a release waiting for room in the line or stock to ship looks again
+	orderPoll = time.Minute
+)
+
+type OrdersLayout struct {
+	// Release is push when empty
+	Release string `json:"release,omitempty" yaml:"release,omitempty"`
+	// conwip: most parts in the line at once
+	WIP int `json:"wip,omitempty" yaml:"wip,omitempty"`
+	// kanban: parts of each product kept in Stock
+	Kanban int    `json:"kanban,omitempty" yaml:"kanban,omitempty"`
+	Stock  string `json:"stock,omitempty" yaml:"stock,omitempty"`
+	// File is a YAML or JSON list of orders, placed as well as those in List
+	File   string        `json:"file,omitempty" yaml:"file,omitempty"`
+	List   []OrderLayout `json:"list,omitempty" yaml:"list,omitempty"`
+	Demand *DemandLayout `json:"demand,omitempty" yaml:"demand,omitempty"`
+}
+
+// OrderLayout is placed At after the simulation starts, and due Due after it is placed.
+type OrderLayout struct {
+	ID       string `json:"id,omitempty" yaml:"id,omitempty"`
+	Product  string `json:"product" yaml:"product"`
+	Quantity int    `json:"quantity" yaml:"quantity"`
+	At       string `json:"at,omitempty" yaml:"at,omitempty"`
+	Due      string `json:"due" yaml:"due"`
+}
+
+// DemandLayout places orders for one of Products at random, on average every
+// Interval, for between MinQuantity and MaxQuantity parts due Lead after.
+type DemandLayout struct {
+	Interval    string   `json:"interval" yaml:"interval"`
+	Products    []string `json:"products" yaml:"products"`
+	MinQuantity int      `json:"min_quantity" yaml:"min_quantity"`
+	MaxQuantity int      `json:"max_quantity,omitempty" yaml:"max_quantity,omitempty"`
+	Lead        string   `json:"lead" yaml:"lead"`
+}
+
+// orders are the orders of the file and the list.
+func (o *OrdersLayout) orders() ([]OrderLayout, error) {
+	orders := append([]OrderLayout(nil), o.List...)
+	if o.File == "" {
+		return orders, nil
+	}
+	data, err := os.ReadFile(o.File)
+	if err != nil {
+		return nil, err
+	}
+	var loaded []OrderLayout
+	decoder := yaml.NewDecoder(bytes.NewReader(data))
+	decoder.KnownFields(true)
+	if err := decoder.Decode(&loaded); err != nil {
+		return nil, err
+	}
+	return append(orders, loaded...), nil
+}
+
+func (o *OrdersLayout) validate(byID map[string]*NodeLayout) []string {
+	var problems []string
+	switch o.Release {
+	case "", ReleasePush:
+	case ReleaseCONWIP:
+		if o.WIP < 1 {
+			problems = append(problems, fmt.Sprintf("orders need a wip of at least 1 for the %s release", o.Release))
+		}
+	case ReleaseKanban:
+		if o.Kanban < 1 {
+			problems = append(problems, fmt.Sprintf("orders need a kanban of at least 1 for the %s release", o.Release))
+		}
+		if stock := byID[o.stock()]; stock == nil || stock.Type != "inventory" {
+			problems = append(problems, fmt.Sprintf("orders are shipped from %q, which is not an inventory", o.stock()))
+		}
+	default:
+		problems = append(problems, fmt.Sprintf("orders have unknown release %q", o.Release))
+	}
+	if o.WIP != 0 && o.Release != ReleaseCONWIP {
+		problems = append(problems, fmt.Sprintf("orders: wip only applies to the %s release", ReleaseCONWIP))
+	}
+	if (o.Kanban != 0 || o.Stock != "") && o.Release != ReleaseKanban {
+		problems = append(problems, fmt.Sprintf("orders: kanban and stock only apply to the %s release", ReleaseKanban))
+	}
+
+	orders, err := o.orders()
+	if err != nil {
+		problems = append(problems, fmt.Sprintf("could not read orders file %q: %v", o.File, err))
+	}
+	if len(orders) == 0 && o.Demand == nil && err == nil {
+		problems = append(problems, "orders need a file, a list or a demand")
+	}
+	ids := make(map[string]bool)
+	for i, order := range orders {
+		name := order.ID
+		if name == "" {
+			name = fmt.Sprint(i + 1)
+		} else if ids[order.ID] {
+			problems = append(problems, fmt.Sprintf("order %q is defined twice", order.ID))
+		}
+		ids[order.ID] = true
+		if strings.TrimSpace(order.Product) == "" {
+			problems = append(problems, fmt.Sprintf("order %s has no product", name))
+		}
+		if order.Quantity < 1 {
+			problems = append(problems, fmt.Sprintf("order %s needs a quantity of at least 1", name))
+		}
+		if at, err := time.ParseDuration(order.At); order.At != "" && (err != nil || at < 0) {
+			problems = append(problems, fmt.Sprintf("order %s needs an at such as 2h, got %q", name, order.At))
+		}
+		if due, err := time.ParseDuration(order.Due); err != nil || due <= 0 {
+			problems = append(problems, fmt.Sprintf("order %s needs a positive due, got %q", name, order.Due))
+		}
+	}
+
+	if d := o.Demand; d != nil {
+		for _, field := range []struct{ name, value string }{{"interval", d.Interval}, {"lead", d.Lead}} {
+			if duration, err := time.ParseDuration(field.value); err != nil || duration <= 0 {
+				problems = append(problems, fmt.Sprintf("order demand needs a positive %s, got %q", field.name, field.value))
+			}
+		}
+		if len(d.Products) == 0 {
+			problems = append(problems, "order demand needs products")
+		}
+		if d.MinQuantity < 1 {
+			problems = append(problems, "order demand needs a min_quantity of at least 1")
+		}
+		if d.MaxQuantity != 0 && d.MaxQuantity < d.MinQuantity {
+			problems = append(problems, "order demand cannot have a max_quantity below its min_quantity")
+		}
+	}
+	return problems
+}
+
+func (o *OrdersLayout) stock() string {
+	if o.Stock == "" {
+		return defaultStock
+	}
+	return o.Stock
+}
+
+func (o *OrdersLayout) book(f *Factory) (*OrderBook, error) {
+	orders, err := o.orders()
+	if err != nil {
+		return nil, err
+	}
+	book := &OrderBook{Release: o.Release, WIP: o.WIP, Kanban: o.Kanban, rng: f.stream(ordersStream)}
+	if book.Release == "" {
+		book.Release = ReleasePush
+	}
+	for _, order := range orders {
+		at, _ := time.ParseDuration(order.At)
+		due, _ := time.ParseDuration(order.Due)
+		book.Pending = append(book.Pending, &Order{ID: order.ID, Product: order.Product, Quantity: order.Quantity, At: at, Lead: due})
+	}
+	sort.SliceStable(book.Pending, func(i, j int) bool {
+		return book.Pending[i].At < book.Pending[j].At
+	})
+	if d := o.Demand; d != nil {
+		interval, _ := time.ParseDuration(d.Interval)
+		lead, _ := time.ParseDuration(d.Lead)
+		book.Demand = &Demand{Interval: interval, Products: d.Products, MinQuantity: d.MinQuantity, MaxQuantity: d.MaxQuantity, Lead: lead}
+		if book.Demand.MaxQuantity == 0 {
+			book.Demand.MaxQuantity = d.MinQuantity
+		}
+	}
+	if book.Release == ReleaseKanban {
+		book.Stock = f.GetNode(o.stock()).(*InventoryNode)
+		book.Stock.Keep = true
+		// Every product starts with a full stock's worth of cards
+		book.Cards = make(map[string]int)
+		for _, product := range book.products() {
+			book.Cards[product] = book.Kanban
+		}
+	}
+	return book, nil
+}
+
+type OrderBook struct {
+	Release string
+	WIP     int
+	Kanban  int
+	Stock   *InventoryNode
+	Demand  *Demand
+
+	// Pending orders are yet to be placed, and Open ones placed but not fulfilled
+	Pending []*Order
+	Open    []*Order
+	// Placed counts the orders placed, to number those without an ID
+	Placed int
+	// Released and Left count the parts that entered and left the line
+	Released int
+	Left     int
+	// Cards are the kanban cards of each product waiting for a part to be released
+	Cards map[string]int
+	// Start is when the first orders were placed, and NextDemand when the demand
+	// places its next one
+	Start      time.Time
+	NextDemand time.Time
+	// Last is the order written to the orders data source
+	Last *Order
+
+	mu  sync.Mutex
+	rng *rand.Rand
+}
+
+type Demand struct {
+	Interval    time.Duration
+	Products    []string
+	MinQuantity int
+	MaxQuantity int
+	Lead        time.Duration
+}
+
+type Order struct {
+	ID          string        `json:"id"`
+	Product     string        `json:"product"`
+	Quantity    int           `json:"quantity"`
+	Released    int           `json:"released"`
+	Fulfilled   int           `json:"fulfilled"`
+	Status      string        `json:"status,omitempty"`
+	At          time.Duration `json:"at,omitempty"`
+	Lead        time.Duration `json:"lead"`
+	PlacedAt    time.Time     `json:"placed_at,omitempty"`
+	DueAt       time.Time     `json:"due_at,omitempty"`
+	FulfilledAt time.Time     `json:"fulfilled_at,omitempty"`
+}
+
+// products are every product the book can have orders for, sorted.
+func (b *OrderBook) products() []string {
+	seen := make(map[string]bool)
+	var products []string
+	add := func(product string) {
+		if !seen[product] {
+			seen[product] = true
+			products = append(products, product)
+		}
+	}
+	for _, order := range b.Pending {
+		add(order.Product)
+	}
+	if b.Demand != nil {
+		for _, product := range b.Demand.Products {
+			add(product)
+		}
+	}
+	sort.Strings(products)
+	return products
+}
+
+// isProduct is whether p is product: its type if an assembly made it, its
+// material otherwise.
+func isProduct(p *Part, product string) bool {
+	if p.Type != "" {
+		return p.Type == product
+	}
+	return p.Material == product
+}
+
+// rawParts is how many parts released into the line p is made of.
+func rawParts(p *Part) int {
+	if len(p.Components) == 0 {
+		return 1
+	}
+	count := 0
+	for _, component := range p.Components {
+		count += rawParts(component)
+	}
+	return count
+}
+
+// backlog is how many parts the open orders are still waiting for. Called with
+// the mutex held.
+func (b *OrderBook) backlog() int {
+	backlog := 0
+	for _, order := range b.Open {
+		backlog += order.Quantity - order.Fulfilled
+	}
+	return backlog
+}
+
+// write records order as it is now in the orders data source. Called with the
+// mutex held.
+func (b *OrderBook) write(order *Order, n *Node, connections map[string]*DataSource) {
+	saved := *order
+	b.Last = &saved
+	if conn, exists := connections["orders"]; exists {
+		conn.Appender(nil, n, conn.DataMapper(nil, n.self()))
+	}
+}
+
+// place opens order at placed. Called with the mutex held.
+func (b *OrderBook) place(order *Order, placed time.Time, n *Node, connections map[string]*DataSource) {
+	b.Placed++
+	if order.ID == "" {
+		order.ID = fmt.Sprintf("order%d", b.Placed)
+	}
+	order.Status = OrderOpen
+	order.PlacedAt = placed
+	order.DueAt = placed.Add(order.Lead)
+	b.Open = append(b.Open, order)
+	// Earlier due orders are released for and fulfilled first
+	sort.SliceStable(b.Open, func(i, j int) bool {
+		return b.Open[i].DueAt.Before(b.Open[j].DueAt)
+	})
+	logging("Order %s placed for %d %s due %s\n", order.ID, order.Quantity, order.Product, order.DueAt.Format(time.RFC3339))
+	b.write(order, n, connections)
+}
+
+// fulfil counts p towards the order it was released for, or else the earliest
+// due open order for its product, and returns that order's ID, empty if no
+// order wanted it. Called with the mutex held.
+func (b *OrderBook) fulfil(p *Part, n *Node, connections map[string]*DataSource) string {
+	i := b.open(p.OrderID)
+	if i < 0 || !isProduct(p, b.Open[i].Product) {
+		i = -1
+		for j, order := range b.Open {
+			if isProduct(p, order.Product) {
+				i = j
+				break
+			}
+		}
+	}
+	if i >= 0 {
+		order := b.Open[i]
+		order.Fulfilled++
+		if order.Fulfilled == order.Quantity {
+			order.Status = OrderFulfilled
+			order.FulfilledAt = Now()
+			b.Open = append(b.Open[:i], b.Open[i+1:]...)
+			logging("Order %s fulfilled %s after it was due\n", order.ID, order.FulfilledAt.Sub(order.DueAt))
+			b.write(order, n, connections)
+		}
+		return order.ID
+	}
+	return ""
+}
+
+// open is the index of the open order id, -1 if it isn't open.
+func (b *OrderBook) open(id string) int {
+	for i, order := range b.Open {
+		if id != "" && order.ID == id {
+			return i
+		}
+	}
+	return -1
+}
+
+// complete counts p leaving the line at n. Completed parts fulfil an order
+// unless orders are shipped from stock, and rejected ones are released again.
+func (b *OrderBook) complete(p *Part, n *Node, connections map[string]*DataSource) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.Left += rawParts(p)
+	switch {
+	case n.NodeVersion != NodeTypeComplete && b.Release == ReleaseKanban:
+		if _, exists := b.Cards[p.Product]; exists {
+			b.Cards[p.Product]++
+		}
+	case n.NodeVersion != NodeTypeComplete:
+		if i := b.open(p.OrderID); i >= 0 {
+			b.Open[i].Released--
+		}
+	case b.Release != ReleaseKanban:
+		p.OrderID = b.fulfil(p, n, connections)
+	}
+}
+
+// ship sends the open orders what the stock holds of their products, freeing a
+// card for every part shipped. Called with the mutex held.
+func (b *OrderBook) ship(connections map[string]*DataSource) {
+	drawing.Lock()
+	defer drawing.Unlock()
+	stock := b.Stock
+	stock.Mu.Lock()
+	defer stock.Mu.Unlock()
+
+	var shipped []int
+	taken := make(map[int]bool)
+	for _, order := range append([]*Order(nil), b.Open...) {
+		for i, part := range stock.StoredParts {
+			if taken[i] || !isProduct(part, order.Product) || order.Status == OrderFulfilled {
+				continue
+			}
+			taken[i] = true
+			shipped = append(shipped, i)
+			b.Left += rawParts(part)
+			part.OrderID = b.fulfil(part, &stock.Node, connections)
+			b.Cards[order.Product]++
+		}
+	}
+	sort.Ints(shipped)
+	stock.issue(shipped, connections)
+}
+
+// update places the orders that are due to be placed, ships what it can from
+// stock and marks orders that are now late, then returns the product to release
+// a part of now, and the order it is for, empty if none.
+func (b *OrderBook) update(n *Node, connections map[string]*DataSource) (string, *Order) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	now := Now()
+	if b.Start.IsZero() {
+		b.Start = now
+		if b.Demand != nil {
+			b.NextDemand = now
+		}
+	}
+
+	for len(b.Pending) > 0 && !now.Before(b.Start.Add(b.Pending[0].At)) {
+		order := b.Pending[0]
+		b.Pending = b.Pending[1:]
+		b.place(order, b.Start.Add(order.At), n, connections)
+	}
+	for d := b.Demand; d != nil && !now.Before(b.NextDemand); {
+		quantity := d.MinQuantity + b.rng.Intn(d.MaxQuantity-d.MinQuantity+1)
+		order := &Order{Product: d.Products[b.rng.Intn(len(d.Products))], Quantity: quantity, Lead: d.Lead}
+		b.place(order, b.NextDemand, n, connections)
+		b.NextDemand = b.NextDemand.Add(time.Duration(float64(d.Interval) * b.rng.ExpFloat64()))
+	}
+
+	if b.Release == ReleaseKanban {
+		b.ship(connections)
+	}
+	for _, order := range b.Open {
+		if order.Status == OrderOpen && now.After(order.DueAt) {
+			order.Status = OrderLate
+			logging("Order %s is late, %d of %d fulfilled\n", order.ID, order.Fulfilled, order.Quantity)
+			b.write(order, n, connections)
+		}
+	}
+
+	switch b.Release {
+	case ReleaseKanban:
+		for _, product := range sortedKeys(b.Cards) {
+			if b.Cards[product] > 0 {
+				return product, nil
+			}
+		}
+	case ReleaseCONWIP:
+		if b.Released-b.Left >= b.WIP {
+			return "", nil
+		}
+		fallthrough
+	default:
+		for _, order := range b.Open {
+			if order.Released < order.Quantity {
+				return order.Product, order
+			}
+		}
+	}
+	return "", nil
+}
+
+// released counts a part of product released for order, or for a kanban card.
+func (b *OrderBook) released(product string, order *Order) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.Released++
+	if order != nil {
+		order.Released++
+	} else {
+		b.Cards[product]--
+	}
+}
+
+// wait is how long until the book needs updating again, zero once no order is
+// open or left to place.
+func (b *OrderBook) wait(releasing bool, rate int, rng *rand.Rand) time.Duration {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	now := Now()
+	if releasing {
+		return arrivalInterval(rng, rate)
+	}
+
+	var next time.Time
+	consider := func(at time.Time) {
+		if next.IsZero() || at.Before(next) {
+			next = at
+		}
+	}
+	if len(b.Pending) > 0 {
+		consider(b.Start.Add(b.Pending[0].At))
+	}
+	if b.Demand != nil {
+		consider(b.NextDemand)
+	}
+	for _, order := range b.Open {
+		if order.Status == OrderOpen {
+			consider(order.DueAt.Add(time.Nanosecond))
+		}
+	}
+	// Room in the line or stock to ship is only noticed on the next look
+	if len(b.Open) > 0 || b.Release == ReleaseKanban {
+		consider(now.Add(orderPoll))
+	}
+	if next.IsZero() {
+		return 0
+	}
+	if wait := next.Sub(now); wait > 0 {
+		return wait
+	}
+	return time.Nanosecond
+}
+
+// releaseOrders updates the book and releases the part it calls for with send,
+// then returns how long until it should run again, zero once there is nothing
+// left to release.
+func releaseOrders(book *OrderBook, start FactoryNode, connections map[string]*DataSource, rng *rand.Rand, rate int, number func() int, send func(*Part) bool) time.Duration {
+	product, order := book.update(start.base(), connections)
+	if product == "" {
+		return book.wait(false, rate, rng)
+	}
+	part := newPart(number(), rng)
+	if contains(materials, product) {
+		part.Material = product
+	}
+	part.Product = product
+	if order != nil {
+		part.OrderID = order.ID
+	}
+	if !send(part) {
+		log.Printf("Queue full, skipping part: %s", part.ID)
+		return book.wait(true, rate, rng)
+	}
+	book.released(product, order)
+	return book.wait(true, rate, rng)
+}
+
+// runOrders releases parts for the orders on the clock until ctx ends.
+func runOrders(ctx context.Context, factory *Factory, connections map[string]*DataSource, wg *sync.WaitGroup) {
+	defer wg.Done()
+	defer clock.Leave()
+	start := factory.GetNode("start")
+	rng := factory.stream(arrivalsStream)
+	counter := 0
+	number := func() int {
+		counter++
+		return counter
+	}
+	send := func(part *Part) bool {
+		return sendPart(ctx, start, part)
+	}
+	for {
+		wait := releaseOrders(factory.orders, start, connections, rng, factory.Rate(), number, send)
+		if wait == 0 || !clock.Sleep(ctx, wait) {
+			log.Println("Stopping order release")
+			return
+		}
+	}
+}
+
+func sortedKeys(m map[string]int) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
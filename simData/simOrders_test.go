@@ -0,0 +1,98 @@
+package simData
+
+import (
+	"testing"
+	"time"
+)
+
+// clockAt moves the clock to d after the simulation start.
+func clockAt(d time.Duration) {
+	SetClock(NewVirtualClock(simulationStart.Add(d)))
+}
+
+func TestOrderBookUpdate(t *testing.T) {
+	quietLogs(t)
+	start, sources := &Node{ID: "start"}, map[string]*DataSource{}
+	book := &OrderBook{Release: ReleasePush, Pending: []*Order{
+		{ID: "steel", Product: "Steel", Quantity: 2, Lead: time.Hour},
+		{ID: "aluminum", Product: "Aluminum", Quantity: 1, At: 30 * time.Minute, Lead: 10 * time.Minute},
+	}}
+
+	clockAt(0)
+	product, order := book.update(start, sources)
+	if product != "Steel" || order == nil || order.ID != "steel" || len(book.Pending) != 1 {
+		t.Fatalf("got %q for %v with %d orders pending, want Steel for the steel order", product, order, len(book.Pending))
+	}
+	book.released(product, order)
+	book.released(product, order)
+	if product, _ := book.update(start, sources); product != "" {
+		t.Errorf("released %s with every placed order released for", product)
+	}
+
+	clockAt(30 * time.Minute)
+	product, order = book.update(start, sources)
+	if product != "Aluminum" || order.DueAt != simulationStart.Add(40*time.Minute) {
+		t.Fatalf("got %q for %+v, want the aluminum order due at 40 minutes", product, order)
+	}
+	clockAt(41 * time.Minute)
+	book.update(start, sources)
+	if steel := book.Open[book.open("steel")]; order.Status != OrderLate || steel.Status != OrderOpen {
+		t.Errorf("got statuses %s and %s, want the aluminum order late and the steel one open", order.Status, steel.Status)
+	}
+	if book.Placed != 2 || book.Released != 2 {
+		t.Errorf("got %d orders placed and %d parts released", book.Placed, book.Released)
+	}
+}
+
+func TestOrderBookUpdateCONWIP(t *testing.T) {
+	quietLogs(t)
+	clockAt(0)
+	book := &OrderBook{Release: ReleaseCONWIP, WIP: 2, Pending: []*Order{{Product: "Steel", Quantity: 5, Lead: time.Hour}}}
+	for want := 0; want < 3; want++ {
+		product, order := book.update(&Node{}, map[string]*DataSource{})
+		if want == 2 {
+			if product != "" {
+				t.Errorf("released %s with %d parts in the line", product, book.Released-book.Left)
+			}
+			break
+		}
+		if product != "Steel" || order.ID != "order1" {
+			t.Fatalf("got %q for %v, want Steel for order1", product, order)
+		}
+		book.released(product, order)
+	}
+	book.Left++
+	if product, _ := book.update(&Node{}, map[string]*DataSource{}); product != "Steel" {
+		t.Errorf("got %q once a part left the line, want Steel", product)
+	}
+}
+
+func TestOrderBookFulfil(t *testing.T) {
+	quietLogs(t)
+	clockAt(time.Hour)
+	book := &OrderBook{Open: []*Order{
+		{ID: "early", Product: "Steel", Quantity: 1, DueAt: simulationStart},
+		{ID: "late", Product: "Steel", Quantity: 2, DueAt: simulationStart.Add(time.Hour)},
+		{ID: "widgets", Product: "Widget", Quantity: 1},
+	}}
+	tests := []struct {
+		name string
+		part *Part
+		want string
+	}{
+		{name: "released for an order", part: &Part{Material: "Steel", OrderID: "late"}, want: "late"},
+		{name: "earliest due", part: &Part{Material: "Steel"}, want: "early"},
+		{name: "released for a fulfilled order", part: &Part{Material: "Steel", OrderID: "early"}, want: "late"},
+		{name: "no open order", part: &Part{Material: "Steel"}},
+		{name: "released for another product", part: &Part{Material: "Plastic", OrderID: "widgets"}},
+		{name: "product by type", part: &Part{Material: assembledMaterial, Type: "Widget"}, want: "widgets"},
+	}
+	for _, test := range tests {
+		if got := book.fulfil(test.part, &Node{}, map[string]*DataSource{}); got != test.want {
+			t.Errorf("%s: fulfilled %q, want %q", test.name, got, test.want)
+		}
+	}
+	if len(book.Open) != 0 {
+		t.Errorf("%d orders are still open", len(book.Open))
+	}
+}
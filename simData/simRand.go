@@ -0,0 +1,128 @@
+package simData
+
+import (
+	"hash/fnv"
+	"math/rand"
+	"sort"
+	"time"
+)
+
+/*
+Every random decision in a simulation is drawn from a stream derived from the factory's
+seed and the name of whatever makes the decision: one per node, plus one for part
+arrivals. A node's stream depends only on the seed and its own ID, so adding or removing
+a node doesn't change the draws of the others. Map iteration is random in Go, so choices
+between next nodes or station members are made over the nodes sorted by ID.
+
+Only the event engine turns the same seed and layout into byte-identical logs and data
+source rows. Under the goroutine engine each node runs in its own goroutine, so the order
+in which they see parts, and the timestamps they write, depend on timing as well as the
+seed. Seeded runs therefore use the event engine unless SIM_ENGINE asks for goroutines.
+*/
+
+const arrivalsStream = "arrivals"
+
+// NewSeed picks a seed for a simulation that wasn't given one.
+func NewSeed() int64 {
+	return time.Now().UnixNano()
+}
+
+// streamSeed mixes the seed with the stream's name so nearby seeds and similar
+// names still give unrelated streams.
+func streamSeed(seed int64, name string) int64 {
+	hash := fnv.New64a()
+	hash.Write([]byte(name))
+	return int64(splitmix(uint64(seed) ^ hash.Sum64()))
+}
+
+func splitmix(z uint64) uint64 {
+	z += 0x9e3779b97f4a7c15
+	z = (z ^ (z >> 30)) * 0xbf58476d1ce4e5b9
+	z = (z ^ (z >> 27)) * 0x94d049bb133111eb
+	return z ^ (z >> 31)
+}
+
+// streamSource is a splitmix64 generator. Unlike math/rand's own source its
+// whole state is one number, so snapshots can save and restore it.
+type streamSource struct {
+	state uint64
+}
+
+func (s *streamSource) Seed(seed int64) {
+	s.state = uint64(seed)
+}
+
+func (s *streamSource) Uint64() uint64 {
+	s.state += 0x9e3779b97f4a7c15
+	z := s.state
+	z = (z ^ (z >> 30)) * 0xbf58476d1ce4e5b9
+	z = (z ^ (z >> 27)) * 0x94d049bb133111eb
+	return z ^ (z >> 31)
+}
+
+func (s *streamSource) Int63() int64 {
+	return int64(s.Uint64() >> 1)
+}
+
+// stream is the named random stream of the factory, which carries on where it
+// left off when asked for again.
+func (f *Factory) stream(name string) *rand.Rand {
+	if f.streams == nil {
+		f.streams = make(map[string]*streamSource)
+	}
+	source, exists := f.streams[name]
+	if !exists {
+		source = &streamSource{state: uint64(streamSeed(f.seed, name))}
+		f.streams[name] = source
+	}
+	return rand.New(source)
+}
+
+func (f *Factory) Seed() int64 {
+	return f.seed
+}
+
+// Seeded is whether the seed was given, by the layout or SetSeed, rather than
+// picked for the run.
+func (f *Factory) Seeded() bool {
+	return f.seeded
+}
+
+// SetSeed restarts every node's stream from seed. It must be called before the
+// simulation starts, as the streams are not safe to replace while nodes use them.
+func (f *Factory) SetSeed(seed int64) {
+	f.seed = seed
+	f.seeded = true
+	f.streams = nil
+	for id, node := range f.nodes {
+		node.SetRand(f.stream("node:" + id))
+		if breakdown := node.base().Breakdown; breakdown != nil {
+			breakdown.rng = f.stream("breakdown:" + id)
+		}
+		if worker, ok := node.(*WorkerNode); ok && worker.Shift != nil {
+			worker.Shift.rng = f.stream("shifts:" + id)
+		}
+	}
+	if f.orders != nil {
+		f.orders.rng = f.stream(ordersStream)
+	}
+}
+
+func sortedNodes(nodes map[string]FactoryNode) []FactoryNode {
+	sorted := make([]FactoryNode, 0, len(nodes))
+	for _, node := range nodes {
+		sorted = append(sorted, node)
+	}
+	sort.Slice(sorted, func(i, j int) bool {
+		return sorted[i].GetID() < sorted[j].GetID()
+	})
+	return sorted
+}
+
+// pickNode chooses one of nodes at random, or nil when there are none.
+func pickNode(rng *rand.Rand, nodes map[string]FactoryNode) FactoryNode {
+	if len(nodes) == 0 {
+		return nil
+	}
+	return sortedNodes(nodes)[rng.Intn(len(nodes))]
+}
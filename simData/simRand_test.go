@@ -0,0 +1,180 @@
+package simData
+
+import (
+	"bytes"
+	"encoding/json"
+	"foo/backend/connections"
+	"foo/services/util"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// simulationStart is when test simulations start, so their timestamps are
+// the same every run.
+var simulationStart = time.Date(2024, 1, 1, 6, 0, 0, 0, time.UTC)
+
+// recordRows has each data source pass the rows it would add to the database
+// to record, along with the name of the data source.
+func recordRows(sources map[string]*DataSource, record func(source string, row map[string]interface{})) {
+	for name, source := range sources {
+		name, mapper, conditions := name, source.DataMapper, source.Conditions
+		source.DataMapper = func(p *Part, n FactoryNode) map[string]interface{} {
+			row := mapper(p, n)
+			if conditions == nil || conditions(n.base(), p) {
+				record(name, row)
+			}
+			return row
+		}
+	}
+}
+
+// quietLogs sends the simulation's log file to a file in the test's temporary
+// directory, and discards what it logs through the log package. No workspace
+// connectors are registered, so data sources write nothing to a database.
+func quietLogs(t *testing.T) string {
+	t.Helper()
+	previousPath, previousClock, previousOutput, previousRegistry := logPath, clock, log.Writer(), connections.Reg
+	logPath = filepath.Join(t.TempDir(), "log.txt")
+	log.SetOutput(io.Discard)
+	connections.Reg = util.NewRegistry()
+	t.Cleanup(func() {
+		logPath, clock, connections.Reg = previousPath, previousClock, previousRegistry
+		log.SetOutput(previousOutput)
+	})
+	return logPath
+}
+
+// runEvents runs the default line with seed on the event engine for events
+// events, and returns its log and the rows its data sources wrote.
+func runEvents(t *testing.T, seed int64, events int) ([]byte, []byte) {
+	t.Helper()
+	path := quietLogs(t)
+	var rows bytes.Buffer
+	sources := IntialiseConnections(nil)
+	recordRows(sources, func(source string, row map[string]interface{}) {
+		line, _ := json.Marshal(row)
+		rows.WriteString(source + " " + string(line) + "\n")
+	})
+
+	factory, err := DefaultFactoryLayout().Build(sources)
+	if err != nil {
+		t.Fatalf("Build: %v", err)
+	}
+	factory.SetSeed(seed)
+	engine := NewEventEngine(factory, sources, simulationStart)
+	SetClock(engine)
+	for i := 0; i < events && engine.Step(); i++ {
+	}
+
+	logs, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatalf("reading the simulation log: %v", err)
+	}
+	return logs, rows.Bytes()
+}
+
+func TestSeededRunsAreIdentical(t *testing.T) {
+	const events = 20000
+	firstLogs, firstRows := runEvents(t, 42, events)
+	secondLogs, secondRows := runEvents(t, 42, events)
+
+	if len(firstLogs) == 0 || len(firstRows) == 0 {
+		t.Fatalf("the simulation wrote %d bytes of logs and %d of rows", len(firstLogs), len(firstRows))
+	}
+	if !bytes.Equal(firstLogs, secondLogs) {
+		t.Errorf("two runs with seed 42 wrote different logs, first difference at byte %d", firstDifference(firstLogs, secondLogs))
+	}
+	if !bytes.Equal(firstRows, secondRows) {
+		t.Errorf("two runs with seed 42 wrote different rows, first difference at byte %d", firstDifference(firstRows, secondRows))
+	}
+
+	otherLogs, _ := runEvents(t, 7, events)
+	if bytes.Equal(firstLogs, otherLogs) {
+		t.Error("runs with seeds 42 and 7 wrote the same log")
+	}
+}
+
+func TestStreamsAreIndependent(t *testing.T) {
+	factory := &Factory{seed: 42}
+	first := factory.stream("node:cutting1").Int63()
+
+	other := &Factory{seed: 42}
+	other.stream("node:cutting2").Int63()
+	other.stream("node:cutting2").Int63()
+	if got := other.stream("node:cutting1").Int63(); got != first {
+		t.Errorf("drawing from another stream changed cutting1's first draw from %d to %d", first, got)
+	}
+	if got := factory.stream("node:cutting1").Int63(); got == first {
+		t.Error("asking for a stream again started it over")
+	}
+	if streamSeed(42, "node:a") == streamSeed(43, "node:a") || streamSeed(42, "node:a") == streamSeed(42, "node:b") {
+		t.Error("streams of nearby seeds or names share a seed")
+	}
+}
+
+func firstDifference(a, b []byte) int {
+	for i := 0; i < len(a) && i < len(b); i++ {
+		if a[i] != b[i] {
+			return i
+		}
+	}
+	if len(a) < len(b) {
+		return len(a)
+	}
+	return len(b)
+}
+
+func TestParseEngine(t *testing.T) {
+	tests := []struct {
+		name    string
+		seeded  bool
+		want    string
+		invalid bool
+	}{
+		{name: "", want: EngineGoroutines},
+		{name: "", seeded: true, want: EngineEvents},
+		{name: "goroutines", seeded: true, want: EngineGoroutines},
+		{name: " Events ", want: EngineEvents},
+		{name: "threads", invalid: true},
+	}
+	for _, test := range tests {
+		got, err := ParseEngine(test.name, test.seeded)
+		if test.invalid {
+			if err == nil {
+				t.Errorf("ParseEngine(%q) should fail", test.name)
+			}
+			continue
+		}
+		if err != nil || got != test.want {
+			t.Errorf("ParseEngine(%q, %v) = %q, %v, want %q", test.name, test.seeded, got, err, test.want)
+		}
+	}
+}
+
+func TestFactorySeeded(t *testing.T) {
+	layout := DefaultFactoryLayout()
+	factory, err := layout.Build(map[string]*DataSource{})
+	if err != nil {
+		t.Fatalf("Build: %v", err)
+	}
+	if factory.Seeded() {
+		t.Error("a factory without a seed should not be seeded")
+	}
+	factory.SetSeed(42)
+	if !factory.Seeded() || factory.Seed() != 42 {
+		t.Errorf("got seeded %v with seed %d, want seed 42", factory.Seeded(), factory.Seed())
+	}
+
+	seed := int64(7)
+	layout.Seed = &seed
+	if factory, err = layout.Build(map[string]*DataSource{}); err != nil {
+		t.Fatalf("Build: %v", err)
+	}
+	if !factory.Seeded() || factory.Seed() != 7 {
+		t.Errorf("got seeded %v with seed %d, want the layout's seed 7", factory.Seeded(), factory.Seed())
+	}
+}
@@ -0,0 +1,281 @@
+package simData
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+/*
+A node's routing policy decides which of its next nodes a part goes to, and a station's which
+of its members it hands a part to. Edges can carry a weight, and a rule on the part's attributes
+such as `DefectsCount > 0`: parts matching the rule of any of a node's edges only go along those,
+and the others only along edges without a rule. The policy then picks among those edges, every
+choice made over the nodes sorted by ID so a seed always routes parts the same way. Station
+members without edges of their own send parts along the station's edges, rules and weights.
+*/
+
+const (
+	// RoutingWeighted picks at random in proportion to the edge weights, all 1
+	// unless the layout sets them. It is the default, except for stations.
+	RoutingWeighted      = "weighted"
+	RoutingRoundRobin    = "round_robin"
+	RoutingShortestQueue = "shortest_queue"
+	// RoutingSkill picks the most skilled worker, or the node with the most
+	// skilled operator, then the shortest queue.
+	RoutingSkill = "skill"
+	// RoutingIdleFirst picks an idle node, then the shortest queue. It is the
+	// default for stations.
+	RoutingIdleFirst = "idle_first"
+)
+
+var routingPolicies = []string{RoutingWeighted, RoutingRoundRobin, RoutingShortestQueue, RoutingSkill, RoutingIdleFirst}
+
+type Routing struct {
+	Policy string
+	// Routes are the weights and rules of the edges to each next node
+	Routes map[string]*Route
+	// Turn is how many parts round robin routing has sent on
+	Turn int
+}
+
+type Route struct {
+	Weight float64
+	When   *Rule
+}
+
+// NewRouting routes parts with policy, the default when empty.
+func NewRouting(policy string, station bool) *Routing {
+	routing := &Routing{Policy: policy, Routes: make(map[string]*Route)}
+	switch {
+	case policy != "":
+	case station:
+		routing.Policy = RoutingIdleFirst
+	default:
+		routing.Policy = RoutingWeighted
+	}
+	return routing
+}
+
+// route is the node the part goes to next, or nil if there are none it can
+// go to. Called with the mutex held.
+func (n *Node) route(p *Part) FactoryNode {
+	if n.Routing == nil {
+		return pickNode(n.GetRand(), n.NextNodes)
+	}
+	return n.Routing.pick(n, n.candidates(p))
+}
+
+// candidates are the next nodes p can go to, sorted by ID.
+func (n *Node) candidates(p *Part) []FactoryNode {
+	var matched, open []FactoryNode
+	for _, node := range sortedNodes(n.NextNodes) {
+		route := n.Routing.Routes[node.GetID()]
+		switch {
+		case route == nil || route.When == nil:
+			open = append(open, node)
+		case route.When.matches(p):
+			matched = append(matched, node)
+		}
+	}
+	if len(matched) > 0 {
+		return matched
+	}
+	return open
+}
+
+// pick chooses one of nodes by the policy, nil when there are none. Called
+// with n's mutex held, which guards the turn.
+func (r *Routing) pick(n *Node, nodes []FactoryNode) FactoryNode {
+	if len(nodes) == 0 {
+		return nil
+	}
+	switch r.Policy {
+	case RoutingRoundRobin:
+		r.Turn++
+		return nodes[(r.Turn-1)%len(nodes)]
+	case RoutingShortestQueue:
+		return shortestQueue(nodes)
+	case RoutingSkill:
+		return mostSkilled(nodes)
+	case RoutingIdleFirst:
+		for _, node := range nodes {
+			if node.GetEvent() == Idle {
+				return node
+			}
+		}
+		return shortestQueue(nodes)
+	default:
+		return r.weighted(n, nodes)
+	}
+}
+
+// weighted picks one of nodes in proportion to the weights of their edges.
+func (r *Routing) weighted(n *Node, nodes []FactoryNode) FactoryNode {
+	weights := make([]float64, len(nodes))
+	total := 0.0
+	even := true
+	for i, node := range nodes {
+		weights[i] = 1
+		if route := r.Routes[node.GetID()]; route != nil && route.Weight > 0 {
+			weights[i] = route.Weight
+		}
+		total += weights[i]
+		even = even && weights[i] == weights[0]
+	}
+	// Even weights draw the same way as unrouted nodes, so a seed runs the same
+	if even {
+		return nodes[n.GetRand().Intn(len(nodes))]
+	}
+	draw := n.GetRand().Float64() * total
+	for i, node := range nodes {
+		if draw -= weights[i]; draw < 0 {
+			return node
+		}
+	}
+	return nodes[len(nodes)-1]
+}
+
+func shortestQueue(nodes []FactoryNode) FactoryNode {
+	shortest := nodes[0]
+	for _, node := range nodes[1:] {
+		if len(node.GetQueue()) < len(shortest.GetQueue()) {
+			shortest = node
+		}
+	}
+	return shortest
+}
+
+func mostSkilled(nodes []FactoryNode) FactoryNode {
+	best := nodes[0]
+	for _, node := range nodes[1:] {
+		skill, bestSkill := skillOf(node), skillOf(best)
+		if skill > bestSkill || (skill == bestSkill && len(node.GetQueue()) < len(best.GetQueue())) {
+			best = node
+		}
+	}
+	return best
+}
+
+// skillOf is the skill level of a worker, of the most skilled operator of a
+// machine, or of the most skilled member of a station.
+func skillOf(node FactoryNode) int {
+	if worker, ok := node.(*WorkerNode); ok {
+		return worker.SkillLevel
+	}
+	best := 0
+	for _, operator := range node.base().operators {
+		if skill := skillOf(operator.self()); skill > best {
+			best = skill
+		}
+	}
+	for _, member := range node.GetNodesWithin() {
+		if skill := skillOf(member); skill > best {
+			best = skill
+		}
+	}
+	return best
+}
+
+// Rule is a condition on a part's attributes, such as `DefectsCount > 0` or
+// `Material == Steel && Weight >= 2`.
+type Rule struct {
+	Text       string
+	conditions []condition
+}
+
+type condition struct {
+	field string
+	op    string
+	value string
+}
+
+// partFields are the attributes rules can test, by their name in lower case
+// without underscores, so DefectsCount and defects_count are the same.
+var partFields = map[string]func(p *Part) any{
+	"defectscount":   func(p *Part) any { return float64(p.DefectsCount) },
+	"cutattempts":    func(p *Part) any { return float64(p.Cutattempts) },
+	"cutval":         func(p *Part) any { return float64(p.CutVal) },
+	"weight":         func(p *Part) any { return p.Weight },
+	"temperature":    func(p *Part) any { return p.Temperature },
+	"timesrepaired":  func(p *Part) any { return float64(p.TimesRepaired) },
+	"timesassembled": func(p *Part) any { return float64(p.TimesAssembled) },
+	"material":       func(p *Part) any { return p.Material },
+	"type":           func(p *Part) any { return p.Type },
+	"product":        func(p *Part) any { return p.Product },
+	"ispackaged":     func(p *Part) any { return p.IsPackaged },
+}
+
+var ruleOps = []string{"==", "!=", "<=", ">=", "<", ">"}
+
+func ParseRule(text string) (*Rule, error) {
+	rule := &Rule{Text: text}
+	for _, clause := range strings.Split(text, "&&") {
+		fields := strings.Fields(clause)
+		if len(fields) != 3 || !contains(ruleOps, fields[1]) {
+			return nil, fmt.Errorf("%q is not of the form `field op value`", strings.TrimSpace(clause))
+		}
+		c := condition{field: strings.ToLower(strings.ReplaceAll(fields[0], "_", "")), op: fields[1], value: strings.Trim(fields[2], `"'`)}
+		field, exists := partFields[c.field]
+		if !exists {
+			return nil, fmt.Errorf("parts have no attribute %q", fields[0])
+		}
+		switch field(&Part{}).(type) {
+		case float64:
+			if _, err := strconv.ParseFloat(c.value, 64); err != nil {
+				return nil, fmt.Errorf("%s needs a number, got %q", fields[0], fields[2])
+			}
+		case bool:
+			if _, err := strconv.ParseBool(c.value); err != nil {
+				return nil, fmt.Errorf("%s needs true or false, got %q", fields[0], fields[2])
+			}
+		}
+		if _, number := field(&Part{}).(float64); !number && c.op != "==" && c.op != "!=" {
+			return nil, fmt.Errorf("%s can only be compared with == or !=", fields[0])
+		}
+		rule.conditions = append(rule.conditions, c)
+	}
+	return rule, nil
+}
+
+func (r *Rule) matches(p *Part) bool {
+	for _, c := range r.conditions {
+		var compared int
+		switch value := partFields[c.field](p).(type) {
+		case float64:
+			want, _ := strconv.ParseFloat(c.value, 64)
+			switch {
+			case value < want:
+				compared = -1
+			case value > want:
+				compared = 1
+			}
+		case bool:
+			want, _ := strconv.ParseBool(c.value)
+			if value != want {
+				compared = 1
+			}
+		case string:
+			compared = strings.Compare(value, c.value)
+		}
+		var holds bool
+		switch c.op {
+		case "==":
+			holds = compared == 0
+		case "!=":
+			holds = compared != 0
+		case "<":
+			holds = compared < 0
+		case "<=":
+			holds = compared <= 0
+		case ">":
+			holds = compared > 0
+		case ">=":
+			holds = compared >= 0
+		}
+		if !holds {
+			return false
+		}
+	}
+	return true
+}
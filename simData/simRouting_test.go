@@ -0,0 +1,123 @@
+package simData
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestParseRule(t *testing.T) {
+	tests := []struct {
+		text    string
+		problem string
+	}{
+		{text: "DefectsCount > 0"},
+		{text: "defects_count >= 1 && Material == Steel"},
+		{text: "Material == 'Steel'"},
+		{text: "IsPackaged == true"},
+		{text: "DefectsCount > 0 &&", problem: "is not of the form"},
+		{text: "DefectsCount => 0", problem: "is not of the form"},
+		{text: "Colour == Red", problem: `no attribute "Colour"`},
+		{text: "Weight > heavy", problem: "needs a number"},
+		{text: "IsPackaged == maybe", problem: "needs true or false"},
+		{text: "Material > Steel", problem: "only be compared with == or !="},
+	}
+	for _, test := range tests {
+		rule, err := ParseRule(test.text)
+		if test.problem == "" {
+			if err != nil || rule.Text != test.text {
+				t.Errorf("ParseRule(%q) = %v, %v", test.text, rule, err)
+			}
+			continue
+		}
+		if err == nil || !strings.Contains(err.Error(), test.problem) {
+			t.Errorf("ParseRule(%q) got error %v, want one saying %q", test.text, err, test.problem)
+		}
+	}
+}
+
+func TestRuleMatches(t *testing.T) {
+	part := &Part{DefectsCount: 2, Weight: 2.5, Material: "Steel", IsPackaged: true}
+	tests := []struct {
+		text string
+		want bool
+	}{
+		{text: "DefectsCount > 0", want: true},
+		{text: "DefectsCount > 2"},
+		{text: "DefectsCount >= 2", want: true},
+		{text: "DefectsCount == 2", want: true},
+		{text: "DefectsCount != 2"},
+		{text: "Weight < 2.5"},
+		{text: "Weight <= 2.5", want: true},
+		{text: "Material == Steel", want: true},
+		{text: "Material != Steel"},
+		{text: "IsPackaged == true", want: true},
+		{text: "Material == Steel && Weight > 3"},
+		{text: "Material == Steel && Weight > 2", want: true},
+	}
+	for _, test := range tests {
+		rule, err := ParseRule(test.text)
+		if err != nil {
+			t.Fatalf("ParseRule(%q): %v", test.text, err)
+		}
+		if got := rule.matches(part); got != test.want {
+			t.Errorf("%q matches = %v, want %v", test.text, got, test.want)
+		}
+	}
+}
+
+func TestRoutingCandidates(t *testing.T) {
+	rework, err := ParseRule("DefectsCount > 0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	n := &Node{ID: "cutter", Routing: NewRouting(RoutingRoundRobin, false)}
+	n.NextNodes = map[string]FactoryNode{
+		"repair":  &Node{ID: "repair"},
+		"sensor1": &Node{ID: "sensor1"},
+		"sensor2": &Node{ID: "sensor2"},
+	}
+	n.Routing.Routes["repair"] = &Route{When: rework}
+
+	var got []string
+	for i := 0; i < 4; i++ {
+		got = append(got, n.route(&Part{}).GetID())
+	}
+	if want := "sensor1 sensor2 sensor1 sensor2"; strings.Join(got, " ") != want {
+		t.Errorf("good parts went to %v, want %s in turn", got, want)
+	}
+	if next := n.route(&Part{DefectsCount: 1}); next.GetID() != "repair" {
+		t.Errorf("a defective part went to %s, want repair", next.GetID())
+	}
+	if n.Routing.Turn != 5 {
+		t.Errorf("got turn %d after 5 parts", n.Routing.Turn)
+	}
+}
+
+func TestRoutingPick(t *testing.T) {
+	busy := NewWorkerNode("busy", "Ann", "Cutting", 3, time.Second)
+	busy.SetEvent(Processing)
+	idle := NewWorkerNode("idle", "Bo", "Cutting", 1, time.Second)
+	idle.Queue = make(chan *Part, 2)
+	idle.Queue <- &Part{}
+	expert := NewWorkerNode("expert", "Cy", "Cutting", 5, time.Second)
+	expert.SetEvent(Processing)
+	nodes := []FactoryNode{busy, expert, idle}
+
+	tests := []struct {
+		policy string
+		want   string
+	}{
+		{policy: RoutingIdleFirst, want: "idle"},
+		{policy: RoutingSkill, want: "expert"},
+		{policy: RoutingShortestQueue, want: "busy"},
+	}
+	for _, test := range tests {
+		if got := NewRouting(test.policy, false).pick(&Node{}, nodes); got.GetID() != test.want {
+			t.Errorf("%s picked %s, want %s", test.policy, got.GetID(), test.want)
+		}
+	}
+	if got := NewRouting(RoutingWeighted, false).pick(&Node{}, nil); got != nil {
+		t.Errorf("picked %s from no nodes", got.GetID())
+	}
+}
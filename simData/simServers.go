@@ -0,0 +1,241 @@
+package simData
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"time"
+)
+
+/*
+A machine can have several servers, such as the bays of a repair area, each working on parts
+from the machine's queue at the same time as the others. A server given a batch loads parts
+until it holds the batch size, then processes them all together in one processing time, like
+an oven. It starts on a smaller batch once it holds the minimum fill and the queue is empty,
+or, whatever it holds, once the timeout has passed since it loaded its first part. Each
+server's busy time, from starting on a batch until the last part of it has left, is written
+with its utilisation to the server_utilisation data source. Breakdowns and maintenance stop
+the whole machine, so no server takes parts while it is down.
+*/
+
+type BatchLayout struct {
+	Size int `json:"size" yaml:"size"`
+	// MinFill is the fewest parts a batch starts with before the timeout, the size when unset
+	MinFill int    `json:"min_fill,omitempty" yaml:"min_fill,omitempty"`
+	Timeout string `json:"timeout,omitempty" yaml:"timeout,omitempty"`
+}
+
+func (b *BatchLayout) validate(id string) []string {
+	var problems []string
+	if b.Size < 1 {
+		problems = append(problems, fmt.Sprintf("node %q needs a batch size of at least 1", id))
+	}
+	if b.MinFill < 0 || b.MinFill > b.Size {
+		problems = append(problems, fmt.Sprintf("node %q needs a batch min_fill between 1 and its size", id))
+	}
+	if b.Timeout != "" {
+		if timeout, err := time.ParseDuration(b.Timeout); err != nil || timeout <= 0 {
+			problems = append(problems, fmt.Sprintf("node %q needs a positive batch timeout, got %q", id, b.Timeout))
+		}
+	}
+	return problems
+}
+
+func (b *BatchLayout) batch() *Batch {
+	if b == nil {
+		return nil
+	}
+	batch := &Batch{Size: b.Size, MinFill: b.MinFill}
+	if batch.MinFill == 0 {
+		batch.MinFill = batch.Size
+	}
+	batch.Timeout, _ = time.ParseDuration(b.Timeout)
+	return batch
+}
+
+type Batch struct {
+	Size    int
+	MinFill int
+	// Timeout is how long a server waits for its batch to fill, for ever when 0
+	Timeout time.Duration
+}
+
+// size is the most parts a server works on at once.
+func (b *Batch) size() int {
+	if b == nil {
+		return 1
+	}
+	return b.Size
+}
+
+// ready is whether a server that loaded its first part at loaded and holds
+// count parts starts on them, drained when the queue has no more for it.
+func (b *Batch) ready(count int, loaded time.Time, drained bool) bool {
+	switch {
+	case count == 0:
+		return false
+	case count >= b.size():
+		return true
+	case drained && count >= b.MinFill:
+		return true
+	}
+	return b.Timeout > 0 && !Now().Before(loaded.Add(b.Timeout))
+}
+
+type Server struct {
+	Index int
+	// Batch are the parts the server holds, and Next the node each goes to once
+	// processed, nil for parts that go nowhere
+	Batch []*Part
+	Next  []FactoryNode
+	// Loaded is when the server loaded the first part of its batch
+	Loaded time.Time
+	// Busy is set from when the server starts on its batch until the last part
+	// has left, and Out is how many parts are still to leave
+	Busy    bool
+	Out     int
+	Started time.Time
+
+	// Opened is when the server started serving, which its utilisation is
+	// measured from
+	Opened   time.Time
+	BusyTime time.Duration
+	Parts    int
+	Batches  int
+	// Last is how long the server was busy with its last batch
+	Last time.Duration
+}
+
+func newServers(count int) []*Server {
+	servers := make([]*Server, count)
+	for i := range servers {
+		servers[i] = &Server{Index: i}
+	}
+	return servers
+}
+
+// Utilisation is the share of the time since the server opened that it was busy.
+func (s *Server) Utilisation(now time.Time) float64 {
+	open := now.Sub(s.Opened)
+	if s.Opened.IsZero() || open <= 0 {
+		return 0
+	}
+	return float64(s.BusyTime) / float64(open)
+}
+
+// servers are the node's servers, one unless the layout gives it more.
+func (n *Node) servers() []*Server {
+	n.Mu.Lock()
+	defer n.Mu.Unlock()
+	if len(n.Servers) == 0 {
+		n.Servers = newServers(1)
+	}
+	return n.Servers
+}
+
+// open starts measuring the utilisation of n's servers from now, unless it
+// already is.
+func (n *Node) open(now time.Time) {
+	servers := n.servers()
+	n.Mu.Lock()
+	defer n.Mu.Unlock()
+	for _, server := range servers {
+		if server.Opened.IsZero() {
+			server.Opened = now
+		}
+	}
+}
+
+// out is whether n is down or stopped for maintenance, so none of its servers
+// take parts.
+func (n *Node) out() bool {
+	n.Mu.Lock()
+	defer n.Mu.Unlock()
+	if n.Breakdown != nil && n.Breakdown.Down != nil {
+		return true
+	}
+	machine, ok := n.outer.(*CuttingMachineNode)
+	return ok && machine.Maintenance != nil && machine.Maintenance.Window != nil
+}
+
+// load adds part to the server's batch.
+func (s *Server) load(part *Part) {
+	if len(s.Batch) == 0 {
+		s.Loaded = Now()
+	}
+	s.Batch = append(s.Batch, part)
+}
+
+// begin starts the server on its batch, and processes each part of it.
+func (n *Node) begin(server *Server, connections map[string]*DataSource) {
+	n.Mu.Lock()
+	server.Busy = true
+	server.Started = Now()
+	n.Mu.Unlock()
+	server.Next = make([]FactoryNode, len(server.Batch))
+	if len(server.Batch) > 1 {
+		logging("Server %d of %s started on a batch of %d parts\n", server.Index, n.ID, len(server.Batch))
+	}
+	for i, part := range server.Batch {
+		server.Next[i] = beginProcessing(part, n.self(), connections)
+	}
+}
+
+// served frees the server once the last part of its batch has left, and
+// records how long it was busy.
+func (n *Node) served(server *Server, connections map[string]*DataSource) {
+	conn, exists := connections["server_utilisation"]
+	var row map[string]interface{}
+
+	n.Mu.Lock()
+	server.Last = Now().Sub(server.Started)
+	server.BusyTime += server.Last
+	server.Parts += len(server.Batch)
+	server.Batches++
+	n.lastServer = server
+	if exists {
+		row = conn.DataMapper(nil, n.self())
+	}
+	server.Busy = false
+	server.Batch, server.Next = nil, nil
+	n.Mu.Unlock()
+
+	// The row is written once the mutex is free, so the other servers don't
+	// wait on the database
+	if exists {
+		conn.Appender(nil, n, row)
+	}
+}
+
+// gather loads the server with parts from n's queue until its batch is ready,
+// and returns false once the queue is closed or ctx ends. An empty server
+// returns as soon as the queue is.
+func (n *Node) gather(ctx context.Context, server *Server) bool {
+	for {
+		select {
+		case <-ctx.Done():
+			log.Printf("Context cancelled, exiting node %s", n.ID)
+			return false
+
+		case part, ok := <-n.Queue:
+			if !ok {
+				log.Printf("Queue closed, exiting node %s", n.ID)
+				return false
+			}
+			server.load(part)
+			if !n.Batch.ready(len(server.Batch), server.Loaded, false) {
+				continue
+			}
+			return true
+
+		default:
+			if len(server.Batch) == 0 || n.Batch.ready(len(server.Batch), server.Loaded, true) {
+				return true
+			}
+			if !clock.Sleep(ctx, idlePoll) {
+				log.Printf("Context cancelled while filling a batch, exiting node %s", n.ID)
+				return false
+			}
+		}
+	}
+}
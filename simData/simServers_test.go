@@ -0,0 +1,105 @@
+package simData
+
+import (
+	"context"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestBatchReady(t *testing.T) {
+	quietLogs(t)
+	SetClock(NewVirtualClock(simulationStart))
+	oven := &Batch{Size: 4, MinFill: 2, Timeout: time.Minute}
+	tests := []struct {
+		name    string
+		batch   *Batch
+		count   int
+		loaded  time.Time
+		drained bool
+		want    bool
+	}{
+		{name: "no batch, empty", count: 0},
+		{name: "no batch, one part", count: 1, loaded: simulationStart, want: true},
+		{name: "empty", batch: oven, count: 0, loaded: simulationStart.Add(-time.Hour)},
+		{name: "full", batch: oven, count: 4, loaded: simulationStart, want: true},
+		{name: "filling", batch: oven, count: 3, loaded: simulationStart},
+		{name: "drained at min fill", batch: oven, count: 2, loaded: simulationStart, drained: true, want: true},
+		{name: "drained below min fill", batch: oven, count: 1, loaded: simulationStart, drained: true},
+		{name: "timed out below min fill", batch: oven, count: 1, loaded: simulationStart.Add(-time.Minute), want: true},
+		{name: "no timeout", batch: &Batch{Size: 4, MinFill: 4}, count: 3, loaded: simulationStart.Add(-time.Hour), drained: true},
+	}
+	for _, test := range tests {
+		if got := test.batch.ready(test.count, test.loaded, test.drained); got != test.want {
+			t.Errorf("%s: ready = %v, want %v", test.name, got, test.want)
+		}
+	}
+}
+
+// serversLayout has a cutter with three servers, sending parts round robin to
+// two sensors that bake them in batches.
+const serversLayout = `
+version: 1
+name: servers
+seed: 42
+nodes:
+  - {id: reject, type: reject}
+  - {id: start, type: start}
+  - {id: complete, type: complete}
+  - {id: cutter, type: cutting_machine, processing_time: 3s, failure_rate: 0, servers: 3, routing: round_robin}
+  - {id: sensor1, type: sensor_machine, processing_time: 2s, failure_chance: 0, batch: {size: 2, timeout: 10s}}
+  - {id: sensor2, type: sensor_machine, processing_time: 2s, failure_chance: 0, batch: {size: 2, timeout: 10s}}
+edges:
+  - {from: start, to: cutter}
+  - {from: cutter, to: sensor1}
+  - {from: cutter, to: sensor2}
+  - {from: sensor1, to: complete}
+  - {from: sensor2, to: complete}
+`
+
+func TestParallelServersOnGoroutines(t *testing.T) {
+	quietLogs(t)
+	t.Setenv("SIM_LOG_DIR", t.TempDir())
+	layout, err := ParseFactoryLayout([]byte(serversLayout))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var mu sync.Mutex
+	batches := make(map[string]int)
+	sources := IntialiseConnections(nil)
+	recordRows(sources, func(source string, row map[string]interface{}) {
+		if source != "server_utilisation" {
+			return
+		}
+		mu.Lock()
+		defer mu.Unlock()
+		batches[row["machine_id"].(string)+"/"+strings.Repeat("I", row["server"].(int)+1)] = row["batches"].(int)
+	})
+	factory, err := layout.Build(sources)
+	if err != nil {
+		t.Fatalf("Build: %v", err)
+	}
+	factory.SetRate(3)
+	SetClock(NewVirtualClock(simulationStart))
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		SimulateData(sources, factory, ctx)
+	}()
+	for Now().Sub(simulationStart) < 5*time.Minute {
+		time.Sleep(time.Millisecond)
+	}
+	cancel()
+	<-done
+
+	mu.Lock()
+	defer mu.Unlock()
+	for _, server := range []string{"cutter/I", "cutter/II", "cutter/III", "sensor1/I", "sensor2/I"} {
+		if batches[server] == 0 {
+			t.Errorf("server %s finished no batches, got %v", server, batches)
+		}
+	}
+}
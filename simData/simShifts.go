@@ -0,0 +1,350 @@
+package simData
+
+import (
+	"context"
+	"fmt"
+	"math/rand"
+	"strings"
+	"sync"
+	"time"
+)
+
+/*
+Workers given a shift calendar, their own or their department's, only work during its shifts and
+take no parts during breaks. Each shift a worker may be absent, and with fatigue their effective
+skill drops the longer the shift has gone on. Machines can name the workers that operate them, and
+stall while none of those are on shift. Shift changes happen at the same simulated time for both
+engines: the event engine runs them as events, and the goroutine engine has a goroutine sleep on
+the clock until the next one. Every change is written to worker_activity.
+*/
+
+const (
+	ShiftOff    = "off_shift"
+	ShiftOn     = "on_shift"
+	ShiftBreak  = "on_break"
+	ShiftAbsent = "absent"
+
+	// a tired worker keeps at least this much of their skill
+	minFatigue = 0.5
+)
+
+var weekdays = map[string]time.Weekday{
+	"sun": time.Sunday, "mon": time.Monday, "tue": time.Tuesday, "wed": time.Wednesday,
+	"thu": time.Thursday, "fri": time.Friday, "sat": time.Saturday,
+}
+
+type CalendarLayout struct {
+	ID string `json:"id" yaml:"id"`
+	// Departments whose workers follow the calendar, unless they name their own
+	Departments []string `json:"departments,omitempty" yaml:"departments,omitempty"`
+	// Days the shifts are worked, every day when empty
+	Days   []string      `json:"days,omitempty" yaml:"days,omitempty"`
+	Shifts []ShiftLayout `json:"shifts" yaml:"shifts"`
+	// Absence is the chance a worker misses a shift
+	Absence float64 `json:"absence,omitempty" yaml:"absence,omitempty"`
+	// Fatigue is the share of their skill a worker loses for every hour of a shift
+	Fatigue float64 `json:"fatigue,omitempty" yaml:"fatigue,omitempty"`
+}
+
+// ShiftLayout runs from Start to End, both times of day, past midnight if End
+// is earlier.
+type ShiftLayout struct {
+	Name   string        `json:"name" yaml:"name"`
+	Start  string        `json:"start" yaml:"start"`
+	End    string        `json:"end" yaml:"end"`
+	Breaks []BreakLayout `json:"breaks,omitempty" yaml:"breaks,omitempty"`
+}
+
+type BreakLayout struct {
+	Start    string `json:"start" yaml:"start"`
+	Duration string `json:"duration" yaml:"duration"`
+}
+
+func (c *CalendarLayout) validate() []string {
+	var problems []string
+	if len(c.Shifts) == 0 {
+		problems = append(problems, fmt.Sprintf("calendar %q has no shifts", c.ID))
+	}
+	for _, day := range c.Days {
+		if _, exists := weekdays[strings.ToLower(day)]; !exists {
+			problems = append(problems, fmt.Sprintf("calendar %q has unknown day %q", c.ID, day))
+		}
+	}
+	for _, shift := range c.Shifts {
+		start, startErr := parseTimeOfDay(shift.Start)
+		end, endErr := parseTimeOfDay(shift.End)
+		if startErr != nil || endErr != nil {
+			problems = append(problems, fmt.Sprintf("calendar %q: shift %q needs a start and end such as 06:00", c.ID, shift.Name))
+			continue
+		}
+		length := shiftLength(start, end)
+		for _, b := range shift.Breaks {
+			breakStart, err := parseTimeOfDay(b.Start)
+			duration, durationErr := time.ParseDuration(b.Duration)
+			if err != nil || durationErr != nil || duration <= 0 {
+				problems = append(problems, fmt.Sprintf("calendar %q: shift %q has an invalid break at %q", c.ID, shift.Name, b.Start))
+				continue
+			}
+			if offset := shiftLength(start, breakStart); offset+duration > length {
+				problems = append(problems, fmt.Sprintf("calendar %q: break at %s is outside shift %q", c.ID, b.Start, shift.Name))
+			}
+		}
+	}
+	if c.Absence < 0 || c.Absence > 1 {
+		problems = append(problems, fmt.Sprintf("calendar %q needs an absence between 0 and 1", c.ID))
+	}
+	if c.Fatigue < 0 {
+		problems = append(problems, fmt.Sprintf("calendar %q cannot have a negative fatigue", c.ID))
+	}
+	return problems
+}
+
+func parseTimeOfDay(value string) (time.Duration, error) {
+	t, err := time.Parse("15:04", value)
+	if err != nil {
+		return 0, err
+	}
+	return time.Duration(t.Hour())*time.Hour + time.Duration(t.Minute())*time.Minute, nil
+}
+
+// shiftLength is the time from start to end, both times of day.
+func shiftLength(start, end time.Duration) time.Duration {
+	length := end - start
+	if length <= 0 {
+		length += 24 * time.Hour
+	}
+	return length
+}
+
+func (c *CalendarLayout) calendar() *Calendar {
+	calendar := &Calendar{ID: c.ID, Absence: c.Absence, Fatigue: c.Fatigue}
+	for i := range calendar.Days {
+		calendar.Days[i] = len(c.Days) == 0
+	}
+	for _, day := range c.Days {
+		calendar.Days[weekdays[strings.ToLower(day)]] = true
+	}
+	for _, s := range c.Shifts {
+		start, _ := parseTimeOfDay(s.Start)
+		end, _ := parseTimeOfDay(s.End)
+		shift := Shift{Name: s.Name, Start: start, Length: shiftLength(start, end)}
+		for _, b := range s.Breaks {
+			breakStart, _ := parseTimeOfDay(b.Start)
+			duration, _ := time.ParseDuration(b.Duration)
+			shift.Breaks = append(shift.Breaks, Break{Offset: shiftLength(start, breakStart), Length: duration})
+		}
+		calendar.Shifts = append(calendar.Shifts, shift)
+	}
+	return calendar
+}
+
+type Calendar struct {
+	ID      string
+	Days    [7]bool
+	Shifts  []Shift
+	Absence float64
+	Fatigue float64
+}
+
+type Shift struct {
+	Name   string
+	Start  time.Duration
+	Length time.Duration
+	Breaks []Break
+}
+
+// Break starts Offset into its shift.
+type Break struct {
+	Offset time.Duration
+	Length time.Duration
+}
+
+// at is the status at t, with the shift and the time it started when t is in one.
+func (c *Calendar) at(t time.Time) (string, string, time.Time) {
+	day := midnight(t)
+	for _, date := range []time.Time{day.AddDate(0, 0, -1), day} {
+		if !c.Days[date.Weekday()] {
+			continue
+		}
+		for _, shift := range c.Shifts {
+			start := date.Add(shift.Start)
+			if t.Before(start) || !t.Before(start.Add(shift.Length)) {
+				continue
+			}
+			for _, b := range shift.Breaks {
+				breakStart := start.Add(b.Offset)
+				if !t.Before(breakStart) && t.Before(breakStart.Add(b.Length)) {
+					return ShiftBreak, shift.Name, start
+				}
+			}
+			return ShiftOn, shift.Name, start
+		}
+	}
+	return ShiftOff, "", time.Time{}
+}
+
+// next is the first time after t that a shift or break starts or ends, zero if
+// the calendar has no working days.
+func (c *Calendar) next(t time.Time) time.Time {
+	var next time.Time
+	consider := func(change time.Time) {
+		if change.After(t) && (next.IsZero() || change.Before(next)) {
+			next = change
+		}
+	}
+	day := midnight(t)
+	for i := -1; i <= 7; i++ {
+		date := day.AddDate(0, 0, i)
+		if !c.Days[date.Weekday()] {
+			continue
+		}
+		for _, shift := range c.Shifts {
+			start := date.Add(shift.Start)
+			consider(start)
+			consider(start.Add(shift.Length))
+			for _, b := range shift.Breaks {
+				consider(start.Add(b.Offset))
+				consider(start.Add(b.Offset + b.Length))
+			}
+		}
+	}
+	return next
+}
+
+func midnight(t time.Time) time.Time {
+	return time.Date(t.Year(), t.Month(), t.Day(), 0, 0, 0, 0, t.Location())
+}
+
+// ShiftState is where a worker is in their calendar.
+type ShiftState struct {
+	Calendar *Calendar
+	Status   string
+	// Shift is the name of the shift the worker is in, and Started when it started
+	Shift   string
+	Started time.Time
+	// Change is the activity the last change is written to worker_activity as
+	Change string
+
+	rng *rand.Rand
+}
+
+// updateShift moves w to where its calendar is at now, and returns whether that
+// changed anything.
+func updateShift(w *WorkerNode, connections map[string]*DataSource) bool {
+	w.Mu.Lock()
+	state := w.Shift
+	status, name, started := state.Calendar.at(Now())
+	newShift := status != ShiftOff && !started.Equal(state.Started)
+	switch {
+	case newShift && state.rng.Float64() < state.Calendar.Absence:
+		status = ShiftAbsent
+	case !newShift && state.Status == ShiftAbsent && status != ShiftOff:
+		status = ShiftAbsent
+	}
+	w.offShift = status != ShiftOn
+	if status == state.Status && started.Equal(state.Started) {
+		w.Mu.Unlock()
+		return false
+	}
+
+	switch {
+	case status == ShiftAbsent:
+		state.Change = "Absent"
+	case status == ShiftBreak:
+		state.Change = "Break Start"
+	case status == ShiftOn && state.Status == ShiftBreak && !newShift:
+		state.Change = "Break End"
+	case status == ShiftOn && (state.Status == ShiftOn || state.Status == ShiftBreak):
+		state.Change = "Shift Change"
+	case status == ShiftOn:
+		state.Change = "Shift Start"
+	default:
+		state.Change = "Shift End"
+		// The shift that ended is the one written
+		name = state.Shift
+	}
+	state.Status, state.Shift, state.Started = status, name, started
+	w.Mu.Unlock()
+
+	logging("Worker %s: %s %s\n", w.ID, state.Change, name)
+	if conn, exists := connections["worker_activity"]; exists {
+		conn.Appender(nil, &w.Node, conn.DataMapper(nil, w))
+	}
+	return true
+}
+
+// shiftWorkers are the factory's workers that have a calendar.
+func shiftWorkers(f *Factory) []*WorkerNode {
+	var workers []*WorkerNode
+	for _, node := range sortedNodes(f.nodes) {
+		if worker, ok := node.(*WorkerNode); ok && worker.Shift != nil {
+			workers = append(workers, worker)
+		}
+	}
+	return workers
+}
+
+// updateShifts moves every worker to where their calendar is at now, and
+// returns when the next change is, zero if there are none.
+func updateShifts(workers []*WorkerNode, connections map[string]*DataSource) time.Time {
+	var next time.Time
+	for _, worker := range workers {
+		updateShift(worker, connections)
+		if change := worker.Shift.Calendar.next(Now()); !change.IsZero() && (next.IsZero() || change.Before(next)) {
+			next = change
+		}
+	}
+	return next
+}
+
+// runShifts changes shifts on the clock until ctx ends.
+func runShifts(ctx context.Context, workers []*WorkerNode, connections map[string]*DataSource, wg *sync.WaitGroup) {
+	defer wg.Done()
+	defer clock.Leave()
+	for {
+		next := updateShifts(workers, connections)
+		if next.IsZero() {
+			return
+		}
+		if !clock.Sleep(ctx, next.Sub(Now())) {
+			return
+		}
+	}
+}
+
+// skill is the worker's skill level less any fatigue. Called with the mutex held.
+func (w *WorkerNode) skill() float64 {
+	skill := float64(w.SkillLevel)
+	if w.Shift == nil || w.Shift.Calendar.Fatigue == 0 || w.Shift.Started.IsZero() {
+		return skill
+	}
+	left := 1 - w.Shift.Calendar.Fatigue*Now().Sub(w.Shift.Started).Hours()
+	if left < minFatigue {
+		left = minFatigue
+	}
+	return skill * left
+}
+
+func (n *Node) onShift() bool {
+	n.Mu.Lock()
+	defer n.Mu.Unlock()
+	return !n.offShift
+}
+
+// stalled is whether n can't take parts: while it is a worker off shift or held
+// for a repair, or a machine none of whose operators are on shift.
+func (n *Node) stalled() bool {
+	n.Mu.Lock()
+	stalled := n.heldFor != "" || n.offShift
+	operators := n.operators
+	n.Mu.Unlock()
+	if stalled || len(operators) == 0 {
+		return stalled
+	}
+	for _, operator := range operators {
+		if operator.onShift() {
+			return false
+		}
+	}
+	return true
+}
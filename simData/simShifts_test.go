@@ -0,0 +1,157 @@
+package simData
+
+import (
+	"math/rand"
+	"strings"
+	"testing"
+	"time"
+)
+
+// weekCalendar works a day shift with a break and a night shift past midnight,
+// Monday to Friday. The simulation starts on a Monday at 06:00.
+func weekCalendar(t *testing.T) *Calendar {
+	t.Helper()
+	layout := &CalendarLayout{
+		ID:   "week",
+		Days: []string{"mon", "tue", "wed", "thu", "fri"},
+		Shifts: []ShiftLayout{
+			{Name: "day", Start: "06:00", End: "14:00", Breaks: []BreakLayout{{Start: "10:00", Duration: "30m"}}},
+			{Name: "night", Start: "22:00", End: "06:00"},
+		},
+	}
+	if problems := layout.validate(); len(problems) > 0 {
+		t.Fatalf("invalid calendar: %v", problems)
+	}
+	return layout.calendar()
+}
+
+func TestCalendarValidate(t *testing.T) {
+	tests := []struct {
+		layout  CalendarLayout
+		problem string
+	}{
+		{layout: CalendarLayout{ID: "none"}, problem: "has no shifts"},
+		{layout: CalendarLayout{ID: "c", Days: []string{"funday"}, Shifts: []ShiftLayout{{Name: "day", Start: "06:00", End: "14:00"}}}, problem: `unknown day "funday"`},
+		{layout: CalendarLayout{ID: "c", Shifts: []ShiftLayout{{Name: "day", Start: "6am", End: "14:00"}}}, problem: "needs a start and end"},
+		{layout: CalendarLayout{ID: "c", Shifts: []ShiftLayout{{Name: "day", Start: "06:00", End: "14:00", Breaks: []BreakLayout{{Start: "13:45", Duration: "30m"}}}}}, problem: "is outside shift"},
+		{layout: CalendarLayout{ID: "c", Absence: 2, Shifts: []ShiftLayout{{Name: "day", Start: "06:00", End: "14:00"}}}, problem: "absence between 0 and 1"},
+	}
+	for _, test := range tests {
+		problems := strings.Join(test.layout.validate(), "; ")
+		if !strings.Contains(problems, test.problem) {
+			t.Errorf("calendar %q got problems %q, want one saying %q", test.layout.ID, problems, test.problem)
+		}
+	}
+}
+
+func TestCalendarAt(t *testing.T) {
+	calendar := weekCalendar(t)
+	monday := midnight(simulationStart)
+	tests := []struct {
+		at     time.Duration
+		status string
+		shift  string
+		start  time.Duration
+	}{
+		{at: 5*time.Hour + 59*time.Minute, status: ShiftOff},
+		{at: 6 * time.Hour, status: ShiftOn, shift: "day", start: 6 * time.Hour},
+		{at: 10*time.Hour + 15*time.Minute, status: ShiftBreak, shift: "day", start: 6 * time.Hour},
+		{at: 14 * time.Hour, status: ShiftOff},
+		{at: 27 * time.Hour, status: ShiftOn, shift: "night", start: 22 * time.Hour},
+		// Friday's night shift runs into Saturday, which has no shifts of its own
+		{at: 5*24*time.Hour + 3*time.Hour, status: ShiftOn, shift: "night", start: 4*24*time.Hour + 22*time.Hour},
+		{at: 5*24*time.Hour + 12*time.Hour, status: ShiftOff},
+	}
+	for _, test := range tests {
+		status, shift, started := calendar.at(monday.Add(test.at))
+		var want time.Time
+		if test.shift != "" {
+			want = monday.Add(test.start)
+		}
+		if status != test.status || shift != test.shift || !started.Equal(want) {
+			t.Errorf("at %s got %s %q from %s, want %s %q from %s", test.at, status, shift, started, test.status, test.shift, want)
+		}
+	}
+}
+
+func TestCalendarNext(t *testing.T) {
+	calendar := weekCalendar(t)
+	monday := midnight(simulationStart)
+	tests := []struct{ at, want time.Duration }{
+		{at: 6 * time.Hour, want: 10 * time.Hour},
+		{at: 10 * time.Hour, want: 10*time.Hour + 30*time.Minute},
+		{at: 14 * time.Hour, want: 22 * time.Hour},
+		{at: 4*24*time.Hour + 23*time.Hour, want: 5*24*time.Hour + 6*time.Hour},
+		{at: 5*24*time.Hour + 6*time.Hour, want: 7*24*time.Hour + 6*time.Hour},
+	}
+	for _, test := range tests {
+		if got := calendar.next(monday.Add(test.at)); !got.Equal(monday.Add(test.want)) {
+			t.Errorf("next after %s got %s, want %s", test.at, got.Sub(monday), test.want)
+		}
+	}
+	if got := (&Calendar{Shifts: calendar.Shifts}).next(monday); !got.IsZero() {
+		t.Errorf("a calendar without working days changes at %s", got)
+	}
+}
+
+func TestUpdateShift(t *testing.T) {
+	quietLogs(t)
+	monday := midnight(simulationStart)
+	worker := NewWorkerNode("worker1", "Ann", "Cutting", 4, time.Second)
+	worker.Shift = &ShiftState{Calendar: weekCalendar(t), Status: ShiftOff, rng: rand.New(rand.NewSource(1))}
+	tests := []struct {
+		at     time.Duration
+		change string
+	}{
+		{at: 5 * time.Hour},
+		{at: 6 * time.Hour, change: "Shift Start"},
+		{at: 7 * time.Hour},
+		{at: 10 * time.Hour, change: "Break Start"},
+		{at: 10*time.Hour + 30*time.Minute, change: "Break End"},
+		{at: 14 * time.Hour, change: "Shift End"},
+		{at: 22 * time.Hour, change: "Shift Start"},
+	}
+	for _, test := range tests {
+		SetClock(NewVirtualClock(monday.Add(test.at)))
+		previous := worker.Shift.Change
+		changed := updateShift(worker, map[string]*DataSource{})
+		if changed != (test.change != "") || (changed && worker.Shift.Change != test.change) {
+			t.Errorf("at %s got change %v %q, want %q", test.at, changed, worker.Shift.Change, test.change)
+		}
+		if !changed && worker.Shift.Change != previous {
+			t.Errorf("at %s the change became %q with nothing changed", test.at, worker.Shift.Change)
+		}
+		if onShift := worker.Shift.Status == ShiftOn; worker.offShift == onShift {
+			t.Errorf("at %s a worker %s has offShift %v", test.at, worker.Shift.Status, worker.offShift)
+		}
+	}
+
+	worker.Shift.Calendar.Absence = 1
+	SetClock(NewVirtualClock(monday.Add(30 * time.Hour)))
+	if !updateShift(worker, map[string]*DataSource{}) || worker.Shift.Status != ShiftAbsent || !worker.stalled() {
+		t.Errorf("a worker sure to be absent got status %s on the next shift", worker.Shift.Status)
+	}
+}
+
+func TestWorkerSkillFatigue(t *testing.T) {
+	monday := midnight(simulationStart)
+	calendar := weekCalendar(t)
+	calendar.Fatigue = 0.1
+	worker := NewWorkerNode("worker1", "Ann", "Cutting", 4, time.Second)
+	worker.Shift = &ShiftState{Calendar: calendar, Started: monday.Add(6 * time.Hour)}
+	tests := []struct {
+		at   time.Duration
+		want float64
+	}{
+		{at: 6 * time.Hour, want: 4},
+		{at: 9 * time.Hour, want: 2.8},
+		{at: 13 * time.Hour, want: 2},
+	}
+	quietLogs(t)
+	for _, test := range tests {
+		SetClock(NewVirtualClock(monday.Add(test.at)))
+		if got := worker.skill(); got < test.want-1e-9 || got > test.want+1e-9 {
+			t.Errorf("at %s got skill %v, want %v", test.at, got, test.want)
+		}
+	}
+}
@@ -0,0 +1,748 @@
+package simData
+
+import (
+	"container/heap"
+	"encoding/json"
+	"fmt"
+	"os"
+	"sort"
+	"time"
+)
+
+/*
+A snapshot is the whole state of a simulation on the event engine, saved as JSON: the layout
+the factory was built from, every node's queue, state and machine internals, the parts in
+flight, the random streams and the pending events. The event engine is between events when
+it is taken, so a restored snapshot carries on exactly where it was saved. Parts are stored
+once and referred to by ID, as the same part can be in a queue, an inventory and an event.
+*/
+
+// SnapshotVersion is the format snapshots are saved in. Version 1 kept a busy
+// flag per node, with the part it was working on in the node's finish or
+// transfer event; breakdowns, maintenance, shifts, kits, orders and routing
+// turns were added to it as sections a snapshot can leave out, and those left
+// out start as the layout has them. Version 2 keeps each node's servers and the
+// batches they hold instead. Older versions are migrated when restored.
+const SnapshotVersion = 2
+
+type Snapshot struct {
+	Version int            `json:"version"`
+	Seed    int64          `json:"seed"`
+	Rate    int            `json:"rate"`
+	Time    time.Time      `json:"time"`
+	Layout  *FactoryLayout `json:"layout"`
+
+	Nodes   []NodeSnapshot    `json:"nodes"`
+	Parts   []PartSnapshot    `json:"parts"`
+	Streams map[string]uint64 `json:"streams"`
+
+	PartCounter int             `json:"part_counter"`
+	EventSeq    int             `json:"event_seq"`
+	EventsRan   int             `json:"events_ran"`
+	Events      []EventSnapshot `json:"events"`
+	// Orders is set when parts are released for orders
+	Orders *OrderBookSnapshot `json:"orders,omitempty"`
+}
+
+type NodeSnapshot struct {
+	ID    string `json:"id"`
+	Event string `json:"event"`
+	// Busy is only in version 1, before nodes had servers
+	Busy           bool          `json:"busy,omitempty"`
+	ProcessingTime time.Duration `json:"processing_time"`
+	NextNodes      []string      `json:"next_nodes"`
+	NodesWithin    []string      `json:"nodes_within,omitempty"`
+	Queue          []string      `json:"queue,omitempty"`
+	// Servers are the node's servers in order, with the batches they hold
+	Servers []ServerSnapshot `json:"servers,omitempty"`
+
+	// cutting_machine
+	Dullness            *float64             `json:"dullness,omitempty"`
+	TimeSinceLastRepair *time.Duration       `json:"time_since_last_repair,omitempty"`
+	Maintenance         *MaintenanceSnapshot `json:"maintenance,omitempty"`
+	// inventory
+	CurrentStored *int     `json:"current_stored,omitempty"`
+	StoredParts   []string `json:"stored_parts,omitempty"`
+	// sensor_machine
+	Calibration   *float64 `json:"calibration,omitempty"`
+	FailureChance *float64 `json:"failure_chance,omitempty"`
+	// machines that break down, and the workers repairing them
+	Breakdown *BreakdownSnapshot `json:"breakdown,omitempty"`
+	HeldFor   string             `json:"held_for,omitempty"`
+	// workers with a shift calendar
+	Shift *ShiftSnapshot `json:"shift,omitempty"`
+	// Turn is where round robin routing has got to
+	Turn int `json:"turn,omitempty"`
+	// assembly_station with a bom
+	Kit       []string `json:"kit,omitempty"`
+	Assembled int      `json:"assembled,omitempty"`
+}
+
+type ServerSnapshot struct {
+	Batch []string `json:"batch,omitempty"`
+	// Next are the nodes the batch's parts go to, empty for those going nowhere
+	Next     []string      `json:"next,omitempty"`
+	Loaded   time.Time     `json:"loaded,omitempty"`
+	Busy     bool          `json:"busy,omitempty"`
+	Out      int           `json:"out,omitempty"`
+	Started  time.Time     `json:"started,omitempty"`
+	Opened   time.Time     `json:"opened"`
+	BusyTime time.Duration `json:"busy_time"`
+	Parts    int           `json:"parts"`
+	Batches  int           `json:"batches"`
+	Last     time.Duration `json:"last"`
+}
+
+type OrderBookSnapshot struct {
+	Pending    []Order        `json:"pending,omitempty"`
+	Open       []Order        `json:"open,omitempty"`
+	Placed     int            `json:"placed"`
+	Released   int            `json:"released"`
+	Left       int            `json:"left"`
+	Cards      map[string]int `json:"cards,omitempty"`
+	Start      time.Time      `json:"start,omitempty"`
+	NextDemand time.Time      `json:"next_demand,omitempty"`
+	Last       *Order         `json:"last,omitempty"`
+}
+
+type ShiftSnapshot struct {
+	Status  string    `json:"status"`
+	Shift   string    `json:"shift,omitempty"`
+	Started time.Time `json:"started,omitempty"`
+	Change  string    `json:"change,omitempty"`
+}
+
+type MaintenanceSnapshot struct {
+	Cuts   int                `json:"cuts"`
+	Window *MaintenanceWindow `json:"window,omitempty"`
+	Last   *MaintenanceWindow `json:"last,omitempty"`
+}
+
+type BreakdownSnapshot struct {
+	Uptime      time.Duration `json:"uptime"`
+	NextFailure time.Duration `json:"next_failure"`
+	Down        *Downtime     `json:"down,omitempty"`
+	Last        *Downtime     `json:"last,omitempty"`
+}
+
+type PartSnapshot struct {
+	ID             string             `json:"id"`
+	NodeHistory    []string           `json:"node_history,omitempty"`
+	Cutattempts    int                `json:"cut_attempts"`
+	CutVal         int                `json:"cut_val"`
+	Weight         float64            `json:"weight"`
+	Temperature    float64            `json:"temperature"`
+	Material       string             `json:"material"`
+	DefectsCount   int                `json:"defects_count"`
+	ProcessLog     []string           `json:"process_log,omitempty"`
+	IsPackaged     bool               `json:"is_packaged"`
+	TimesRepaired  int                `json:"times_repaired"`
+	TimesAssembled int                `json:"times_assembled"`
+	SensorReadings map[string]float64 `json:"sensor_readings,omitempty"`
+	Type           string             `json:"type,omitempty"`
+	ParentID       string             `json:"parent_id,omitempty"`
+	Components     []string           `json:"components,omitempty"`
+	Product        string             `json:"product,omitempty"`
+	OrderID        string             `json:"order_id,omitempty"`
+}
+
+type EventSnapshot struct {
+	At     time.Time `json:"at"`
+	Seq    int       `json:"seq"`
+	Kind   string    `json:"kind"`
+	Node   string    `json:"node,omitempty"`
+	Server int       `json:"server,omitempty"`
+	Next   string    `json:"next,omitempty"`
+	Part   string    `json:"part,omitempty"`
+}
+
+// TakeSnapshot saves the running simulation, which must be on the event engine.
+func TakeSnapshot() (*Snapshot, error) {
+	engine, ok := clock.(*EventEngine)
+	if !ok {
+		return nil, &ControlError{Message: fmt.Sprintf("snapshots need the %s engine", EngineEvents)}
+	}
+	return engine.Snapshot()
+}
+
+// Snapshot saves the engine's state between two events.
+func (e *EventEngine) Snapshot() (*Snapshot, error) {
+	e.stepMu.Lock()
+	defer e.stepMu.Unlock()
+	e.mu.RLock()
+	defer e.mu.RUnlock()
+
+	if e.factory.layout == nil {
+		return nil, fmt.Errorf("the factory was not built from a layout")
+	}
+	snapshot := &Snapshot{
+		Version:     SnapshotVersion,
+		Seed:        e.factory.Seed(),
+		Rate:        e.factory.Rate(),
+		Time:        e.now,
+		Layout:      e.factory.layout,
+		Streams:     make(map[string]uint64),
+		PartCounter: e.parts,
+		EventSeq:    e.seq,
+		EventsRan:   e.ran,
+	}
+
+	seen := make(map[*Part]bool)
+	var addPart func(part *Part) string
+	addPart = func(part *Part) string {
+		if !seen[part] {
+			seen[part] = true
+			snapshot.Parts = append(snapshot.Parts, snapshotPart(part))
+			for _, component := range part.Components {
+				addPart(component)
+			}
+		}
+		return part.ID
+	}
+
+	for _, node := range sortedNodes(e.factory.nodes) {
+		saved := NodeSnapshot{
+			ID:             node.GetID(),
+			Event:          node.GetEvent().String(),
+			ProcessingTime: node.GetProcessingTime(),
+			NextNodes:      allKeys(node.GetNextNodes()),
+			NodesWithin:    allKeys(node.GetNodesWithin()),
+		}
+		for _, part := range queuedParts(node) {
+			saved.Queue = append(saved.Queue, addPart(part))
+		}
+		base := node.base()
+		for _, server := range base.servers() {
+			savedServer := ServerSnapshot{
+				Loaded:   server.Loaded,
+				Busy:     server.Busy,
+				Out:      server.Out,
+				Started:  server.Started,
+				Opened:   server.Opened,
+				BusyTime: server.BusyTime,
+				Parts:    server.Parts,
+				Batches:  server.Batches,
+				Last:     server.Last,
+			}
+			for i, part := range server.Batch {
+				savedServer.Batch = append(savedServer.Batch, addPart(part))
+				if i < len(server.Next) {
+					next := ""
+					if server.Next[i] != nil {
+						next = server.Next[i].GetID()
+					}
+					savedServer.Next = append(savedServer.Next, next)
+				}
+			}
+			saved.Servers = append(saved.Servers, savedServer)
+		}
+		saved.HeldFor = base.heldFor
+		if base.Routing != nil {
+			saved.Turn = base.Routing.Turn
+		}
+		if b := base.Breakdown; b != nil {
+			saved.Breakdown = &BreakdownSnapshot{Uptime: b.Uptime, NextFailure: b.NextFailure, Down: copyDowntime(b.Down), Last: copyDowntime(b.Last)}
+		}
+		// Values are copied, as the simulation carries on once the snapshot is taken
+		switch n := node.(type) {
+		case *CuttingMachineNode:
+			dullness, sinceRepair := n.Dullness, n.TimeSinceLastRepair
+			saved.Dullness, saved.TimeSinceLastRepair = &dullness, &sinceRepair
+			if m := n.Maintenance; m != nil {
+				saved.Maintenance = &MaintenanceSnapshot{Cuts: m.Cuts, Window: copyWindow(m.Window), Last: copyWindow(m.Last)}
+			}
+		case *InventoryNode:
+			stored := n.CurrentStored
+			saved.CurrentStored = &stored
+			for _, part := range n.StoredParts {
+				saved.StoredParts = append(saved.StoredParts, addPart(part))
+			}
+		case *AssemblyStationNode:
+			for _, part := range n.Kit {
+				saved.Kit = append(saved.Kit, addPart(part))
+			}
+			saved.Assembled = n.Assembled
+		case *SensorMachineNode:
+			calibration, failureChance := n.Calibration, n.FailureChance
+			saved.Calibration, saved.FailureChance = &calibration, &failureChance
+		case *WorkerNode:
+			if shift := n.Shift; shift != nil {
+				saved.Shift = &ShiftSnapshot{Status: shift.Status, Shift: shift.Shift, Started: shift.Started, Change: shift.Change}
+			}
+		}
+		snapshot.Nodes = append(snapshot.Nodes, saved)
+	}
+
+	events := append([]*event(nil), e.events...)
+	sort.Slice(events, func(i, j int) bool {
+		return eventQueue(events).Less(i, j)
+	})
+	for _, ev := range events {
+		saved := EventSnapshot{At: ev.at, Seq: ev.seq, Kind: ev.kind.String(), Server: ev.server}
+		if ev.node != nil {
+			saved.Node = ev.node.GetID()
+		}
+		if ev.next != nil {
+			saved.Next = ev.next.GetID()
+		}
+		if ev.part != nil {
+			saved.Part = addPart(ev.part)
+		}
+		snapshot.Events = append(snapshot.Events, saved)
+	}
+
+	if book := e.factory.orders; book != nil {
+		snapshot.Orders = book.snapshot()
+	}
+
+	for name, source := range e.factory.streams {
+		snapshot.Streams[name] = source.state
+	}
+	return snapshot, nil
+}
+
+func (b *OrderBook) snapshot() *OrderBookSnapshot {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	saved := &OrderBookSnapshot{
+		Placed:     b.Placed,
+		Released:   b.Released,
+		Left:       b.Left,
+		Start:      b.Start,
+		NextDemand: b.NextDemand,
+		Last:       copyOrder(b.Last),
+	}
+	for _, order := range b.Pending {
+		saved.Pending = append(saved.Pending, *order)
+	}
+	for _, order := range b.Open {
+		saved.Open = append(saved.Open, *order)
+	}
+	if b.Cards != nil {
+		saved.Cards = make(map[string]int, len(b.Cards))
+		for product, cards := range b.Cards {
+			saved.Cards[product] = cards
+		}
+	}
+	return saved
+}
+
+func (b *OrderBook) restore(saved *OrderBookSnapshot) {
+	b.Pending, b.Open = nil, nil
+	for _, order := range saved.Pending {
+		b.Pending = append(b.Pending, copyOrder(&order))
+	}
+	for _, order := range saved.Open {
+		b.Open = append(b.Open, copyOrder(&order))
+	}
+	b.Placed, b.Released, b.Left = saved.Placed, saved.Released, saved.Left
+	b.Start, b.NextDemand = saved.Start, saved.NextDemand
+	b.Last = copyOrder(saved.Last)
+	if saved.Cards != nil {
+		b.Cards = make(map[string]int, len(saved.Cards))
+		for product, cards := range saved.Cards {
+			b.Cards[product] = cards
+		}
+	}
+}
+
+func copyOrder(order *Order) *Order {
+	if order == nil {
+		return nil
+	}
+	saved := *order
+	return &saved
+}
+
+func copyDowntime(down *Downtime) *Downtime {
+	if down == nil {
+		return nil
+	}
+	saved := *down
+	return &saved
+}
+
+func copyWindow(window *MaintenanceWindow) *MaintenanceWindow {
+	if window == nil {
+		return nil
+	}
+	saved := *window
+	return &saved
+}
+
+// queuedParts lists the parts waiting in node's queue, leaving them in place.
+func queuedParts(node FactoryNode) []*Part {
+	queue := node.GetQueue()
+	parts := make([]*Part, 0, len(queue))
+	for len(queue) > 0 {
+		parts = append(parts, <-queue)
+	}
+	for _, part := range parts {
+		queue <- part
+	}
+	return parts
+}
+
+func snapshotPart(part *Part) PartSnapshot {
+	history := make([]string, 0, len(part.NodeHistory))
+	for _, node := range part.NodeHistory {
+		history = append(history, node.GetID())
+	}
+	var readings map[string]float64
+	if part.SensorReadings != nil {
+		readings = make(map[string]float64, len(part.SensorReadings))
+		for name, value := range part.SensorReadings {
+			readings[name] = value
+		}
+	}
+	var components []string
+	for _, component := range part.Components {
+		components = append(components, component.ID)
+	}
+	return PartSnapshot{
+		ID:             part.ID,
+		NodeHistory:    history,
+		Cutattempts:    part.Cutattempts,
+		CutVal:         part.CutVal,
+		Weight:         part.Weight,
+		Temperature:    part.Temperature,
+		Material:       part.Material,
+		DefectsCount:   part.DefectsCount,
+		ProcessLog:     append([]string(nil), part.ProcessLog...),
+		IsPackaged:     part.IsPackaged,
+		TimesRepaired:  part.TimesRepaired,
+		TimesAssembled: part.TimesAssembled,
+		SensorReadings: readings,
+		Type:           part.Type,
+		ParentID:       part.ParentID,
+		Components:     components,
+		Product:        part.Product,
+		OrderID:        part.OrderID,
+	}
+}
+
+// Restore rebuilds the factory and event engine saved in the snapshot.
+func (s *Snapshot) Restore(connections map[string]*DataSource) (*EventEngine, error) {
+	if s.Version == 1 {
+		s.migrateServers()
+	}
+	if s.Version != SnapshotVersion {
+		return nil, fmt.Errorf("unsupported snapshot version %d, expected %d", s.Version, SnapshotVersion)
+	}
+	if s.Layout == nil {
+		return nil, fmt.Errorf("snapshot has no layout")
+	}
+	factory, err := s.Layout.Build(connections)
+	if err != nil {
+		return nil, err
+	}
+	factory.SetSeed(s.Seed)
+	factory.SetRate(s.Rate)
+
+	node := func(id string) (FactoryNode, error) {
+		if n := factory.GetNode(id); n != nil {
+			return n, nil
+		}
+		return nil, fmt.Errorf("snapshot refers to unknown node %q", id)
+	}
+	nodeMap := func(ids []string) (map[string]FactoryNode, error) {
+		nodes := make(map[string]FactoryNode)
+		for _, id := range ids {
+			n, err := node(id)
+			if err != nil {
+				return nil, err
+			}
+			nodes[id] = n
+		}
+		return nodes, nil
+	}
+
+	parts := make(map[string]*Part)
+	for _, saved := range s.Parts {
+		part := &Part{
+			ID:             saved.ID,
+			Cutattempts:    saved.Cutattempts,
+			CutVal:         saved.CutVal,
+			Weight:         saved.Weight,
+			Temperature:    saved.Temperature,
+			Material:       saved.Material,
+			DefectsCount:   saved.DefectsCount,
+			ProcessLog:     saved.ProcessLog,
+			IsPackaged:     saved.IsPackaged,
+			TimesRepaired:  saved.TimesRepaired,
+			TimesAssembled: saved.TimesAssembled,
+			SensorReadings: saved.SensorReadings,
+			Type:           saved.Type,
+			ParentID:       saved.ParentID,
+			Product:        saved.Product,
+			OrderID:        saved.OrderID,
+		}
+		for _, id := range saved.NodeHistory {
+			n, err := node(id)
+			if err != nil {
+				return nil, err
+			}
+			part.NodeHistory = append(part.NodeHistory, n)
+		}
+		parts[saved.ID] = part
+	}
+	part := func(id string) (*Part, error) {
+		if p, exists := parts[id]; exists {
+			return p, nil
+		}
+		return nil, fmt.Errorf("snapshot refers to unknown part %q", id)
+	}
+	// Components are linked once every part exists
+	for _, saved := range s.Parts {
+		for _, id := range saved.Components {
+			component, err := part(id)
+			if err != nil {
+				return nil, err
+			}
+			parts[saved.ID].Components = append(parts[saved.ID].Components, component)
+		}
+	}
+
+	engine := newEventEngine(factory, connections, s.Time)
+	for _, saved := range s.Nodes {
+		n, err := node(saved.ID)
+		if err != nil {
+			return nil, err
+		}
+		state, err := parseMachineState(saved.Event)
+		if err != nil {
+			return nil, fmt.Errorf("node %s: %v", saved.ID, err)
+		}
+		n.SetEvent(state)
+		n.SetProcessingTime(saved.ProcessingTime)
+
+		next, err := nodeMap(saved.NextNodes)
+		if err != nil {
+			return nil, err
+		}
+		n.SetNextNodes(next)
+		if n.GetType() == NodeTypeStation {
+			within, err := nodeMap(saved.NodesWithin)
+			if err != nil {
+				return nil, err
+			}
+			n.SetNodesWithin(within)
+		}
+
+		for _, id := range saved.Queue {
+			p, err := part(id)
+			if err != nil {
+				return nil, err
+			}
+			if !queuePart(n, p) {
+				return nil, fmt.Errorf("queue of node %s holds more than %d parts", saved.ID, cap(n.GetQueue()))
+			}
+		}
+
+		base := n.base()
+		servers := base.servers()
+		if len(saved.Servers) > len(servers) {
+			return nil, fmt.Errorf("node %s has %d servers in the snapshot but %d in its layout", saved.ID, len(saved.Servers), len(servers))
+		}
+		for i, savedServer := range saved.Servers {
+			server := servers[i]
+			server.Batch, server.Next = nil, nil
+			for j, id := range savedServer.Batch {
+				p, err := part(id)
+				if err != nil {
+					return nil, err
+				}
+				server.Batch = append(server.Batch, p)
+				if j < len(savedServer.Next) {
+					var next FactoryNode
+					if savedServer.Next[j] != "" {
+						if next, err = node(savedServer.Next[j]); err != nil {
+							return nil, err
+						}
+					}
+					server.Next = append(server.Next, next)
+				}
+			}
+			server.Loaded, server.Busy, server.Out, server.Started = savedServer.Loaded, savedServer.Busy, savedServer.Out, savedServer.Started
+			server.Opened, server.BusyTime, server.Parts, server.Batches, server.Last = savedServer.Opened, savedServer.BusyTime, savedServer.Parts, savedServer.Batches, savedServer.Last
+		}
+		base.heldFor = saved.HeldFor
+		if base.Routing != nil {
+			base.Routing.Turn = saved.Turn
+		}
+		if saved.Breakdown != nil {
+			if base.Breakdown == nil {
+				return nil, fmt.Errorf("node %s has a breakdown in the snapshot but not in its layout", saved.ID)
+			}
+			base.Breakdown.Uptime = saved.Breakdown.Uptime
+			base.Breakdown.NextFailure = saved.Breakdown.NextFailure
+			base.Breakdown.Down = copyDowntime(saved.Breakdown.Down)
+			base.Breakdown.Last = copyDowntime(saved.Breakdown.Last)
+		}
+
+		switch m := n.(type) {
+		case *CuttingMachineNode:
+			if saved.Dullness != nil {
+				m.Dullness = *saved.Dullness
+			}
+			if saved.TimeSinceLastRepair != nil {
+				m.TimeSinceLastRepair = *saved.TimeSinceLastRepair
+			}
+			if saved.Maintenance != nil && m.Maintenance != nil {
+				m.Maintenance.Cuts = saved.Maintenance.Cuts
+				m.Maintenance.Window = copyWindow(saved.Maintenance.Window)
+				m.Maintenance.Last = copyWindow(saved.Maintenance.Last)
+			}
+		case *InventoryNode:
+			if saved.CurrentStored != nil {
+				m.CurrentStored = *saved.CurrentStored
+			}
+			m.StoredParts = []*Part{}
+			for _, id := range saved.StoredParts {
+				p, err := part(id)
+				if err != nil {
+					return nil, err
+				}
+				m.StoredParts = append(m.StoredParts, p)
+			}
+		case *AssemblyStationNode:
+			m.Kit = nil
+			for _, id := range saved.Kit {
+				p, err := part(id)
+				if err != nil {
+					return nil, err
+				}
+				m.Kit = append(m.Kit, p)
+			}
+			m.Assembled = saved.Assembled
+		case *SensorMachineNode:
+			if saved.Calibration != nil {
+				m.Calibration = *saved.Calibration
+			}
+			if saved.FailureChance != nil {
+				m.FailureChance = *saved.FailureChance
+			}
+		case *WorkerNode:
+			if saved.Shift != nil && m.Shift != nil {
+				m.Shift.Status, m.Shift.Shift, m.Shift.Started, m.Shift.Change = saved.Shift.Status, saved.Shift.Shift, saved.Shift.Started, saved.Shift.Change
+				m.offShift = saved.Shift.Status != ShiftOn
+			}
+		}
+	}
+
+	for name, state := range s.Streams {
+		factory.stream(name)
+		factory.streams[name].state = state
+	}
+	if s.Orders != nil {
+		if factory.orders == nil {
+			return nil, fmt.Errorf("snapshot has orders but its layout does not")
+		}
+		factory.orders.restore(s.Orders)
+	}
+	engine.rng = factory.stream(arrivalsStream)
+	engine.parts = s.PartCounter
+	engine.seq = s.EventSeq
+	engine.ran = s.EventsRan
+
+	for _, saved := range s.Events {
+		kind, err := parseEventKind(saved.Kind)
+		if err != nil {
+			return nil, err
+		}
+		ev := &event{at: saved.At, seq: saved.Seq, kind: kind, server: saved.Server}
+		if saved.Node != "" {
+			if ev.node, err = node(saved.Node); err != nil {
+				return nil, err
+			}
+			if saved.Server < 0 || saved.Server >= len(ev.node.base().servers()) {
+				return nil, fmt.Errorf("event %s refers to unknown server %d of node %s", saved.Kind, saved.Server, saved.Node)
+			}
+		}
+		if saved.Next != "" {
+			if ev.next, err = node(saved.Next); err != nil {
+				return nil, err
+			}
+		}
+		if saved.Part != "" {
+			if ev.part, err = part(saved.Part); err != nil {
+				return nil, err
+			}
+		}
+		heap.Push(&engine.events, ev)
+	}
+	return engine, nil
+}
+
+// migrateServers moves the part each busy node of a version 1 snapshot was
+// working on to the node's first server. A node's busy time is measured from
+// the snapshot, as version 1 did not keep it.
+func (s *Snapshot) migrateServers() {
+	servers := make(map[string]*ServerSnapshot)
+	for i := range s.Nodes {
+		node := &s.Nodes[i]
+		if node.Busy {
+			servers[node.ID] = &ServerSnapshot{Opened: s.Time, Started: s.Time}
+		}
+		node.Busy = false
+	}
+	for i := range s.Events {
+		ev := &s.Events[i]
+		server, busy := servers[ev.Node]
+		if !busy || ev.Part == "" {
+			continue
+		}
+		switch ev.Kind {
+		case eventFinish.String():
+			server.Batch, server.Next, server.Busy = []string{ev.Part}, []string{ev.Next}, true
+			ev.Part, ev.Next = "", ""
+		case eventTransfer.String(), eventTransferRetry.String(), eventRejectRetry.String():
+			server.Batch, server.Next, server.Busy, server.Out = []string{ev.Part}, []string{ev.Next}, true, 1
+		}
+	}
+	// Nodes busy only because they are down or in maintenance hold no part
+	for i := range s.Nodes {
+		if server := servers[s.Nodes[i].ID]; server != nil && server.Busy {
+			s.Nodes[i].Servers = []ServerSnapshot{*server}
+		}
+	}
+	s.Version = 2
+}
+
+func parseMachineState(name string) (MachineState, error) {
+	for _, state := range []MachineState{Idle, Processing, Processed, Faulty, InMaintenance} {
+		if state.String() == name {
+			return state, nil
+		}
+	}
+	return Idle, fmt.Errorf("unknown machine state %q", name)
+}
+
+func parseEventKind(name string) (eventKind, error) {
+	for kind, kindName := range eventKindNames {
+		if kindName == name {
+			return eventKind(kind), nil
+		}
+	}
+	return 0, fmt.Errorf("unknown event kind %q", name)
+}
+
+func (s *Snapshot) Save(path string) error {
+	data, err := json.MarshalIndent(s, "", "  ")
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(path, data, 0644)
+}
+
+func LoadSnapshot(path string) (*Snapshot, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("error reading snapshot %s: %v", path, err)
+	}
+	snapshot := &Snapshot{}
+	if err := json.Unmarshal(data, snapshot); err != nil {
+		return nil, fmt.Errorf("error parsing snapshot %s: %v", path, err)
+	}
+	return snapshot, nil
+}
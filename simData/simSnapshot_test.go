@@ -0,0 +1,180 @@
+package simData
+
+import (
+	"bytes"
+	"encoding/json"
+	"os"
+	"reflect"
+	"testing"
+)
+
+// snapshotRun is a line on the event engine, with its log read from where the
+// last read left off.
+type snapshotRun struct {
+	t       *testing.T
+	path    string
+	sources map[string]*DataSource
+	engine  *EventEngine
+	read    int
+}
+
+func newSnapshotRun(t *testing.T, layout *FactoryLayout, seed int64) *snapshotRun {
+	t.Helper()
+	run := &snapshotRun{t: t, path: quietLogs(t), sources: IntialiseConnections(nil)}
+	factory, err := layout.Build(run.sources)
+	if err != nil {
+		t.Fatalf("Build: %v", err)
+	}
+	factory.SetSeed(seed)
+	run.engine = NewEventEngine(factory, run.sources, simulationStart)
+	SetClock(run.engine)
+	return run
+}
+
+// step runs events events and returns what they logged.
+func (r *snapshotRun) step(events int) []byte {
+	r.t.Helper()
+	for i := 0; i < events && r.engine.Step(); i++ {
+	}
+	logs, err := os.ReadFile(r.path)
+	if err != nil {
+		r.t.Fatalf("reading the simulation log: %v", err)
+	}
+	logs, r.read = logs[r.read:], len(logs)
+	return logs
+}
+
+// snapshot saves the run as JSON and loads it back.
+func (r *snapshotRun) snapshot() *Snapshot {
+	r.t.Helper()
+	snapshot, err := r.engine.Snapshot()
+	if err != nil {
+		r.t.Fatalf("Snapshot: %v", err)
+	}
+	data, err := json.Marshal(snapshot)
+	if err != nil {
+		r.t.Fatalf("saving the snapshot: %v", err)
+	}
+	loaded := &Snapshot{}
+	if err := json.Unmarshal(data, loaded); err != nil {
+		r.t.Fatalf("loading the snapshot: %v", err)
+	}
+	return loaded
+}
+
+// restore carries the run on from snapshot.
+func (r *snapshotRun) restore(snapshot *Snapshot) {
+	r.t.Helper()
+	engine, err := snapshot.Restore(r.sources)
+	if err != nil {
+		r.t.Fatalf("Restore: %v", err)
+	}
+	r.engine = engine
+	SetClock(engine)
+}
+
+func TestSnapshotRestoreCarriesOn(t *testing.T) {
+	run := newSnapshotRun(t, DefaultFactoryLayout(), 42)
+	run.step(5000)
+	snapshot := run.snapshot()
+	want := run.step(5000)
+
+	run.restore(snapshot)
+	if got := run.step(5000); !bytes.Equal(got, want) {
+		t.Errorf("the restored run logged differently, first difference at byte %d of %d", firstDifference(got, want), len(want))
+	}
+}
+
+func TestSnapshotRestoreOrders(t *testing.T) {
+	demand := &DemandLayout{Interval: "10m", Products: []string{"Steel", "Aluminum"}, MinQuantity: 1, MaxQuantity: 3, Lead: "2h"}
+	for _, orders := range []*OrdersLayout{
+		{Release: ReleaseKanban, Kanban: 3, Demand: demand},
+		{Release: ReleaseCONWIP, WIP: 6, Demand: demand},
+	} {
+		t.Run(orders.Release, func(t *testing.T) {
+			layout := DefaultFactoryLayout()
+			layout.Orders = orders
+			if orders.Release == ReleaseKanban {
+				// Orders are shipped from finished_inventory, so it keeps its stock
+				for i, edge := range layout.Edges {
+					if edge.From == "finished_inventory" {
+						layout.Edges = append(layout.Edges[:i], layout.Edges[i+1:]...)
+						break
+					}
+				}
+			}
+			run := newSnapshotRun(t, layout, 42)
+			run.step(5000)
+			snapshot := run.snapshot()
+			released := 0
+			for _, part := range snapshot.Parts {
+				if part.Product != "" {
+					released++
+				}
+			}
+			if released == 0 {
+				t.Fatal("no part in flight was released for a product")
+			}
+			want := run.step(5000)
+
+			run.restore(snapshot)
+			if again := run.snapshot(); !reflect.DeepEqual(again.Parts, snapshot.Parts) {
+				t.Error("the restored parts differ from those saved")
+			}
+			if got := run.step(5000); !bytes.Equal(got, want) {
+				t.Errorf("the restored run logged differently, first difference at byte %d of %d", firstDifference(got, want), len(want))
+			}
+		})
+	}
+}
+
+// version1 turns snapshot back into the version 1 format, which kept a busy
+// flag per node and the part it worked on in its events.
+func version1(t *testing.T, snapshot *Snapshot) *Snapshot {
+	t.Helper()
+	old := *snapshot
+	old.Version = 1
+	old.Nodes = append([]NodeSnapshot(nil), snapshot.Nodes...)
+	old.Events = append([]EventSnapshot(nil), snapshot.Events...)
+	busy := 0
+	for i := range old.Nodes {
+		node := &old.Nodes[i]
+		for _, server := range node.Servers {
+			if !server.Busy {
+				continue
+			}
+			if len(node.Servers) > 1 || len(server.Batch) != 1 {
+				t.Fatalf("node %s has more than one server or part, which version 1 cannot keep", node.ID)
+			}
+			node.Busy = true
+			busy++
+			for j := range old.Events {
+				if ev := &old.Events[j]; ev.Node == node.ID && ev.Kind == eventFinish.String() {
+					ev.Part, ev.Next = server.Batch[0], server.Next[0]
+				}
+			}
+		}
+		node.Servers = nil
+	}
+	if busy == 0 {
+		t.Fatal("no node is busy, so there is nothing to migrate")
+	}
+	return &old
+}
+
+func TestRestoreVersion1(t *testing.T) {
+	run := newSnapshotRun(t, DefaultFactoryLayout(), 42)
+	run.step(5000)
+	snapshot := version1(t, run.snapshot())
+	want := run.step(5000)
+
+	run.restore(snapshot)
+	if got := run.step(5000); !bytes.Equal(got, want) {
+		t.Errorf("the run restored from version 1 logged differently, first difference at byte %d of %d", firstDifference(got, want), len(want))
+	}
+
+	snapshot.Version = 0
+	if _, err := snapshot.Restore(run.sources); err == nil {
+		t.Error("restoring a snapshot of an unknown version should fail")
+	}
+}
@@ -72,7 +72,7 @@ func createService(config *util.Config, registry *util.Registry, manager *servic
 			webService := services.NewWebService(config.ServerAddress, templates, registry)
 			manager.Register(webService)
 		case util.ETLService:
-			etlService := services.NewEtlService()
+			etlService := services.NewEtlService(registry)
 			manager.Register(etlService)
 		case util.SimulateService:
 			simDataService := services.NewSimulatedService(registry)
@@ -70,7 +70,8 @@ export class Graph {
             'Idle': '#45B7D1',
             'Processing': '#34A853',
             'Processed': '#FBBC05',
-            'Faulty': '#EA4335'
+            'Faulty': '#EA4335',
+            'Maintenance': '#9C27B0'
         };
         this.hoverNode = null;
         